@@ -0,0 +1,247 @@
+// Package admin implements administrative REST API (under /api/) and gRPC API
+// (see adminpb/admin.proto) over device, transport and handler registries.
+// All requests must have "Authorization: Bearer <token>" header,
+// API is disabled when token is not set.
+//
+// Endpoints:
+//
+//	GET    /api/devices                 all devices, with last seen time and latest message
+//	GET    /api/devices/<id>            single device, by ID (0x...) or display name
+//	PATCH  /api/devices/<id>            update display_name, handlers, transport
+//	DELETE /api/devices/<id>            delete device
+//	GET    /api/devices/<id>/messages   recent messages of device
+//	POST   /api/devices/<id>/downlink   send message to device, {"type": "...", "message": {...}}
+//	GET    /api/stream                  live device messages and dropped packets (Server-Sent Events),
+//	                                    filtered by ?device=<id>&transport=<name>, both may be repeated
+//	GET    /api/schemas/<name>          fields of protobuf message, by full name
+//	GET    /api/transports              transports with packet counters
+//	GET    /api/handlers                device handlers
+//	GET    /api/jobs                    scheduled jobs with next / last run times and last error
+//	GET    /api/joins                   devices waiting for join approval
+//	POST   /api/joins/<id>/approve      approve join
+//	DELETE /api/joins/<id>              reject join
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+var flagToken = flag.String("admin.token", "", "Bearer token of admin API (/api/), API is disabled when empty")
+
+// OnDevicesChanged is called after devices have been updated / deleted / approved
+// using API, e.g. to persist them
+var OnDevicesChanged func()
+
+// Request is API call to be run by main loop, so it doesn't race with message processing
+type Request struct {
+	fn   func()
+	done chan struct{}
+}
+
+var queue = make(chan *Request)
+
+// Queue returns channel of API requests, they must be run using Request.Run()
+func Queue() <-chan *Request {
+	return queue
+}
+
+// Run runs API request
+func (r *Request) Run() {
+	r.fn()
+	close(r.done)
+}
+
+// apiError is error with HTTP status code
+type apiError struct {
+	code int
+	err  error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func errorf(code int, format string, args ...interface{}) error {
+	return &apiError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// Maximum size of JSON request body
+const maxBodySize = 1 << 20
+
+// route is API endpoint: method and path pattern, "*" matches any path segment.
+// Handler runs in main loop, so request body is decoded (into value returned
+// by body, if any) and validated before, by HTTP server goroutine.
+type route struct {
+	method  string
+	pattern string
+	body    func() interface{}
+	handler func(params []string, body interface{}) (interface{}, error)
+}
+
+// validator is implemented by request bodies which can be checked without main loop
+type validator interface {
+	validate() error
+}
+
+var routes = []route{
+	{http.MethodGet, "devices", nil, listDevices},
+	{http.MethodGet, "devices/*", nil, getDevice},
+	{http.MethodPatch, "devices/*", func() interface{} { return &deviceUpdate{} }, updateDevice},
+	{http.MethodDelete, "devices/*", nil, deleteDevice},
+	{http.MethodGet, "devices/*/messages", nil, listMessages},
+	{http.MethodPost, "devices/*/downlink", func() interface{} { return &downlinkRequest{} }, sendDownlink},
+	{http.MethodGet, "schemas/*", nil, getSchema},
+	{http.MethodGet, "transports", nil, listTransports},
+	{http.MethodGet, "handlers", nil, listHandlers},
+	{http.MethodGet, "jobs", nil, listJobs},
+	{http.MethodGet, "joins", nil, listJoins},
+	{http.MethodPost, "joins/*/approve", nil, approveJoin},
+	{http.MethodDelete, "joins/*", nil, rejectJoin},
+}
+
+// Handler returns HTTP handler of API, it has to be mounted at /api/
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+		// Stream is long living, it is not a regular JSON API call
+		if path == "stream" {
+			serveStream(w, r)
+			return
+		}
+		found := false
+		for _, rt := range routes {
+			params, ok := rt.match(path)
+			if !ok {
+				continue
+			}
+			found = true
+			if rt.method != r.Method {
+				continue
+			}
+			var body interface{}
+			if rt.body != nil {
+				body = rt.body()
+				if err := decodeBody(w, r, body); err != nil {
+					writeError(w, r, err)
+					return
+				}
+			}
+			result, err := run(r.Context(), func() (interface{}, error) {
+				return rt.handler(params, body)
+			})
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, result)
+			return
+		}
+
+		if found {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		} else {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		}
+	})
+}
+
+// decodeBody reads limited JSON request body into value and validates it
+func decodeBody(w http.ResponseWriter, r *http.Request, value interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(value); err != nil {
+		return errorf(http.StatusBadRequest, "invalid request: %v", err)
+	}
+	if v, ok := value.(validator); ok {
+		return v.validate()
+	}
+	return nil
+}
+
+// writeError responds with error, status code is taken from apiError
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	if apiErr, ok := err.(*apiError); ok {
+		code = apiErr.code
+	}
+	glog.Infof("Admin API %s %s failed: %v", r.Method, r.URL.Path, err)
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func authorized(r *http.Request) bool {
+	return validToken(r.Header.Get("Authorization"))
+}
+
+// validToken checks value of authorization header: "Bearer <token>"
+func validToken(header string) bool {
+	if *flagToken == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(*flagToken)) == 1
+}
+
+// match returns values of "*" segments when path matches route's pattern
+func (rt route) match(path string) ([]string, bool) {
+	patternParts := strings.Split(rt.pattern, "/")
+	pathParts := strings.Split(path, "/")
+	if len(patternParts) != len(pathParts) {
+		return nil, false
+	}
+	var params []string
+	for index, part := range patternParts {
+		switch {
+		case part == "*" && pathParts[index] != "":
+			params = append(params, pathParts[index])
+		case part != pathParts[index]:
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// run passes fn to main loop and waits for result
+func run(ctx context.Context, fn func() (interface{}, error)) (interface{}, error) {
+	var result interface{}
+	var err error
+	request := &Request{
+		fn: func() {
+			result, err = fn()
+		},
+		done: make(chan struct{}),
+	}
+
+	select {
+	case queue <- request:
+	case <-ctx.Done():
+		return nil, errorf(http.StatusServiceUnavailable, "request canceled")
+	}
+	<-request.done
+
+	return result, err
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+func devicesChanged() {
+	if OnDevicesChanged != nil {
+		OnDevicesChanged()
+	}
+}
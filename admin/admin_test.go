@@ -0,0 +1,335 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/encode"
+	"github.com/open-iot-devices/server/processor"
+	"github.com/open-iot-devices/server/transport"
+)
+
+type mockTransport struct {
+	name    string
+	history [][]byte
+}
+
+func (m *mockTransport) GetName() string {
+	return m.name
+}
+
+func (m *mockTransport) GetTypeName() string {
+	return "mock"
+}
+
+func (m *mockTransport) Start() error {
+	return nil
+}
+
+func (m *mockTransport) Stop() {
+}
+
+func (m *mockTransport) Receive() <-chan []byte {
+	return nil
+}
+
+func (m *mockTransport) Send(msg []byte) error {
+	m.history = append(m.history, msg)
+	return nil
+}
+
+type mockHandler struct {
+	devices []*device.Device
+	removed []*device.Device
+}
+
+func (m *mockHandler) GetName() string {
+	return "admin_mock"
+}
+
+func (m *mockHandler) Start() error {
+	return nil
+}
+
+func (m *mockHandler) Stop() {
+}
+
+func (m *mockHandler) ProcessMessage(dev *device.Device, msgType string, msg proto.Message) error {
+	return nil
+}
+
+func (m *mockHandler) AddDevice(dev *device.Device) {
+	m.devices = append(m.devices, dev)
+}
+
+func (m *mockHandler) RemoveDevice(dev *device.Device) {
+	m.removed = append(m.removed, dev)
+}
+
+// testAPI serves API requests the same way main loop does
+type testAPI struct {
+	t       *testing.T
+	handler http.Handler
+	changes int
+	doneCh  chan struct{}
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	*flagToken = "secret"
+	api := &testAPI{
+		t:       t,
+		handler: Handler(),
+		doneCh:  make(chan struct{}),
+	}
+	OnDevicesChanged = func() {
+		api.changes++
+	}
+	go func() {
+		for {
+			select {
+			case request := <-Queue():
+				request.Run()
+			case <-api.doneCh:
+				return
+			}
+		}
+	}()
+	return api
+}
+
+func (api *testAPI) close() {
+	close(api.doneCh)
+	OnDevicesChanged = nil
+	*flagToken = ""
+}
+
+// do makes API call, decodes JSON response into result (if not nil)
+func (api *testAPI) do(method, path, body string, result interface{}) int {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, r)
+	assert.Equal(api.t, "application/json", w.Header().Get("Content-Type"))
+	if result != nil && w.Code == http.StatusOK {
+		require.NoError(api.t, json.Unmarshal(w.Body.Bytes(), result), w.Body.String())
+	}
+	return w.Code
+}
+
+func TestAuth(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.close()
+
+	for _, header := range []string{"", "Bearer", "Bearer wrong", "secret"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/devices", nil)
+		r.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, header)
+	}
+	assert.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/devices", "", nil))
+	assert.Equal(t, http.StatusNotFound, api.do(http.MethodGet, "/api/nothing", "", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, api.do(http.MethodPut, "/api/devices", "", nil))
+
+	// Disabled without token
+	*flagToken = ""
+	assert.Equal(t, http.StatusUnauthorized, api.do(http.MethodGet, "/api/devices", "", nil))
+}
+
+func TestDevices(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.close()
+	handler := &mockHandler{}
+	device.MustAddHandler(handler)
+	defer device.DeleteHandler(handler.GetName())
+	tr := &mockTransport{name: "admin_tr"}
+	require.NoError(t, transport.AddTransport(tr))
+	defer transport.DeleteTransport(tr.name)
+	defer device.DeleteAllDevices()
+
+	dev := device.NewDevice(0x10)
+	dev.DisplayName = "kitchen"
+	dev.ProtobufName = "openiot.JoinResponse"
+	require.NoError(t, device.AddDevice(dev))
+	other := device.NewDevice(0x11)
+	other.DisplayName = "porch"
+	require.NoError(t, device.AddDevice(other))
+
+	var list []*deviceInfo
+	require.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/devices", "", &list))
+	require.Len(t, list, 2)
+	assert.Equal(t, "kitchen", list[0].DisplayName)
+	assert.Equal(t, "0x11", list[1].ID)
+
+	var info deviceInfo
+	require.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/devices/0x10", "", &info))
+	assert.Equal(t, "kitchen", info.DisplayName)
+	assert.Equal(t, "PLAIN", info.EncryptionType)
+	assert.Equal(t, []string{}, info.Handlers)
+	assert.Equal(t, http.StatusNotFound, api.do(http.MethodGet, "/api/devices/bedroom", "", nil))
+
+	// Update
+	require.Equal(t, http.StatusOK, api.do(http.MethodPatch, "/api/devices/kitchen",
+		`{"display_name": "lamp", "handlers": ["admin_mock"], "transport": "admin_tr"}`, &info))
+	assert.Equal(t, "lamp", info.DisplayName)
+	assert.Equal(t, []string{"admin_mock"}, dev.HandlerNames)
+	assert.Equal(t, []*device.Device{dev}, handler.devices)
+	assert.Equal(t, tr, dev.Transport())
+	assert.Equal(t, 1, api.changes)
+	for body, code := range map[string]int{
+		`{"display_name": "porch"}`:                      http.StatusConflict,
+		`{"display_name": ""}`:                           http.StatusBadRequest,
+		`{"handlers": ["nothing"]}`:                      http.StatusBadRequest,
+		`{"display_name": "x", "handlers": ["nothing"]}`: http.StatusBadRequest,
+		`{"transport": "nothing"}`:                       http.StatusBadRequest,
+		`{"key": "00"}`:                                  http.StatusBadRequest,
+		`{"display_name": "x", "transport": "y"`:         http.StatusBadRequest,
+	} {
+		assert.Equal(t, code, api.do(http.MethodPatch, "/api/devices/lamp", body, nil), body)
+	}
+	// Nothing changed by invalid updates
+	assert.Equal(t, "lamp", dev.DisplayName)
+	assert.Equal(t, []string{"admin_mock"}, dev.HandlerNames)
+	assert.Equal(t, 1, api.changes)
+
+	// Downlink
+	require.Equal(t, http.StatusOK, api.do(http.MethodPost, "/api/devices/lamp/downlink",
+		`{"message": {"name": "srv", "timestamp": "5"}}`, nil))
+	require.Len(t, tr.history, 1)
+	buf := bytes.NewBuffer(tr.history[0])
+	require.NoError(t, encode.ReadSingleMessage(buf, &openiot.Header{}))
+	resp := &openiot.JoinResponse{}
+	require.NoError(t, encode.ReadPlain(buf, &openiot.MessageInfo{}, resp))
+	assert.Equal(t, "srv", resp.Name)
+	assert.Equal(t, int64(5), resp.Timestamp)
+	for body, code := range map[string]int{
+		`{"type": "nothing.Message"}`:     http.StatusBadRequest,
+		`{"message": {"unknown": 1}}`:     http.StatusBadRequest,
+		`{"type": "openiot.JoinResponse"`: http.StatusBadRequest,
+	} {
+		assert.Equal(t, code, api.do(http.MethodPost, "/api/devices/lamp/downlink", body, nil), body)
+	}
+	// No transport
+	assert.Equal(t, http.StatusBadGateway, api.do(http.MethodPost, "/api/devices/porch/downlink",
+		`{"type": "openiot.JoinResponse"}`, nil))
+
+	// Transports
+	var transports []map[string]interface{}
+	require.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/transports", "", &transports))
+	require.Len(t, transports, 1)
+	assert.Equal(t, "admin_tr", transports[0]["name"])
+	assert.EqualValues(t, processor.GetTransportStats(tr).PacketsSent, transports[0]["packets_sent"])
+
+	// Schemas
+	var msgSchema messageSchema
+	require.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/schemas/openiot.JoinResponse", "", &msgSchema))
+	assert.Equal(t, "openiot.JoinResponse", msgSchema.Name)
+	assert.Contains(t, msgSchema.Fields, &fieldSchema{Name: "name", JSONName: "name", Kind: "string"})
+	assert.Equal(t, http.StatusNotFound, api.do(http.MethodGet, "/api/schemas/nothing.Message", "", nil))
+
+	// Handlers
+	var handlers []map[string]interface{}
+	require.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/handlers", "", &handlers))
+	assert.Contains(t, handlers, map[string]interface{}{"name": "admin_mock", "devices": float64(1)})
+
+	// Scheduled jobs
+	var jobs []map[string]interface{}
+	require.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/jobs", "", &jobs))
+	assert.NotNil(t, jobs)
+
+	// Recent messages
+	var messages []*recentMessage
+	require.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/devices/lamp/messages", "", &messages))
+	assert.Empty(t, messages)
+	payload, err := encode.MakeReadyToSendMessage(&openiot.Header{DeviceId: dev.ID}, openiot.EncryptionType_PLAIN, nil,
+		&openiot.MessageInfo{Sequence: 1}, &openiot.JoinResponse{Name: "hello"})
+	require.NoError(t, err)
+	require.NoError(t, processor.ProcessMessage(&processor.Message{Source: tr, Payload: payload}))
+	require.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/devices/lamp/messages", "", &messages))
+	require.Len(t, messages, 1)
+	assert.Equal(t, "openiot.JoinResponse", messages[0].Type)
+	assert.JSONEq(t, `{"name": "hello"}`, string(messages[0].Message))
+	require.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/devices/lamp", "", &info))
+	require.NotNil(t, info.LastSeen)
+	assert.Equal(t, messages[0].Time.Unix(), info.LastSeen.Unix())
+	require.NotNil(t, info.LastMessage)
+	assert.JSONEq(t, `{"name": "hello"}`, string(info.LastMessage.Message))
+	require.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/transports", "", &transports))
+	assert.NotNil(t, transports[0]["last_received"])
+
+	// Delete
+	require.Equal(t, http.StatusOK, api.do(http.MethodDelete, "/api/devices/lamp", "", nil))
+	assert.Nil(t, device.FindDeviceByID(0x10))
+	assert.Equal(t, []*device.Device{dev}, handler.removed)
+	assert.Equal(t, 2, api.changes)
+	assert.Equal(t, http.StatusNotFound, api.do(http.MethodDelete, "/api/devices/lamp", "", nil))
+}
+
+func TestRequestBody(t *testing.T) {
+	*flagToken = "secret"
+	defer func() { *flagToken = "" }()
+
+	// Body is decoded and validated without main loop (nobody reads Queue())
+	for body, code := range map[string]int{
+		`{"display_name": ""}`: http.StatusBadRequest,
+		`{"display_name": "x"`: http.StatusBadRequest,
+		`{"unknown": 1}`:       http.StatusBadRequest,
+		`{"display_name": "` + strings.Repeat("x", maxBodySize) + `"}`: http.StatusBadRequest,
+	} {
+		r := httptest.NewRequest(http.MethodPatch, "/api/devices/kitchen", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, r)
+		assert.Equal(t, code, w.Code, w.Body.String())
+	}
+}
+
+func TestJoins(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.close()
+	defer device.DeleteAllDevices()
+	require.NoError(t, flag.Set("join.approve", "true"))
+	defer flag.Set("join.approve", "false")
+
+	tr := &mockTransport{name: "admin_join"}
+	for _, id := range []uint64{0x20, 0x21} {
+		hdr := &openiot.Header{DeviceId: id, JoinRequest: true}
+		payload, err := encode.MakeReadyToSendMessage(hdr, openiot.EncryptionType_PLAIN, nil,
+			&openiot.JoinRequest{Name: "sensor"})
+		require.NoError(t, err)
+		require.NoError(t, processor.ProcessMessage(&processor.Message{Source: tr, Payload: payload}))
+	}
+
+	var joins []*processor.PendingJoin
+	require.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/joins", "", &joins))
+	require.Len(t, joins, 2)
+	assert.Equal(t, "sensor", joins[0].Name)
+
+	var info deviceInfo
+	require.Equal(t, http.StatusOK, api.do(http.MethodPost, "/api/joins/0x20/approve", "", &info))
+	assert.Equal(t, "0x20", info.ID)
+	assert.NotNil(t, device.FindDeviceByID(0x20))
+	assert.Len(t, tr.history, 1)
+	assert.Equal(t, 1, api.changes)
+
+	require.Equal(t, http.StatusOK, api.do(http.MethodDelete, "/api/joins/0x21", "", nil))
+	assert.Nil(t, device.FindDeviceByID(0x21))
+	require.Equal(t, http.StatusOK, api.do(http.MethodGet, "/api/joins", "", &joins))
+	assert.Empty(t, joins)
+
+	// Negative
+	assert.Equal(t, http.StatusNotFound, api.do(http.MethodPost, "/api/joins/0x21/approve", "", nil))
+	assert.Equal(t, http.StatusNotFound, api.do(http.MethodDelete, "/api/joins/0x21", "", nil))
+	assert.Equal(t, http.StatusBadRequest, api.do(http.MethodDelete, "/api/joins/xyz", "", nil))
+}
@@ -0,0 +1,4 @@
+// Package adminpb contains gRPC service definition of admin API and Go code generated from it
+package adminpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
@@ -0,0 +1,379 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/processor"
+	"github.com/open-iot-devices/server/scheduler"
+	"github.com/open-iot-devices/server/transport"
+	"github.com/open-iot-devices/server/utils/schema"
+)
+
+// deviceInfo is device as returned by API, encryption key is never exposed
+type deviceInfo struct {
+	ID              string            `json:"id"`
+	Name            string            `json:"name"`
+	DisplayName     string            `json:"display_name"`
+	Manufacturer    string            `json:"manufacturer"`
+	ProductURL      string            `json:"product_url"`
+	ProtobufName    string            `json:"protobuf_name"`
+	MessageTypes    map[uint32]string `json:"message_types,omitempty"`
+	SchemaVersion   uint32            `json:"schema_version,omitempty"`
+	Handlers        []string          `json:"handlers"`
+	Transport       string            `json:"transport"`
+	EncryptionType  string            `json:"encryption_type"`
+	SequenceSend    uint32            `json:"sequence_send"`
+	SequenceReceive uint32            `json:"sequence_receive"`
+	KeyFingerprint  string            `json:"key_fingerprint,omitempty"`
+	RekeyPending    bool              `json:"rekey_pending,omitempty"`
+	Location        string            `json:"location,omitempty"`
+	Latitude        *float64          `json:"latitude,omitempty"`
+	Longitude       *float64          `json:"longitude,omitempty"`
+	// Latest recent message (see processor history), nil when there is none
+	LastSeen    *time.Time     `json:"last_seen,omitempty"`
+	LastMessage *recentMessage `json:"last_message,omitempty"`
+}
+
+// deviceUpdate is body of PATCH request, only present fields are updated
+type deviceUpdate struct {
+	DisplayName *string   `json:"display_name"`
+	Handlers    *[]string `json:"handlers"`
+	Transport   *string   `json:"transport"`
+}
+
+type downlinkRequest struct {
+	// Protobuf full name, device's default one when empty
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message"`
+}
+
+type recentMessage struct {
+	Time    time.Time       `json:"time"`
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message"`
+}
+
+type transportInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	processor.TransportStats
+}
+
+func newDeviceInfo(dev *device.Device) *deviceInfo {
+	handlers := dev.HandlerNames
+	if handlers == nil {
+		handlers = []string{}
+	}
+	info := &deviceInfo{
+		ID:              dev.IDhex,
+		Name:            dev.Name,
+		DisplayName:     dev.DisplayName,
+		Manufacturer:    dev.Manufacturer,
+		ProductURL:      dev.ProductURL,
+		ProtobufName:    dev.ProtobufName,
+		MessageTypes:    dev.MessageTypes,
+		SchemaVersion:   dev.SchemaVersion,
+		Handlers:        handlers,
+		Transport:       dev.TransportName,
+		EncryptionType:  dev.EncryptionType.String(),
+		SequenceSend:    dev.SequenceSend,
+		SequenceReceive: dev.SequenceReceive,
+		KeyFingerprint:  dev.KeyFingerprint(),
+		RekeyPending:    dev.RekeyPending,
+		Location:        dev.Location,
+		Latitude:        dev.Latitude,
+		Longitude:       dev.Longitude,
+	}
+	if recent := processor.GetRecentMessages(dev.ID); len(recent) > 0 {
+		last := recent[len(recent)-1]
+		info.LastSeen = &last.Time
+		if message, err := newRecentMessage(last); err == nil {
+			info.LastMessage = message
+		}
+	}
+	return info
+}
+
+func newRecentMessage(recent *processor.RecentMessage) (*recentMessage, error) {
+	message, err := protojson.Marshal(proto.MessageV2(recent.Message))
+	if err != nil {
+		return nil, err
+	}
+	return &recentMessage{
+		Time:    recent.Time,
+		Type:    recent.Type,
+		Message: message,
+	}, nil
+}
+
+func findDevice(name string) (*device.Device, error) {
+	dev := device.FindDevice(name)
+	if dev == nil {
+		return nil, errorf(http.StatusNotFound, "device '%s' not found", name)
+	}
+	return dev, nil
+}
+
+// resolveDevices converts device names into set of hex IDs (as in events).
+// Unregistered devices are allowed by ID, e.g. to watch their join attempts.
+func resolveDevices(names []string) (map[string]bool, error) {
+	ids := map[string]bool{}
+	for _, name := range names {
+		if dev := device.FindDevice(name); dev != nil {
+			ids[dev.IDhex] = true
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(name, "0x"), 16, 64)
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "device '%s' not found", name)
+		}
+		ids[fmt.Sprintf("0x%x", id)] = true
+	}
+	return ids, nil
+}
+
+func listDevices(params []string, body interface{}) (interface{}, error) {
+	results := []*deviceInfo{}
+	for _, dev := range device.GetAllDevices() {
+		results = append(results, newDeviceInfo(dev))
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].DisplayName < results[j].DisplayName
+	})
+	return results, nil
+}
+
+func getDevice(params []string, body interface{}) (interface{}, error) {
+	dev, err := findDevice(params[0])
+	if err != nil {
+		return nil, err
+	}
+	return newDeviceInfo(dev), nil
+}
+
+func updateDevice(params []string, body interface{}) (interface{}, error) {
+	dev, err := findDevice(params[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := body.(*deviceUpdate).apply(dev); err != nil {
+		return nil, err
+	}
+
+	return newDeviceInfo(dev), nil
+}
+
+// validate checks update without access to registries, so doesn't need main loop
+func (update *deviceUpdate) validate() error {
+	if update.DisplayName != nil && *update.DisplayName == "" {
+		return errorf(http.StatusBadRequest, "display_name must not be empty")
+	}
+	return nil
+}
+
+// apply validates update against registries and applies it to device,
+// update is all or nothing. It must be validated already.
+func (update *deviceUpdate) apply(dev *device.Device) error {
+	if update.DisplayName != nil {
+		if other := device.FindDevice(*update.DisplayName); other != nil && other != dev {
+			return errorf(http.StatusConflict, "display_name '%s' is already used by 0x%x", *update.DisplayName, other.ID)
+		}
+	}
+	var tr transport.Transport
+	if update.Transport != nil {
+		if tr = transport.FindTransportByName(*update.Transport); tr == nil {
+			return errorf(http.StatusBadRequest, "unknown transport '%s'", *update.Transport)
+		}
+	}
+	if update.Handlers != nil {
+		for _, name := range *update.Handlers {
+			if device.FindHandlerByName(name) == nil {
+				return errorf(http.StatusBadRequest, "unknown handler '%s'", name)
+			}
+		}
+	}
+
+	// SetHandlers is the only step which may fail, so goes first
+	if update.Handlers != nil {
+		if err := dev.SetHandlers(*update.Handlers); err != nil {
+			return errorf(http.StatusBadRequest, "%v", err)
+		}
+	}
+	if update.DisplayName != nil {
+		dev.DisplayName = *update.DisplayName
+	}
+	if tr != nil {
+		dev.SetTransport(tr)
+	}
+	glog.Infof("0x%x: updated using admin API", dev.ID)
+	devicesChanged()
+
+	return nil
+}
+
+func deleteDevice(params []string, body interface{}) (interface{}, error) {
+	dev, err := findDevice(params[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := device.DeleteDeviceByID(dev.ID); err != nil {
+		return nil, err
+	}
+	processor.DeleteRecentMessages(dev.ID)
+	glog.Infof("0x%x: deleted using admin API", dev.ID)
+	devicesChanged()
+
+	return newDeviceInfo(dev), nil
+}
+
+func listMessages(params []string, body interface{}) (interface{}, error) {
+	dev, err := findDevice(params[0])
+	if err != nil {
+		return nil, err
+	}
+	results := []*recentMessage{}
+	for _, recent := range processor.GetRecentMessages(dev.ID) {
+		message, err := newRecentMessage(recent)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, message)
+	}
+	return results, nil
+}
+
+func sendDownlink(params []string, body interface{}) (interface{}, error) {
+	dev, err := findDevice(params[0])
+	if err != nil {
+		return nil, err
+	}
+	request := body.(*downlinkRequest)
+	if request.Type == "" {
+		request.Type = dev.ProtobufName
+	}
+	if len(request.Message) == 0 {
+		request.Message = json.RawMessage("{}")
+	}
+	msg := schema.NewMessage(request.Type)
+	if msg == nil {
+		return nil, errorf(http.StatusBadRequest, "protobuf '%s' is not registered", request.Type)
+	}
+	if err := protojson.Unmarshal(request.Message, proto.MessageV2(msg)); err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid %s message: %v", request.Type, err)
+	}
+	if err := send(dev, request.Type, msg); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"sequence": dev.SequenceSend}, nil
+}
+
+func send(dev *device.Device, msgType string, msg proto.Message) error {
+	if err := processor.SendMessage(dev, msg); err != nil {
+		return errorf(http.StatusBadGateway, "%v", err)
+	}
+	glog.Infof("0x%x: %s sent using admin API", dev.ID, msgType)
+	return nil
+}
+
+func listTransports(params []string, body interface{}) (interface{}, error) {
+	results := []*transportInfo{}
+	for _, tr := range transport.GetAllTransports() {
+		results = append(results, &transportInfo{
+			Name:           tr.GetName(),
+			Type:           tr.GetTypeName(),
+			TransportStats: processor.GetTransportStats(tr),
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+func listHandlers(params []string, body interface{}) (interface{}, error) {
+	// Handler name -> amount of devices using it
+	results := map[string]int{}
+	for name := range device.GetAllHandlers() {
+		results[name] = 0
+	}
+	for _, dev := range device.GetAllDevices() {
+		for _, name := range dev.HandlerNames {
+			if _, ok := results[name]; ok {
+				results[name]++
+			}
+		}
+	}
+	type handlerInfo struct {
+		Name    string `json:"name"`
+		Devices int    `json:"devices"`
+	}
+	list := []*handlerInfo{}
+	for name, devices := range results {
+		list = append(list, &handlerInfo{Name: name, Devices: devices})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+func listJobs(params []string, body interface{}) (interface{}, error) {
+	jobs := scheduler.GetUpcomingJobs()
+	if jobs == nil {
+		jobs = []*scheduler.JobStatus{}
+	}
+	return jobs, nil
+}
+
+func listJoins(params []string, body interface{}) (interface{}, error) {
+	return processor.GetPendingJoins(), nil
+}
+
+func approveJoin(params []string, body interface{}) (interface{}, error) {
+	id, err := parseID(params[0])
+	if err != nil {
+		return nil, err
+	}
+	dev, err := processor.ApproveJoin(id)
+	if dev == nil {
+		return nil, errorf(http.StatusNotFound, "%v", err)
+	}
+	// Device is registered even if JoinResponse was not sent: it will be sent on next JoinRequest
+	devicesChanged()
+	if err != nil {
+		glog.Infof("0x%x: unable to send JoinResponse: %v", dev.ID, err)
+	}
+
+	return newDeviceInfo(dev), nil
+}
+
+func rejectJoin(params []string, body interface{}) (interface{}, error) {
+	id, err := parseID(params[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := processor.RejectJoin(id); err != nil {
+		return nil, errorf(http.StatusNotFound, "%v", err)
+	}
+	return map[string]string{}, nil
+}
+
+func parseID(value string) (uint64, error) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 64)
+	if err != nil {
+		return 0, errorf(http.StatusBadRequest, "invalid device id '%s'", value)
+	}
+	return id, nil
+}
@@ -0,0 +1,439 @@
+package admin
+
+import (
+	"context"
+	"crypto/aes"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/admin/adminpb"
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/processor"
+	"github.com/open-iot-devices/server/transport"
+	"github.com/open-iot-devices/server/utils/events"
+	"github.com/open-iot-devices/server/utils/schema"
+)
+
+// Amount of events buffered for slow Subscribe clients, extra events are dropped
+const subscribeBuffer = 256
+
+// NewGRPCServer returns gRPC server with Admin service (see adminpb/admin.proto) registered,
+// options are passed to grpc.NewServer (e.g. TLS credentials).
+// Like REST API it requires "authorization: Bearer <token>" metadata.
+func NewGRPCServer(options ...grpc.ServerOption) *grpc.Server {
+	options = append(options,
+		grpc.UnaryInterceptor(unaryAuth),
+		grpc.StreamInterceptor(streamAuth),
+	)
+	server := grpc.NewServer(options...)
+	adminpb.RegisterAdminServer(server, &grpcServer{})
+	return server
+}
+
+type grpcServer struct {
+	adminpb.UnimplementedAdminServer
+}
+
+func (s *grpcServer) ListDevices(ctx context.Context, req *adminpb.ListDevicesRequest) (*adminpb.ListDevicesResponse, error) {
+	result, err := runGRPC(ctx, func() (interface{}, error) {
+		resp := &adminpb.ListDevicesResponse{}
+		for _, dev := range device.GetAllDevices() {
+			resp.Devices = append(resp.Devices, newDevicePB(dev))
+		}
+		sort.Slice(resp.Devices, func(i, j int) bool {
+			return resp.Devices[i].DisplayName < resp.Devices[j].DisplayName
+		})
+		return resp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*adminpb.ListDevicesResponse), nil
+}
+
+func (s *grpcServer) GetDevice(ctx context.Context, req *adminpb.GetDeviceRequest) (*adminpb.Device, error) {
+	return runDevice(ctx, func() (*device.Device, error) {
+		return findDevice(req.Device)
+	})
+}
+
+func (s *grpcServer) CreateDevice(ctx context.Context, req *adminpb.CreateDeviceRequest) (*adminpb.Device, error) {
+	return runDevice(ctx, func() (*device.Device, error) {
+		return createDevice(req)
+	})
+}
+
+func (s *grpcServer) UpdateDevice(ctx context.Context, req *adminpb.UpdateDeviceRequest) (*adminpb.Device, error) {
+	var update deviceUpdate
+	if req.Update == nil {
+		req.Update = &adminpb.Device{}
+	}
+	for _, field := range req.UpdateMask.GetPaths() {
+		switch field {
+		case "display_name":
+			update.DisplayName = &req.Update.DisplayName
+		case "handlers":
+			update.Handlers = &req.Update.Handlers
+		case "transport":
+			update.Transport = &req.Update.Transport
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "field '%s' can not be updated", field)
+		}
+	}
+	if err := update.validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return runDevice(ctx, func() (*device.Device, error) {
+		dev, err := findDevice(req.Device)
+		if err != nil {
+			return nil, err
+		}
+		return dev, update.apply(dev)
+	})
+}
+
+func (s *grpcServer) DeleteDevice(ctx context.Context, req *adminpb.DeleteDeviceRequest) (*adminpb.DeleteDeviceResponse, error) {
+	_, err := runGRPC(ctx, func() (interface{}, error) {
+		return deleteDevice([]string{req.Device}, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &adminpb.DeleteDeviceResponse{}, nil
+}
+
+func (s *grpcServer) SendDownlink(ctx context.Context, req *adminpb.SendDownlinkRequest) (*adminpb.SendDownlinkResponse, error) {
+	result, err := runGRPC(ctx, func() (interface{}, error) {
+		dev, err := findDevice(req.Device)
+		if err != nil {
+			return nil, err
+		}
+		// Type URL is "type.googleapis.com/<full name>", device's default message when not set
+		msgType := dev.ProtobufName
+		var value []byte
+		if req.Message != nil {
+			msgType = req.Message.TypeUrl[strings.LastIndex(req.Message.TypeUrl, "/")+1:]
+			value = req.Message.Value
+		}
+		msg := schema.NewMessage(msgType)
+		if msg == nil {
+			return nil, errorf(http.StatusBadRequest, "protobuf '%s' is not registered", msgType)
+		}
+		if err := proto.Unmarshal(value, msg); err != nil {
+			return nil, errorf(http.StatusBadRequest, "invalid %s message: %v", msgType, err)
+		}
+		if err := send(dev, msgType, msg); err != nil {
+			return nil, err
+		}
+		return &adminpb.SendDownlinkResponse{Sequence: dev.SequenceSend}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*adminpb.SendDownlinkResponse), nil
+}
+
+func (s *grpcServer) Subscribe(req *adminpb.SubscribeRequest, stream adminpb.Admin_SubscribeServer) error {
+	// Resolve devices once, so filter is cheap: it is called for every published event
+	result, err := runGRPC(stream.Context(), func() (interface{}, error) {
+		return resolveDevices(req.Devices)
+	})
+	if err != nil {
+		return err
+	}
+	for _, pattern := range req.Types {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid type pattern '%s'", pattern)
+		}
+	}
+	filter := &subscribeFilter{req: req, devices: result.(map[string]bool)}
+
+	sub := events.Subscribe(subscribeBuffer, filter.match)
+	defer sub.Close()
+	glog.Infof("Admin API subscriber connected, devices %v, types %v, handlers %v",
+		req.Devices, req.Types, req.Handlers)
+
+	for {
+		select {
+		case event := <-sub.C:
+			pb, err := newEventPB(event)
+			if err != nil {
+				glog.Infof("Admin API: unable to stream %s event: %v", event.Type, err)
+				continue
+			}
+			if err := stream.Send(pb); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			if dropped := sub.Dropped(); dropped > 0 {
+				glog.Infof("Admin API subscriber disconnected, %d events dropped", dropped)
+			}
+			return nil
+		}
+	}
+}
+
+type subscribeFilter struct {
+	req     *adminpb.SubscribeRequest
+	devices map[string]bool
+}
+
+func (f *subscribeFilter) match(event *events.Event) bool {
+	if len(f.devices) > 0 && !f.devices[event.DeviceID] {
+		return false
+	}
+	if event.Type != processor.EventMessage {
+		return f.req.Events
+	}
+
+	if len(f.req.Types) > 0 {
+		msgType, _ := event.Data["type"].(string)
+		found := false
+		for _, pattern := range f.req.Types {
+			if ok, _ := path.Match(pattern, msgType); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.req.Handlers) > 0 {
+		handlers, _ := event.Data["handlers"].([]string)
+		for _, name := range f.req.Handlers {
+			for _, handler := range handlers {
+				if name == handler {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func createDevice(req *adminpb.CreateDeviceRequest) (*device.Device, error) {
+	if req.Device == nil {
+		return nil, errorf(http.StatusBadRequest, "device is required")
+	}
+	id, err := parseID(req.Device.Id)
+	if err != nil {
+		return nil, err
+	}
+	if device.FindDeviceByID(id) != nil {
+		return nil, errorf(http.StatusConflict, "device 0x%x already exists", id)
+	}
+	if name := req.Device.DisplayName; name != "" && device.FindDevice(name) != nil {
+		return nil, errorf(http.StatusConflict, "display_name '%s' is already used", name)
+	}
+
+	encType := openiot.EncryptionType_PLAIN
+	if req.Device.EncryptionType != "" {
+		value, ok := openiot.EncryptionType_value[req.Device.EncryptionType]
+		if !ok {
+			return nil, errorf(http.StatusBadRequest, "unknown encryption_type '%s'", req.Device.EncryptionType)
+		}
+		encType = openiot.EncryptionType(value)
+	}
+	switch encType {
+	case openiot.EncryptionType_PLAIN:
+		if len(req.Key) > 0 {
+			return nil, errorf(http.StatusBadRequest, "key is not used by PLAIN encryption")
+		}
+	case openiot.EncryptionType_AES_ECB:
+		if _, err := aes.NewCipher(req.Key); err != nil {
+			return nil, errorf(http.StatusBadRequest, "invalid key: %v", err)
+		}
+	default:
+		return nil, errorf(http.StatusBadRequest, "encryption_type %v is not supported", encType)
+	}
+
+	lat, long := req.Device.Latitude, req.Device.Longitude
+	if (lat == nil) != (long == nil) {
+		return nil, errorf(http.StatusBadRequest, "both latitude and longitude must be set")
+	}
+	if lat != nil && (*lat < -90 || *lat > 90 || *long < -180 || *long > 180) {
+		return nil, errorf(http.StatusBadRequest, "invalid coordinates")
+	}
+
+	var tr transport.Transport
+	if req.Device.Transport != "" {
+		if tr = transport.FindTransportByName(req.Device.Transport); tr == nil {
+			return nil, errorf(http.StatusBadRequest, "unknown transport '%s'", req.Device.Transport)
+		}
+	}
+	for _, name := range req.Device.Handlers {
+		if device.FindHandlerByName(name) == nil {
+			return nil, errorf(http.StatusBadRequest, "unknown handler '%s'", name)
+		}
+	}
+
+	dev := device.NewDevice(id)
+	if req.Device.Name != "" {
+		dev.Name = req.Device.Name
+	}
+	if req.Device.Manufacturer != "" {
+		dev.Manufacturer = req.Device.Manufacturer
+	}
+	dev.DisplayName = req.Device.DisplayName
+	dev.ProductURL = req.Device.ProductUrl
+	dev.ProtobufName = req.Device.ProtobufName
+	if len(req.Device.MessageTypes) > 0 {
+		dev.MessageTypes = req.Device.MessageTypes
+	}
+	dev.Location = req.Device.Location
+	dev.Latitude, dev.Longitude = lat, long
+	dev.EncryptionType = encType
+	dev.SetKey(req.Key)
+	if tr != nil {
+		dev.SetTransport(tr)
+	}
+	if err := device.AddDevice(dev); err != nil {
+		return nil, err
+	}
+	if err := dev.SetHandlers(req.Device.Handlers); err != nil {
+		return nil, err
+	}
+	glog.Infof("0x%x: created using admin API", dev.ID)
+	devicesChanged()
+
+	return dev, nil
+}
+
+func newDevicePB(dev *device.Device) *adminpb.Device {
+	return &adminpb.Device{
+		Id:              dev.IDhex,
+		Name:            dev.Name,
+		DisplayName:     dev.DisplayName,
+		Manufacturer:    dev.Manufacturer,
+		ProductUrl:      dev.ProductURL,
+		ProtobufName:    dev.ProtobufName,
+		MessageTypes:    dev.MessageTypes,
+		Handlers:        dev.HandlerNames,
+		Transport:       dev.TransportName,
+		EncryptionType:  dev.EncryptionType.String(),
+		SequenceSend:    dev.SequenceSend,
+		SequenceReceive: dev.SequenceReceive,
+		Location:        dev.Location,
+		Latitude:        dev.Latitude,
+		Longitude:       dev.Longitude,
+	}
+}
+
+func newEventPB(event *events.Event) (*adminpb.Event, error) {
+	pb := &adminpb.Event{
+		Time:     timestamppb.New(event.Time),
+		DeviceId: event.DeviceID,
+	}
+
+	if event.Type == processor.EventMessage {
+		uplink := &adminpb.Uplink{}
+		uplink.Type, _ = event.Data["type"].(string)
+		uplink.Transport, _ = event.Data["transport"].(string)
+		uplink.Handlers, _ = event.Data["handlers"].([]string)
+		if msg, ok := event.Data["message"].(proto.Message); ok {
+			value, err := anypb.New(proto.MessageV2(msg))
+			if err != nil {
+				return nil, err
+			}
+			uplink.Message = value
+		}
+		pb.Kind = &adminpb.Event_Uplink{Uplink: uplink}
+		return pb, nil
+	}
+
+	// Event data is arbitrary, JSON is the simplest way to convert it into Struct
+	data := &structpb.Struct{}
+	if len(event.Data) > 0 {
+		value, err := json.Marshal(event.Data)
+		if err != nil {
+			return nil, err
+		}
+		if err := protojson.Unmarshal(value, data); err != nil {
+			return nil, err
+		}
+	}
+	pb.Kind = &adminpb.Event_Event{Event: &adminpb.ServerEvent{Type: event.Type, Data: data}}
+	return pb, nil
+}
+
+// runDevice runs fn on main loop, converts resulting device into protobuf
+func runDevice(ctx context.Context, fn func() (*device.Device, error)) (*adminpb.Device, error) {
+	result, err := runGRPC(ctx, func() (interface{}, error) {
+		dev, err := fn()
+		if err != nil {
+			return nil, err
+		}
+		return newDevicePB(dev), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*adminpb.Device), nil
+}
+
+// runGRPC is run() with errors converted into gRPC status
+func runGRPC(ctx context.Context, fn func() (interface{}, error)) (interface{}, error) {
+	result, err := run(ctx, fn)
+	if err == nil {
+		return result, nil
+	}
+
+	code := codes.Internal
+	if apiErr, ok := err.(*apiError); ok {
+		switch apiErr.code {
+		case http.StatusBadRequest:
+			code = codes.InvalidArgument
+		case http.StatusNotFound:
+			code = codes.NotFound
+		case http.StatusConflict:
+			code = codes.AlreadyExists
+		case http.StatusBadGateway, http.StatusServiceUnavailable:
+			code = codes.Unavailable
+		}
+	}
+	glog.Infof("Admin API gRPC call failed: %v", err)
+	return nil, status.Error(code, err.Error())
+}
+
+func unaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	if !authorizedGRPC(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return handler(ctx, req)
+}
+
+func streamAuth(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	if !authorizedGRPC(stream.Context()) {
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return handler(srv, stream)
+}
+
+func authorizedGRPC(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	return len(values) == 1 && validToken(values[0])
+}
@@ -0,0 +1,300 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/admin/adminpb"
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/encode"
+	"github.com/open-iot-devices/server/processor"
+	"github.com/open-iot-devices/server/transport"
+	"github.com/open-iot-devices/server/utils/events"
+)
+
+// newTestClient starts gRPC server on random port, returns client and
+// context with valid token
+func newTestClient(t *testing.T) (adminpb.AdminClient, context.Context, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := NewGRPCServer()
+	go server.Serve(listener)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+
+	return adminpb.NewAdminClient(conn), ctx, func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.close()
+	client, ctx, stop := newTestClient(t)
+	defer stop()
+
+	for _, token := range []string{"", "Bearer", "Bearer wrong", "secret"} {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", token)
+		_, err := client.ListDevices(ctx, &adminpb.ListDevicesRequest{})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err), token)
+
+		stream, err := client.Subscribe(ctx, &adminpb.SubscribeRequest{})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Unauthenticated, status.Code(err), token)
+	}
+	_, err := client.ListDevices(ctx, &adminpb.ListDevicesRequest{})
+	assert.NoError(t, err)
+
+	// Disabled without token
+	*flagToken = ""
+	_, err = client.ListDevices(ctx, &adminpb.ListDevicesRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestGRPCDevices(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.close()
+	client, ctx, stop := newTestClient(t)
+	defer stop()
+	handler := &mockHandler{}
+	device.MustAddHandler(handler)
+	defer device.DeleteHandler(handler.GetName())
+	tr := &mockTransport{name: "admin_grpc"}
+	require.NoError(t, transport.AddTransport(tr))
+	defer transport.DeleteTransport(tr.name)
+	defer device.DeleteAllDevices()
+
+	// Create
+	key := []byte("0123456789abcdef")
+	created, err := client.CreateDevice(ctx, &adminpb.CreateDeviceRequest{
+		Device: &adminpb.Device{
+			Id:             "0x30",
+			DisplayName:    "garage",
+			ProtobufName:   "openiot.JoinResponse",
+			Handlers:       []string{"admin_mock"},
+			Transport:      "admin_grpc",
+			EncryptionType: "AES_ECB",
+			Latitude:       proto.Float64(51.5),
+			Longitude:      proto.Float64(-0.1),
+		},
+		Key: key,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "0x30", created.Id)
+	assert.Equal(t, 51.5, created.GetLatitude())
+	assert.Equal(t, "Unknown Device", created.Name)
+	assert.Equal(t, "AES_ECB", created.EncryptionType)
+	dev := device.FindDeviceByID(0x30)
+	require.NotNil(t, dev)
+	assert.Equal(t, key, dev.Key())
+	assert.Equal(t, tr, dev.Transport())
+	require.NotNil(t, dev.Latitude)
+	require.NotNil(t, dev.Longitude)
+	assert.Equal(t, 51.5, *dev.Latitude)
+	assert.Equal(t, -0.1, *dev.Longitude)
+	assert.Equal(t, []*device.Device{dev}, handler.devices)
+	assert.Equal(t, 1, api.changes)
+
+	for _, request := range []*adminpb.CreateDeviceRequest{
+		{},
+		{Device: &adminpb.Device{Id: "xyz"}},
+		{Device: &adminpb.Device{Id: "0x31", EncryptionType: "AES_ECB", DisplayName: "a"}},
+		{Device: &adminpb.Device{Id: "0x31", EncryptionType: "NOTHING"}},
+		{Device: &adminpb.Device{Id: "0x31"}, Key: key},
+		{Device: &adminpb.Device{Id: "0x31", Handlers: []string{"nothing"}}},
+		{Device: &adminpb.Device{Id: "0x31", Transport: "nothing"}},
+		{Device: &adminpb.Device{Id: "0x31", Latitude: proto.Float64(1)}},
+		{Device: &adminpb.Device{Id: "0x31", Latitude: proto.Float64(91), Longitude: proto.Float64(0)}},
+	} {
+		_, err := client.CreateDevice(ctx, request)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), request.String())
+	}
+	for _, request := range []*adminpb.CreateDeviceRequest{
+		{Device: &adminpb.Device{Id: "0x30"}},
+		{Device: &adminpb.Device{Id: "0x31", DisplayName: "garage"}},
+	} {
+		_, err := client.CreateDevice(ctx, request)
+		assert.Equal(t, codes.AlreadyExists, status.Code(err), request.String())
+	}
+	assert.Nil(t, device.FindDeviceByID(0x31))
+	assert.Equal(t, 1, api.changes)
+
+	// Get / List
+	got, err := client.GetDevice(ctx, &adminpb.GetDeviceRequest{Device: "garage"})
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(created, got))
+	_, err = client.GetDevice(ctx, &adminpb.GetDeviceRequest{Device: "attic"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	list, err := client.ListDevices(ctx, &adminpb.ListDevicesRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Devices, 1)
+
+	// Update: only fields from mask
+	updated, err := client.UpdateDevice(ctx, &adminpb.UpdateDeviceRequest{
+		Device:     "0x30",
+		Update:     &adminpb.Device{DisplayName: "shed", Transport: "nothing"},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"display_name"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "shed", updated.DisplayName)
+	assert.Equal(t, "admin_grpc", updated.Transport)
+	assert.Equal(t, 2, api.changes)
+	_, err = client.UpdateDevice(ctx, &adminpb.UpdateDeviceRequest{
+		Device:     "shed",
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"sequence_send"}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.UpdateDevice(ctx, &adminpb.UpdateDeviceRequest{
+		Device:     "shed",
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"transport"}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Downlink
+	msg, err := anypb.New(proto.MessageV2(&openiot.JoinResponse{Name: "srv"}))
+	require.NoError(t, err)
+	sent, err := client.SendDownlink(ctx, &adminpb.SendDownlinkRequest{Device: "shed", Message: msg})
+	require.NoError(t, err)
+	assert.Equal(t, dev.SequenceSend, sent.Sequence)
+	require.Len(t, tr.history, 1)
+	buf := bytes.NewBuffer(tr.history[0])
+	require.NoError(t, encode.ReadSingleMessage(buf, &openiot.Header{}))
+	resp := &openiot.JoinResponse{}
+	require.NoError(t, encode.DecryptAndRead(buf, openiot.EncryptionType_AES_ECB, key, &openiot.MessageInfo{}, resp))
+	assert.Equal(t, "srv", resp.Name)
+	_, err = client.SendDownlink(ctx, &adminpb.SendDownlinkRequest{
+		Device:  "shed",
+		Message: &anypb.Any{TypeUrl: "type.googleapis.com/nothing.Message"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Delete
+	_, err = client.DeleteDevice(ctx, &adminpb.DeleteDeviceRequest{Device: "shed"})
+	require.NoError(t, err)
+	assert.Nil(t, device.FindDeviceByID(0x30))
+	assert.Equal(t, 3, api.changes)
+	_, err = client.DeleteDevice(ctx, &adminpb.DeleteDeviceRequest{Device: "shed"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGRPCSubscribe(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.close()
+	client, ctx, stop := newTestClient(t)
+	defer stop()
+	defer device.DeleteAllDevices()
+	tr := &mockTransport{name: "admin_sub"}
+
+	dev := device.NewDevice(0x40)
+	dev.ProtobufName = "openiot.JoinResponse"
+	require.NoError(t, device.AddDevice(dev))
+	other := device.NewDevice(0x41)
+	other.DisplayName = "other"
+	other.ProtobufName = "openiot.JoinResponse"
+	require.NoError(t, device.AddDevice(other))
+
+	unknown, err := client.Subscribe(ctx, &adminpb.SubscribeRequest{Devices: []string{"nothing"}})
+	require.NoError(t, err)
+	_, err = unknown.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	stream, err := client.Subscribe(ctx, &adminpb.SubscribeRequest{
+		Devices: []string{"0x40"},
+		Types:   []string{"openiot.Join*"},
+		Events:  true,
+	})
+	require.NoError(t, err)
+
+	// Events published before subscription is made are not delivered:
+	// keep pinging until first ping received
+	subscribed := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-subscribed:
+				return
+			case <-time.After(10 * time.Millisecond):
+				events.Publish(&events.Event{Type: "test.ping", DeviceID: "0x40"})
+			}
+		}
+	}()
+	recv := func() *adminpb.Event {
+		for {
+			event, err := stream.Recv()
+			require.NoError(t, err)
+			if event.GetEvent().GetType() != "test.ping" {
+				return event
+			}
+		}
+	}
+	for {
+		event, err := stream.Recv()
+		require.NoError(t, err)
+		if event.GetEvent().GetType() == "test.ping" {
+			close(subscribed)
+			break
+		}
+	}
+
+	for _, id := range []uint64{0x41, 0x40} {
+		payload, err := encode.MakeReadyToSendMessage(&openiot.Header{DeviceId: id}, openiot.EncryptionType_PLAIN, nil,
+			&openiot.MessageInfo{Sequence: 1}, &openiot.JoinResponse{Name: "hello"})
+		require.NoError(t, err)
+		require.NoError(t, processor.ProcessMessage(&processor.Message{Source: tr, Payload: payload}))
+	}
+	events.Publish(&events.Event{Type: "rule", Data: map[string]interface{}{"name": "global"}})
+	events.Publish(&events.Event{Type: "rule", DeviceID: "0x40", Data: map[string]interface{}{"value": 1.5}})
+
+	// Message of 0x41 and event without device are filtered out
+	event := recv()
+	assert.Equal(t, "0x40", event.DeviceId)
+	uplink := event.GetUplink()
+	require.NotNil(t, uplink)
+	assert.Equal(t, "openiot.JoinResponse", uplink.Type)
+	assert.Equal(t, "admin_sub", uplink.Transport)
+	resp := &openiot.JoinResponse{}
+	require.NoError(t, uplink.Message.UnmarshalTo(proto.MessageV2(resp)))
+	assert.Equal(t, "hello", resp.Name)
+
+	event = recv()
+	require.NotNil(t, event.GetEvent())
+	assert.Equal(t, "rule", event.GetEvent().Type)
+	assert.Equal(t, 1.5, event.GetEvent().Data.Fields["value"].GetNumberValue())
+	assert.False(t, event.Time.AsTime().IsZero())
+
+	// Filters
+	filter := &subscribeFilter{
+		req:     &adminpb.SubscribeRequest{Handlers: []string{"mqtt"}},
+		devices: map[string]bool{},
+	}
+	message := &events.Event{
+		Type: processor.EventMessage,
+		Data: map[string]interface{}{"type": "openiot.JoinResponse", "handlers": []string{"file", "mqtt"}},
+	}
+	assert.True(t, filter.match(message))
+	assert.False(t, filter.match(&events.Event{Type: "rule"}))
+	filter.req.Handlers = []string{"influxdb"}
+	assert.False(t, filter.match(message))
+	filter.req = &adminpb.SubscribeRequest{Types: []string{"openiot.sensor.*"}}
+	assert.False(t, filter.match(message))
+}
@@ -0,0 +1,69 @@
+package admin
+
+import (
+	"net/http"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/open-iot-devices/server/utils/schema"
+)
+
+// Nested messages deeper than that are not described (protobufs may be recursive)
+const maxSchemaDepth = 5
+
+// messageSchema describes protobuf message, e.g. to build downlink form
+type messageSchema struct {
+	Name   string         `json:"name"`
+	Fields []*fieldSchema `json:"fields"`
+}
+
+type fieldSchema struct {
+	// Name as used in JSON (protojson accepts both original and JSON names)
+	Name     string `json:"name"`
+	JSONName string `json:"json_name"`
+	// Protobuf kind: bool, string, int32, double, enum, message, ...
+	Kind     string `json:"kind"`
+	Repeated bool   `json:"repeated,omitempty"`
+	Map      bool   `json:"map,omitempty"`
+	// Names of values, for enums
+	Enum []string `json:"enum,omitempty"`
+	// For messages, nil when nesting is too deep
+	Message *messageSchema `json:"message,omitempty"`
+}
+
+func getSchema(params []string, body interface{}) (interface{}, error) {
+	desc := schema.FindMessageDescriptor(params[0])
+	if desc == nil {
+		return nil, errorf(http.StatusNotFound, "protobuf '%s' is not registered", params[0])
+	}
+	return newMessageSchema(desc, 0), nil
+}
+
+func newMessageSchema(desc protoreflect.MessageDescriptor, depth int) *messageSchema {
+	result := &messageSchema{
+		Name:   string(desc.FullName()),
+		Fields: []*fieldSchema{},
+	}
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		info := &fieldSchema{
+			Name:     string(field.Name()),
+			JSONName: field.JSONName(),
+			Kind:     field.Kind().String(),
+			Repeated: field.IsList(),
+			Map:      field.IsMap(),
+		}
+		if enum := field.Enum(); enum != nil {
+			values := enum.Values()
+			for j := 0; j < values.Len(); j++ {
+				info.Enum = append(info.Enum, string(values.Get(j).Name()))
+			}
+		}
+		if message := field.Message(); message != nil && !field.IsMap() && depth < maxSchemaDepth {
+			info.Message = newMessageSchema(message, depth+1)
+		}
+		result.Fields = append(result.Fields, info)
+	}
+	return result
+}
@@ -0,0 +1,152 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/open-iot-devices/server/processor"
+	"github.com/open-iot-devices/server/utils/events"
+)
+
+const (
+	// Amount of events buffered for slow stream clients, extra events are dropped
+	streamBuffer = 256
+	// Comment sent to idle stream, so proxies don't close connection
+	streamKeepAlive = 30 * time.Second
+)
+
+// streamEvent is processed device message or dropped packet, sent as
+// Server-Sent Event of the same type ("message" or "dropped")
+type streamEvent struct {
+	Type        string          `json:"type"`
+	Time        time.Time       `json:"time"`
+	DeviceID    string          `json:"device_id,omitempty"`
+	Transport   string          `json:"transport"`
+	MessageType string          `json:"message_type,omitempty"`
+	Message     json.RawMessage `json:"message,omitempty"`
+	Handlers    []string        `json:"handlers,omitempty"`
+	// Dropped packets only: reason (e.g. "crc", "duplicate"), error and raw packet (hex)
+	Reason  string `json:"reason,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Payload string `json:"payload,omitempty"`
+}
+
+type streamFilter struct {
+	devices    map[string]bool
+	transports map[string]bool
+}
+
+func (f *streamFilter) match(event *events.Event) bool {
+	if event.Type != processor.EventMessage && event.Type != processor.EventError {
+		return false
+	}
+	if len(f.devices) > 0 && !f.devices[event.DeviceID] {
+		return false
+	}
+	if len(f.transports) > 0 {
+		name, _ := event.Data["transport"].(string)
+		return f.transports[name]
+	}
+	return true
+}
+
+// serveStream streams device messages / dropped packets as Server-Sent Events
+// until client disconnects. Query parameters "device" (ID or display name) and
+// "transport" (name) filter events, both may be repeated.
+func serveStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming not supported"})
+		return
+	}
+
+	query := r.URL.Query()
+	devices, err := run(r.Context(), func() (interface{}, error) {
+		return resolveDevices(query["device"])
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	filter := &streamFilter{
+		devices:    devices.(map[string]bool),
+		transports: map[string]bool{},
+	}
+	for _, name := range query["transport"] {
+		filter.transports[name] = true
+	}
+
+	sub := events.Subscribe(streamBuffer, filter.match)
+	defer sub.Close()
+	glog.Infof("Admin API stream client %s connected, devices %v, transports %v",
+		r.RemoteAddr, query["device"], query["transport"])
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-sub.C:
+			value := newStreamEvent(event)
+			data, err := json.Marshal(value)
+			if err != nil {
+				glog.Infof("Admin API: unable to stream %s event: %v", event.Type, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", value.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			glog.Infof("Admin API stream client %s disconnected, %d events dropped", r.RemoteAddr, sub.Dropped())
+			return
+		}
+	}
+}
+
+func newStreamEvent(event *events.Event) *streamEvent {
+	result := &streamEvent{
+		Time:     event.Time,
+		DeviceID: event.DeviceID,
+	}
+	result.Transport, _ = event.Data["transport"].(string)
+
+	if event.Type == processor.EventError {
+		result.Type = "dropped"
+		result.Reason, _ = event.Data["reason"].(string)
+		result.Error, _ = event.Data["error"].(string)
+		result.Payload, _ = event.Data["payload"].(string)
+		return result
+	}
+
+	result.Type = "message"
+	result.MessageType, _ = event.Data["type"].(string)
+	result.Handlers, _ = event.Data["handlers"].([]string)
+	if msg, ok := event.Data["message"].(proto.Message); ok {
+		if value, err := protojson.Marshal(proto.MessageV2(msg)); err == nil {
+			result.Message = value
+		} else {
+			result.Error = err.Error()
+		}
+	}
+	return result
+}
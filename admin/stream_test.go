@@ -0,0 +1,113 @@
+package admin
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/encode"
+	"github.com/open-iot-devices/server/processor"
+)
+
+// readStreamEvent reads next Server-Sent Event, skipping keep-alive comments
+func readStreamEvent(t *testing.T, reader *bufio.Reader) (string, *streamEvent) {
+	var name string
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event := &streamEvent{}
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), event))
+			return name, event
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.close()
+	server := httptest.NewServer(api.handler)
+	defer server.Close()
+	defer device.DeleteAllDevices()
+
+	dev := device.NewDevice(0x50)
+	dev.DisplayName = "cellar"
+	dev.ProtobufName = "openiot.JoinResponse"
+	require.NoError(t, device.AddDevice(dev))
+	lora := &mockTransport{name: "stream_lora"}
+	wifi := &mockTransport{name: "stream_wifi"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	get := func(query string) *http.Response {
+		r, err := http.NewRequest(http.MethodGet, server.URL+"/api/stream"+query, nil)
+		require.NoError(t, err)
+		r.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(r.WithContext(ctx))
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := get("?device=nothing")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, http.StatusMethodNotAllowed, api.do(http.MethodPost, "/api/stream", "", nil))
+
+	// Subscription is made before response headers are sent
+	resp = get("?device=cellar&device=0x51&transport=stream_lora")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	send := func(tr *mockTransport, id uint64, sequence uint32) []byte {
+		payload, err := encode.MakeReadyToSendMessage(&openiot.Header{DeviceId: id}, openiot.EncryptionType_PLAIN, nil,
+			&openiot.MessageInfo{Sequence: sequence}, &openiot.JoinResponse{Name: "hello"})
+		require.NoError(t, err)
+		processor.ProcessMessage(&processor.Message{Source: tr, Payload: payload})
+		return payload
+	}
+	send(wifi, 0x50, 1)
+	send(lora, 0x52, 1)
+	send(lora, 0x50, 2)
+	duplicate := send(lora, 0x50, 2)
+	unknown := send(lora, 0x51, 1)
+
+	// Messages from other transport / device are filtered out
+	reader := bufio.NewReader(resp.Body)
+	name, event := readStreamEvent(t, reader)
+	assert.Equal(t, "message", name)
+	assert.Equal(t, "message", event.Type)
+	assert.Equal(t, "0x50", event.DeviceID)
+	assert.Equal(t, "stream_lora", event.Transport)
+	assert.Equal(t, "openiot.JoinResponse", event.MessageType)
+	assert.JSONEq(t, `{"name": "hello"}`, string(event.Message))
+	assert.Empty(t, event.Payload)
+
+	name, event = readStreamEvent(t, reader)
+	assert.Equal(t, "dropped", name)
+	assert.Equal(t, "0x50", event.DeviceID)
+	assert.Equal(t, "duplicate", event.Reason)
+	assert.Equal(t, "0x50: drop duplicate packet seq 2 (last seq 2)", event.Error)
+	assert.Equal(t, hex.EncodeToString(duplicate), event.Payload)
+
+	name, event = readStreamEvent(t, reader)
+	assert.Equal(t, "dropped", name)
+	assert.Equal(t, "0x51", event.DeviceID)
+	assert.Equal(t, "unknown_device", event.Reason)
+	assert.Equal(t, hex.EncodeToString(unknown), event.Payload)
+}
@@ -0,0 +1,577 @@
+package ui
+
+// Assets are kept as Go constants, so server binary is self-contained.
+// Keep JavaScript free of backticks: constants are raw string literals.
+
+const indexHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>OpenIoT server</title>
+<link rel="stylesheet" href="style.css">
+</head>
+<body>
+<header>
+  <h1>OpenIoT server</h1>
+  <form id="token-form">
+    <input id="token" type="password" placeholder="Admin API token" autocomplete="current-password">
+    <button type="submit">Connect</button>
+  </form>
+  <span id="status"></span>
+</header>
+<main>
+  <section>
+    <h2>Devices</h2>
+    <table>
+      <thead><tr><th>Name</th><th>ID</th><th>Protobuf</th><th>Transport</th><th>Handlers</th><th>Last seen</th><th>Latest values</th></tr></thead>
+      <tbody id="devices"></tbody>
+    </table>
+  </section>
+  <section>
+    <h2>Transports</h2>
+    <table>
+      <thead><tr><th>Name</th><th>Type</th><th>Health</th><th>Received</th><th>Bytes</th><th>Sent</th><th>Send errors</th><th>Last received</th></tr></thead>
+      <tbody id="transports"></tbody>
+    </table>
+  </section>
+  <section>
+    <h2>Pending joins</h2>
+    <table>
+      <thead><tr><th>ID</th><th>Name</th><th>Manufacturer</th><th>Protobuf</th><th>Transport</th><th>Requested</th><th></th></tr></thead>
+      <tbody id="joins"></tbody>
+    </table>
+  </section>
+  <section>
+    <h2>Send downlink</h2>
+    <form id="downlink-form">
+      <label>Device <select id="downlink-device"></select></label>
+      <label>Message <select id="downlink-type"></select></label>
+      <div id="downlink-fields"></div>
+      <button type="submit">Send</button>
+      <span id="downlink-result"></span>
+    </form>
+  </section>
+  <section>
+    <h2>Live messages</h2>
+    <form id="stream-form">
+      <input id="stream-device" placeholder="Device (ID or name)">
+      <input id="stream-transport" placeholder="Transport">
+      <button id="stream-button" type="submit">Start</button>
+    </form>
+    <table>
+      <thead><tr><th>Time</th><th>Device</th><th>Transport</th><th>Type</th><th>Details</th></tr></thead>
+      <tbody id="log"></tbody>
+    </table>
+  </section>
+</main>
+<script src="app.js"></script>
+</body>
+</html>
+`
+
+const styleCSS = `body {
+  margin: 0;
+  font-family: sans-serif;
+  font-size: 14px;
+  color: #222;
+  background: #f4f5f7;
+}
+header {
+  display: flex;
+  align-items: center;
+  gap: 16px;
+  padding: 8px 16px;
+  background: #263238;
+  color: #fff;
+}
+header h1 {
+  font-size: 18px;
+  margin: 0;
+}
+main {
+  padding: 0 16px 16px;
+}
+section {
+  margin-top: 16px;
+  padding: 8px 12px;
+  background: #fff;
+  border-radius: 4px;
+  overflow-x: auto;
+}
+h2 {
+  font-size: 16px;
+  margin: 4px 0 8px;
+}
+table {
+  width: 100%;
+  border-collapse: collapse;
+}
+th, td {
+  padding: 4px 6px;
+  border-bottom: 1px solid #e0e0e0;
+  text-align: left;
+  vertical-align: top;
+}
+th {
+  font-weight: 600;
+  color: #555;
+}
+td.values, td.details {
+  font-family: monospace;
+  word-break: break-all;
+}
+tr.dropped td {
+  background: #fdecea;
+}
+.ok {
+  color: #2e7d32;
+}
+.warning {
+  color: #ef6c00;
+}
+.error {
+  color: #c62828;
+}
+form label {
+  margin-right: 12px;
+}
+fieldset {
+  margin: 6px 0;
+  border: 1px solid #ddd;
+}
+fieldset label {
+  display: block;
+  margin: 4px 0;
+}
+#downlink-fields {
+  margin: 8px 0;
+}
+`
+
+const appJS = `"use strict";
+
+var state = {
+  token: localStorage.getItem("openiot.token") || "",
+  devices: [],
+  stream: null,
+  timer: null
+};
+var maxLogRows = 200;
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+function el(tag, text, className) {
+  var node = document.createElement(tag);
+  if (text !== undefined && text !== null) {
+    node.textContent = text;
+  }
+  if (className) {
+    node.className = className;
+  }
+  return node;
+}
+
+function row(cells) {
+  var tr = el("tr");
+  cells.forEach(function(cell) {
+    if (cell instanceof Node) {
+      var td = el("td");
+      td.appendChild(cell);
+      tr.appendChild(td);
+    } else {
+      tr.appendChild(el("td", cell));
+    }
+  });
+  return tr;
+}
+
+function setStatus(text, className) {
+  var status = $("status");
+  status.textContent = text;
+  status.className = className || "";
+}
+
+function api(method, path, body) {
+  var options = {method: method, headers: {"Authorization": "Bearer " + state.token}};
+  if (body !== undefined) {
+    options.headers["Content-Type"] = "application/json";
+    options.body = JSON.stringify(body);
+  }
+  return fetch("/api/" + path, options).then(function(resp) {
+    return resp.json().then(function(data) {
+      if (!resp.ok) {
+        throw new Error(data.error || resp.statusText);
+      }
+      return data;
+    });
+  });
+}
+
+function ago(value) {
+  if (!value) {
+    return "never";
+  }
+  var seconds = Math.round((Date.now() - new Date(value).getTime()) / 1000);
+  if (seconds < 60) {
+    return seconds + "s ago";
+  }
+  if (seconds < 3600) {
+    return Math.round(seconds / 60) + "m ago";
+  }
+  if (seconds < 86400) {
+    return Math.round(seconds / 3600) + "h ago";
+  }
+  return Math.round(seconds / 86400) + "d ago";
+}
+
+// flatten converts message into "a.b=1" lines
+function flatten(value, prefix, out) {
+  out = out || [];
+  if (value !== null && typeof value === "object" && !Array.isArray(value)) {
+    Object.keys(value).forEach(function(key) {
+      flatten(value[key], prefix ? prefix + "." + key : key, out);
+    });
+  } else {
+    out.push(prefix + "=" + JSON.stringify(value));
+  }
+  return out;
+}
+
+function deviceName(dev) {
+  return dev.display_name || dev.id;
+}
+
+function renderDevices(devices) {
+  state.devices = devices;
+  var body = $("devices");
+  body.textContent = "";
+  devices.forEach(function(dev) {
+    var values = dev.last_message ? flatten(dev.last_message.message, "").join("\n") : "";
+    var tr = row([deviceName(dev), dev.id, dev.protobuf_name, dev.transport,
+      dev.handlers.join(", "), ago(dev.last_seen), values]);
+    tr.lastChild.className = "values";
+    body.appendChild(tr);
+  });
+  renderDownlinkDevices();
+}
+
+function transportHealth(tr) {
+  if (tr.send_errors > 0 && tr.send_errors >= tr.packets_sent) {
+    return ["send failing", "error"];
+  }
+  if (!tr.last_received) {
+    return ["no traffic", "warning"];
+  }
+  if (Date.now() - new Date(tr.last_received).getTime() > 3600 * 1000) {
+    return ["idle", "warning"];
+  }
+  return ["ok", "ok"];
+}
+
+function renderTransports(transports) {
+  var body = $("transports");
+  body.textContent = "";
+  transports.forEach(function(tr) {
+    var health = transportHealth(tr);
+    body.appendChild(row([tr.name, tr.type, el("span", health[0], health[1]),
+      tr.packets_received, tr.bytes_received, tr.packets_sent, tr.send_errors, ago(tr.last_received)]));
+  });
+}
+
+function renderJoins(joins) {
+  var body = $("joins");
+  body.textContent = "";
+  joins.forEach(function(join) {
+    var actions = el("span");
+    var approve = el("button", "Approve");
+    approve.onclick = function() {
+      api("POST", "joins/" + join.id + "/approve").then(refresh, showError);
+    };
+    var reject = el("button", "Reject");
+    reject.onclick = function() {
+      api("DELETE", "joins/" + join.id).then(refresh, showError);
+    };
+    actions.appendChild(approve);
+    actions.appendChild(reject);
+    body.appendChild(row([join.id, join.name, join.manufacturer, join.protobuf_name,
+      join.transport, ago(join.time), actions]));
+  });
+}
+
+function showError(err) {
+  setStatus(err.message, "error");
+}
+
+function refresh() {
+  if (!state.token) {
+    setStatus("Enter API token", "warning");
+    return;
+  }
+  Promise.all([api("GET", "devices"), api("GET", "transports"), api("GET", "joins")]).then(function(results) {
+    renderDevices(results[0]);
+    renderTransports(results[1]);
+    renderJoins(results[2]);
+    setStatus("Updated " + new Date().toLocaleTimeString(), "ok");
+  }, showError);
+}
+
+// Downlink form is built from protobuf schema of selected message type
+
+function renderDownlinkDevices() {
+  var select = $("downlink-device");
+  var selected = select.value;
+  select.textContent = "";
+  state.devices.forEach(function(dev) {
+    var option = el("option", deviceName(dev));
+    option.value = dev.id;
+    select.appendChild(option);
+  });
+  if (selected) {
+    select.value = selected;
+  }
+  if (select.value !== selected) {
+    renderDownlinkTypes();
+  }
+}
+
+function selectedDevice() {
+  var id = $("downlink-device").value;
+  return state.devices.filter(function(dev) {
+    return dev.id === id;
+  })[0];
+}
+
+function renderDownlinkTypes() {
+  var select = $("downlink-type");
+  select.textContent = "";
+  var dev = selectedDevice();
+  if (!dev) {
+    return;
+  }
+  var types = [dev.protobuf_name];
+  Object.keys(dev.message_types || {}).forEach(function(tag) {
+    if (types.indexOf(dev.message_types[tag]) < 0) {
+      types.push(dev.message_types[tag]);
+    }
+  });
+  types.filter(Boolean).forEach(function(name) {
+    select.appendChild(el("option", name));
+  });
+  renderDownlinkFields();
+}
+
+function renderDownlinkFields() {
+  var container = $("downlink-fields");
+  container.textContent = "";
+  var type = $("downlink-type").value;
+  if (!type) {
+    return;
+  }
+  api("GET", "schemas/" + type).then(function(schema) {
+    container.textContent = "";
+    container.appendChild(messageFieldset(schema, schema.name));
+  }, showError);
+}
+
+function messageFieldset(schema, title) {
+  var fieldset = el("fieldset");
+  fieldset.appendChild(el("legend", title));
+  fieldset.schema = schema;
+  schema.fields.forEach(function(field) {
+    var label = el("label", field.name + " ");
+    var input;
+    if (field.message && !field.repeated) {
+      input = messageFieldset(field.message, field.name);
+    } else if (field.repeated || field.map || field.kind === "message") {
+      input = el("textarea");
+      input.placeholder = "JSON";
+    } else if (field.kind === "bool") {
+      input = el("input");
+      input.type = "checkbox";
+    } else if (field.kind === "enum") {
+      input = el("select");
+      input.appendChild(el("option", ""));
+      field.enum.forEach(function(name) {
+        input.appendChild(el("option", name));
+      });
+    } else {
+      input = el("input");
+      if (field.kind.indexOf("int") >= 0 || field.kind.indexOf("fixed") >= 0 ||
+          field.kind === "float" || field.kind === "double") {
+        input.type = "number";
+        input.step = "any";
+      }
+    }
+    input.field = field;
+    label.appendChild(input);
+    fieldset.appendChild(label);
+  });
+  return fieldset;
+}
+
+// collectMessage reads form values into protojson object, empty inputs are skipped
+function collectMessage(fieldset) {
+  var result = {};
+  Array.prototype.forEach.call(fieldset.children, function(label) {
+    var input = label.lastChild;
+    if (!input || !input.field) {
+      return;
+    }
+    var field = input.field;
+    var value;
+    if (input.tagName === "FIELDSET") {
+      value = collectMessage(input);
+      if (Object.keys(value).length === 0) {
+        return;
+      }
+    } else if (input.type === "checkbox") {
+      if (!input.checked) {
+        return;
+      }
+      value = true;
+    } else if (input.value === "") {
+      return;
+    } else if (input.tagName === "TEXTAREA") {
+      value = JSON.parse(input.value);
+    } else if (input.type === "number" && field.kind.indexOf("64") < 0) {
+      value = Number(input.value);
+    } else {
+      value = input.value;
+    }
+    result[field.json_name] = value;
+  });
+  return result;
+}
+
+function sendDownlink(event) {
+  event.preventDefault();
+  var fieldset = $("downlink-fields").firstChild;
+  var result = $("downlink-result");
+  var message;
+  try {
+    message = fieldset ? collectMessage(fieldset) : {};
+  } catch (err) {
+    result.textContent = "Invalid JSON: " + err.message;
+    result.className = "error";
+    return;
+  }
+  api("POST", "devices/" + $("downlink-device").value + "/downlink",
+    {type: $("downlink-type").value, message: message}).then(function(resp) {
+    result.textContent = "Sent, sequence " + resp.sequence;
+    result.className = "ok";
+  }, function(err) {
+    result.textContent = err.message;
+    result.className = "error";
+  });
+}
+
+// Live log reads Server-Sent Events using fetch: EventSource can't send Authorization header
+
+function addLogRow(event) {
+  var details;
+  if (event.type === "dropped") {
+    details = event.reason + ": " + event.error + "\n" + event.payload;
+  } else {
+    details = flatten(event.message, "").join("\n");
+  }
+  var tr = row([new Date(event.time).toLocaleTimeString(), event.device_id || "", event.transport,
+    event.type === "dropped" ? "dropped" : event.message_type, details]);
+  tr.lastChild.className = "details";
+  if (event.type === "dropped") {
+    tr.className = "dropped";
+  }
+  var body = $("log");
+  body.insertBefore(tr, body.firstChild);
+  while (body.children.length > maxLogRows) {
+    body.removeChild(body.lastChild);
+  }
+}
+
+function stopStream() {
+  if (state.stream) {
+    state.stream.abort();
+    state.stream = null;
+  }
+  $("stream-button").textContent = "Start";
+}
+
+function startStream(event) {
+  event.preventDefault();
+  if (state.stream) {
+    stopStream();
+    return;
+  }
+  var params = [];
+  if ($("stream-device").value) {
+    params.push("device=" + encodeURIComponent($("stream-device").value));
+  }
+  if ($("stream-transport").value) {
+    params.push("transport=" + encodeURIComponent($("stream-transport").value));
+  }
+  var controller = new AbortController();
+  state.stream = controller;
+  $("stream-button").textContent = "Stop";
+
+  fetch("/api/stream?" + params.join("&"), {
+    headers: {"Authorization": "Bearer " + state.token},
+    signal: controller.signal
+  }).then(function(resp) {
+    if (!resp.ok) {
+      return resp.json().then(function(data) {
+        throw new Error(data.error || resp.statusText);
+      });
+    }
+    var reader = resp.body.getReader();
+    var decoder = new TextDecoder();
+    var buffer = "";
+    function read() {
+      return reader.read().then(function(chunk) {
+        if (chunk.done) {
+          throw new Error("stream closed");
+        }
+        buffer += decoder.decode(chunk.value, {stream: true});
+        var index;
+        while ((index = buffer.indexOf("\n\n")) >= 0) {
+          var block = buffer.slice(0, index);
+          buffer = buffer.slice(index + 2);
+          block.split("\n").forEach(function(line) {
+            if (line.indexOf("data: ") === 0) {
+              addLogRow(JSON.parse(line.slice(6)));
+            }
+          });
+        }
+        return read();
+      });
+    }
+    return read();
+  }).catch(function(err) {
+    if (state.stream === controller) {
+      stopStream();
+      showError(err);
+    }
+  });
+}
+
+function connect(event) {
+  if (event) {
+    event.preventDefault();
+    state.token = $("token").value;
+    localStorage.setItem("openiot.token", state.token);
+  }
+  stopStream();
+  clearInterval(state.timer);
+  refresh();
+  state.timer = setInterval(refresh, 10000);
+}
+
+$("token").value = state.token;
+$("token-form").onsubmit = connect;
+$("downlink-device").onchange = renderDownlinkTypes;
+$("downlink-type").onchange = renderDownlinkFields;
+$("downlink-form").onsubmit = sendDownlink;
+$("stream-form").onsubmit = startStream;
+connect();
+`
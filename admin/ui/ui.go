@@ -0,0 +1,46 @@
+// Package ui implements small web UI of admin API: devices with latest values,
+// transports, pending joins, live message log and downlink form.
+// Static assets are compiled into binary (see assets.go), UI has no external
+// dependencies, so it works without internet access.
+package ui
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+type asset struct {
+	contentType string
+	content     string
+}
+
+var assets = map[string]asset{
+	"index.html": {"text/html; charset=utf-8", indexHTML},
+	"app.js":     {"application/javascript; charset=utf-8", appJS},
+	"style.css":  {"text/css; charset=utf-8", styleCSS},
+}
+
+// Assets never change while server is running
+var started = time.Now()
+
+// Handler returns HTTP handler of UI, it has to be mounted at /ui/.
+// UI itself is public, API token is asked by UI and kept in browser.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/ui/")
+		if name == "" {
+			name = "index.html"
+		}
+		asset, ok := assets[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", asset.contentType)
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, name, started, strings.NewReader(asset.content))
+	})
+}
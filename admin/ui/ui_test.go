@@ -0,0 +1,37 @@
+package ui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	for path, contentType := range map[string]string{
+		"/ui/":           "text/html; charset=utf-8",
+		"/ui/index.html": "text/html; charset=utf-8",
+		"/ui/app.js":     "application/javascript; charset=utf-8",
+		"/ui/style.css":  "text/css; charset=utf-8",
+	} {
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, contentType, w.Header().Get("Content-Type"), path)
+		assert.Equal(t, "default-src 'self'", w.Header().Get("Content-Security-Policy"), path)
+		assert.NotEmpty(t, w.Body.String(), path)
+	}
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ui/nothing.js", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestNoExternalResources(t *testing.T) {
+	for name, asset := range assets {
+		assert.False(t, strings.Contains(asset.content, "http://"), name)
+		assert.False(t, strings.Contains(asset.content, "https://"), name)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Subset of API responses used in output, see package admin
+
+type deviceInfo struct {
+	ID              string            `json:"id"`
+	Name            string            `json:"name"`
+	DisplayName     string            `json:"display_name"`
+	Manufacturer    string            `json:"manufacturer"`
+	ProductURL      string            `json:"product_url"`
+	ProtobufName    string            `json:"protobuf_name"`
+	MessageTypes    map[uint32]string `json:"message_types"`
+	SchemaVersion   uint32            `json:"schema_version"`
+	Handlers        []string          `json:"handlers"`
+	Transport       string            `json:"transport"`
+	EncryptionType  string            `json:"encryption_type"`
+	SequenceSend    uint32            `json:"sequence_send"`
+	SequenceReceive uint32            `json:"sequence_receive"`
+	KeyFingerprint  string            `json:"key_fingerprint"`
+	RekeyPending    bool              `json:"rekey_pending"`
+	Location        string            `json:"location"`
+	LastSeen        *time.Time        `json:"last_seen"`
+	LastMessage     *struct {
+		Type    string          `json:"type"`
+		Message json.RawMessage `json:"message"`
+	} `json:"last_message"`
+}
+
+type transportInfo struct {
+	Name            string     `json:"name"`
+	Type            string     `json:"type"`
+	PacketsReceived uint64     `json:"packets_received"`
+	BytesReceived   uint64     `json:"bytes_received"`
+	PacketsSent     uint64     `json:"packets_sent"`
+	SendErrors      uint64     `json:"send_errors"`
+	LastReceived    *time.Time `json:"last_received"`
+}
+
+type pendingJoin struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Manufacturer string    `json:"manufacturer"`
+	ProtobufName string    `json:"protobuf_name"`
+	Transport    string    `json:"transport"`
+	Time         time.Time `json:"time"`
+}
+
+type streamEvent struct {
+	Type        string          `json:"type"`
+	Time        time.Time       `json:"time"`
+	DeviceID    string          `json:"device_id"`
+	Transport   string          `json:"transport"`
+	MessageType string          `json:"message_type"`
+	Message     json.RawMessage `json:"message"`
+	Reason      string          `json:"reason"`
+	Error       string          `json:"error"`
+	Payload     string          `json:"payload"`
+}
+
+// get makes GET request, prints raw response in JSON mode.
+// Returns false when response is printed already.
+func (c *cli) get(path string, result interface{}) (bool, error) {
+	if c.json {
+		var raw json.RawMessage
+		if err := c.client.do(http.MethodGet, path, nil, &raw); err != nil {
+			return false, err
+		}
+		return false, c.printJSON(raw)
+	}
+	return true, c.client.do(http.MethodGet, path, nil, result)
+}
+
+func (c *cli) printJSON(raw json.RawMessage) error {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "%s\n", data)
+	return nil
+}
+
+func (c *cli) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+}
+
+func formatTime(value *time.Time) string {
+	if value == nil {
+		return "never"
+	}
+	return value.Local().Format("2006-01-02 15:04:05")
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func listDevices(c *cli, args []string) error {
+	var devices []*deviceInfo
+	if ok, err := c.get("devices", &devices); !ok || err != nil {
+		return err
+	}
+	w := c.table()
+	fmt.Fprintln(w, "ID\tNAME\tPROTOBUF\tTRANSPORT\tHANDLERS\tLAST SEEN")
+	for _, dev := range devices {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", dev.ID, orDash(dev.DisplayName), orDash(dev.ProtobufName),
+			orDash(dev.Transport), orDash(strings.Join(dev.Handlers, ",")), formatTime(dev.LastSeen))
+	}
+	return w.Flush()
+}
+
+func showDevice(c *cli, args []string) error {
+	var dev deviceInfo
+	if ok, err := c.get("devices/"+escape(args[0]), &dev); !ok || err != nil {
+		return err
+	}
+	w := c.table()
+	fmt.Fprintf(w, "ID:\t%s\n", dev.ID)
+	fmt.Fprintf(w, "Display name:\t%s\n", orDash(dev.DisplayName))
+	fmt.Fprintf(w, "Name:\t%s\n", dev.Name)
+	fmt.Fprintf(w, "Manufacturer:\t%s\n", dev.Manufacturer)
+	fmt.Fprintf(w, "Product URL:\t%s\n", orDash(dev.ProductURL))
+	fmt.Fprintf(w, "Protobuf:\t%s\n", orDash(dev.ProtobufName))
+	var tags []int
+	for tag := range dev.MessageTypes {
+		tags = append(tags, int(tag))
+	}
+	sort.Ints(tags)
+	for _, tag := range tags {
+		fmt.Fprintf(w, "Message type %d:\t%s\n", tag, dev.MessageTypes[uint32(tag)])
+	}
+	if dev.SchemaVersion != 0 {
+		fmt.Fprintf(w, "Schema version:\t%d\n", dev.SchemaVersion)
+	}
+	fmt.Fprintf(w, "Transport:\t%s\n", orDash(dev.Transport))
+	fmt.Fprintf(w, "Handlers:\t%s\n", orDash(strings.Join(dev.Handlers, ", ")))
+	fmt.Fprintf(w, "Encryption:\t%s\n", dev.EncryptionType)
+	fmt.Fprintf(w, "Key fingerprint:\t%s\n", orDash(dev.KeyFingerprint))
+	if dev.RekeyPending {
+		fmt.Fprintf(w, "Key rotation:\tpending\n")
+	}
+	fmt.Fprintf(w, "Sequence send:\t%d\n", dev.SequenceSend)
+	fmt.Fprintf(w, "Sequence receive:\t%d\n", dev.SequenceReceive)
+	if dev.Location != "" {
+		fmt.Fprintf(w, "Location:\t%s\n", dev.Location)
+	}
+	fmt.Fprintf(w, "Last seen:\t%s\n", formatTime(dev.LastSeen))
+	if dev.LastMessage != nil {
+		fmt.Fprintf(w, "Last message:\t%s %s\n", dev.LastMessage.Type, dev.LastMessage.Message)
+	}
+	return w.Flush()
+}
+
+// update makes PATCH request to device, prints its new state
+func (c *cli) update(name string, update map[string]interface{}) error {
+	var dev deviceInfo
+	if err := c.client.do(http.MethodPatch, "devices/"+escape(name), update, &dev); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "%s: display name '%s', handlers [%s], transport '%s'\n",
+		dev.ID, dev.DisplayName, strings.Join(dev.Handlers, ", "), dev.Transport)
+	return nil
+}
+
+func renameDevice(c *cli, args []string) error {
+	return c.update(args[0], map[string]interface{}{"display_name": strings.Join(args[1:], " ")})
+}
+
+func attachHandlers(c *cli, args []string) error {
+	var dev deviceInfo
+	if err := c.client.do(http.MethodGet, "devices/"+escape(args[0]), nil, &dev); err != nil {
+		return err
+	}
+	handlers := dev.Handlers
+	for _, name := range args[1:] {
+		if !contains(handlers, name) {
+			handlers = append(handlers, name)
+		}
+	}
+	return c.update(args[0], map[string]interface{}{"handlers": handlers})
+}
+
+func detachHandlers(c *cli, args []string) error {
+	var dev deviceInfo
+	if err := c.client.do(http.MethodGet, "devices/"+escape(args[0]), nil, &dev); err != nil {
+		return err
+	}
+	for _, name := range args[1:] {
+		if !contains(dev.Handlers, name) {
+			return fmt.Errorf("handler '%s' is not attached to %s", name, dev.ID)
+		}
+	}
+	handlers := []string{}
+	for _, name := range dev.Handlers {
+		if !contains(args[1:], name) {
+			handlers = append(handlers, name)
+		}
+	}
+	return c.update(args[0], map[string]interface{}{"handlers": handlers})
+}
+
+func contains(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func deleteDevice(c *cli, args []string) error {
+	var dev deviceInfo
+	if err := c.client.do(http.MethodDelete, "devices/"+escape(args[0]), nil, &dev); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "%s deleted\n", dev.ID)
+	return nil
+}
+
+const sendUsage = "send [-type name] <id> <JSON message | ->"
+
+func sendDownlink(c *cli, args []string) error {
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	msgType := flags.String("type", "", "Protobuf full name of message, device's default one when empty")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	if flags.NArg() != 2 {
+		fmt.Fprintf(c.stderr, "Usage: openiotctl %s\n", sendUsage)
+		return errUsage
+	}
+
+	message := []byte(flags.Arg(1))
+	if flags.Arg(1) == "-" {
+		var err error
+		if message, err = ioutil.ReadAll(c.stdin); err != nil {
+			return err
+		}
+	}
+	if !json.Valid(message) {
+		return fmt.Errorf("message is not valid JSON")
+	}
+	request := map[string]interface{}{
+		"type":    *msgType,
+		"message": json.RawMessage(message),
+	}
+	var resp struct {
+		Sequence uint32 `json:"sequence"`
+	}
+	if err := c.client.do(http.MethodPost, "devices/"+escape(flags.Arg(0))+"/downlink", request, &resp); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "Sent, sequence %d\n", resp.Sequence)
+	return nil
+}
+
+func listTransports(c *cli, args []string) error {
+	var transports []*transportInfo
+	if ok, err := c.get("transports", &transports); !ok || err != nil {
+		return err
+	}
+	w := c.table()
+	fmt.Fprintln(w, "NAME\tTYPE\tRECEIVED\tBYTES\tSENT\tSEND ERRORS\tLAST RECEIVED")
+	for _, tr := range transports {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\n", tr.Name, tr.Type, tr.PacketsReceived, tr.BytesReceived,
+			tr.PacketsSent, tr.SendErrors, formatTime(tr.LastReceived))
+	}
+	return w.Flush()
+}
+
+func listHandlers(c *cli, args []string) error {
+	var handlers []struct {
+		Name    string `json:"name"`
+		Devices int    `json:"devices"`
+	}
+	if ok, err := c.get("handlers", &handlers); !ok || err != nil {
+		return err
+	}
+	w := c.table()
+	fmt.Fprintln(w, "NAME\tDEVICES")
+	for _, handler := range handlers {
+		fmt.Fprintf(w, "%s\t%d\n", handler.Name, handler.Devices)
+	}
+	return w.Flush()
+}
+
+func listJoins(c *cli, args []string) error {
+	var joins []*pendingJoin
+	if ok, err := c.get("joins", &joins); !ok || err != nil {
+		return err
+	}
+	w := c.table()
+	fmt.Fprintln(w, "ID\tNAME\tMANUFACTURER\tPROTOBUF\tTRANSPORT\tREQUESTED")
+	for _, join := range joins {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", join.ID, join.Name, join.Manufacturer,
+			orDash(join.ProtobufName), join.Transport, formatTime(&join.Time))
+	}
+	return w.Flush()
+}
+
+func approveJoin(c *cli, args []string) error {
+	var dev deviceInfo
+	if err := c.client.do(http.MethodPost, "joins/"+escape(args[0])+"/approve", nil, &dev); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "%s approved\n", dev.ID)
+	return nil
+}
+
+func rejectJoin(c *cli, args []string) error {
+	if err := c.client.do(http.MethodDelete, "joins/"+escape(args[0]), nil, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "%s rejected\n", args[0])
+	return nil
+}
+
+// stringList is repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func tail(c *cli, args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	var devices, transports stringList
+	flags.Var(&devices, "device", "Only messages of device, ID or display name (repeatable)")
+	flags.Var(&transports, "transport", "Only messages received from transport (repeatable)")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+
+	query := url.Values{"device": devices, "transport": transports}
+	return c.client.stream("stream", query, func(name string, data []byte) error {
+		if c.json {
+			_, err := fmt.Fprintf(c.stdout, "%s\n", data)
+			return err
+		}
+		var event streamEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return fmt.Errorf("invalid event: %v", err)
+		}
+		timestamp := event.Time.Local().Format("15:04:05.000")
+		if event.Type == "dropped" {
+			fmt.Fprintf(c.stdout, "%s %s %s DROPPED %s: %s [%s]\n", timestamp, orDash(event.DeviceID),
+				orDash(event.Transport), event.Reason, event.Error, event.Payload)
+		} else {
+			fmt.Fprintf(c.stdout, "%s %s %s %s %s\n", timestamp, event.DeviceID,
+				orDash(event.Transport), event.MessageType, event.Message)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,131 @@
+// Command openiotctl manages OpenIoT server using its admin API (see package admin).
+//
+// Usage:
+//
+//	openiotctl [-server URL] [-token TOKEN] [-json] <command> [arguments]
+//
+// Server URL and token are also taken from OPENIOT_SERVER / OPENIOT_TOKEN
+// environment variables. Run "openiotctl help" for list of commands.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// command is single openiotctl sub-command
+type command struct {
+	usage string
+	help  string
+	// Minimal amount of positional arguments
+	args int
+	run  func(c *cli, args []string) error
+}
+
+var commands = map[string]*command{
+	"devices":    {"devices", "List devices", 0, listDevices},
+	"device":     {"device <id>", "Show device details, including sequence counters and key fingerprint", 1, showDevice},
+	"rename":     {"rename <id> <display name>", "Change display name of device", 2, renameDevice},
+	"attach":     {"attach <id> <handler>...", "Attach handlers to device", 2, attachHandlers},
+	"detach":     {"detach <id> <handler>...", "Detach handlers from device", 2, detachHandlers},
+	"delete":     {"delete <id>", "Delete device", 1, deleteDevice},
+	"send":       {sendUsage, "Send message to device, \"-\" reads JSON from stdin", 0, sendDownlink},
+	"transports": {"transports", "List transports with packet counters", 0, listTransports},
+	"handlers":   {"handlers", "List device handlers", 0, listHandlers},
+	"joins":      {"joins", "List devices waiting for join approval", 0, listJoins},
+	"approve":    {"approve <id>", "Approve join", 1, approveJoin},
+	"reject":     {"reject <id>", "Reject join", 1, rejectJoin},
+	"tail":       {"tail [-device id]... [-transport name]...", "Stream device messages and dropped packets", 0, tail},
+}
+
+// errUsage is returned when command line is invalid, usage is printed already
+var errUsage = errors.New("invalid usage")
+
+// cli is state shared by all commands
+type cli struct {
+	client *client
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	// Print raw JSON responses instead of tables
+	json bool
+}
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	if err == errUsage {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "openiotctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("openiotctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	server := flags.String("server", envDefault("OPENIOT_SERVER", "http://localhost:8080"), "Server URL")
+	token := flags.String("token", os.Getenv("OPENIOT_TOKEN"), "Admin API token (admin.token flag of server)")
+	asJSON := flags.Bool("json", false, "Print raw JSON responses")
+	flags.Usage = func() {
+		usage(flags, stderr)
+	}
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+
+	name := flags.Arg(0)
+	if name == "" || name == "help" {
+		usage(flags, stderr)
+		if name == "" {
+			return errUsage
+		}
+		return nil
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown command '%s'\n", name)
+		usage(flags, stderr)
+		return errUsage
+	}
+	c := &cli{
+		client: newClient(*server, *token),
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+		json:   *asJSON,
+	}
+	// Commands with own flags check amount of arguments themselves
+	if flags.NArg()-1 < cmd.args {
+		fmt.Fprintf(stderr, "Usage: openiotctl %s\n", cmd.usage)
+		return errUsage
+	}
+
+	return cmd.run(c, flags.Args()[1:])
+}
+
+func usage(flags *flag.FlagSet, out io.Writer) {
+	fmt.Fprintf(out, "Usage: openiotctl [flags] <command> [arguments]\n\nCommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-45s %s\n", commands[name].usage, commands[name].help)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flags.PrintDefaults()
+}
+
+func envDefault(name, value string) string {
+	if env := os.Getenv(name); env != "" {
+		return env
+	}
+	return value
+}
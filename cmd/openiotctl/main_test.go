@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer replies with canned responses by "METHOD path", records request bodies
+type fakeServer struct {
+	responses map[string]string
+	requests  map[string]string
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.Path
+	body, _ := ioutil.ReadAll(r.Body)
+	f.requests[key] = string(body)
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error": "unauthorized"}`)
+		return
+	}
+	response, ok := f.responses[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error": "not found"}`)
+		return
+	}
+	if r.URL.Path == "/api/stream" {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "%s", strings.Replace(response, "$query", r.URL.RawQuery, -1))
+		return
+	}
+	fmt.Fprint(w, response)
+}
+
+func runTest(t *testing.T, server *httptest.Server, stdin string, args ...string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-server", server.URL, "-token", "secret"}, args...)
+	err := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return stdout.String(), stderr.String(), err
+}
+
+const lampJSON = `{"id": "0x10", "name": "Lamp", "display_name": "lamp", "manufacturer": "ACME",
+	"protobuf_name": "openiot.JoinResponse", "handlers": ["mqtt"], "transport": "lora",
+	"encryption_type": "AES_ECB", "sequence_send": 5, "sequence_receive": 7,
+	"key_fingerprint": "78faccdc303884f6", "last_message": {"type": "openiot.JoinResponse", "message": {"name": "x"}}}`
+
+func TestCommands(t *testing.T) {
+	fake := &fakeServer{
+		responses: map[string]string{
+			"GET /api/devices":                "[" + lampJSON + "]",
+			"GET /api/devices/lamp":           lampJSON,
+			"PATCH /api/devices/lamp":         lampJSON,
+			"DELETE /api/devices/lamp":        lampJSON,
+			"POST /api/devices/lamp/downlink": `{"sequence": 6}`,
+			"GET /api/transports":             `[{"name": "lora", "type": "lora", "packets_received": 3}]`,
+			"GET /api/joins":                  `[{"id": "0x20", "name": "sensor", "time": "2020-01-01T00:00:00Z"}]`,
+			"POST /api/joins/0x20/approve":    `{"id": "0x20"}`,
+			"DELETE /api/joins/0x21":          `{}`,
+		},
+		requests: map[string]string{},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	out, _, err := runTest(t, server, "", "devices")
+	require.NoError(t, err)
+	assert.Contains(t, out, "0x10  lamp  openiot.JoinResponse  lora       mqtt      never")
+
+	out, _, err = runTest(t, server, "", "device", "lamp")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Key fingerprint:   78faccdc303884f6")
+	assert.Contains(t, out, "Sequence send:     5")
+	assert.Contains(t, out, "Sequence receive:  7")
+	assert.Contains(t, out, `Last message:      openiot.JoinResponse {"name": "x"}`)
+
+	out, _, err = runTest(t, server, "", "-json", "device", "lamp")
+	require.NoError(t, err)
+	assert.Contains(t, out, `"key_fingerprint": "78faccdc303884f6"`)
+
+	// Updates
+	_, _, err = runTest(t, server, "", "rename", "lamp", "desk", "lamp")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"display_name": "desk lamp"}`, fake.requests["PATCH /api/devices/lamp"])
+	_, _, err = runTest(t, server, "", "attach", "lamp", "file", "mqtt")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"handlers": ["mqtt", "file"]}`, fake.requests["PATCH /api/devices/lamp"])
+	_, _, err = runTest(t, server, "", "detach", "lamp", "mqtt")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"handlers": []}`, fake.requests["PATCH /api/devices/lamp"])
+	_, _, err = runTest(t, server, "", "detach", "lamp", "file")
+	assert.EqualError(t, err, "handler 'file' is not attached to 0x10")
+	out, _, err = runTest(t, server, "", "delete", "lamp")
+	require.NoError(t, err)
+	assert.Equal(t, "0x10 deleted\n", out)
+
+	// Downlink
+	out, _, err = runTest(t, server, "", "send", "-type", "openiot.JoinResponse", "lamp", `{"name": "srv"}`)
+	require.NoError(t, err)
+	assert.Equal(t, "Sent, sequence 6\n", out)
+	assert.JSONEq(t, `{"type": "openiot.JoinResponse", "message": {"name": "srv"}}`,
+		fake.requests["POST /api/devices/lamp/downlink"])
+	_, _, err = runTest(t, server, `{"name": "stdin"}`, "send", "lamp", "-")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type": "", "message": {"name": "stdin"}}`, fake.requests["POST /api/devices/lamp/downlink"])
+	_, _, err = runTest(t, server, "", "send", "lamp", "{")
+	assert.EqualError(t, err, "message is not valid JSON")
+
+	// Transports / joins
+	out, _, err = runTest(t, server, "", "transports")
+	require.NoError(t, err)
+	assert.Contains(t, out, "lora  lora  3")
+	out, _, err = runTest(t, server, "", "joins")
+	require.NoError(t, err)
+	assert.Contains(t, out, "0x20  sensor")
+	out, _, err = runTest(t, server, "", "approve", "0x20")
+	require.NoError(t, err)
+	assert.Equal(t, "0x20 approved\n", out)
+	out, _, err = runTest(t, server, "", "reject", "0x21")
+	require.NoError(t, err)
+	assert.Equal(t, "0x21 rejected\n", out)
+
+	// Errors
+	_, _, err = runTest(t, server, "", "device", "nothing")
+	assert.EqualError(t, err, "404 Not Found: not found")
+	err = run([]string{"-server", server.URL, "devices"}, nil, ioutil.Discard, ioutil.Discard)
+	assert.EqualError(t, err, "401 Unauthorized: unauthorized")
+	_, stderr, err := runTest(t, server, "", "rename", "lamp")
+	assert.Equal(t, errUsage, err)
+	assert.Equal(t, "Usage: openiotctl rename <id> <display name>\n", stderr)
+	_, stderr, err = runTest(t, server, "", "nothing")
+	assert.Equal(t, errUsage, err)
+	assert.Contains(t, stderr, "Unknown command 'nothing'")
+	_, _, err = runTest(t, server, "", "send", "lamp")
+	assert.Equal(t, errUsage, err)
+}
+
+func TestTail(t *testing.T) {
+	fake := &fakeServer{
+		responses: map[string]string{
+			"GET /api/stream": ": keep-alive\n\n" +
+				`event: message` + "\n" +
+				`data: {"type": "message", "time": "2020-01-01T00:00:00Z", "device_id": "0x10", "transport": "$query", ` +
+				`"message_type": "openiot.JoinResponse", "message": {"name":"x"}}` + "\n\n" +
+				`event: dropped` + "\n" +
+				`data: {"type": "dropped", "time": "2020-01-01T00:00:01Z", "transport": "lora", "reason": "crc", ` +
+				`"error": "CRC check failed", "payload": "0a0b"}` + "\n\n",
+		},
+		requests: map[string]string{},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	out, _, err := runTest(t, server, "", "tail", "-device", "lamp", "-device", "0x11", "-transport", "lora")
+	assert.EqualError(t, err, "stream closed by server")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], ` 0x10 device=lamp&device=0x11&transport=lora openiot.JoinResponse {"name":"x"}`)
+	assert.Contains(t, lines[1], " - lora DROPPED crc: CRC check failed [0a0b]")
+
+	out, _, _ = runTest(t, server, "", "-json", "tail")
+	assert.Contains(t, out, `"reason": "crc"`)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/encode"
+	"github.com/open-iot-devices/server/utils/schema"
+)
+
+// decoder decodes frames the same way as processor does, printing result of every stage
+type decoder struct {
+	out     io.Writer
+	devices map[uint64]*device.Device
+	// Overrides of device's parameters, nil / empty when not set
+	key        []byte
+	encryption *openiot.EncryptionType
+	msgType    string
+	// Frames are sent by server, it matters for join / key exchange frames
+	downlink bool
+}
+
+// stageError tells which stage of decoding failed
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.stage, e.err)
+}
+
+func (d *decoder) ok(stage string, format string, args ...interface{}) {
+	fmt.Fprintf(d.out, "%-13s OK  %s\n", stage+":", fmt.Sprintf(format, args...))
+}
+
+func (d *decoder) fail(stage string, err error) error {
+	fmt.Fprintf(d.out, "%-13s FAILED  %v\n", stage+":", err)
+	return &stageError{stage, err}
+}
+
+// decode prints decoded frame, stops at first failed stage and returns its error
+func (d *decoder) decode(frame *frame) error {
+	if frame.err != nil {
+		fmt.Fprintf(d.out, "%-13s %s\n", "Frame:", frame.label)
+		return d.fail("Input", frame.err)
+	}
+	fmt.Fprintf(d.out, "%-13s %s, %d bytes\n", "Frame:", frame.label, len(frame.data))
+	buf := bytes.NewBuffer(frame.data)
+
+	// First message (openiot.Header) is always unencrypted
+	hdr := &openiot.Header{}
+	if err := encode.ReadSingleMessage(buf, hdr); err != nil {
+		return d.fail("Header", err)
+	}
+	var kind []string
+	if hdr.KeyExchange {
+		kind = append(kind, "key exchange")
+	}
+	if hdr.JoinRequest {
+		kind = append(kind, "join request")
+	}
+	if len(kind) == 0 {
+		kind = append(kind, "message")
+	}
+	d.ok("Header", "device 0x%x, %s", hdr.DeviceId, strings.Join(kind, ", "))
+
+	if crc := crc32.ChecksumIEEE(buf.Bytes()); crc != hdr.Crc {
+		return d.fail("CRC", fmt.Errorf("header has 0x%08x, payload 0x%08x", hdr.Crc, crc))
+	}
+	d.ok("CRC", "0x%08x", hdr.Crc)
+
+	dev, known, err := d.device(hdr)
+	if err != nil {
+		return d.fail("Device", err)
+	}
+	if known {
+		d.ok("Device", "%s '%s', %v, key %s", dev.IDhex, dev.DisplayName, dev.EncryptionType, orNone(dev.KeyFingerprint()))
+	} else {
+		d.ok("Device", "%s not registered, %v, key %s", dev.IDhex, dev.EncryptionType, orNone(dev.KeyFingerprint()))
+	}
+
+	decrypted, err := encode.Decrypt(buf, dev.EncryptionType, dev.Key())
+	if err != nil {
+		return d.fail("Decrypt", err)
+	}
+	d.ok("Decrypt", "%v, %d bytes", dev.EncryptionType, decrypted.Len())
+
+	// Join / key exchange frames carry single message without MessageInfo
+	msgType := d.frameType(hdr, known)
+	if msgType == "" {
+		info := &openiot.MessageInfo{}
+		if err := encode.ReadSingleMessage(decrypted, info); err != nil {
+			return d.fail("MessageInfo", fmt.Errorf("%v (wrong key / encryption type?)", err))
+		}
+		date := "invalid"
+		if value, err := encode.DecodeDateTime(info.Date, info.Time); err == nil {
+			date = value.Format("2006-01-02 15:04:05")
+		}
+		tag, version := encode.GetMessageType(info)
+		d.ok("MessageInfo", "sequence %d, date %s (%08x %06x), type tag %d, schema version %d",
+			info.Sequence, date, info.Date, info.Time, tag, version)
+
+		msgType = d.msgType
+		if msgType == "" {
+			msgType = dev.MessageTypeName(tag)
+		}
+		if msgType == "" {
+			return d.fail("Message", fmt.Errorf("unknown message type tag %d", tag))
+		}
+	}
+
+	msg := schema.NewMessage(msgType)
+	if msg == nil {
+		return d.fail("Message", fmt.Errorf("Protobuf '%s' is not registered", msgType))
+	}
+	if err := encode.ReadSingleMessage(decrypted, msg); err != nil {
+		return d.fail("Message", fmt.Errorf("%s: %v", msgType, err))
+	}
+	value, err := protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(proto.MessageV2(msg))
+	if err != nil {
+		return d.fail("Message", err)
+	}
+	d.ok("Message", "%s", msgType)
+	fmt.Fprintf(d.out, "%s\n", value)
+
+	return nil
+}
+
+// device returns device parameters used to decrypt frame, overrides applied
+func (d *decoder) device(hdr *openiot.Header) (*device.Device, bool, error) {
+	var dev *device.Device
+	registered, known := d.devices[hdr.DeviceId]
+	if known {
+		// Do not modify devices while applying overrides
+		copied := *registered
+		dev = &copied
+	} else {
+		// Devices start joining unencrypted
+		if !hdr.KeyExchange && !hdr.JoinRequest && d.key == nil && d.encryption == nil {
+			return nil, false, fmt.Errorf("0x%x is not in devices config, use -key / -encryption", hdr.DeviceId)
+		}
+		dev = device.NewDevice(hdr.DeviceId)
+	}
+
+	if d.encryption != nil {
+		dev.EncryptionType = *d.encryption
+	}
+	if d.key != nil {
+		dev.SetKey(d.key)
+	}
+	// Initial key exchange is never encrypted
+	if hdr.KeyExchange && !known {
+		dev.EncryptionType = openiot.EncryptionType_PLAIN
+	}
+
+	return dev, known, nil
+}
+
+// frameType returns protobuf name of join / key exchange frame message,
+// empty string for regular frames.
+func (d *decoder) frameType(hdr *openiot.Header, known bool) string {
+	if d.msgType != "" && (hdr.KeyExchange || hdr.JoinRequest) {
+		return d.msgType
+	}
+	switch {
+	case hdr.KeyExchange:
+		// Registered devices do key exchange only for server initiated key rotation
+		if known == d.downlink {
+			return "openiot.KeyExchangeRequest"
+		}
+		return "openiot.KeyExchangeResponse"
+	case hdr.JoinRequest:
+		if d.downlink {
+			return "openiot.JoinResponse"
+		}
+		return "openiot.JoinRequest"
+	}
+
+	return ""
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return value
+}
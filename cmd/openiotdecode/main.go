@@ -0,0 +1,218 @@
+// Command openiotdecode decodes raw OpenIoT frames offline, e.g. captured from
+// misbehaving device, and reports stage by stage what is inside or where exactly
+// decoding fails: header, CRC, device lookup, decryption, MessageInfo, message.
+//
+// Usage:
+//
+//	openiotdecode [flags] [frame]...
+//	openiotdecode [flags] -pcap capture.pcap
+//
+// Frames are hex or base64 encoded, one per argument or, when there are no
+// arguments, one per line of stdin. Device keys are taken from devices config
+// of server, message types from compiled in and -schemas protobufs.
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/utils/schema"
+)
+
+// errUsage is returned when command line is invalid, usage is printed already
+var errUsage = errors.New("invalid usage")
+
+// frame is single raw packet to decode
+type frame struct {
+	// Where frame comes from, e.g. pcap timestamp and addresses
+	label string
+	data  []byte
+	// Frame could not be parsed from input
+	err error
+}
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	if err == errUsage {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "openiotdecode: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("openiotdecode", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	devicesFilename := flags.String("devices", ".config/devices.yaml", "Devices config filename (config.devices flag of server)")
+	schemasDir := flags.String("schemas", ".config/schemas", "Directory with protobuf descriptor sets (config.schemas flag of server)")
+	keyHex := flags.String("key", "", "Encryption key (hex), overrides key from devices config")
+	encryption := flags.String("encryption", "", "Encryption type (e.g. PLAIN, AES_ECB), overrides device's one")
+	msgType := flags.String("type", "", "Protobuf name of message, overrides type selected by device / MessageInfo")
+	downlink := flags.Bool("downlink", false, "Frames are sent by server to device")
+	format := flags.String("format", "auto", "Frame encoding: auto, hex or base64")
+	pcapFilename := flags.String("pcap", "", "Decode UDP payloads from pcap capture file instead")
+	port := flags.Int("port", 0, "With -pcap: only UDP packets from / to this port")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: openiotdecode [flags] [frame]...\n       openiotdecode [flags] -pcap capture.pcap\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	if *format != "auto" && *format != "hex" && *format != "base64" {
+		fmt.Fprintf(stderr, "Unknown format '%s'\n", *format)
+		return errUsage
+	}
+
+	d := &decoder{
+		out:      stdout,
+		msgType:  *msgType,
+		downlink: *downlink,
+	}
+	if *keyHex != "" {
+		key, err := hex.DecodeString(*keyHex)
+		if err != nil {
+			return fmt.Errorf("invalid key: %v", err)
+		}
+		d.key = key
+	}
+	if *encryption != "" {
+		value, ok := openiot.EncryptionType_value[strings.ToUpper(*encryption)]
+		if !ok {
+			return fmt.Errorf("unknown encryption type '%s'", *encryption)
+		}
+		encType := openiot.EncryptionType(value)
+		d.encryption = &encType
+	}
+	if err := schema.Load(*schemasDir); err != nil {
+		return fmt.Errorf("unable to load protobuf schemas: %v", err)
+	}
+	devices, err := readDevices(*devicesFilename)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(stderr, "openiotdecode: %s does not exist, only -key / -encryption are used\n", *devicesFilename)
+	} else if err != nil {
+		return fmt.Errorf("%s: %v", *devicesFilename, err)
+	}
+	d.devices = devices
+
+	// Collect frames
+	var frames []*frame
+	switch {
+	case *pcapFilename != "":
+		fd, err := os.Open(*pcapFilename)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		if frames, err = readPcap(fd, *port); err != nil {
+			return fmt.Errorf("%s: %v", *pcapFilename, err)
+		}
+	case flags.NArg() > 0:
+		for _, arg := range flags.Args() {
+			frames = append(frames, parseFrame(arg, *format))
+		}
+	default:
+		scanner := bufio.NewScanner(stdin)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			frames = append(frames, parseFrame(line, *format))
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	for index, frame := range frames {
+		if index > 0 {
+			fmt.Fprintln(stdout)
+		}
+		if frame.label == "" {
+			frame.label = fmt.Sprintf("#%d", index+1)
+		}
+		if err := d.decode(frame); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d frames failed to decode", failed, len(frames))
+	}
+
+	return nil
+}
+
+// parseFrame decodes hex / base64 text of frame. In auto format text
+// that is valid hex is taken as hex, base64 otherwise.
+func parseFrame(text, format string) *frame {
+	if format != "base64" {
+		cleaned := strings.TrimPrefix(strings.ToLower(text), "0x")
+		cleaned = strings.NewReplacer(" ", "", ":", "").Replace(cleaned)
+		data, err := hex.DecodeString(cleaned)
+		if err == nil || format == "hex" {
+			return &frame{data: data, err: err}
+		}
+	}
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		if data, err := encoding.DecodeString(text); err == nil {
+			return &frame{data: data}
+		}
+	}
+	if format == "base64" {
+		return &frame{err: fmt.Errorf("not valid base64")}
+	}
+	return &frame{err: fmt.Errorf("neither hex nor base64")}
+}
+
+// readDevices reads devices config of server. Unlike device.LoadDevices
+// it does not touch device registry and does not need handlers / transports.
+func readDevices(filename string) (map[uint64]*device.Device, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var devices []*device.Device
+	decoder := yaml.NewDecoder(fd)
+	decoder.SetStrict(true)
+	if err := decoder.Decode(&devices); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	result := map[uint64]*device.Device{}
+	for _, dev := range devices {
+		id, err := strconv.ParseUint(dev.IDhex, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		key, err := hex.DecodeString(dev.KeyString)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid key: %v", dev.IDhex, err)
+		}
+		dev.ID = id
+		dev.SetKey(key)
+		result[id] = dev
+	}
+
+	return result, nil
+}
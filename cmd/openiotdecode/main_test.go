@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/encode"
+)
+
+const testKey = "000102030405060708090a0b0c0d0e0f"
+
+const testDevices = `
+- id: "0x10"
+  name: Lamp
+  display_name: lamp
+  key: ` + testKey + `
+  protobuf_name: openiot.JoinResponse
+  message_types:
+    1: openiot.JoinRequest
+  handlers: [mqtt]
+  transport: udp
+  encryptiontype: 1
+`
+
+func makeFrame(t *testing.T, hdr *openiot.Header, enc openiot.EncryptionType, msgs ...proto.Message) []byte {
+	key, _ := hex.DecodeString(testKey)
+	payload, err := encode.MakeReadyToSendMessage(hdr, enc, key, msgs...)
+	require.NoError(t, err)
+	return payload
+}
+
+func runTest(t *testing.T, stdin string, args ...string) (string, error) {
+	dir, err := ioutil.TempDir("", "openiotdecode")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "devices.yaml")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(testDevices), 0644))
+
+	var stdout bytes.Buffer
+	args = append([]string{"-devices", filename, "-schemas", dir}, args...)
+	err = run(args, strings.NewReader(stdin), &stdout, ioutil.Discard)
+	return stdout.String(), err
+}
+
+func TestDecode(t *testing.T) {
+	// 2020-01-02 (Thursday) 10:11:12
+	info := &openiot.MessageInfo{Sequence: 7, Date: 0x20010204, Time: 0x101112}
+	frame := makeFrame(t, &openiot.Header{DeviceId: 0x10}, openiot.EncryptionType_AES_ECB,
+		info, &openiot.JoinResponse{Name: "srv"})
+
+	out, err := runTest(t, "", hex.EncodeToString(frame))
+	require.NoError(t, err)
+	assert.Contains(t, out, "Header:       OK  device 0x10, message\n")
+	assert.Contains(t, out, "CRC:          OK  ")
+	assert.Contains(t, out, "Device:       OK  0x10 'lamp', AES_ECB, key ")
+	assert.Contains(t, out, "Decrypt:      OK  AES_ECB, 32 bytes\n")
+	assert.Contains(t, out, "MessageInfo:  OK  sequence 7, date 2020-01-02 10:11:12 (20010204 101112), type tag 0, schema version 0\n")
+	assert.Contains(t, out, "Message:      OK  openiot.JoinResponse\n")
+	// protojson output is deliberately unstable in whitespace
+	assert.Regexp(t, `"name":\s+"srv"`, out)
+
+	// Base64 from stdin, type tag selects message type
+	encode.SetMessageType(info, 1, 2)
+	frame = makeFrame(t, &openiot.Header{DeviceId: 0x10}, openiot.EncryptionType_AES_ECB,
+		info, &openiot.JoinRequest{Name: "sensor"})
+	out, err = runTest(t, "# comment\n\n"+base64.StdEncoding.EncodeToString(frame)+"\n")
+	require.NoError(t, err)
+	assert.Contains(t, out, "type tag 1, schema version 2\n")
+	assert.Contains(t, out, "Message:      OK  openiot.JoinRequest\n")
+	assert.Regexp(t, `"name":\s+"sensor"`, out)
+
+	// Type override
+	out, err = runTest(t, "", "-type", "openiot.JoinResponse", hex.EncodeToString(frame))
+	require.NoError(t, err)
+	assert.Contains(t, out, "Message:      OK  openiot.JoinResponse\n")
+}
+
+func TestDecodeJoin(t *testing.T) {
+	// Unknown device starts with unencrypted key exchange
+	frame := makeFrame(t, &openiot.Header{DeviceId: 0x20, KeyExchange: true}, openiot.EncryptionType_PLAIN,
+		&openiot.KeyExchangeRequest{DhG: 5, DhP: 23, EncryptionType: openiot.EncryptionType_AES_ECB})
+	out, err := runTest(t, "", hex.EncodeToString(frame))
+	require.NoError(t, err)
+	assert.Contains(t, out, "Header:       OK  device 0x20, key exchange\n")
+	assert.Contains(t, out, "Device:       OK  0x20 not registered, PLAIN, key none\n")
+	assert.Contains(t, out, "Message:      OK  openiot.KeyExchangeRequest\n")
+	assert.NotContains(t, out, "MessageInfo")
+
+	// JoinRequest encrypted by negotiated key
+	frame = makeFrame(t, &openiot.Header{DeviceId: 0x20, JoinRequest: true}, openiot.EncryptionType_AES_ECB,
+		&openiot.JoinRequest{Name: "sensor"})
+	out, err = runTest(t, "", "-key", testKey, "-encryption", "aes_ecb", hex.EncodeToString(frame))
+	require.NoError(t, err)
+	assert.Contains(t, out, "Message:      OK  openiot.JoinRequest\n")
+
+	// Server's JoinResponse
+	frame = makeFrame(t, &openiot.Header{DeviceId: 0x10, JoinRequest: true}, openiot.EncryptionType_AES_ECB,
+		&openiot.JoinResponse{Name: "srv"})
+	out, err = runTest(t, "", "-downlink", hex.EncodeToString(frame))
+	require.NoError(t, err)
+	assert.Contains(t, out, "Message:      OK  openiot.JoinResponse\n")
+}
+
+func TestDecodeFailures(t *testing.T) {
+	info := &openiot.MessageInfo{Sequence: 1}
+	valid := makeFrame(t, &openiot.Header{DeviceId: 0x10}, openiot.EncryptionType_AES_ECB,
+		info, &openiot.JoinResponse{Name: "srv"})
+	corrupted := append([]byte{}, valid...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	unknown := makeFrame(t, &openiot.Header{DeviceId: 0x30}, openiot.EncryptionType_PLAIN,
+		info, &openiot.JoinResponse{})
+	encode.SetMessageType(info, 5, 0)
+	unknownTag := makeFrame(t, &openiot.Header{DeviceId: 0x10}, openiot.EncryptionType_AES_ECB,
+		info, &openiot.JoinResponse{})
+
+	runs := map[string]string{
+		"xyz!":                                   "Input:        FAILED  neither hex nor base64",
+		"ff":                                     "Header:       FAILED  ",
+		hex.EncodeToString(corrupted):            "CRC:          FAILED  header has 0x",
+		hex.EncodeToString(unknown):              "Device:       FAILED  0x30 is not in devices config, use -key / -encryption",
+		hex.EncodeToString(unknownTag):           "Message:      FAILED  unknown message type tag 5",
+		hex.EncodeToString(valid[:len(valid)-1]): "CRC:          FAILED  ",
+	}
+	for input, expected := range runs {
+		out, err := runTest(t, "", input)
+		assert.EqualError(t, err, "1 of 1 frames failed to decode")
+		assert.Contains(t, out, expected, input)
+	}
+
+	// Wrong key: ECB decrypts anything, so MessageInfo / message fails
+	out, err := runTest(t, "", "-key", "ff"+testKey[2:], hex.EncodeToString(valid))
+	assert.Error(t, err)
+	assert.Regexp(t, "(MessageInfo|Message): +FAILED", out)
+
+	// Plain frame decrypted as AES
+	out, err = runTest(t, "", "-encryption", "AES_ECB", hex.EncodeToString(unknown))
+	assert.Error(t, err)
+	assert.Contains(t, out, "Decrypt:      FAILED  ")
+
+	// Only failed frames are counted
+	out, err = runTest(t, "", hex.EncodeToString(valid), "00")
+	assert.EqualError(t, err, "1 of 2 frames failed to decode")
+	assert.Contains(t, out, "Frame:        #2, 1 bytes\n")
+
+	_, err = runTest(t, "", "-format", "xml")
+	assert.Equal(t, errUsage, err)
+	_, err = runTest(t, "", "-format", "hex", base64.StdEncoding.EncodeToString(valid))
+	assert.Error(t, err)
+}
+
+// pcapPacket makes Ethernet / IPv4 / UDP packet
+func pcapPacket(srcPort, dstPort int, payload []byte) []byte {
+	packet := make([]byte, 14+20+8)
+	binary.BigEndian.PutUint16(packet[12:], etherTypeIPv4)
+	ip := packet[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+8+len(payload)))
+	ip[8] = 64
+	ip[9] = protocolUDP
+	copy(ip[12:], []byte{10, 0, 0, 1})
+	copy(ip[16:], []byte{10, 0, 0, 2})
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	return append(packet, payload...)
+}
+
+func TestPcap(t *testing.T) {
+	frame := makeFrame(t, &openiot.Header{DeviceId: 0x20, KeyExchange: true}, openiot.EncryptionType_PLAIN,
+		&openiot.KeyExchangeRequest{DhG: 5, DhP: 23})
+	tcp := pcapPacket(1000, 2000, []byte{1, 2, 3})
+	tcp[14+9] = 6
+
+	var capture bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeEthernet)
+	capture.Write(header)
+	for index, packet := range [][]byte{tcp, pcapPacket(1000, 2000, frame), pcapPacket(1001, 2001, frame)} {
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:], 1577836800)
+		binary.LittleEndian.PutUint32(record[4:], uint32(index*1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+		capture.Write(record)
+		capture.Write(packet)
+	}
+
+	frames, err := readPcap(bytes.NewReader(capture.Bytes()), 0)
+	require.NoError(t, err)
+	require.Len(t, frames, 2)
+	assert.Equal(t, "#2 2020-01-01T00:00:00.001Z 10.0.0.1:1000 -> 10.0.0.2:2000", frames[0].label)
+	assert.Equal(t, frame, frames[0].data)
+
+	frames, err = readPcap(bytes.NewReader(capture.Bytes()), 2001)
+	require.NoError(t, err)
+	require.Len(t, frames, 1)
+	assert.Equal(t, "#3 2020-01-01T00:00:00.002Z 10.0.0.1:1001 -> 10.0.0.2:2001", frames[0].label)
+
+	// Through command line
+	dir, err := ioutil.TempDir("", "openiotdecode")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "capture.pcap")
+	require.NoError(t, ioutil.WriteFile(filename, capture.Bytes(), 0644))
+	out, err := runTest(t, "", "-pcap", filename, "-port", "1001")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Frame:        #3 2020-01-01T00:00:00.002Z 10.0.0.1:1001 -> 10.0.0.2:2001")
+	assert.Contains(t, out, "Message:      OK  openiot.KeyExchangeRequest\n")
+
+	// Errors
+	_, err = readPcap(bytes.NewReader([]byte{0x0a, 0x0d, 0x0d, 0x0a}), 0)
+	assert.Error(t, err)
+	pcapng := append([]byte{0x0a, 0x0d, 0x0d, 0x0a}, make([]byte, 20)...)
+	_, err = readPcap(bytes.NewReader(pcapng), 0)
+	assert.EqualError(t, err, "pcapng is not supported, convert it first: editcap -F pcap")
+	_, err = readPcap(bytes.NewReader(capture.Bytes()[:capture.Len()-1]), 0)
+	assert.EqualError(t, err, "packet 3: unexpected EOF")
+}
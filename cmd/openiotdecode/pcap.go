@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Link types of pcap, see https://www.tcpdump.org/linktypes.html
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLoop     = 108
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	protocolUDP   = 17
+)
+
+// readPcap returns UDP payloads of classic libpcap capture file (pcapng is not supported).
+// When port is not 0 only packets from / to this port are returned.
+func readPcap(reader io.Reader, port int) ([]*frame, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("invalid pcap header: %v", err)
+	}
+	var order binary.ByteOrder
+	var nanoseconds bool
+	switch magic := binary.LittleEndian.Uint32(header); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+		nanoseconds = magic == 0xa1b23c4d
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+		nanoseconds = magic == 0x4d3cb2a1
+	case 0x0a0d0d0a:
+		return nil, fmt.Errorf("pcapng is not supported, convert it first: editcap -F pcap")
+	default:
+		return nil, fmt.Errorf("not a pcap file (magic %08x)", magic)
+	}
+	linkType := order.Uint32(header[20:])
+
+	var frames []*frame
+	record := make([]byte, 16)
+	for index := 1; ; index++ {
+		if _, err := io.ReadFull(reader, record); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("packet %d: %v", index, err)
+		}
+		length := order.Uint32(record[8:])
+		if length > 256*1024 {
+			return nil, fmt.Errorf("packet %d: invalid length %d", index, length)
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			return nil, fmt.Errorf("packet %d: %v", index, err)
+		}
+
+		src, dst, payload, ok := udpPayload(linkType, packet)
+		if !ok || (port != 0 && src.Port != port && dst.Port != port) {
+			continue
+		}
+		fraction := time.Duration(order.Uint32(record[4:]))
+		if !nanoseconds {
+			fraction *= time.Microsecond
+		}
+		timestamp := time.Unix(int64(order.Uint32(record[0:])), int64(fraction)).UTC()
+		frames = append(frames, &frame{
+			label: fmt.Sprintf("#%d %s %s -> %s", index, timestamp.Format(time.RFC3339Nano), src, dst),
+			data:  payload,
+		})
+	}
+
+	return frames, nil
+}
+
+// udpPayload extracts addresses and payload of UDP datagram,
+// returns false for non UDP / fragmented packets.
+func udpPayload(linkType uint32, packet []byte) (src, dst *net.UDPAddr, payload []byte, ok bool) {
+	// Link layer
+	etherType := -1
+	switch linkType {
+	case linkTypeEthernet:
+		if len(packet) < 14 {
+			return
+		}
+		etherType = int(binary.BigEndian.Uint16(packet[12:]))
+		packet = packet[14:]
+		if etherType == etherTypeVLAN && len(packet) >= 4 {
+			etherType = int(binary.BigEndian.Uint16(packet[2:]))
+			packet = packet[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(packet) < 16 {
+			return
+		}
+		etherType = int(binary.BigEndian.Uint16(packet[14:]))
+		packet = packet[16:]
+	case linkTypeNull, linkTypeLoop:
+		// Address family is in host byte order, IP version tells the same
+		if len(packet) < 4 {
+			return
+		}
+		packet = packet[4:]
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	default:
+		return
+	}
+	if len(packet) == 0 {
+		return
+	}
+	if etherType == -1 {
+		switch packet[0] >> 4 {
+		case 4:
+			etherType = etherTypeIPv4
+		case 6:
+			etherType = etherTypeIPv6
+		}
+	}
+
+	// Network layer
+	var srcIP, dstIP net.IP
+	switch etherType {
+	case etherTypeIPv4:
+		if len(packet) < 20 {
+			return
+		}
+		headerLen := int(packet[0]&0x0f) * 4
+		fragment := binary.BigEndian.Uint16(packet[6:]) & 0x3fff
+		if packet[9] != protocolUDP || fragment != 0 || headerLen < 20 || len(packet) < headerLen {
+			return
+		}
+		srcIP, dstIP = net.IP(packet[12:16]), net.IP(packet[16:20])
+		packet = packet[headerLen:]
+	case etherTypeIPv6:
+		// Extension headers are not supported
+		if len(packet) < 40 || packet[6] != protocolUDP {
+			return
+		}
+		srcIP, dstIP = net.IP(packet[8:24]), net.IP(packet[24:40])
+		packet = packet[40:]
+	default:
+		return
+	}
+
+	// Transport layer
+	if len(packet) < 8 {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(packet[4:]))
+	if length < 8 || length > len(packet) {
+		return
+	}
+	src = &net.UDPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(packet[0:]))}
+	dst = &net.UDPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(packet[2:]))}
+
+	return src, dst, packet[8:length], true
+}
@@ -0,0 +1,202 @@
+// Command openiotsim simulates OpenIoT devices for load and integration testing
+// of server (see package simulator).
+//
+// Simulator talks to server using transport from config in the same format as
+// server's transports config, e.g. for UDP it is counterpart of server's one:
+//
+//	udp:
+//	  sim:
+//	    listen: ":5001"          # "remote" of server's UDP transport
+//	    remote: "localhost:5000" # "listen" of server's UDP transport
+//
+// Usage:
+//
+//	openiotsim -transports sim.yaml -type openiot.sensor.Temperature -devices 1000 -interval 10s
+//
+// Simulated devices must not be registered on server, use -first_id to pick unused IDs.
+// Server rate limits key exchanges (keyexchange.rate / keyexchange.burst flags),
+// so joining thousands of devices takes a while unless limits are raised.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/simulator"
+	"github.com/open-iot-devices/server/transport"
+	"github.com/open-iot-devices/server/utils/schema"
+
+	// Transports
+	_ "github.com/open-iot-devices/server/transport/udp"
+
+	// Protobufs
+	_ "github.com/open-iot-devices/protobufs/go/openiot/sensor"
+)
+
+var flagTransportsFilename = flag.String("transports", "sim_transports.yaml", "Transports config filename, same format as server's one")
+var flagTransport = flag.String("transport", "", "Name of transport to use, may be omitted when config has only one")
+var flagSchemasDir = flag.String("schemas", ".config/schemas", "Directory with protobuf descriptor sets (protoc --include_imports -o)")
+var flagDevices = flag.Int("devices", 10, "Amount of simulated devices")
+var flagFirstID = flag.String("first_id", "0x1000", "ID of the first device, other devices get next IDs")
+var flagName = flag.String("name", "Simulated Device", "Device name sent in JoinRequest")
+var flagManufacturer = flag.String("manufacturer", "OpenIoT Simulator", "Manufacturer sent in JoinRequest")
+var flagType = flag.String("type", "", "Protobuf name of messages sent by devices")
+var flagDownlinkType = flag.String("downlink_type", "", "Protobuf name of downlink messages, -type when empty")
+var flagEncryption = flag.String("encryption", "AES_ECB", "Encryption type: PLAIN or AES_ECB")
+var flagInterval = flag.Duration("interval", 10*time.Second, "Time between messages of single device")
+var flagMessages = flag.Int("messages", 0, "Amount of messages sent by every device, 0 means until stopped")
+var flagTimeout = flag.Duration("timeout", 5*time.Second, "Time to wait for join responses before retry")
+var flagLoss = flag.Float64("loss", 0, "Probability (0..1) of uplink packet loss")
+var flagDuplicate = flag.Float64("duplicate", 0, "Probability (0..1) of uplink packet duplication")
+var flagReorder = flag.Float64("reorder", 0, "Probability (0..1) of uplink packet to be sent after the next one")
+var flagSeed = flag.Int64("seed", 0, "Seed of generated values and faults, 0 means random")
+var flagStats = flag.Duration("stats", 10*time.Second, "Interval of printing stats, 0 to disable")
+var flagPrintDownlinks = flag.Bool("print_downlinks", true, "Print received downlink messages")
+
+func main() {
+	flag.Set("logtostderr", "true")
+	flag.Parse()
+	defer glog.Flush()
+
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "openiotsim: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if *flagType == "" {
+		return fmt.Errorf("-type is required")
+	}
+	if err := schema.Load(*flagSchemasDir); err != nil {
+		return fmt.Errorf("unable to load protobuf schemas: %v", err)
+	}
+	firstID, err := strconv.ParseUint(*flagFirstID, 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid -first_id: %v", err)
+	}
+	encryption, ok := openiot.EncryptionType_value[strings.ToUpper(*flagEncryption)]
+	if !ok {
+		return fmt.Errorf("unknown encryption type '%s'", *flagEncryption)
+	}
+	tr, err := loadTransport(*flagTransportsFilename, *flagTransport)
+	if err != nil {
+		return err
+	}
+
+	config := simulator.Config{
+		Devices:        *flagDevices,
+		FirstID:        firstID,
+		Name:           *flagName,
+		Manufacturer:   *flagManufacturer,
+		MessageType:    *flagType,
+		DownlinkType:   *flagDownlinkType,
+		EncryptionType: openiot.EncryptionType(encryption),
+		Interval:       *flagInterval,
+		Messages:       *flagMessages,
+		Timeout:        *flagTimeout,
+		Faults: simulator.Faults{
+			Loss:      *flagLoss,
+			Duplicate: *flagDuplicate,
+			Reorder:   *flagReorder,
+		},
+		Seed: *flagSeed,
+	}
+	if *flagPrintDownlinks {
+		config.OnDownlink = printDownlink
+	}
+	sim, err := simulator.New(config, tr)
+	if err != nil {
+		return err
+	}
+
+	if err := tr.Start(); err != nil {
+		return fmt.Errorf("unable to start transport %s/%s: %v", tr.GetTypeName(), tr.GetName(), err)
+	}
+	defer tr.Stop()
+
+	// Stop on ctrl+c
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signalCh
+		glog.Infof("Got SIG %v, terminating...", sig)
+		cancel()
+	}()
+
+	if *flagStats > 0 {
+		go func() {
+			ticker := time.NewTicker(*flagStats)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					printStats(sim.Stats(), *flagDevices)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	glog.Infof("Simulating %d devices 0x%x..0x%x using %s/%s",
+		*flagDevices, firstID, firstID+uint64(*flagDevices)-1, tr.GetTypeName(), tr.GetName())
+	err = sim.Run(ctx)
+	printStats(sim.Stats(), *flagDevices)
+
+	return err
+}
+
+// loadTransport reads transports config and returns transport by name
+func loadTransport(filename, name string) (transport.Transport, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	if err := transport.LoadTransports(fd); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	transports := transport.GetAllTransports()
+	if name != "" {
+		if tr := transport.FindTransportByName(name); tr != nil {
+			return tr, nil
+		}
+		return nil, fmt.Errorf("transport '%s' not found in %s", name, filename)
+	}
+	if len(transports) != 1 {
+		return nil, fmt.Errorf("%s has %d transports, use -transport to pick one", filename, len(transports))
+	}
+
+	return transports[0], nil
+}
+
+func printDownlink(dev *simulator.Device, msg proto.Message) {
+	value, err := protojson.Marshal(proto.MessageV2(msg))
+	if err != nil {
+		value = []byte(err.Error())
+	}
+	fmt.Printf("0x%x downlink %s\n", dev.ID(), value)
+}
+
+func printStats(stats simulator.Stats, devices int) {
+	fmt.Printf("joined %d/%d, sent %d, lost %d, duplicated %d, reordered %d, "+
+		"key exchanges %d, join requests %d, timeouts %d, downlinks %d, key rotations %d, dropped %d\n",
+		stats.Joined, devices, stats.Sent, stats.Lost, stats.Duplicated, stats.Reordered,
+		stats.KeyExchanges, stats.JoinRequests, stats.Timeouts, stats.Downlinks, stats.Rekeys, stats.Dropped)
+}
@@ -1,9 +1,11 @@
 package device
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/open-iot-devices/protobufs/go/openiot"
 	"github.com/open-iot-devices/server/transport"
@@ -17,20 +19,57 @@ type Device struct {
 	Name            string
 	DisplayName     string `yaml:"display_name"`
 	Manufacturer    string
-	ProductURL      string   `yaml:"product_url"`
-	KeyString       string   `yaml:"key"`
-	SequenceSend    uint32   `yaml:"sequence_send"`
-	SequenceReceive uint32   `yaml:"sequence_receive"`
-	ProtobufName    string   `yaml:"protobuf_name"`
-	HandlerNames    []string `yaml:"handlers"`
-	TransportName   string   `yaml:"transport"`
-	EncryptionType  openiot.EncryptionType
+	ProductURL      string `yaml:"product_url"`
+	KeyString       string `yaml:"key"`
+	SequenceSend    uint32 `yaml:"sequence_send"`
+	SequenceReceive uint32 `yaml:"sequence_receive"`
+	ProtobufName    string `yaml:"protobuf_name"`
+	// Devices may send different kinds of messages, they're
+	// selected by type tag from MessageInfo (0 means ProtobufName)
+	MessageTypes   map[uint32]string `yaml:"message_types,omitempty"`
+	SchemaVersion  uint32            `yaml:"schema_version,omitempty"`
+	HandlerNames   []string          `yaml:"handlers"`
+	TransportName  string            `yaml:"transport"`
+	EncryptionType openiot.EncryptionType
+	// Server requested key rotation, it is kept until device confirms new key
+	RekeyPending bool `yaml:"rekey_pending,omitempty"`
+	// Key rotation in progress. Persisted, so device which already uses
+	// new key is not stranded by server restart.
+	Rekey *RekeySession `yaml:"rekey,omitempty"`
+	// Where device is: named location (see utils/sun) or own coordinates
+	Location  string   `yaml:"location,omitempty"`
+	Latitude  *float64 `yaml:"latitude,omitempty"`
+	Longitude *float64 `yaml:"longitude,omitempty"`
 
 	key       []byte
 	transport transport.Transport
 	handlers  []Handler
 }
 
+// RekeySession is state of server initiated key rotation: server's part of
+// Diffie-Hellman exchange and, once device replied, new key accepted
+// along with current one until Expires.
+type RekeySession struct {
+	Private      []uint32  `yaml:"private,flow"`
+	Public       []uint32  `yaml:"public,flow"`
+	NewKeyString string    `yaml:"new_key,omitempty"`
+	Expires      time.Time `yaml:"expires,omitempty"`
+
+	newKey []byte
+}
+
+// SetNewKey sets key calculated from device's reply
+func (session *RekeySession) SetNewKey(key []byte, expires time.Time) {
+	session.newKey = key
+	session.NewKeyString = hex.EncodeToString(key)
+	session.Expires = expires
+}
+
+// NewKey returns new key, nil until device replied
+func (session *RekeySession) NewKey() []byte {
+	return session.newKey
+}
+
 // NewDevice creates "unknown" device.
 func NewDevice(id uint64) *Device {
 	return &Device{
@@ -60,12 +99,52 @@ func (dev *Device) AddHandler(name string) {
 
 // SetHandler sets device handler (replaces existing)
 func (dev *Device) SetHandler(name string) {
+	var handlers []Handler
+	if handler := FindHandlerByName(name); handler != nil {
+		handlers = []Handler{handler}
+	}
 	dev.HandlerNames = []string{name}
+	dev.replaceHandlers(handlers)
+}
 
-	if handler := FindHandlerByName(name); handler != nil {
-		dev.handlers = []Handler{handler}
+// SetHandlers replaces device handlers, all of them must be registered
+func (dev *Device) SetHandlers(names []string) error {
+	var handlers []Handler
+	for _, name := range names {
+		handler := FindHandlerByName(name)
+		if handler == nil {
+			return fmt.Errorf("unknown handler '%s'", name)
+		}
+		handlers = append(handlers, handler)
+	}
+
+	dev.HandlerNames = names
+	dev.replaceHandlers(handlers)
+
+	return nil
+}
+
+// replaceHandlers attaches new handlers and notifies detached ones
+func (dev *Device) replaceHandlers(handlers []Handler) {
+	previous := dev.handlers
+	dev.handlers = handlers
+	for _, handler := range handlers {
 		handler.AddDevice(dev)
 	}
+	for _, old := range previous {
+		if !containsHandler(handlers, old) {
+			old.RemoveDevice(dev)
+		}
+	}
+}
+
+func containsHandler(handlers []Handler, handler Handler) bool {
+	for _, value := range handlers {
+		if value == handler {
+			return true
+		}
+	}
+	return false
 }
 
 // Handlers return array of associated device's handlers
@@ -73,6 +152,15 @@ func (dev *Device) Handlers() []Handler {
 	return dev.handlers
 }
 
+// MessageTypeName returns protobuf name of message by type tag.
+// Returns empty string for unknown tags.
+func (dev *Device) MessageTypeName(tag uint32) string {
+	if tag == 0 {
+		return dev.ProtobufName
+	}
+	return dev.MessageTypes[tag]
+}
+
 // SetKey set device's encryption key
 func (dev *Device) SetKey(key []byte) {
 	dev.key = key
@@ -84,6 +172,16 @@ func (dev *Device) Key() []byte {
 	return dev.key
 }
 
+// KeyFingerprint returns short hash of encryption key, so keys can be compared
+// without being exposed. Empty when device has no key.
+func (dev *Device) KeyFingerprint() string {
+	if len(dev.key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(dev.key)
+	return hex.EncodeToString(sum[:8])
+}
+
 // SetTransport sets new transport
 func (dev *Device) SetTransport(transport transport.Transport) {
 	dev.transport = transport
@@ -110,6 +208,16 @@ func (dev *Device) fixParameters() error {
 	} else {
 		return err
 	}
+	if dev.Rekey != nil && dev.Rekey.NewKeyString != "" {
+		key, err := hex.DecodeString(dev.Rekey.NewKeyString)
+		if err != nil {
+			return fmt.Errorf("%s: invalid rekey new_key: %v", dev.IDhex, err)
+		}
+		dev.Rekey.newKey = key
+	}
+	if (dev.Latitude == nil) != (dev.Longitude == nil) {
+		return fmt.Errorf("%s: both latitude and longitude must be set", dev.IDhex)
+	}
 	// Setup transport
 	if transport := transport.FindTransportByName(dev.TransportName); transport != nil {
 		dev.SetTransport(transport)
@@ -3,6 +3,8 @@ package device
 import (
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"sync"
 
 	"gopkg.in/yaml.v2"
@@ -20,6 +22,29 @@ func FindDeviceByID(id uint64) *Device {
 	return devicesByID[id]
 }
 
+// FindDevice looks up device by ID (0x...) or display name.
+// Returns Device or nil if not found
+func FindDevice(name string) *Device {
+	// Only 0x prefixed names are IDs, names like "cafe" are valid hex too
+	if strings.HasPrefix(name, "0x") {
+		if id, err := strconv.ParseUint(name[2:], 16, 64); err == nil {
+			if dev := FindDeviceByID(id); dev != nil {
+				return dev
+			}
+		}
+	}
+
+	deviceLock.RLock()
+	defer deviceLock.RUnlock()
+	for _, dev := range devicesByID {
+		if dev.DisplayName == name {
+			return dev
+		}
+	}
+
+	return nil
+}
+
 // AddDevice adds new device into registry
 func AddDevice(device *Device) error {
 	deviceLock.Lock()
@@ -41,16 +66,20 @@ func DeleteAllDevices() {
 	devicesByID = map[uint64]*Device{}
 }
 
-// DeleteDeviceByID deletes device from registry
+// DeleteDeviceByID deletes device from registry and notifies its handlers
 func DeleteDeviceByID(id uint64) error {
 	deviceLock.Lock()
-	defer deviceLock.Unlock()
-
-	if _, ok := devicesByID[id]; !ok {
+	dev, ok := devicesByID[id]
+	if !ok {
+		deviceLock.Unlock()
 		return fmt.Errorf("Device with ID %x not found", id)
 	}
-
 	delete(devicesByID, id)
+	deviceLock.Unlock()
+
+	for _, handler := range dev.handlers {
+		handler.RemoveDevice(dev)
+	}
 
 	return nil
 }
@@ -114,5 +143,12 @@ func LoadDevices(reader io.Reader) error {
 	}
 	deviceLock.Unlock()
 
+	// Let handlers know about loaded devices
+	for _, dev := range devices {
+		for _, handler := range dev.handlers {
+			handler.AddDevice(dev)
+		}
+	}
+
 	return nil
 }
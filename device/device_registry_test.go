@@ -11,17 +11,36 @@ import (
 
 func TestDeviceRegistry(t *testing.T) {
 	DeleteAllDevices()
+	handler := &mockHandler{name: "mock"}
+	MustAddHandler(handler)
+	defer DeleteHandler(handler.name)
 
 	dev := NewDevice(111)
+	dev.AddHandler("mock")
 
 	// Add / Lookup / Delete device
 	assert.NoError(t, AddDevice(dev))
 	assert.Error(t, AddDevice(dev)) // already exists
 	assert.Equal(t, dev, FindDeviceByID(111))
 	assert.Equal(t, []*Device{dev}, GetAllDevices())
+	dev.DisplayName = "kitchen"
+	assert.Equal(t, dev, FindDevice("0x6f"))
+	assert.Equal(t, dev, FindDevice("kitchen"))
+	assert.Nil(t, FindDevice("bedroom"))
+	// Names which are valid hex are not IDs
+	cafe := NewDevice(0xcafe)
+	assert.NoError(t, AddDevice(cafe))
+	defer DeleteDeviceByID(cafe.ID)
+	cafe.DisplayName = "bed"
+	dev.DisplayName = "cafe"
+	assert.Equal(t, dev, FindDevice("cafe"))
+	assert.Equal(t, cafe, FindDevice("bed"))
+	assert.Equal(t, cafe, FindDevice("0xcafe"))
+	assert.Nil(t, FindDevice("6f"))
 	assert.NoError(t, DeleteDeviceByID(111))
-	// Lookup again (device has been deleted)
+	// Lookup again (device has been deleted), handlers are notified
 	assert.Nil(t, FindDeviceByID(111))
+	assert.Equal(t, []*Device{dev}, handler.removed)
 
 	// Negative: no such device
 	assert.Nil(t, FindDeviceByID(55666666))
@@ -41,6 +60,8 @@ var testConfig = `- id: "0x112233"
   - hmock
   transport: tmock
   encryptiontype: 0
+  latitude: 39.5
+  longitude: -104.9
 - id: "0x556677"
   name: Unknown Device
   display_name: device_112233
@@ -53,6 +74,7 @@ var testConfig = `- id: "0x112233"
   handlers: []
   transport: ""
   encryptiontype: 0
+  location: cabin
 `
 
 func TestDeviceRegistryLoadSave(t *testing.T) {
@@ -75,4 +97,10 @@ func TestDeviceRegistryLoadSave(t *testing.T) {
 	assert.NoError(t, SaveDevices(&writer))
 
 	assert.Equal(t, testConfig, writer.String())
+
+	// Negative: only one of coordinates set
+	reader = bytes.NewReader([]byte(`- id: "0x1"
+  latitude: 39.5
+`))
+	assert.Error(t, LoadDevices(reader))
 }
@@ -24,6 +24,8 @@ func TestDeviceHandler(t *testing.T) {
 	// Ensure that set key actually updates 2 fields
 	assert.Equal(t, "0102030437", dev.KeyString)
 	assert.Equal(t, []byte{1, 2, 3, 4, 55}, dev.Key())
+	assert.Equal(t, "78faccdc303884f6", dev.KeyFingerprint())
+	assert.Empty(t, NewDevice(1).KeyFingerprint())
 
 	// Add the same handlers, should be ignored
 	dev.AddHandler("mock")
@@ -35,6 +37,16 @@ func TestDeviceHandler(t *testing.T) {
 	dev.SetHandler("mock")
 	assert.Equal(t, []string{"mock"}, dev.HandlerNames)
 	assert.Equal(t, []Handler{handler}, dev.handlers)
+	assert.Empty(t, handler.removed)
+
+	// SetHandlers: all or nothing
+	assert.Error(t, dev.SetHandlers([]string{"mock", "non_existing"}))
+	assert.Equal(t, []string{"mock"}, dev.HandlerNames)
+	assert.NoError(t, dev.SetHandlers([]string{}))
+	assert.Equal(t, []string{}, dev.HandlerNames)
+	assert.Empty(t, dev.handlers)
+	// Detached handler is notified
+	assert.Equal(t, []*Device{dev}, handler.removed)
 }
 
 func TestDeviceTransport(t *testing.T) {
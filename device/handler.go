@@ -7,6 +7,11 @@ type Handler interface {
 	GetName() string
 	Start() error
 	Stop()
-	ProcessMessage(device *Device, msg proto.Message) error
+	// ProcessMessage is called for every message from device,
+	// msgType is full protobuf name of msg
+	ProcessMessage(device *Device, msgType string, msg proto.Message) error
 	AddDevice(device *Device)
+	// RemoveDevice is called when handler is detached from device
+	// or device is deleted, to clean up per device state
+	RemoveDevice(device *Device)
 }
@@ -5,6 +5,7 @@ import "github.com/golang/protobuf/proto"
 type mockHandler struct {
 	name    string
 	history []*Device
+	removed []*Device
 }
 
 type mockTransport struct {
@@ -24,7 +25,7 @@ func (m *mockHandler) Stop() {
 
 }
 
-func (*mockHandler) ProcessMessage(device *Device, msg proto.Message) error {
+func (*mockHandler) ProcessMessage(device *Device, msgType string, msg proto.Message) error {
 	return nil
 }
 
@@ -32,6 +33,10 @@ func (m *mockHandler) AddDevice(device *Device) {
 	m.history = append(m.history, device)
 }
 
+func (m *mockHandler) RemoveDevice(device *Device) {
+	m.removed = append(m.removed, device)
+}
+
 // Mock Transport
 
 func (m *mockTransport) GetName() string {
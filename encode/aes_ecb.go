@@ -39,19 +39,10 @@ func WriteAndEncryptECB(buffer *bytes.Buffer, key []byte, msgs ...proto.Message)
 // DecryptAndReadECB decrypts buffer using AES-ECB with provided key,
 // then de-serializes all messages using "delimited" approach.
 func DecryptAndReadECB(buffer *bytes.Buffer, key []byte, msgs ...proto.Message) error {
-	// AES encrypted message must be aligned to AES block size
-	if buffer.Len()%aes.BlockSize != 0 {
-		return fmt.Errorf("Buffer is not aligned to AES block size")
-	}
-	// Decode buffer
-	block, err := aes.NewCipher(key)
+	decrypted, err := DecryptECB(buffer, key)
 	if err != nil {
 		return err
 	}
-	decrypted := make([]byte, buffer.Len())
-	for i := 0; buffer.Len() > 0; i += aes.BlockSize {
-		block.Decrypt(decrypted[i:], buffer.Next(aes.BlockSize))
-	}
 	// Deserialize messages
 	tmpBuf := bytes.NewBuffer(decrypted)
 	for _, msg := range msgs {
@@ -62,3 +53,22 @@ func DecryptAndReadECB(buffer *bytes.Buffer, key []byte, msgs ...proto.Message)
 
 	return nil
 }
+
+// DecryptECB decrypts whole buffer using AES-ECB with provided key.
+func DecryptECB(buffer *bytes.Buffer, key []byte) ([]byte, error) {
+	// AES encrypted message must be aligned to AES block size
+	if buffer.Len()%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Buffer is not aligned to AES block size")
+	}
+	// Decode buffer
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]byte, buffer.Len())
+	for i := 0; buffer.Len() > 0; i += aes.BlockSize {
+		block.Decrypt(decrypted[i:], buffer.Next(aes.BlockSize))
+	}
+
+	return decrypted, nil
+}
@@ -2,6 +2,7 @@ package encode
 
 import (
 	"bytes"
+	"fmt"
 	"hash/crc32"
 	"time"
 
@@ -93,6 +94,38 @@ func encodeTime(date *time.Time) uint32 {
 	return res
 }
 
+// DecodeDateTime converts BCD encoded MessageInfo date (YY-MM-DD-WD)
+// and time (HH:MM:SS) into time. Devices have no notion of time zone,
+// so result is in UTC. Weekday is not checked.
+func DecodeDateTime(date, tm uint32) (time.Time, error) {
+	var values [6]int
+	for index, bcd := range []uint32{date >> 24, date >> 16, date >> 8, tm >> 16, tm >> 8, tm} {
+		value, err := bcdToInt(bcd & 0xff)
+		if err != nil {
+			return time.Time{}, err
+		}
+		values[index] = value
+	}
+	year, month, day := values[0]+2000, values[1], values[2]
+	hour, minute, second := values[3], values[4], values[5]
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || minute > 59 || second > 59 {
+		return time.Time{}, fmt.Errorf("Invalid date/time %06x %06x", date>>8, tm)
+	}
+	result := time.Date(year, time.Month(month), day, hour, minute, second, 0, time.UTC)
+	if result.Day() != day {
+		return time.Time{}, fmt.Errorf("Invalid date %06x", date>>8)
+	}
+
+	return result, nil
+}
+
+func bcdToInt(bcd uint32) (int, error) {
+	if bcd>>4 > 9 || bcd&0xf > 9 {
+		return 0, fmt.Errorf("Invalid BCD value %02x", bcd)
+	}
+	return int(bcd>>4*10 + bcd&0xf), nil
+}
+
 func intToBcd(val int) uint32 {
 	if val > 99 {
 		return 0
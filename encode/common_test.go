@@ -129,3 +129,21 @@ func TestEncodeTime(t *testing.T) {
 	date := time.Date(2011, time.December, 13, 22, 23, 24, 0, time.UTC)
 	assert.Equal(t, uint32(0x222324), encodeTime(&date))
 }
+
+func TestDecodeDateTime(t *testing.T) {
+	date := time.Date(2011, time.December, 25, 22, 23, 24, 0, time.UTC)
+	decoded, err := DecodeDateTime(encodeDate(&date), encodeTime(&date))
+	require.NoError(t, err)
+	assert.Equal(t, date, decoded)
+
+	// Not BCD
+	_, err = DecodeDateTime(0x111a1302, 0x222324)
+	assert.EqualError(t, err, "Invalid BCD value 1a")
+	// Out of range
+	_, err = DecodeDateTime(0x11131302, 0x222324)
+	assert.EqualError(t, err, "Invalid date/time 111313 222324")
+	_, err = DecodeDateTime(0x11023102, 0x222324)
+	assert.EqualError(t, err, "Invalid date 110231")
+	_, err = DecodeDateTime(0, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,55 @@
+package encode
+
+import (
+	"crypto/aes"
+	"math/rand"
+)
+
+// Devices negotiate encryption key using simplified Diffie-Hellman:
+// every byte of key is calculated separately from its own private / public pair.
+
+// GenerateDiffieHellman generates private and public parts of key exchange
+// for generator dhG and modulus dhP.
+func GenerateDiffieHellman(dhG, dhP uint64) ([]uint32, []uint32) {
+	public := make([]uint32, aes.BlockSize)
+	private := make([]uint32, aes.BlockSize)
+	for i := 0; i < aes.BlockSize; i++ {
+		private[i] = rand.Uint32() % 4096
+		public[i] = uint32(
+			diffieHellmanPowMod(int(dhG), int(private[i]), int(dhP)),
+		)
+	}
+	return private, public
+}
+
+// DiffieHellmanKey calculates shared key from public part of other side
+// and own private part.
+func DiffieHellmanKey(dhP uint64, public, private []uint32) []byte {
+	key := make([]byte, len(private))
+	for index := range private {
+		key[index] = byte(diffieHellmanPowMod(
+			int(public[index]),
+			int(private[index]),
+			int(dhP),
+		))
+	}
+	return key
+}
+
+// it does math: g**x mod n
+func diffieHellmanPowMod(g, x, p int) int {
+	var r int
+	var y int = 1
+
+	for x > 0 {
+		r = x % 2
+		// Fast exponention
+		if r == 1 {
+			y = (y * g) % p
+		}
+		g = g * g % p
+		x = x / 2
+	}
+
+	return y
+}
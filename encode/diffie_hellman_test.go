@@ -0,0 +1,29 @@
+package encode
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateDiffieHellman(t *testing.T) {
+	rand.Seed(1)
+	private, public := GenerateDiffieHellman(199, 4001)
+
+	assert.Equal(t,
+		[]uint32{1090, 1054, 2958, 2422, 2818, 780, 1650, 1368, 3728, 3912, 2445, 1375, 3909, 4067, 688, 2613},
+		private)
+	assert.Equal(t,
+		[]uint32{121, 3672, 1450, 3760, 394, 1031, 2886, 3418, 625, 1154, 3231, 2055, 755, 1524, 3610, 3203},
+		public)
+}
+
+func TestDiffieHellmanKey(t *testing.T) {
+	privateA, publicA := GenerateDiffieHellman(199, 4001)
+	privateB, publicB := GenerateDiffieHellman(199, 4001)
+
+	key := DiffieHellmanKey(4001, publicB, privateA)
+	assert.Len(t, key, 16)
+	assert.Equal(t, key, DiffieHellmanKey(4001, publicA, privateB))
+}
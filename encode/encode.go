@@ -23,6 +23,23 @@ func DecryptAndRead(
 	return fmt.Errorf("Encoding %v is not supported", encType)
 }
 
+// Decrypt decrypts whole buffer using encoding from encType.
+// Returns buffer with "delimited" messages ready to be read one by one.
+func Decrypt(buffer *bytes.Buffer, encType openiot.EncryptionType, key []byte) (*bytes.Buffer, error) {
+	switch encType {
+	case openiot.EncryptionType_PLAIN:
+		return buffer, nil
+	case openiot.EncryptionType_AES_ECB:
+		decrypted, err := DecryptECB(buffer, key)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewBuffer(decrypted), nil
+	}
+
+	return nil, fmt.Errorf("Encoding %v is not supported", encType)
+}
+
 // WriteAndEncrypt serializes all messages using "delimited"
 // approach, then encodes result with encoding from encType.
 func WriteAndEncrypt(
@@ -0,0 +1,64 @@
+package encode
+
+import (
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+)
+
+// Multi-type devices put message type tag and schema version into MessageInfo.
+// These fields are optional, so they're read / written as extra (unknown) fields
+// to keep MessageInfo compatible with devices that don't know about them.
+const (
+	messageInfoTypeField    protowire.Number = 100
+	messageInfoVersionField protowire.Number = 101
+)
+
+// GetMessageType returns message type tag and schema version from MessageInfo.
+// Zeros are returned when device does not use them.
+func GetMessageType(info *openiot.MessageInfo) (tag uint32, version uint32) {
+	raw := proto.MessageReflect(info).GetUnknown()
+	for len(raw) > 0 {
+		num, typ, n := protowire.ConsumeTag(raw)
+		if n < 0 {
+			break
+		}
+		raw = raw[n:]
+		if typ == protowire.VarintType {
+			value, n := protowire.ConsumeVarint(raw)
+			if n < 0 {
+				break
+			}
+			switch num {
+			case messageInfoTypeField:
+				tag = uint32(value)
+			case messageInfoVersionField:
+				version = uint32(value)
+			}
+			raw = raw[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, raw)
+		if n < 0 {
+			break
+		}
+		raw = raw[n:]
+	}
+
+	return
+}
+
+// SetMessageType writes message type tag and schema version into MessageInfo
+func SetMessageType(info *openiot.MessageInfo, tag uint32, version uint32) {
+	var raw []byte
+	if tag != 0 {
+		raw = protowire.AppendTag(raw, messageInfoTypeField, protowire.VarintType)
+		raw = protowire.AppendVarint(raw, uint64(tag))
+	}
+	if version != 0 {
+		raw = protowire.AppendTag(raw, messageInfoVersionField, protowire.VarintType)
+		raw = protowire.AppendVarint(raw, uint64(version))
+	}
+	proto.MessageReflect(info).SetUnknown(raw)
+}
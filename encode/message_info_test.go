@@ -0,0 +1,29 @@
+package encode
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageType(t *testing.T) {
+	info := &openiot.MessageInfo{Sequence: 1}
+	tag, version := GetMessageType(info)
+	assert.Equal(t, uint32(0), tag)
+	assert.Equal(t, uint32(0), version)
+
+	SetMessageType(info, 3, 12)
+
+	// Serialize / de-serialize: extra fields must survive
+	var buf bytes.Buffer
+	require.NoError(t, WriteSingleMessage(&buf, info))
+	result := &openiot.MessageInfo{}
+	require.NoError(t, ReadSingleMessage(&buf, result))
+	assert.Equal(t, uint32(1), result.Sequence)
+	tag, version = GetMessageType(result)
+	assert.Equal(t, uint32(3), tag)
+	assert.Equal(t, uint32(12), version)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/open-iot-devices/server/admin"
+)
+
+var flagGRPCAddr = flag.String("grpc.addr", "", "Listen address of gRPC admin API (see admin/adminpb), empty to disable")
+var flagGRPCCert = flag.String("grpc.tls_cert", "", "TLS certificate file of gRPC server, required unless grpc.addr is loopback")
+var flagGRPCKey = flag.String("grpc.tls_key", "", "TLS private key file of gRPC server")
+
+// startGRPCServer starts gRPC server, it will be terminated once doneCh closed
+func startGRPCServer(wg *sync.WaitGroup, doneCh chan interface{}) {
+	if *flagGRPCAddr == "" {
+		glog.Info("gRPC server disabled")
+		return
+	}
+	options, err := grpcServerOptions(*flagGRPCAddr, *flagGRPCCert, *flagGRPCKey)
+	if err != nil {
+		glog.Errorf("gRPC server failed: %v", err)
+		return
+	}
+	listener, err := net.Listen("tcp", *flagGRPCAddr)
+	if err != nil {
+		glog.Errorf("gRPC server failed: %v", err)
+		return
+	}
+	server := admin.NewGRPCServer(options...)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		glog.Infof("gRPC server listening on %s", *flagGRPCAddr)
+		if err := server.Serve(listener); err != nil {
+			glog.Errorf("gRPC server failed: %v", err)
+		}
+	}()
+	go func() {
+		<-doneCh
+		// Subscribe streams end only when client disconnects, so don't wait for them
+		server.Stop()
+	}()
+}
+
+// grpcServerOptions returns TLS credentials, if configured. Bearer token must not
+// be sent in plain text over network, so without TLS only loopback address is allowed.
+func grpcServerOptions(addr, certFile, keyFile string) ([]grpc.ServerOption, error) {
+	if certFile == "" && keyFile == "" {
+		if !isLoopback(addr) {
+			return nil, fmt.Errorf("TLS (-grpc.tls_cert / -grpc.tls_key) is required to listen on %s", addr)
+		}
+		return nil, nil
+	}
+	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return []grpc.ServerOption{grpc.Creds(creds)}, nil
+}
+
+// isLoopback returns true when listen address is localhost only
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -1,3 +1,6 @@
+// Package belyalov is custom handler with hard-coded automation.
+//
+// Deprecated: use rules handler (handlers/rules), see example configuration there.
 package belyalov
 
 import (
@@ -35,7 +38,11 @@ func (h *deviceHandler) AddDevice(dev *device.Device) {
 
 }
 
-func (h *deviceHandler) ProcessMessage(dev *device.Device, rawMsg proto.Message) error {
+func (h *deviceHandler) RemoveDevice(dev *device.Device) {
+
+}
+
+func (h *deviceHandler) ProcessMessage(dev *device.Device, msgType string, rawMsg proto.Message) error {
 	msg, ok := rawMsg.(*pb.Status)
 	if !ok {
 		return fmt.Errorf("Got %T, but belyalov custom handler expects only pb.Status", rawMsg)
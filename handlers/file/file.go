@@ -0,0 +1,295 @@
+package file
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"gopkg.in/yaml.v2"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/utils"
+)
+
+const handlerName = "file"
+
+const (
+	// All messages into single file, one JSON object per line
+	formatJSONL = "jsonl"
+	// File per protobuf type, column per (flattened) field
+	formatCSV = "csv"
+)
+
+// Repeated fields are written into single CSV column, values separated by ";"
+var csvFlattenOptions = utils.FlattenOptions{EnumNames: true}
+
+type fileConfig struct {
+	Enabled   bool
+	Directory string
+	Format    string `yaml:",omitempty"`
+	// Rotation: by size in bytes and / or by time (e.g. "24h" rotates at midnight UTC)
+	MaxSize        int64  `yaml:"max_size,omitempty"`
+	RotateInterval string `yaml:"rotate_interval,omitempty"`
+	// Compress rotated files with gzip
+	Compress bool `yaml:",omitempty"`
+	// Retention of rotated files: amount and / or age
+	MaxFiles int    `yaml:"max_files,omitempty"`
+	MaxAge   string `yaml:"max_age,omitempty"`
+}
+
+// jsonRecord is single line of JSONL file
+type jsonRecord struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Device    jsonDevice      `json:"device"`
+	Type      string          `json:"type"`
+	Message   json.RawMessage `json:"message"`
+}
+
+type jsonDevice struct {
+	ID           string `json:"id"`
+	Name         string `json:"name,omitempty"`
+	DisplayName  string `json:"display_name,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+}
+
+type deviceHandler struct {
+	config  fileConfig
+	options rotateOptions
+
+	mutex sync.Mutex
+	// Opened files, keyed by base name. Nil when handler is not running.
+	files map[string]*rotatingFile
+	// CSV columns by protobuf type
+	columns map[string][]string
+	wg      sync.WaitGroup
+	now     func() time.Time
+}
+
+var flagConfigFilename = flag.String("config.file", ".config/file.yaml", "File archive config filename")
+
+func (h *deviceHandler) GetName() string {
+	return handlerName
+}
+
+func (h *deviceHandler) Start() error {
+	// Load configuration
+	reader, err := os.Open(*flagConfigFilename)
+	if err != nil {
+		// This is not fatal error, continue
+		glog.Infof("Unable to load config: %v, file archive disabled.", err)
+		return nil
+	}
+	defer reader.Close()
+	decoder := yaml.NewDecoder(reader)
+	decoder.SetStrict(true)
+	if err := decoder.Decode(&h.config); err != nil {
+		return err
+	}
+	if !h.config.Enabled {
+		glog.Infof("File archive disabled")
+		return nil
+	}
+
+	return h.start()
+}
+
+// start validates config and makes handler ready to write messages
+func (h *deviceHandler) start() error {
+	if h.config.Directory == "" {
+		h.config.Directory = "archive"
+	}
+	switch h.config.Format {
+	case "":
+		h.config.Format = formatJSONL
+	case formatJSONL, formatCSV:
+	default:
+		return fmt.Errorf("file: unknown format '%s'", h.config.Format)
+	}
+	h.options = rotateOptions{
+		maxSize:  h.config.MaxSize,
+		compress: h.config.Compress,
+		maxFiles: h.config.MaxFiles,
+	}
+	var err error
+	if h.options.interval, err = parseDuration(h.config.RotateInterval); err != nil {
+		return fmt.Errorf("file: rotate_interval: %v", err)
+	}
+	if h.options.maxAge, err = parseDuration(h.config.MaxAge); err != nil {
+		return fmt.Errorf("file: max_age: %v", err)
+	}
+	if err := os.MkdirAll(h.config.Directory, 0755); err != nil {
+		return err
+	}
+	if h.now == nil {
+		h.now = time.Now
+	}
+
+	h.mutex.Lock()
+	h.files = map[string]*rotatingFile{}
+	h.columns = map[string][]string{}
+	h.mutex.Unlock()
+	glog.Infof("Archiving messages into %s (%s)", h.config.Directory, h.config.Format)
+
+	return nil
+}
+
+// Stop closes all files and waits for background compression
+func (h *deviceHandler) Stop() {
+	h.mutex.Lock()
+	for _, file := range h.files {
+		if err := file.close(); err != nil {
+			glog.Infof("Unable to close %s: %v", file.filename(), err)
+		}
+	}
+	h.files = nil
+	h.mutex.Unlock()
+
+	h.wg.Wait()
+}
+
+func (h *deviceHandler) AddDevice(device *device.Device) {
+
+}
+
+func (h *deviceHandler) RemoveDevice(device *device.Device) {
+
+}
+
+func (h *deviceHandler) ProcessMessage(dev *device.Device, msgType string, msg proto.Message) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.files == nil {
+		return nil
+	}
+
+	now := h.now()
+	base, ext := "messages", ".jsonl"
+	var columns []string
+	var data []byte
+	var err error
+	if h.config.Format == formatCSV {
+		base, ext = msgType, ".csv"
+		columns = h.csvColumns(msgType, msg)
+		data, err = formatCSVLine(csvRow(dev, columns, msg, now))
+	} else {
+		data, err = jsonlRecord(dev, msgType, msg, now)
+	}
+	if err != nil {
+		return fmt.Errorf("0x%x: %v", dev.ID, err)
+	}
+
+	file, ok := h.files[base]
+	if !ok {
+		file = &rotatingFile{
+			dir:     h.config.Directory,
+			base:    base,
+			ext:     ext,
+			options: &h.options,
+			wg:      &h.wg,
+		}
+		if columns != nil {
+			if file.header, err = formatCSVLine(columns); err != nil {
+				return fmt.Errorf("0x%x: %v", dev.ID, err)
+			}
+		}
+		h.files[base] = file
+	}
+	if err := file.write(data, now); err != nil {
+		return fmt.Errorf("0x%x: %s: %v", dev.ID, file.filename(), err)
+	}
+
+	return nil
+}
+
+// jsonlRecord makes JSON line with device metadata and protojson of message
+func jsonlRecord(dev *device.Device, msgType string, msg proto.Message, now time.Time) ([]byte, error) {
+	message, err := protojson.Marshal(proto.MessageV2(msg))
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(&jsonRecord{
+		Timestamp: now.UTC(),
+		Device: jsonDevice{
+			ID:           dev.IDhex,
+			Name:         dev.Name,
+			DisplayName:  dev.DisplayName,
+			Manufacturer: dev.Manufacturer,
+		},
+		Type:    msgType,
+		Message: message,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// csvColumns returns CSV columns of message type. Columns are derived from
+// protobuf descriptor, so they're stable regardless of fields set.
+// Must be called with lock held.
+func (h *deviceHandler) csvColumns(msgType string, msg proto.Message) []string {
+	columns, ok := h.columns[msgType]
+	if !ok {
+		columns = []string{"timestamp", "device_id", "display_name"}
+		desc := proto.MessageReflect(msg).Descriptor()
+		for _, field := range utils.ListFlattenedFields(desc, csvFlattenOptions) {
+			columns = append(columns, field.Name)
+		}
+		h.columns[msgType] = columns
+	}
+	return columns
+}
+
+func csvRow(dev *device.Device, columns []string, msg proto.Message, now time.Time) []string {
+	values := utils.FlattenProtobuf(msg, csvFlattenOptions)
+	row := []string{now.UTC().Format(time.RFC3339Nano), dev.IDhex, dev.DisplayName}
+	for _, column := range columns[len(row):] {
+		row = append(row, formatCSVValue(values[column]))
+	}
+	return row
+}
+
+func formatCSVLine(values []string) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(values)
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+func formatCSVValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, formatCSVValue(item))
+		}
+		return strings.Join(values, ";")
+	}
+	return fmt.Sprint(value)
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// Register device handler
+func init() {
+	device.MustAddHandler(&deviceHandler{})
+}
@@ -0,0 +1,216 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-iot-devices/protobufs/go/openiot/sensor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/server/device"
+)
+
+// testClock is fake time, advanced by step on every call
+type testClock struct {
+	now  time.Time
+	step time.Duration
+}
+
+func (c *testClock) Now() time.Time {
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+func newTestHandler(t *testing.T, config fileConfig) (*deviceHandler, *testClock) {
+	dir, err := ioutil.TempDir("", "file_handler")
+	require.NoError(t, err)
+	clock := &testClock{now: time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC), step: time.Second}
+	config.Enabled = true
+	config.Directory = dir
+	h := &deviceHandler{config: config, now: clock.Now}
+	require.NoError(t, h.start())
+	return h, clock
+}
+
+func newTestDevice() *device.Device {
+	dev := device.NewDevice(0x1234)
+	dev.Name = "multisensor"
+	dev.DisplayName = "kitchen"
+	return dev
+}
+
+func sendTestMessages(t *testing.T, h *deviceHandler, count int) {
+	dev := newTestDevice()
+	for i := 0; i < count; i++ {
+		msg := &sensor.MultiSensorStatus{
+			Temperature: &sensor.Temperature{ValueC: 20},
+			Uptime:      uint32(i),
+		}
+		require.NoError(t, h.ProcessMessage(dev, "sensor.MultiSensorStatus", msg))
+	}
+}
+
+func readLines(t *testing.T, filename string) []string {
+	file, err := os.Open(filename)
+	require.NoError(t, err)
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(filename, ".gz") {
+		reader, err = gzip.NewReader(file)
+		require.NoError(t, err)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+	return lines
+}
+
+func listDir(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestJSONL(t *testing.T) {
+	h, _ := newTestHandler(t, fileConfig{})
+	defer os.RemoveAll(h.config.Directory)
+	sendTestMessages(t, h, 2)
+	h.Stop()
+
+	lines := readLines(t, filepath.Join(h.config.Directory, "messages.jsonl"))
+	require.Len(t, lines, 2)
+	var record struct {
+		Timestamp time.Time
+		Device    map[string]string
+		Type      string
+		Message   map[string]interface{}
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal(t, time.Date(2020, 5, 1, 10, 0, 1, 0, time.UTC), record.Timestamp)
+	assert.Equal(t, "0x1234", record.Device["id"])
+	assert.Equal(t, "kitchen", record.Device["display_name"])
+	assert.Equal(t, "sensor.MultiSensorStatus", record.Type)
+	assert.Equal(t, float64(1), record.Message["uptime"])
+
+	// Restart: appended to existing file
+	require.NoError(t, h.start())
+	sendTestMessages(t, h, 1)
+	h.Stop()
+	assert.Len(t, readLines(t, filepath.Join(h.config.Directory, "messages.jsonl")), 3)
+}
+
+func TestCSV(t *testing.T) {
+	h, _ := newTestHandler(t, fileConfig{Format: formatCSV})
+	defer os.RemoveAll(h.config.Directory)
+	filename := filepath.Join(h.config.Directory, "sensor.MultiSensorStatus.csv")
+	// Existing file with other columns gets rotated
+	require.NoError(t, ioutil.WriteFile(filename, []byte("timestamp,old\n1,2\n"), 0644))
+
+	sendTestMessages(t, h, 2)
+	h.Stop()
+
+	lines := readLines(t, filename)
+	require.Len(t, lines, 3)
+	header := strings.Split(lines[0], ",")
+	assert.Equal(t, []string{"timestamp", "device_id", "display_name"}, header[:3])
+	assert.Contains(t, header, "temperature.value_c")
+	assert.Contains(t, header, "uptime")
+	row := strings.Split(lines[2], ",")
+	require.Len(t, row, len(header))
+	values := map[string]string{}
+	for i, column := range header {
+		values[column] = row[i]
+	}
+	assert.Equal(t, "2020-05-01T10:00:01Z", values["timestamp"])
+	assert.Equal(t, "0x1234", values["device_id"])
+	assert.Equal(t, "20", values["temperature.value_c"])
+	assert.Equal(t, "1", values["uptime"])
+
+	assert.Equal(t, []string{"sensor.MultiSensorStatus-20200501T100000.csv", "sensor.MultiSensorStatus.csv"},
+		listDir(t, h.config.Directory))
+}
+
+func TestRotateBySize(t *testing.T) {
+	h, _ := newTestHandler(t, fileConfig{
+		MaxSize:  1,
+		Compress: true,
+		MaxFiles: 2,
+	})
+	defer os.RemoveAll(h.config.Directory)
+	sendTestMessages(t, h, 5)
+	h.Stop()
+
+	// Every message in own file, only 2 rotated files kept
+	assert.Equal(t, []string{
+		"messages-20200501T100003.jsonl.gz",
+		"messages-20200501T100004.jsonl.gz",
+		"messages.jsonl",
+	}, listDir(t, h.config.Directory))
+	lines := readLines(t, filepath.Join(h.config.Directory, "messages-20200501T100004.jsonl.gz"))
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], `"uptime":3`)
+}
+
+func TestRotateByInterval(t *testing.T) {
+	h, clock := newTestHandler(t, fileConfig{
+		RotateInterval: "1h",
+	})
+	defer os.RemoveAll(h.config.Directory)
+	clock.step = 40 * time.Minute
+	// 10:00, 10:40 - same file, 11:20, 12:00, 12:40
+	sendTestMessages(t, h, 5)
+	h.Stop()
+
+	assert.Equal(t, []string{
+		"messages-20200501T112000.jsonl",
+		"messages-20200501T120000.jsonl",
+		"messages.jsonl",
+	}, listDir(t, h.config.Directory))
+	assert.Len(t, readLines(t, filepath.Join(h.config.Directory, "messages-20200501T112000.jsonl")), 2)
+	assert.Len(t, readLines(t, filepath.Join(h.config.Directory, "messages.jsonl")), 2)
+
+	// Retention by age
+	old := filepath.Join(h.config.Directory, "messages-20200501T112000.jsonl")
+	require.NoError(t, os.Chtimes(old, clock.now, clock.now.Add(-3*time.Hour)))
+	file := &rotatingFile{
+		dir:     h.config.Directory,
+		base:    "messages",
+		ext:     ".jsonl",
+		options: &rotateOptions{maxAge: 2 * time.Hour},
+	}
+	file.cleanup(clock.now)
+	assert.Equal(t, []string{
+		"messages-20200501T120000.jsonl",
+		"messages.jsonl",
+	}, listDir(t, h.config.Directory))
+}
+
+func TestConfigNegative(t *testing.T) {
+	for _, config := range []fileConfig{
+		{Format: "xml"},
+		{RotateInterval: "1"},
+		{MaxAge: "x"},
+	} {
+		h := &deviceHandler{config: config}
+		assert.Error(t, h.start())
+	}
+}
@@ -0,0 +1,254 @@
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Timestamp (UTC) of rotation in names of rotated files
+const rotatedTimeLayout = "20060102T150405"
+
+type rotateOptions struct {
+	// Rotate when file grows bigger than maxSize bytes
+	maxSize int64
+	// Rotate when wall clock crosses interval boundary (e.g. midnight UTC for 24h)
+	interval time.Duration
+	compress bool
+	// Retention of rotated files
+	maxFiles int
+	maxAge   time.Duration
+}
+
+// rotatingFile is append only file <dir>/<base><ext>, rotated files are
+// renamed to <dir>/<base>-<timestamp><ext>, optionally gzip'ed
+type rotatingFile struct {
+	dir     string
+	base    string
+	ext     string
+	options *rotateOptions
+	// Written at start of every file, e.g. CSV column names
+	header []byte
+	// Background compression of rotated files
+	wg *sync.WaitGroup
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func (f *rotatingFile) filename() string {
+	return filepath.Join(f.dir, f.base+f.ext)
+}
+
+// write appends data to file, rotating it when needed
+func (f *rotatingFile) write(data []byte, now time.Time) error {
+	if f.file == nil {
+		if err := f.open(now); err != nil {
+			return err
+		}
+	}
+	if f.needRotate(int64(len(data)), now) {
+		if err := f.rotate(now); err != nil {
+			return err
+		}
+		if err := f.open(now); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return err
+}
+
+func (f *rotatingFile) needRotate(size int64, now time.Time) bool {
+	// Nothing written yet
+	if f.size <= int64(len(f.header)) {
+		return false
+	}
+	if f.options.maxSize > 0 && f.size+size > f.options.maxSize {
+		return true
+	}
+	if f.options.interval > 0 &&
+		!now.Truncate(f.options.interval).Equal(f.opened.Truncate(f.options.interval)) {
+		return true
+	}
+	return false
+}
+
+// open opens existing file to append to or creates new one.
+// Existing file with different header (e.g. CSV columns changed) is rotated first.
+func (f *rotatingFile) open(now time.Time) error {
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.filename(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = now
+
+	if f.size == 0 {
+		n, err := f.file.Write(f.header)
+		f.size += int64(n)
+		return err
+	}
+	// Continue existing file, its age is time of last write
+	f.opened = info.ModTime()
+	header := make([]byte, len(f.header))
+	if _, err := io.ReadFull(io.NewSectionReader(file, 0, f.size), header); err != nil || !bytes.Equal(header, f.header) {
+		if err := f.rotate(now); err != nil {
+			return err
+		}
+		return f.open(now)
+	}
+
+	return nil
+}
+
+// rotate closes current file and renames it to rotated name
+func (f *rotatingFile) rotate(now time.Time) error {
+	if err := f.close(); err != nil {
+		return err
+	}
+
+	prefix := filepath.Join(f.dir, f.base+"-"+now.UTC().Format(rotatedTimeLayout))
+	rotated := prefix + f.ext
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s-%d%s", prefix, i, f.ext)
+	}
+	if err := os.Rename(f.filename(), rotated); err != nil {
+		return err
+	}
+	glog.V(2).Infof("Rotated %s to %s", f.filename(), rotated)
+
+	if f.options.compress {
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			if err := compressFile(rotated); err != nil {
+				glog.Infof("Unable to compress %s: %v", rotated, err)
+			}
+			f.cleanup(now)
+		}()
+	} else {
+		f.cleanup(now)
+	}
+
+	return nil
+}
+
+func (f *rotatingFile) close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	f.size = 0
+	return err
+}
+
+// rotatedFiles returns names of rotated files (without .gz), oldest first.
+// File being compressed exists in both forms, it is listed once.
+func (f *rotatingFile) rotatedFiles() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(f.dir, f.base+"-*"))
+	if err != nil {
+		return nil, err
+	}
+	var results []string
+	seen := map[string]bool{}
+	for _, match := range matches {
+		match = strings.TrimSuffix(match, ".gz")
+		name := filepath.Base(match)
+		if seen[match] || !strings.HasSuffix(name, f.ext) ||
+			len(name) < len(f.base)+1+len(rotatedTimeLayout) {
+			continue
+		}
+		timestamp := name[len(f.base)+1 : len(f.base)+1+len(rotatedTimeLayout)]
+		if _, err := time.Parse(rotatedTimeLayout, timestamp); err != nil {
+			continue
+		}
+		seen[match] = true
+		results = append(results, match)
+	}
+	sort.Strings(results)
+	return results, nil
+}
+
+// cleanup removes rotated files exceeding retention limits
+func (f *rotatingFile) cleanup(now time.Time) {
+	if f.options.maxFiles == 0 && f.options.maxAge == 0 {
+		return
+	}
+	files, err := f.rotatedFiles()
+	if err != nil {
+		glog.Infof("Unable to list rotated files of %s: %v", f.filename(), err)
+		return
+	}
+	for index, name := range files {
+		remove := f.options.maxFiles > 0 && len(files)-index > f.options.maxFiles
+		if !remove && f.options.maxAge > 0 {
+			info, err := os.Stat(name)
+			if err != nil {
+				info, err = os.Stat(name + ".gz")
+			}
+			remove = err == nil && now.Sub(info.ModTime()) > f.options.maxAge
+		}
+		if !remove {
+			continue
+		}
+		for _, filename := range []string{name, name + ".gz"} {
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				glog.Infof("Unable to remove %s: %v", filename, err)
+			}
+		}
+	}
+}
+
+// compressFile replaces file with its gzip'ed copy (name.gz)
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(name + ".gz")
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(dst)
+	_, err = io.Copy(writer, src)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,323 @@
+package influx
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/influxdata/influxdb1-client/models"
+	influxdb "github.com/influxdata/influxdb1-client/v2"
+)
+
+// Points are buffered in memory and written by background goroutine
+// in batches (by size or interval). Failed batches are retried with
+// exponential backoff, unless rejected by server as invalid (see retryable).
+// When buffer is full the oldest points go to on-disk spool (if configured)
+// or dropped.
+
+const minRetryDelay = time.Second
+
+// Max length of spool line, longer lines are considered corrupted
+const maxSpoolLineSize = 64 * 1024
+
+// addPoints appends points into buffer, wakes up writer once batch is ready
+func (h *deviceHandler) addPoints(points []*influxdb.Point) {
+	h.mutex.Lock()
+	h.points = append(h.points, points...)
+	overflow := h.trimBuffer()
+	ready := len(h.points) >= h.batchSize
+	h.mutex.Unlock()
+
+	h.overflow(overflow)
+	if ready {
+		select {
+		case h.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// trimBuffer removes the oldest points exceeding buffer size.
+// Must be called with lock held.
+func (h *deviceHandler) trimBuffer() []*influxdb.Point {
+	if len(h.points) <= h.bufferSize {
+		return nil
+	}
+	excess := len(h.points) - h.bufferSize
+	overflow := h.points[:excess]
+	h.points = h.points[excess:]
+
+	return overflow
+}
+
+// overflow writes points into spool or drops them
+func (h *deviceHandler) overflow(points []*influxdb.Point) {
+	if len(points) == 0 {
+		return
+	}
+	if h.config.SpoolFilename != "" {
+		err := h.spool(points)
+		if err == nil {
+			return
+		}
+		glog.Errorf("influxdb: unable to spool points: %v", err)
+	}
+	dropped := h.addDropped(len(points))
+	glog.Warningf("influxdb: buffer is full, %d points dropped (%d total)", len(points), dropped)
+}
+
+// addDropped counts dropped points, returns total amount
+func (h *deviceHandler) addDropped(count int) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.dropped += uint64(count)
+	return h.dropped
+}
+
+// takeBatch removes up to batchSize points from head of buffer
+func (h *deviceHandler) takeBatch() []*influxdb.Point {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	size := len(h.points)
+	if size > h.batchSize {
+		size = h.batchSize
+	}
+	batch := h.points[:size:size]
+	h.points = h.points[size:]
+
+	return batch
+}
+
+// putBack returns not written batch back to head of buffer
+func (h *deviceHandler) putBack(batch []*influxdb.Point) {
+	h.mutex.Lock()
+	h.points = append(batch, h.points...)
+	overflow := h.trimBuffer()
+	h.mutex.Unlock()
+
+	h.overflow(overflow)
+}
+
+// flush writes all buffered (and spooled) points
+func (h *deviceHandler) flush() error {
+	for {
+		batch := h.takeBatch()
+		if len(batch) == 0 {
+			// Memory buffer is empty - time to replay spooled points
+			if h.loadSpool() == 0 {
+				return nil
+			}
+			continue
+		}
+		if err := h.write(batch); err != nil {
+			if !retryable(err) {
+				dropped := h.addDropped(len(batch))
+				glog.Errorf("influxdb: write rejected: %v, %d points dropped (%d total)", err, len(batch), dropped)
+				continue
+			}
+			h.putBack(batch)
+			return err
+		}
+	}
+}
+
+func (h *deviceHandler) write(batch []*influxdb.Point) error {
+	return h.writer.Write(batch)
+}
+
+// run is background writer, terminates when doneCh closed
+func (h *deviceHandler) run() {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.flushCh:
+		case <-h.doneCh:
+			return
+		}
+
+		// Retry with exponential backoff until success
+		delay := minRetryDelay
+		if delay > h.maxRetryDelay {
+			delay = h.maxRetryDelay
+		}
+		for {
+			err := h.flush()
+			if err == nil {
+				break
+			}
+			glog.Infof("influxdb: write failed: %v, retry in %s", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-h.doneCh:
+				return
+			}
+			delay *= 2
+			if delay > h.maxRetryDelay {
+				delay = h.maxRetryDelay
+			}
+		}
+	}
+}
+
+// drain performs last attempt to write buffer on shutdown,
+// everything not written goes to spool / dropped
+func (h *deviceHandler) drain() {
+	if err := h.flush(); err != nil {
+		glog.Errorf("influxdb: unable to write buffered points: %v", err)
+		h.mutex.Lock()
+		rest := h.points
+		h.points = nil
+		h.mutex.Unlock()
+		h.overflow(rest)
+	}
+}
+
+// Spool //
+
+// spool appends points to spool file using line protocol
+func (h *deviceHandler) spool(points []*influxdb.Point) error {
+	h.spoolMutex.Lock()
+	defer h.spoolMutex.Unlock()
+
+	fd, err := os.OpenFile(h.config.SpoolFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(fd)
+	for _, point := range points {
+		writer.WriteString(point.String())
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
+
+// loadSpool moves spooled points into memory buffer (as much as fits),
+// returns amount of loaded points.
+func (h *deviceHandler) loadSpool() int {
+	if h.config.SpoolFilename == "" {
+		return 0
+	}
+	h.spoolMutex.Lock()
+	defer h.spoolMutex.Unlock()
+
+	h.mutex.Lock()
+	free := h.bufferSize - len(h.points)
+	h.mutex.Unlock()
+	if free <= 0 {
+		return 0
+	}
+	points, corrupted, err := h.splitSpool(free)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Errorf("influxdb: unable to load spool: %v", err)
+		}
+		return 0
+	}
+	if corrupted > 0 {
+		dropped := h.addDropped(corrupted)
+		glog.Errorf("influxdb: %d corrupted lines skipped in spool %s (%d points dropped total)",
+			corrupted, h.config.SpoolFilename, dropped)
+	}
+
+	// Buffer may exceed its size for a moment, extra points go back
+	// to spool on next addPoints
+	h.mutex.Lock()
+	h.points = append(h.points, points...)
+	h.mutex.Unlock()
+
+	return len(points)
+}
+
+// splitSpool reads up to limit points from spool file, rest of file is kept as is.
+// Spool is read line by line and replaced atomically (written into <spool>.tmp and
+// renamed), so it can be large and crash doesn't lose it.
+// Must be called with spoolMutex held.
+func (h *deviceHandler) splitSpool(limit int) ([]*influxdb.Point, int, error) {
+	fd, err := os.Open(h.config.SpoolFilename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fd.Close()
+	tmpFilename := h.config.SpoolFilename + ".tmp"
+	tmp, err := os.Create(tmpFilename)
+	if err != nil {
+		return nil, 0, err
+	}
+	writer := bufio.NewWriter(tmp)
+	reader := bufio.NewReaderSize(fd, maxSpoolLineSize)
+
+	var points []*influxdb.Point
+	corrupted := 0
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Way longer than any point, skip it
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			corrupted++
+			line = nil
+		}
+		if err != nil && err != io.EOF {
+			tmp.Close()
+			os.Remove(tmpFilename)
+			return nil, 0, err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			if len(points) < limit {
+				// Parse line by line, so corrupted lines (e.g. partially written on crash)
+				// are skipped without losing the rest
+				// Points refer to line, but reader reuses its buffer
+				line = append([]byte(nil), line...)
+				parsed, parseErr := models.ParsePointsWithPrecision(line, time.Now(), "n")
+				if parseErr != nil {
+					corrupted++
+					continue
+				}
+				for _, point := range parsed {
+					points = append(points, influxdb.NewPointFrom(point))
+				}
+			} else {
+				// Keep rest in spool
+				writer.Write(line)
+				if line[len(line)-1] != '\n' {
+					writer.WriteByte('\n')
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpFilename)
+		return nil, 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return nil, 0, err
+	}
+	if err := os.Rename(tmpFilename, h.config.SpoolFilename); err != nil {
+		os.Remove(tmpFilename)
+		return nil, 0, err
+	}
+
+	return points, corrupted, nil
+}
@@ -3,7 +3,7 @@ package influx
 import (
 	"flag"
 	"os"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -17,8 +17,6 @@ import (
 
 const handlerName = "influxdb"
 
-type kv map[string]interface{}
-
 type influxDbConfig struct {
 	Addr               string
 	Username           string
@@ -28,11 +26,44 @@ type influxDbConfig struct {
 
 	Database string
 	Enabled  bool
+
+	// Output API: v1 (default), v2 or line_protocol (see writer.go)
+	Mode string `yaml:"mode,omitempty"`
+	// InfluxDB 2.x
+	Org    string `yaml:"org,omitempty"`
+	Bucket string `yaml:"bucket,omitempty"`
+	Token  string `yaml:"token,omitempty"`
+	// Timestamp precision: ns, us, ms, s
+	Precision string `yaml:"precision,omitempty"`
+	Gzip      bool   `yaml:"gzip,omitempty"`
+
+	// Points are written in batches of BatchSize, at least every FlushInterval
+	BatchSize     int    `yaml:"batch_size,omitempty"`
+	FlushInterval string `yaml:"flush_interval,omitempty"`
+	// Max amount of points kept in memory while InfluxDB is unavailable
+	BufferSize    int    `yaml:"buffer_size,omitempty"`
+	MaxRetryDelay string `yaml:"max_retry_delay,omitempty"`
+	// Optional file to keep points not fitting into memory buffer
+	SpoolFilename string `yaml:"spool_filename,omitempty"`
 }
 
 type deviceHandler struct {
 	config influxDbConfig
-	client influxdb.Client
+	writer *lineProtocolWriter
+
+	batchSize     int
+	bufferSize    int
+	flushInterval time.Duration
+	maxRetryDelay time.Duration
+
+	mutex      sync.Mutex
+	spoolMutex sync.Mutex
+	points     []*influxdb.Point
+	dropped    uint64
+
+	flushCh chan struct{}
+	doneCh  chan struct{}
+	wg      sync.WaitGroup
 }
 
 var flagConfigFilename = flag.String("config.influxdb", ".config/influxdb.yaml", "InfluxDB config filename")
@@ -45,6 +76,10 @@ func (h *deviceHandler) AddDevice(device *device.Device) {
 
 }
 
+func (h *deviceHandler) RemoveDevice(device *device.Device) {
+
+}
+
 func (h *deviceHandler) Start() error {
 	// Load configuration
 	reader, err := os.Open(*flagConfigFilename)
@@ -65,21 +100,69 @@ func (h *deviceHandler) Start() error {
 		return nil
 	}
 
-	h.client, err = influxdb.NewHTTPClient(influxdb.HTTPConfig{
-		Addr:               h.config.Addr,
-		Username:           h.config.Username,
-		Password:           h.config.Password,
-		InsecureSkipVerify: h.config.InsecureSkipVerify,
-	})
-	if err == nil {
-		glog.Infof("Connected to %s", h.config.Addr)
+	return h.start()
+}
+
+// start creates line protocol writer and starts background writer
+func (h *deviceHandler) start() error {
+	var err error
+	h.batchSize = h.config.BatchSize
+	if h.batchSize <= 0 {
+		h.batchSize = 1000
+	}
+	h.bufferSize = h.config.BufferSize
+	if h.bufferSize <= 0 {
+		h.bufferSize = 100000
+	}
+	if h.bufferSize < h.batchSize {
+		h.bufferSize = h.batchSize
+	}
+	h.flushInterval = 10 * time.Second
+	if h.config.FlushInterval != "" {
+		if h.flushInterval, err = time.ParseDuration(h.config.FlushInterval); err != nil {
+			return err
+		}
+	}
+	h.maxRetryDelay = 5 * time.Minute
+	if h.config.MaxRetryDelay != "" {
+		if h.maxRetryDelay, err = time.ParseDuration(h.config.MaxRetryDelay); err != nil {
+			return err
+		}
+	}
+
+	h.writer, err = newLineProtocolWriter(&h.config)
+	if err != nil {
+		return err
 	}
+	glog.Infof("InfluxDb: writing to %s", h.writer.url)
+
+	h.flushCh = make(chan struct{}, 1)
+	h.doneCh = make(chan struct{})
+	h.wg.Add(1)
+	go h.run()
 
-	return err
+	return nil
+}
+
+// stop terminates background writer and writes all buffered points
+func (h *deviceHandler) stop() {
+	if h.writer == nil {
+		return
+	}
+	close(h.doneCh)
+	h.wg.Wait()
+	h.drain()
+	h.mutex.Lock()
+	if h.dropped > 0 {
+		glog.Warningf("influxdb: %d points were dropped", h.dropped)
+	}
+	h.mutex.Unlock()
+	h.writer.Close()
+	h.writer = nil
 }
 
 func (h *deviceHandler) Stop() {
-	h.client.Close()
+	h.stop()
 
 	if writer, err := os.Create(*flagConfigFilename); err == nil {
 		encoder := yaml.NewEncoder(writer)
@@ -89,53 +172,55 @@ func (h *deviceHandler) Stop() {
 	}
 }
 
-func (h *deviceHandler) ProcessMessage(device *device.Device, msg proto.Message) error {
+func (h *deviceHandler) ProcessMessage(device *device.Device, msgType string, msg proto.Message) error {
 	timestamp := time.Now()
 
-	// Extract and log all proto field name/value pairs
-	data := utils.ExtractAllNameValuesFromProtobuf(msg)
+	// Extract all values grouped by table / metric
+	measurements := utils.ExtractMeasurements(msg, 0)
 
-	// Common tags for all influxdb points
-	tags := map[string]string{
-		"device_id":    device.IDhex,
-		"display_name": device.DisplayName,
+	if h.writer == nil {
+		return nil
 	}
 
-	// Group all values by table / metric
-	measurements := map[string]kv{}
-	for fullName, value := range data {
-		tableName, metricName := splitProtobufFullName(fullName)
-		if _, ok := measurements[tableName]; !ok {
-			measurements[tableName] = map[string]interface{}{}
+	// Points are written into db by background writer
+	var points []*influxdb.Point
+	for _, measurement := range measurements {
+		// InfluxDB does not support points without values
+		if len(measurement.Fields) == 0 {
+			continue
 		}
-		measurements[tableName][metricName] = value
-	}
-
-	// Write points into db
-	points, err := influxdb.NewBatchPoints(influxdb.BatchPointsConfig{
-		Precision: "s",
-		Database:  h.config.Database,
-	})
-	if err != nil {
-		return err
-	}
-	for tableName, values := range measurements {
-		point, err := influxdb.NewPoint(tableName, tags, values, timestamp)
+		// Common tags for all influxdb points
+		tags := map[string]string{
+			"device_id":    device.IDhex,
+			"display_name": device.DisplayName,
+		}
+		for name, value := range measurement.Tags {
+			tags[name] = value
+		}
+		values := map[string]interface{}{}
+		for name, value := range measurement.Fields {
+			values[name] = influxValue(value)
+		}
+		point, err := influxdb.NewPoint(measurement.Name, tags, values, timestamp)
 		if err != nil {
 			return err
 		}
-		points.AddPoint(point)
+		points = append(points, point)
 	}
+	h.addPoints(points)
 
-	return h.client.Write(points)
+	return nil
 }
 
-func splitProtobufFullName(fullName string) (string, string) {
-	tokens := strings.SplitN(fullName, ".", 2)
-	if len(tokens) > 1 {
-		return tokens[0], tokens[1]
+// influxValue converts value into type supported by InfluxDB
+func influxValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Unix()
+	case time.Duration:
+		return v.Seconds()
 	}
-	return "default", fullName
+	return value
 }
 
 // Register device handler
@@ -0,0 +1,349 @@
+package influx
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/open-iot-devices/protobufs/go/openiot/sensor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/server/device"
+)
+
+// influxServer is local stand-in for InfluxDB /write endpoint
+type influxServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	failures int
+	status   int
+	lines    []string
+	requests []*http.Request
+}
+
+func newInfluxServer(failures int) *influxServer {
+	s := &influxServer{failures: failures, status: http.StatusInternalServerError}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reader io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			reader, _ = gzip.NewReader(r.Body)
+		}
+		body, _ := ioutil.ReadAll(reader)
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.requests = append(s.requests, r)
+		if s.failures > 0 {
+			s.failures--
+			http.Error(w, `{"error":"failed"}`, s.status)
+			return
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			s.lines = append(s.lines, line)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return s
+}
+
+func (s *influxServer) Lines() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.lines...)
+}
+
+func newTestHandler(t *testing.T, config influxDbConfig) *deviceHandler {
+	h := &deviceHandler{config: config}
+	require.NoError(t, h.start())
+	return h
+}
+
+// waitFor polls condition until it becomes true, fails test after 5 seconds
+func waitFor(t *testing.T, condition func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func sendTestMessages(t *testing.T, h *deviceHandler, count int) {
+	dev := &device.Device{ID: 0x1, IDhex: "0x1", DisplayName: "test"}
+	for i := 0; i < count; i++ {
+		msg := &sensor.MultiSensorStatus{
+			Temperature: &sensor.Temperature{ValueC: 20},
+			Uptime:      uint32(i),
+		}
+		require.NoError(t, h.ProcessMessage(dev, "", msg))
+	}
+}
+
+func TestBatchingAndRetry(t *testing.T) {
+	server := newInfluxServer(2)
+	defer server.Close()
+
+	h := newTestHandler(t, influxDbConfig{
+		Addr:          server.URL,
+		Database:      "test",
+		BatchSize:     4,
+		FlushInterval: "1h",
+		MaxRetryDelay: "10ms",
+	})
+	defer h.stop()
+
+	// 3 messages, 2 points each: batch size reached
+	sendTestMessages(t, h, 3)
+	waitFor(t, func() bool {
+		return len(server.Lines()) == 6
+	})
+	assert.Contains(t, server.Lines()[0], "device_id=0x1")
+}
+
+func TestRejectedBatchDropped(t *testing.T) {
+	// E.g. field type conflict: the same batch would be rejected forever
+	server := newInfluxServer(1)
+	server.status = http.StatusBadRequest
+	defer server.Close()
+
+	h := newTestHandler(t, influxDbConfig{
+		Addr:          server.URL,
+		Database:      "test",
+		BatchSize:     2,
+		FlushInterval: "1h",
+		MaxRetryDelay: "10ms",
+	})
+	sendTestMessages(t, h, 2)
+	h.stop()
+	assert.Len(t, server.Lines(), 2)
+	assert.Equal(t, uint64(2), h.dropped)
+}
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, retryable(errors.New("connection refused")))
+	assert.True(t, retryable(&statusError{code: http.StatusServiceUnavailable}))
+	assert.True(t, retryable(&statusError{code: http.StatusTooManyRequests}))
+	assert.False(t, retryable(&statusError{code: http.StatusBadRequest}))
+	assert.False(t, retryable(&statusError{code: http.StatusUnauthorized}))
+}
+
+func TestStopDrainsBuffer(t *testing.T) {
+	server := newInfluxServer(0)
+	defer server.Close()
+
+	h := newTestHandler(t, influxDbConfig{
+		Addr:          server.URL,
+		Database:      "test",
+		FlushInterval: "1h",
+	})
+	sendTestMessages(t, h, 2)
+	assert.Empty(t, server.Lines())
+
+	h.stop()
+	assert.Len(t, server.Lines(), 4)
+}
+
+func TestSpoolOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	spool := filepath.Join(dir, "spool.txt")
+
+	// InfluxDB is down
+	server := newInfluxServer(1000)
+	h := newTestHandler(t, influxDbConfig{
+		Addr:          server.URL,
+		Database:      "test",
+		BatchSize:     2,
+		BufferSize:    2,
+		FlushInterval: "1h",
+		SpoolFilename: spool,
+	})
+	sendTestMessages(t, h, 3)
+	h.stop()
+	server.Close()
+	raw, err := ioutil.ReadFile(spool)
+	require.NoError(t, err)
+	assert.Equal(t, 6, strings.Count(string(raw), "\n"))
+	assert.Zero(t, h.dropped)
+
+	// Back online: spooled points written
+	server = newInfluxServer(0)
+	defer server.Close()
+	h = newTestHandler(t, influxDbConfig{
+		Addr:          server.URL,
+		Database:      "test",
+		BatchSize:     2,
+		BufferSize:    2,
+		FlushInterval: "1h",
+		SpoolFilename: spool,
+	})
+	h.stop()
+	assert.Len(t, server.Lines(), 6)
+	raw, err = ioutil.ReadFile(spool)
+	require.NoError(t, err)
+	assert.Empty(t, raw)
+}
+
+func TestSpoolCorruptedLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	spool := filepath.Join(dir, "spool.txt")
+	lines := "m,device_id=0x1 v=1 1600000000000000000\n" +
+		"garbage\n" +
+		"m,device_id=0x1 v=2 1600000001000000000\n" +
+		"m,device_id=0x1 v=" // Partially written
+	require.NoError(t, ioutil.WriteFile(spool, []byte(lines), 0644))
+
+	server := newInfluxServer(0)
+	defer server.Close()
+	h := newTestHandler(t, influxDbConfig{
+		Addr:          server.URL,
+		Database:      "test",
+		FlushInterval: "1h",
+		SpoolFilename: spool,
+	})
+	h.stop()
+	assert.Len(t, server.Lines(), 2)
+	assert.Equal(t, uint64(2), h.dropped)
+	raw, err := ioutil.ReadFile(spool)
+	require.NoError(t, err)
+	assert.Empty(t, raw)
+}
+
+func TestLoadSpoolPartially(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	spool := filepath.Join(dir, "spool.txt")
+	lines := "m v=" + strings.Repeat("1", 2*maxSpoolLineSize) + " 1600000000000000000\n" +
+		"m,device_id=0x1 v=1 1600000000000000000\n" +
+		"m,device_id=0x1 v=2 1600000001000000000\n" +
+		"m,device_id=0x1 v=3 1600000002000000000\n" +
+		"m,device_id=0x1 v=4 1600000003000000000"
+	require.NoError(t, ioutil.WriteFile(spool, []byte(lines), 0644))
+
+	// Only what fits into buffer is loaded, too long line is skipped
+	h := &deviceHandler{config: influxDbConfig{SpoolFilename: spool}, bufferSize: 2}
+	assert.Equal(t, 2, h.loadSpool())
+	require.Len(t, h.points, 2)
+	assert.Equal(t, "m,device_id=0x1 v=2 1600000001000000000", h.points[1].String())
+	assert.Equal(t, uint64(1), h.dropped)
+	raw, err := ioutil.ReadFile(spool)
+	require.NoError(t, err)
+	assert.Equal(t, "m,device_id=0x1 v=3 1600000002000000000\nm,device_id=0x1 v=4 1600000003000000000\n", string(raw))
+	_, err = os.Stat(spool + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	// Rest
+	h.points = nil
+	assert.Equal(t, 2, h.loadSpool())
+	assert.Equal(t, "m,device_id=0x1 v=4 1600000003000000000", h.points[1].String())
+}
+
+func TestBufferOverflowDrops(t *testing.T) {
+	server := newInfluxServer(1000)
+	defer server.Close()
+
+	h := newTestHandler(t, influxDbConfig{
+		Addr:          server.URL,
+		Database:      "test",
+		BatchSize:     2,
+		BufferSize:    2,
+		FlushInterval: "1h",
+	})
+	sendTestMessages(t, h, 3)
+	h.stop()
+	assert.Equal(t, uint64(6), h.dropped)
+}
+
+func TestWriteModes(t *testing.T) {
+	server := newInfluxServer(0)
+	defer server.Close()
+
+	// 1.x
+	h := newTestHandler(t, influxDbConfig{
+		Addr:     server.URL,
+		Database: "test",
+		Username: "user",
+		Password: "pass",
+	})
+	sendTestMessages(t, h, 1)
+	h.stop()
+	require.Len(t, server.requests, 1)
+	req := server.requests[0]
+	assert.Equal(t, "/write", req.URL.Path)
+	assert.Equal(t, "test", req.URL.Query().Get("db"))
+	assert.Equal(t, "s", req.URL.Query().Get("precision"))
+	username, password, _ := req.BasicAuth()
+	assert.Equal(t, "user", username)
+	assert.Equal(t, "pass", password)
+
+	// 2.x, gzip
+	h = newTestHandler(t, influxDbConfig{
+		Addr:      server.URL,
+		Mode:      "v2",
+		Org:       "home",
+		Bucket:    "sensors",
+		Token:     "secret",
+		Precision: "ms",
+		Gzip:      true,
+	})
+	sendTestMessages(t, h, 1)
+	h.stop()
+	require.Len(t, server.requests, 2)
+	req = server.requests[1]
+	assert.Equal(t, "/api/v2/write", req.URL.Path)
+	assert.Equal(t, "home", req.URL.Query().Get("org"))
+	assert.Equal(t, "sensors", req.URL.Query().Get("bucket"))
+	assert.Equal(t, "ms", req.URL.Query().Get("precision"))
+	assert.Equal(t, "Token secret", req.Header.Get("Authorization"))
+	assert.Equal(t, "gzip", req.Header.Get("Content-Encoding"))
+
+	// Generic line protocol endpoint, nanoseconds by default
+	h = newTestHandler(t, influxDbConfig{
+		Addr: server.URL + "/api/v1/import/influx?extra=1",
+		Mode: "line_protocol",
+	})
+	sendTestMessages(t, h, 1)
+	h.stop()
+	require.Len(t, server.requests, 3)
+	req = server.requests[2]
+	assert.Equal(t, "/api/v1/import/influx", req.URL.Path)
+	assert.Equal(t, "1", req.URL.Query().Get("extra"))
+	assert.Empty(t, req.URL.Query().Get("precision"))
+
+	// Measurements grouped by first name component, same for all modes
+	lines := server.Lines()
+	require.Len(t, lines, 6)
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		require.Len(t, fields, 3)
+		timestampLen := map[int]int{0: 10, 1: 10, 2: 13, 3: 13, 4: 19, 5: 19}[i]
+		assert.Len(t, fields[2], timestampLen, line)
+	}
+	assert.Contains(t, strings.Join(lines, "\n"), "temperature,device_id=0x1,display_name=test value_c=20")
+}
+
+func TestWriteModesNegative(t *testing.T) {
+	configs := []influxDbConfig{
+		{Addr: "http://localhost", Mode: "v3"},
+		{Addr: "http://localhost", Mode: "v2", Bucket: "b"},
+		{Addr: "http://localhost", Precision: "m"},
+		{Addr: "localhost:8086"},
+	}
+	for _, config := range configs {
+		h := &deviceHandler{config: config}
+		assert.Error(t, h.start(), config)
+	}
+}
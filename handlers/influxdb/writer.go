@@ -0,0 +1,217 @@
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	influxdb "github.com/influxdata/influxdb1-client/v2"
+)
+
+// Supported output modes
+const (
+	// InfluxDB 1.x /write API: database, username / password
+	modeV1 = "v1"
+	// InfluxDB 2.x /api/v2/write API: org, bucket, token
+	modeV2 = "v2"
+	// Any endpoint accepting line protocol (VictoriaMetrics, QuestDB, Telegraf, etc),
+	// Addr is complete write URL
+	modeLineProtocol = "line_protocol"
+)
+
+const writeTimeout = 30 * time.Second
+
+// lineProtocolWriter writes batch of points as line protocol over HTTP
+type lineProtocolWriter struct {
+	url       string
+	precision string
+	gzip      bool
+	headers   http.Header
+	client    *http.Client
+}
+
+func newLineProtocolWriter(config *influxDbConfig) (*lineProtocolWriter, error) {
+	w := &lineProtocolWriter{
+		gzip:    config.Gzip,
+		headers: http.Header{},
+		client: &http.Client{
+			Timeout: writeTimeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
+			},
+		},
+	}
+
+	mode := config.Mode
+	if mode == "" {
+		mode = modeV1
+	}
+	// Precision, line protocol endpoints usually assume nanoseconds
+	w.precision = config.Precision
+	if w.precision == "" {
+		w.precision = "s"
+		if mode == modeLineProtocol {
+			w.precision = "ns"
+		}
+	}
+	switch w.precision {
+	case "ns", "us", "ms", "s":
+	default:
+		return nil, fmt.Errorf("Invalid precision '%s', supported: ns, us, ms, s", w.precision)
+	}
+
+	parsed, err := url.Parse(config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("Invalid addr '%s': http(s) URL expected", config.Addr)
+	}
+	params := parsed.Query()
+
+	switch mode {
+	case modeV1:
+		parsed.Path = strings.TrimSuffix(parsed.Path, "/") + "/write"
+		params.Set("db", config.Database)
+		// 1.x uses "u" for microseconds
+		params.Set("precision", strings.Replace(w.precision, "us", "u", 1))
+		if config.Username != "" {
+			w.headers.Set("Authorization", basicAuth(config.Username, config.Password))
+		}
+	case modeV2:
+		if config.Org == "" || config.Bucket == "" {
+			return nil, fmt.Errorf("org and bucket are required for %s mode", modeV2)
+		}
+		parsed.Path = strings.TrimSuffix(parsed.Path, "/") + "/api/v2/write"
+		params.Set("org", config.Org)
+		params.Set("bucket", config.Bucket)
+		params.Set("precision", w.precision)
+		if config.Token != "" {
+			w.headers.Set("Authorization", "Token "+config.Token)
+		}
+	case modeLineProtocol:
+		// Only pass precision when explicitly configured, not all endpoints know it
+		if config.Precision != "" {
+			params.Set("precision", w.precision)
+		}
+		if config.Token != "" {
+			w.headers.Set("Authorization", "Bearer "+config.Token)
+		} else if config.Username != "" {
+			w.headers.Set("Authorization", basicAuth(config.Username, config.Password))
+		}
+	default:
+		return nil, fmt.Errorf("Unknown mode '%s', supported: %s, %s, %s",
+			config.Mode, modeV1, modeV2, modeLineProtocol)
+	}
+	parsed.RawQuery = params.Encode()
+	w.url = parsed.String()
+
+	userAgent := config.UserAgent
+	if userAgent == "" {
+		userAgent = "OpenIoTServer"
+	}
+	w.headers.Set("User-Agent", userAgent)
+	w.headers.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.gzip {
+		w.headers.Set("Content-Encoding", "gzip")
+	}
+
+	return w, nil
+}
+
+// Write sends batch of points in single HTTP request
+func (w *lineProtocolWriter) Write(points []*influxdb.Point) error {
+	var body bytes.Buffer
+	var err error
+	if w.gzip {
+		gz := gzip.NewWriter(&body)
+		err = w.encode(gz, points)
+		if closeErr := gz.Close(); err == nil {
+			err = closeErr
+		}
+	} else {
+		err = w.encode(&body, points)
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, &body)
+	if err != nil {
+		return err
+	}
+	for name, values := range w.headers {
+		req.Header[name] = values
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &statusError{
+			code:    resp.StatusCode,
+			message: fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(msg))),
+		}
+	}
+
+	return nil
+}
+
+func (w *lineProtocolWriter) encode(writer io.Writer, points []*influxdb.Point) error {
+	// models package uses "n" / "u" for nano / micro seconds
+	precision := w.precision
+	switch precision {
+	case "ns":
+		precision = "n"
+	case "us":
+		precision = "u"
+	}
+	for _, point := range points {
+		if _, err := fmt.Fprintf(writer, "%s\n", point.PrecisionString(precision)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statusError is non 2xx response of write endpoint
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// retryable tells whether failed write may succeed later: network errors,
+// server errors and rate limiting. Other client errors (malformed points,
+// field type conflicts, etc) would fail the same way forever.
+func retryable(err error) bool {
+	if status, ok := err.(*statusError); ok {
+		return status.code >= 500 || status.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// Close releases idle connections
+func (w *lineProtocolWriter) Close() {
+	w.client.CloseIdleConnections()
+}
+
+func basicAuth(username, password string) string {
+	req := &http.Request{Header: http.Header{}}
+	req.SetBasicAuth(username, password)
+	return req.Header.Get("Authorization")
+}
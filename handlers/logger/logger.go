@@ -27,7 +27,12 @@ func (h *deviceHandler) AddDevice(device *device.Device) {
 
 }
 
-func (h *deviceHandler) ProcessMessage(device *device.Device, msg proto.Message) error {
+func (h *deviceHandler) RemoveDevice(device *device.Device) {
+
+}
+
+func (h *deviceHandler) ProcessMessage(device *device.Device, msgType string, msg proto.Message) error {
+	glog.Infof("%s: %s", device.DisplayName, msgType)
 	// Extract and log all proto field name/value pairs
 	for name, value := range utils.ExtractAllNameValuesFromProtobuf(msg) {
 		glog.Infof("%v: %v", name, value)
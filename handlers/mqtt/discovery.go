@@ -0,0 +1,113 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/open-iot-devices/server/utils"
+	"github.com/open-iot-devices/server/utils/schema"
+)
+
+// Home Assistant MQTT discovery, see
+// https://www.home-assistant.io/docs/mqtt/discovery/
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+}
+
+type discoveryAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type discoveryConfig struct {
+	Name              string                  `json:"name"`
+	UniqueID          string                  `json:"unique_id"`
+	StateTopic        string                  `json:"state_topic"`
+	Availability      []discoveryAvailability `json:"availability"`
+	AvailabilityMode  string                  `json:"availability_mode"`
+	UnitOfMeasurement string                  `json:"unit_of_measurement,omitempty"`
+	PayloadOn         string                  `json:"payload_on,omitempty"`
+	PayloadOff        string                  `json:"payload_off,omitempty"`
+	Device            discoveryDevice         `json:"device"`
+}
+
+// publishDiscovery publishes HA discovery config for every scalar field
+// of all device message types
+func (h *deviceHandler) publishDiscovery(state *mqttDevice) error {
+	if h.config.Format == formatJSON {
+		return fmt.Errorf("discovery requires per field topics (format fields or both)")
+	}
+	dev := state.dev
+	nodeID := "openiot_" + strings.TrimPrefix(dev.IDhex, "0x")
+
+	// Fields of all message types, sorted to be deterministic
+	msgTypes := []string{dev.ProtobufName}
+	for _, name := range dev.MessageTypes {
+		msgTypes = append(msgTypes, name)
+	}
+	fields := map[string]protoreflect.FieldDescriptor{}
+	for _, msgType := range msgTypes {
+		desc := schema.FindMessageDescriptor(msgType)
+		if desc == nil {
+			return fmt.Errorf("Protobuf '%s' is not registered", msgType)
+		}
+		for _, field := range utils.ListFlattenedFields(desc, flattenOptions) {
+			fields[field.Name] = field.Field
+		}
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var topics []string
+	for _, name := range names {
+		field := fields[name]
+		objectID := strings.Replace(name, ".", "_", -1)
+		config := &discoveryConfig{
+			Name:       fmt.Sprintf("%s %s", dev.DisplayName, name),
+			UniqueID:   nodeID + "_" + objectID,
+			StateTopic: state.topic + "/" + fieldTopic(name),
+			Availability: []discoveryAvailability{
+				{Topic: h.statusTopic()},
+				{Topic: state.topic + "/availability"},
+			},
+			AvailabilityMode:  "all",
+			UnitOfMeasurement: utils.GetFieldUnit(field),
+			Device: discoveryDevice{
+				Identifiers:  []string{nodeID},
+				Name:         dev.DisplayName,
+				Manufacturer: dev.Manufacturer,
+				Model:        dev.Name,
+			},
+		}
+		component := "sensor"
+		if field != nil && field.Kind() == protoreflect.BoolKind {
+			component = "binary_sensor"
+			config.PayloadOn = "true"
+			config.PayloadOff = "false"
+		}
+		payload, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		topic := fmt.Sprintf("%s/%s/%s/%s/config", h.config.DiscoveryPrefix, component, nodeID, objectID)
+		if err := h.publish(topic, true, payload); err != nil {
+			return err
+		}
+		topics = append(topics, topic)
+	}
+	h.mutex.Lock()
+	state.discoveryTopics = topics
+	h.mutex.Unlock()
+
+	return nil
+}
@@ -0,0 +1,554 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"gopkg.in/yaml.v2"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/processor"
+	"github.com/open-iot-devices/server/utils"
+	"github.com/open-iot-devices/server/utils/schema"
+)
+
+const handlerName = "mqtt"
+
+// Max amount of QoS 1/2 publishes and (un)subscribes waiting for broker
+// acknowledgement to be checked, results of ones above the limit are not logged
+const maxPendingTokens = 1000
+
+// Max amount of commands waiting for main loop, commands above the limit are dropped
+const maxQueuedCommands = 100
+
+// Message publish formats
+const (
+	formatJSON   = "json"
+	formatFields = "fields"
+	formatBoth   = "both"
+)
+
+type mqttConfig struct {
+	Enabled  bool
+	Broker   string
+	ClientID string `yaml:"client_id,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	QoS      byte   `yaml:"qos,omitempty"`
+	Retain   bool   `yaml:"retain,omitempty"`
+
+	// Device topics are <topic_prefix>/<device id> unless overridden in devices
+	TopicPrefix string `yaml:"topic_prefix,omitempty"`
+	// json: whole message as JSON to <device topic>/json/<protobuf name>
+	// fields: every flattened value to own topic, e.g. <device topic>/temperature/value_c
+	// both (default)
+	Format string `yaml:"format,omitempty"`
+	// Home Assistant MQTT discovery
+	Discovery       bool   `yaml:"discovery,omitempty"`
+	DiscoveryPrefix string `yaml:"discovery_prefix,omitempty"`
+	// Device is reported offline when no messages received within timeout
+	AvailabilityTimeout string `yaml:"availability_timeout,omitempty"`
+
+	// Per device overrides, keyed by device id, e.g. "0x1234"
+	Devices map[string]*deviceConfig `yaml:"devices,omitempty"`
+}
+
+type deviceConfig struct {
+	Topic string `yaml:"topic,omitempty"`
+	// Protobuf name of message sent to device from <device topic>/command
+	CommandType string `yaml:"command_type,omitempty"`
+}
+
+// pendingToken is broker operation (e.g. "publish to <topic>") waiting for acknowledgement
+type pendingToken struct {
+	operation string
+	token     paho.Token
+}
+
+// Command is command received from broker. It is run by main loop,
+// so it doesn't race with message processing.
+type Command struct {
+	handler *deviceHandler
+	topic   string
+	payload []byte
+}
+
+var commandQueue = make(chan *Command, maxQueuedCommands)
+
+// Queue returns channel of received commands, they must be run using Command.Run()
+func Queue() <-chan *Command {
+	return commandQueue
+}
+
+// Run converts command into protobuf message and sends it to device
+func (c *Command) Run() {
+	if err := c.handler.processCommand(c.topic, c.payload); err != nil {
+		glog.Infof("MQTT: command %s failed: %v", c.topic, err)
+	}
+}
+
+// mqttDevice is device state tracked by handler
+type mqttDevice struct {
+	dev      *device.Device
+	topic    string
+	lastSeen time.Time
+	online   bool
+	// Retained discovery config topics, cleared once device removed
+	discoveryTopics []string
+}
+
+type deviceHandler struct {
+	config              mqttConfig
+	availabilityTimeout time.Duration
+
+	client paho.Client
+	// Allows to replace broker in tests
+	publish func(topic string, retained bool, payload []byte) error
+
+	mutex   sync.Mutex
+	devices map[uint64]*mqttDevice
+
+	// Operations waiting for broker acknowledgement
+	pendingCh chan *pendingToken
+	doneCh    chan struct{}
+	wg        sync.WaitGroup
+}
+
+var flagConfigFilename = flag.String("config.mqtt", ".config/mqtt.yaml", "MQTT config filename")
+
+// Every element of repeated field gets own topic, enums are published as names
+var flattenOptions = utils.FlattenOptions{SplitRepeated: true, EnumNames: true}
+
+func newDeviceHandler() *deviceHandler {
+	return &deviceHandler{
+		devices: map[uint64]*mqttDevice{},
+	}
+}
+
+func (h *deviceHandler) GetName() string {
+	return handlerName
+}
+
+func (h *deviceHandler) Start() error {
+	// Load configuration
+	reader, err := os.Open(*flagConfigFilename)
+	if err != nil {
+		// This is not fatal error, continue
+		glog.Infof("Unable to load config: %v, MQTT disabled.", err)
+		return nil
+	}
+	defer reader.Close()
+	decoder := yaml.NewDecoder(reader)
+	decoder.SetStrict(true)
+	if err := decoder.Decode(&h.config); err != nil {
+		return err
+	}
+	if !h.config.Enabled {
+		glog.Infof("MQTT disabled")
+		return nil
+	}
+	if err := h.setDefaults(); err != nil {
+		return err
+	}
+
+	// Server status topic is used as Last Will: broker reports
+	// server offline when connection lost
+	options := paho.NewClientOptions()
+	options.AddBroker(h.config.Broker)
+	options.SetClientID(h.config.ClientID)
+	options.SetUsername(h.config.Username)
+	options.SetPassword(h.config.Password)
+	options.SetWill(h.statusTopic(), "offline", h.config.QoS, true)
+	options.SetAutoReconnect(true)
+	options.SetOnConnectHandler(h.onConnect)
+	options.SetConnectionLostHandler(func(client paho.Client, err error) {
+		glog.Infof("MQTT: connection lost: %v", err)
+	})
+	h.client = paho.NewClient(options)
+	h.publish = h.publishToBroker
+
+	h.pendingCh = make(chan *pendingToken, maxPendingTokens)
+	h.doneCh = make(chan struct{})
+	h.wg.Add(2)
+	go h.run()
+	go h.checkTokens()
+
+	return nil
+}
+
+func (h *deviceHandler) Stop() {
+	if h.client == nil {
+		return
+	}
+	close(h.doneCh)
+	h.wg.Wait()
+	if h.client.IsConnected() {
+		h.publish(h.statusTopic(), true, []byte("offline"))
+		h.client.Disconnect(250)
+	}
+}
+
+// setDefaults validates config and fills default values
+func (h *deviceHandler) setDefaults() error {
+	if h.config.Broker == "" {
+		return fmt.Errorf("MQTT: broker is required, e.g. tcp://localhost:1883")
+	}
+	if h.config.ClientID == "" {
+		h.config.ClientID = "openiot-server"
+	}
+	if h.config.TopicPrefix == "" {
+		h.config.TopicPrefix = "openiot"
+	}
+	h.config.TopicPrefix = strings.TrimSuffix(h.config.TopicPrefix, "/")
+	if h.config.DiscoveryPrefix == "" {
+		h.config.DiscoveryPrefix = "homeassistant"
+	}
+	switch h.config.Format {
+	case "":
+		h.config.Format = formatBoth
+	case formatJSON, formatFields, formatBoth:
+	default:
+		return fmt.Errorf("MQTT: unknown format '%s'", h.config.Format)
+	}
+	if h.config.QoS > 2 {
+		return fmt.Errorf("MQTT: invalid qos %d", h.config.QoS)
+	}
+	h.availabilityTimeout = time.Hour
+	if h.config.AvailabilityTimeout != "" {
+		timeout, err := time.ParseDuration(h.config.AvailabilityTimeout)
+		if err != nil {
+			return fmt.Errorf("MQTT: availability_timeout: %v", err)
+		}
+		h.availabilityTimeout = timeout
+	}
+	return nil
+}
+
+// run keeps connection to broker (initial connect is retried until success)
+// and periodically updates devices availability.
+func (h *deviceHandler) run() {
+	defer h.wg.Done()
+
+	for delay := time.Second; ; {
+		token := h.client.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			break
+		}
+		glog.Infof("MQTT: unable to connect to %s: %v, retry in %s", h.config.Broker, token.Error(), delay)
+		select {
+		case <-time.After(delay):
+		case <-h.doneCh:
+			return
+		}
+		if delay < time.Minute {
+			delay *= 2
+		}
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			h.checkAvailability(now)
+		case <-h.doneCh:
+			return
+		}
+	}
+}
+
+// onConnect is called on every (re)connect: publishes server status,
+// discovery configs / availability of known devices and subscribes to commands
+func (h *deviceHandler) onConnect(client paho.Client) {
+	glog.Infof("MQTT: connected to %s", h.config.Broker)
+	h.publish(h.statusTopic(), true, []byte("online"))
+
+	h.mutex.Lock()
+	devices := make([]*mqttDevice, 0, len(h.devices))
+	for _, state := range h.devices {
+		devices = append(devices, state)
+	}
+	h.mutex.Unlock()
+
+	for _, state := range devices {
+		h.announceDevice(state)
+	}
+}
+
+// publishToBroker doesn't wait for broker acknowledgement (QoS 1/2),
+// failed publishes are logged by checkTokens
+func (h *deviceHandler) publishToBroker(topic string, retained bool, payload []byte) error {
+	if !h.client.IsConnected() {
+		return fmt.Errorf("MQTT: not connected")
+	}
+	token := h.client.Publish(topic, h.config.QoS, retained, payload)
+	// QoS 0 tokens complete immediately
+	if h.config.QoS == 0 {
+		return token.Error()
+	}
+	h.checkLater("publish to "+topic, token)
+	return nil
+}
+
+// checkLater passes token to checkTokens, so caller doesn't wait for broker
+func (h *deviceHandler) checkLater(operation string, token paho.Token) {
+	select {
+	case h.pendingCh <- &pendingToken{operation: operation, token: token}:
+	default:
+	}
+}
+
+// checkTokens waits for acknowledgements of broker operations and logs failed ones
+func (h *deviceHandler) checkTokens() {
+	defer h.wg.Done()
+
+	for {
+		select {
+		case pending := <-h.pendingCh:
+			if !pending.token.WaitTimeout(10 * time.Second) {
+				glog.Infof("MQTT: %s timed out", pending.operation)
+			} else if err := pending.token.Error(); err != nil {
+				glog.Infof("MQTT: %s failed: %v", pending.operation, err)
+			}
+		case <-h.doneCh:
+			return
+		}
+	}
+}
+
+func (h *deviceHandler) AddDevice(dev *device.Device) {
+	state := h.trackDevice(dev)
+	// Otherwise device will be announced once connected
+	if h.publish != nil && (h.client == nil || h.client.IsConnected()) {
+		h.announceDevice(state)
+	}
+}
+
+// RemoveDevice clears retained discovery configs / availability of device
+// and unsubscribes from its commands
+func (h *deviceHandler) RemoveDevice(dev *device.Device) {
+	h.mutex.Lock()
+	state, ok := h.devices[dev.ID]
+	delete(h.devices, dev.ID)
+	h.mutex.Unlock()
+	if !ok || h.publish == nil {
+		return
+	}
+	if h.client != nil && !h.client.IsConnected() {
+		glog.Infof("0x%x: MQTT not connected, retained topics of removed device left as is", dev.ID)
+		return
+	}
+
+	// Empty retained message deletes retained one
+	h.mutex.Lock()
+	topics := append([]string{state.topic + "/availability"}, state.discoveryTopics...)
+	h.mutex.Unlock()
+	for _, topic := range topics {
+		if err := h.publish(topic, true, nil); err != nil {
+			glog.Infof("0x%x: MQTT: unable to clear %s: %v", dev.ID, topic, err)
+		}
+	}
+
+	if h.client != nil {
+		token := h.client.Unsubscribe(state.topic+"/command", state.topic+"/command/+")
+		h.checkLater("unsubscribe from "+state.topic+"/command", token)
+	}
+}
+
+// trackDevice returns device state, creates it if needed
+func (h *deviceHandler) trackDevice(dev *device.Device) *mqttDevice {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	state, ok := h.devices[dev.ID]
+	if !ok {
+		state = &mqttDevice{
+			dev:      dev,
+			topic:    h.deviceTopic(dev),
+			lastSeen: time.Now(),
+		}
+		h.devices[dev.ID] = state
+	}
+	return state
+}
+
+// announceDevice publishes discovery configs / availability and subscribes to commands
+func (h *deviceHandler) announceDevice(state *mqttDevice) {
+	if h.config.Discovery {
+		if err := h.publishDiscovery(state); err != nil {
+			glog.Infof("0x%x: MQTT discovery failed: %v", state.dev.ID, err)
+		}
+	}
+	h.mutex.Lock()
+	online := state.online
+	h.mutex.Unlock()
+	if online {
+		h.publish(state.topic+"/availability", true, []byte("online"))
+	}
+
+	if h.client != nil && h.client.IsConnected() {
+		topics := map[string]byte{
+			state.topic + "/command":   h.config.QoS,
+			state.topic + "/command/+": h.config.QoS,
+		}
+		token := h.client.SubscribeMultiple(topics, func(client paho.Client, msg paho.Message) {
+			h.enqueueCommand(msg.Topic(), msg.Payload())
+		})
+		h.checkLater("subscribe to "+state.topic+"/command", token)
+	}
+}
+
+func (h *deviceHandler) ProcessMessage(dev *device.Device, msgType string, msg proto.Message) error {
+	if h.publish == nil {
+		return nil
+	}
+	state := h.trackDevice(dev)
+	h.mutex.Lock()
+	state.lastSeen = time.Now()
+	wasOnline := state.online
+	state.online = true
+	h.mutex.Unlock()
+	if !wasOnline {
+		h.publish(state.topic+"/availability", true, []byte("online"))
+	}
+
+	if h.config.Format == formatJSON || h.config.Format == formatBoth {
+		payload, err := protojson.Marshal(proto.MessageV2(msg))
+		if err != nil {
+			return err
+		}
+		if err := h.publish(state.topic+"/json/"+msgType, h.config.Retain, payload); err != nil {
+			return err
+		}
+	}
+	if h.config.Format == formatFields || h.config.Format == formatBoth {
+		for name, value := range utils.FlattenProtobuf(msg, flattenOptions) {
+			topic := state.topic + "/" + fieldTopic(name)
+			if err := h.publish(topic, h.config.Retain, []byte(formatValue(value))); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkAvailability reports devices without recent messages as offline
+func (h *deviceHandler) checkAvailability(now time.Time) {
+	var offline []*mqttDevice
+	h.mutex.Lock()
+	for _, state := range h.devices {
+		if state.online && now.Sub(state.lastSeen) > h.availabilityTimeout {
+			state.online = false
+			offline = append(offline, state)
+		}
+	}
+	h.mutex.Unlock()
+
+	for _, state := range offline {
+		glog.Infof("0x%x: no messages for %s, reporting offline", state.dev.ID, h.availabilityTimeout)
+		h.publish(state.topic+"/availability", true, []byte("offline"))
+	}
+}
+
+// enqueueCommand passes command to main loop. It doesn't block, since main loop
+// may wait for broker itself, command is dropped when queue is full.
+func (h *deviceHandler) enqueueCommand(topic string, payload []byte) {
+	select {
+	case commandQueue <- &Command{handler: h, topic: topic, payload: payload}:
+	default:
+		glog.Infof("MQTT: command queue is full, %s dropped", topic)
+	}
+}
+
+// processCommand converts JSON command into protobuf message and sends it to device.
+// Must be called from main loop (see Queue).
+// Message type is taken from topic (<device topic>/command/<protobuf name>) or
+// device's command_type.
+func (h *deviceHandler) processCommand(topic string, payload []byte) error {
+	var state *mqttDevice
+	var msgType string
+	h.mutex.Lock()
+	for _, candidate := range h.devices {
+		prefix := candidate.topic + "/command"
+		if topic == prefix {
+			state = candidate
+			if config := h.config.Devices[candidate.dev.IDhex]; config != nil {
+				msgType = config.CommandType
+			}
+			break
+		}
+		if strings.HasPrefix(topic, prefix+"/") {
+			state = candidate
+			msgType = strings.TrimPrefix(topic, prefix+"/")
+			break
+		}
+	}
+	h.mutex.Unlock()
+
+	if state == nil {
+		return fmt.Errorf("no device for topic")
+	}
+	if msgType == "" {
+		return fmt.Errorf("0x%x: command type is not configured", state.dev.ID)
+	}
+	msg := schema.NewMessage(msgType)
+	if msg == nil {
+		return fmt.Errorf("0x%x: Protobuf '%s' is not registered", state.dev.ID, msgType)
+	}
+	if err := protojson.Unmarshal(payload, proto.MessageV2(msg)); err != nil {
+		return fmt.Errorf("0x%x: invalid command: %v", state.dev.ID, err)
+	}
+	if err := processor.SendMessage(state.dev, msg); err != nil {
+		return err
+	}
+	glog.Infof("0x%x: MQTT command %s sent", state.dev.ID, msgType)
+
+	return nil
+}
+
+// Topics //
+
+func (h *deviceHandler) statusTopic() string {
+	return h.config.TopicPrefix + "/status"
+}
+
+func (h *deviceHandler) deviceTopic(dev *device.Device) string {
+	if config := h.config.Devices[dev.IDhex]; config != nil && config.Topic != "" {
+		return strings.TrimSuffix(config.Topic, "/")
+	}
+	return h.config.TopicPrefix + "/" + dev.IDhex
+}
+
+// fieldTopic converts flattened field name into topic: "temperature.value_c" -> "temperature/value_c"
+func fieldTopic(name string) string {
+	return strings.Replace(name, ".", "/", -1)
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case time.Duration:
+		return fmt.Sprint(v.Seconds())
+	case []interface{}:
+		raw, _ := json.Marshal(v)
+		return string(raw)
+	}
+	return fmt.Sprint(value)
+}
+
+// Register device handler
+func init() {
+	device.MustAddHandler(newDeviceHandler())
+}
@@ -0,0 +1,170 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/protobufs/go/openiot/sensor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/encode"
+)
+
+type mockTransport struct {
+	history [][]byte
+}
+
+func (m *mockTransport) GetName() string        { return "mock" }
+func (m *mockTransport) GetTypeName() string    { return "mock" }
+func (m *mockTransport) Start() error           { return nil }
+func (m *mockTransport) Stop()                  {}
+func (m *mockTransport) Receive() <-chan []byte { return nil }
+func (m *mockTransport) Send(packet []byte) error {
+	m.history = append(m.history, packet)
+	return nil
+}
+
+// newTestHandler creates handler with "broker" recording all published messages
+func newTestHandler(t *testing.T, config mqttConfig) (*deviceHandler, map[string]string) {
+	published := map[string]string{}
+	h := newDeviceHandler()
+	h.config = config
+	require.NoError(t, h.setDefaults())
+	h.publish = func(topic string, retained bool, payload []byte) error {
+		published[topic] = string(payload)
+		return nil
+	}
+	return h, published
+}
+
+func newTestDevice() *device.Device {
+	dev := device.NewDevice(0x1234)
+	dev.DisplayName = "kitchen"
+	dev.ProtobufName = string(proto.MessageReflect(&sensor.MultiSensorStatus{}).Descriptor().FullName())
+	dev.EncryptionType = openiot.EncryptionType_PLAIN
+	dev.SetTransport(&mockTransport{})
+	return dev
+}
+
+func TestPublishMessage(t *testing.T) {
+	h, published := newTestHandler(t, mqttConfig{Broker: "tcp://localhost:1883"})
+	dev := newTestDevice()
+
+	msg := &sensor.MultiSensorStatus{
+		Temperature: &sensor.Temperature{ValueC: 21.5},
+		Uptime:      100,
+	}
+	require.NoError(t, h.ProcessMessage(dev, dev.ProtobufName, msg))
+
+	assert.Equal(t, "online", published["openiot/0x1234/availability"])
+	assert.Equal(t, "21.5", published["openiot/0x1234/temperature/value_c"])
+	assert.Equal(t, "100", published["openiot/0x1234/uptime"])
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(published["openiot/0x1234/json/"+dev.ProtobufName]), &decoded))
+	assert.Equal(t, float64(100), decoded["uptime"])
+
+	// No messages for too long: offline
+	h.checkAvailability(time.Now().Add(30 * time.Minute))
+	assert.Equal(t, "online", published["openiot/0x1234/availability"])
+	h.checkAvailability(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, "offline", published["openiot/0x1234/availability"])
+}
+
+func TestDiscovery(t *testing.T) {
+	h, published := newTestHandler(t, mqttConfig{
+		Broker:    "tcp://localhost:1883",
+		Discovery: true,
+		Devices: map[string]*deviceConfig{
+			"0x1234": {Topic: "home/kitchen/"},
+		},
+	})
+	dev := newTestDevice()
+	h.AddDevice(dev)
+
+	raw, ok := published["homeassistant/sensor/openiot_1234/temperature_value_c/config"]
+	require.True(t, ok, "discovery config not published: %v", published)
+	config := &discoveryConfig{}
+	require.NoError(t, json.Unmarshal([]byte(raw), config))
+	assert.Equal(t, "home/kitchen/temperature/value_c", config.StateTopic)
+	assert.Equal(t, "openiot_1234_temperature_value_c", config.UniqueID)
+	assert.Equal(t, "kitchen", config.Device.Name)
+	require.Len(t, config.Availability, 2)
+	assert.Equal(t, "openiot/status", config.Availability[0].Topic)
+	assert.Equal(t, "home/kitchen/availability", config.Availability[1].Topic)
+	assert.Contains(t, published, "homeassistant/sensor/openiot_1234/uptime/config")
+
+	// Retained topics are cleared once device removed
+	h.RemoveDevice(dev)
+	assert.Equal(t, "", published["homeassistant/sensor/openiot_1234/temperature_value_c/config"])
+	assert.Equal(t, "", published["homeassistant/sensor/openiot_1234/uptime/config"])
+	assert.Equal(t, "", published["home/kitchen/availability"])
+	assert.NotContains(t, h.devices, dev.ID)
+}
+
+func TestCommand(t *testing.T) {
+	h, _ := newTestHandler(t, mqttConfig{
+		Broker: "tcp://localhost:1883",
+		Devices: map[string]*deviceConfig{
+			"0x1234": {CommandType: "openiot.JoinResponse"},
+		},
+	})
+	dev := newTestDevice()
+	h.AddDevice(dev)
+	tr := dev.Transport().(*mockTransport)
+
+	// Type from device config / from topic
+	require.NoError(t, h.processCommand("openiot/0x1234/command", []byte(`{"name": "srv", "timestamp": "5"}`)))
+	require.NoError(t, h.processCommand("openiot/0x1234/command/openiot.JoinResponse", []byte(`{"name": "srv2"}`)))
+	require.Len(t, tr.history, 2)
+
+	// Decode downlink
+	buf := bytes.NewBuffer(tr.history[1])
+	hdr := &openiot.Header{}
+	require.NoError(t, encode.ReadSingleMessage(buf, hdr))
+	assert.Equal(t, dev.ID, hdr.DeviceId)
+	info := &openiot.MessageInfo{}
+	require.NoError(t, encode.ReadSingleMessage(buf, info))
+	assert.Equal(t, uint32(2), info.Sequence)
+	resp := &openiot.JoinResponse{}
+	require.NoError(t, encode.ReadSingleMessage(buf, resp))
+	assert.Equal(t, "srv2", resp.Name)
+
+	// Negative
+	assert.Error(t, h.processCommand("openiot/0x9999/command", []byte(`{}`)))
+	assert.Error(t, h.processCommand("openiot/0x1234/command/openiot.Unknown", []byte(`{}`)))
+	assert.Error(t, h.processCommand("openiot/0x1234/command", []byte(`{"unknown_field": 1}`)))
+}
+
+func TestCommandQueue(t *testing.T) {
+	h, _ := newTestHandler(t, mqttConfig{Broker: "tcp://localhost:1883"})
+	dev := newTestDevice()
+	h.AddDevice(dev)
+	tr := dev.Transport().(*mockTransport)
+
+	// Commands are run by main loop only
+	h.enqueueCommand("openiot/0x1234/command/openiot.JoinResponse", []byte(`{"name": "srv"}`))
+	select {
+	case command := <-Queue():
+		assert.Empty(t, tr.history)
+		command.Run()
+	case <-time.After(5 * time.Second):
+		t.Fatal("command not queued")
+	}
+	assert.Len(t, tr.history, 1)
+	assert.Equal(t, uint32(1), dev.SequenceSend)
+
+	// Full queue doesn't block, commands are dropped
+	for i := 0; i < maxQueuedCommands+1; i++ {
+		h.enqueueCommand("openiot/0x1234/command/openiot.JoinResponse", []byte(`{"name": "srv"}`))
+	}
+	assert.Len(t, commandQueue, maxQueuedCommands)
+	for len(commandQueue) > 0 {
+		<-commandQueue
+	}
+}
@@ -0,0 +1,245 @@
+package prometheus
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/utils"
+	"github.com/open-iot-devices/server/utils/metrics"
+)
+
+const handlerName = "prometheus"
+
+// All device values are exposed as gauges named openiot_device_<measurement>_<field>_<unit>,
+// with field metadata applied (see utils.ExtractMeasurements), e.g. "temperature.value_c"
+// -> openiot_device_temperature_value_c. Top level fields have no measurement prefix,
+// tag fields become labels of measurement's gauges.
+const metricPrefix = "openiot_device_"
+
+var labelNames = []string{"device_id", "display_name"}
+
+var flagMaxElements = flag.Int("prometheus.max_elements", 10,
+	"Max amount of elements of repeated / map field exposed as gauges, 0 means no limit")
+var flagMaxGauges = flag.Int("prometheus.max_gauges", 1000,
+	"Max amount of gauges created from device values, 0 means no limit")
+
+// gauge is device value gauge, labeled by device and measurement tags
+type gauge struct {
+	*metrics.Gauge
+	// Sorted tag names, labels after device ones
+	tags []string
+}
+
+type deviceHandler struct {
+	mutex sync.Mutex
+	// Gauges created so far, keyed by metric name
+	gauges map[string]*gauge
+	// Last known display name of device, to remove stale series on rename
+	displayNames map[string]string
+	// Gauge names skipped because of prometheus.max_gauges / tags mismatch, logged once
+	skipped map[string]bool
+
+	lastSeen *metrics.Gauge
+}
+
+func newDeviceHandler() *deviceHandler {
+	return &deviceHandler{
+		gauges:       map[string]*gauge{},
+		displayNames: map[string]string{},
+		skipped:      map[string]bool{},
+		lastSeen: metrics.NewGauge(metricPrefix+"last_seen_timestamp_seconds",
+			"Time of last message received from device", labelNames...),
+	}
+}
+
+func (h *deviceHandler) GetName() string {
+	return handlerName
+}
+
+func (h *deviceHandler) Start() error {
+	return nil
+}
+
+func (h *deviceHandler) Stop() {
+}
+
+func (h *deviceHandler) AddDevice(device *device.Device) {
+
+}
+
+// RemoveDevice drops all series of device
+func (h *deviceHandler) RemoveDevice(device *device.Device) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.deleteDevice(device.IDhex)
+	delete(h.displayNames, device.IDhex)
+}
+
+func (h *deviceHandler) ProcessMessage(device *device.Device, msgType string, msg proto.Message) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// Device renamed: drop series with old name
+	if name, ok := h.displayNames[device.IDhex]; ok && name != device.DisplayName {
+		h.deleteDevice(device.IDhex)
+	}
+	h.displayNames[device.IDhex] = device.DisplayName
+
+	// Every element of repeated field is own series, enum names are not numbers so skipped
+	for _, measurement := range utils.ExtractMeasurements(msg, *flagMaxElements) {
+		tags := make([]string, 0, len(measurement.Tags))
+		for name := range measurement.Tags {
+			tags = append(tags, name)
+		}
+		sort.Strings(tags)
+		labelValues := []string{device.IDhex, device.DisplayName}
+		for _, name := range tags {
+			labelValues = append(labelValues, measurement.Tags[name])
+		}
+
+		for name, value := range measurement.Fields {
+			number, ok := gaugeValue(value)
+			if !ok {
+				continue
+			}
+			if gauge := h.gauge(gaugeName(measurement, name), tags); gauge != nil {
+				gauge.Set(number, labelValues...)
+			}
+		}
+	}
+	h.lastSeen.Set(float64(time.Now().Unix()), device.IDhex, device.DisplayName)
+
+	return nil
+}
+
+// gaugeName returns name of measurement field with unit suffix, e.g. "battery.voltage_v"
+func gaugeName(measurement *utils.Measurement, field string) string {
+	name := field
+	if measurement.Name != utils.DefaultMeasurement {
+		name = measurement.Name + "." + field
+	}
+	unit := strings.Trim(metrics.SanitizeName(measurement.Units[field]), "_")
+	if unit != "" && !strings.HasSuffix(metrics.SanitizeName(name), "_"+unit) {
+		name += "_" + unit
+	}
+	return name
+}
+
+// gauge returns gauge for field name with tags as extra labels, creates it if needed.
+// Returns nil when prometheus.max_gauges is reached or existing gauge has other tags.
+// Must be called with lock held.
+func (h *deviceHandler) gauge(fieldName string, tags []string) *gauge {
+	name := metricPrefix + metrics.SanitizeName(fieldName)
+	if existing, ok := h.gauges[name]; ok {
+		if !equalStrings(existing.tags, tags) {
+			if !h.skipped[name] {
+				h.skipped[name] = true
+				glog.Warningf("prometheus: field '%s' has tags %v, but gauge has %v, not exposed",
+					fieldName, tags, existing.tags)
+			}
+			return nil
+		}
+		return existing
+	}
+	if *flagMaxGauges > 0 && len(h.gauges) >= *flagMaxGauges {
+		if !h.skipped[fieldName] {
+			h.skipped[fieldName] = true
+			glog.Warningf("prometheus: %d gauges limit reached, field '%s' is not exposed",
+				*flagMaxGauges, fieldName)
+		}
+		return nil
+	}
+
+	// Field name may collide with another metric, e.g. "last_seen_timestamp_seconds"
+	metricName := name
+	if metrics.Registered(metricName) {
+		metricName = metricPrefix + "field_" + metrics.SanitizeName(fieldName)
+		for suffix := 2; metrics.Registered(metricName); suffix++ {
+			metricName = fmt.Sprintf("%sfield_%s_%d", metricPrefix, metrics.SanitizeName(fieldName), suffix)
+		}
+		glog.Warningf("prometheus: metric '%s' already exists, field '%s' exposed as '%s'",
+			name, fieldName, metricName)
+	}
+	labels := append(append([]string{}, labelNames...), sanitizeNames(tags)...)
+	created := &gauge{
+		Gauge: metrics.NewGauge(metricName, "Device value "+fieldName, labels...),
+		tags:  tags,
+	}
+	h.gauges[name] = created
+
+	return created
+}
+
+func sanitizeNames(names []string) []string {
+	results := make([]string, len(names))
+	for i, name := range names {
+		results[i] = metrics.SanitizeName(name)
+	}
+	return results
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteDevice removes all series of device. Must be called with lock held.
+func (h *deviceHandler) deleteDevice(id string) {
+	filter := func(labels map[string]string) bool {
+		return labels["device_id"] == id
+	}
+	for _, gauge := range h.gauges {
+		gauge.DeleteMatching(filter)
+	}
+	h.lastSeen.DeleteMatching(filter)
+}
+
+// gaugeValue converts flattened protobuf value into float,
+// non numeric values (strings, enum names) are skipped
+func gaugeValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case time.Time:
+		return float64(v.Unix()), true
+	case time.Duration:
+		return v.Seconds(), true
+	}
+	return 0, false
+}
+
+// Register device handler
+func init() {
+	device.MustAddHandler(newDeviceHandler())
+}
@@ -0,0 +1,123 @@
+package prometheus
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/open-iot-devices/protobufs/go/openiot/sensor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/utils"
+	"github.com/open-iot-devices/server/utils/metrics"
+)
+
+func scrape() string {
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	metrics.WriteAll(writer)
+	writer.Flush()
+	return buf.String()
+}
+
+func TestDeviceValues(t *testing.T) {
+	// Handler is already registered by init()
+	h, ok := device.FindHandlerByName(handlerName).(*deviceHandler)
+	require.True(t, ok)
+
+	dev := &device.Device{ID: 0x10, IDhex: "0x10", DisplayName: "kitchen"}
+	msg := &sensor.MultiSensorStatus{
+		Temperature: &sensor.Temperature{ValueC: 21.5},
+		Uptime:      100,
+	}
+	require.NoError(t, h.ProcessMessage(dev, "openiot.sensor.MultiSensorStatus", msg))
+
+	result := scrape()
+	assert.Contains(t, result, "# TYPE openiot_device_temperature_value_c gauge\n")
+	assert.Contains(t, result, `openiot_device_temperature_value_c{device_id="0x10",display_name="kitchen"} 21.5`)
+	assert.Contains(t, result, `openiot_device_uptime{device_id="0x10",display_name="kitchen"} 100`)
+	assert.Contains(t, result, `openiot_device_last_seen_timestamp_seconds{device_id="0x10",display_name="kitchen"}`)
+
+	// Renamed device: old series removed
+	dev.DisplayName = "living_room"
+	require.NoError(t, h.ProcessMessage(dev, "openiot.sensor.MultiSensorStatus", msg))
+	result = scrape()
+	assert.NotContains(t, result, `display_name="kitchen"`)
+	assert.Contains(t, result, `openiot_device_uptime{device_id="0x10",display_name="living_room"} 100`)
+}
+
+func TestFieldMetadata(t *testing.T) {
+	registered, ok := device.FindHandlerByName(handlerName).(*deviceHandler)
+	require.True(t, ok)
+	h := &deviceHandler{
+		gauges:       map[string]*gauge{},
+		displayNames: map[string]string{},
+		skipped:      map[string]bool{},
+		lastSeen:     registered.lastSeen,
+	}
+	defer unregisterGauges(h)
+	msg := &sensor.MultiSensorStatus{
+		Temperature: &sensor.Temperature{ValueC: 21.5},
+		Humidity:    &sensor.Humidity{RelativePercent: 40},
+		Uptime:      100,
+	}
+	overlay := proto.MessageReflect(msg).Descriptor().FullName() + `:
+  measurement: climate
+  fields:
+    uptime: {unit: s, scale: 0.001}
+    humidity.relative_percent: {tag: true, name: humidity}
+`
+	require.NoError(t, utils.LoadFieldMetadata(strings.NewReader(string(overlay))))
+	defer utils.LoadFieldMetadata(strings.NewReader(""))
+
+	// Scale / unit applied, tags are labels
+	dev := &device.Device{ID: 0x30, IDhex: "0x30", DisplayName: "porch"}
+	require.NoError(t, h.ProcessMessage(dev, "openiot.sensor.MultiSensorStatus", msg))
+	result := scrape()
+	assert.Contains(t, result, `openiot_device_climate_uptime_s{device_id="0x30",display_name="porch",humidity="40"} 0.1`)
+	assert.Contains(t, result,
+		`openiot_device_climate_temperature_value_c{device_id="0x30",display_name="porch",humidity="40"} 21.5`)
+	assert.NotContains(t, result, "openiot_device_climate_humidity")
+
+	// Different tags: gauge is not updated
+	msg.Humidity = nil
+	msg.Uptime = 200
+	require.NoError(t, h.ProcessMessage(dev, "openiot.sensor.MultiSensorStatus", msg))
+	assert.Contains(t, scrape(), `openiot_device_climate_uptime_s{device_id="0x30",display_name="porch",humidity="40"} 0.1`)
+}
+
+func TestGaugeNameCollision(t *testing.T) {
+	h := &deviceHandler{gauges: map[string]*gauge{}, skipped: map[string]bool{}}
+	defer unregisterGauges(h)
+
+	// Must not panic on existing openiot_device_last_seen_timestamp_seconds
+	gauge := h.gauge("last_seen_timestamp_seconds", nil)
+	require.NotNil(t, gauge)
+	gauge.Set(1, "0x20", "collision")
+	assert.Equal(t, gauge, h.gauge("last_seen_timestamp_seconds", nil))
+	assert.Contains(t, scrape(),
+		`openiot_device_field_last_seen_timestamp_seconds{device_id="0x20",display_name="collision"} 1`)
+}
+
+func TestGaugesLimit(t *testing.T) {
+	h := &deviceHandler{gauges: map[string]*gauge{}, skipped: map[string]bool{}}
+	defer unregisterGauges(h)
+	require.NoError(t, flag.Set("prometheus.max_gauges", "2"))
+	defer flag.Set("prometheus.max_gauges", "1000")
+
+	assert.NotNil(t, h.gauge("limit_a", nil))
+	assert.NotNil(t, h.gauge("limit_b", nil))
+	assert.Nil(t, h.gauge("limit_c", nil))
+	assert.NotNil(t, h.gauge("limit_a", nil))
+}
+
+func unregisterGauges(h *deviceHandler) {
+	for _, gauge := range h.gauges {
+		metrics.Unregister(gauge.Name())
+	}
+}
@@ -0,0 +1,328 @@
+package rules
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/processor"
+	"github.com/open-iot-devices/server/utils/events"
+	"github.com/open-iot-devices/server/utils/schema"
+)
+
+// action is what to do when rule matches, exactly one of kinds must be set
+type action struct {
+	Send    *sendAction    `yaml:",omitempty"`
+	Publish *publishAction `yaml:",omitempty"`
+	// Name of device handler to pass incoming message to, e.g. "mqtt"
+	Handler string `yaml:",omitempty"`
+}
+
+// sendAction builds protobuf message and sends it to device
+type sendAction struct {
+	// Target device: ID (0x...) or display name, device message came from when empty
+	Device string `yaml:",omitempty"`
+	// Protobuf full name of message, e.g. "belyalov.Control"
+	Type string
+	// Flattened field name (e.g. "wall_spotlight.hour_on") -> value, see evaluate()
+	Fields map[string]interface{} `yaml:",omitempty"`
+}
+
+// publishAction publishes event, see utils/events
+type publishAction struct {
+	Type string
+	Data map[string]interface{} `yaml:",omitempty"`
+}
+
+// Value expression: "$source" with optional "+ N" / "- N", e.g. "$sunrise.hour + 1"
+var expressionRe = regexp.MustCompile(`^\$([a-z_][a-z0-9_.]*)\s*(?:([+-])\s*([0-9]+(?:\.[0-9]+)?))?$`)
+
+// Expression sources besides "msg.<field>"
+var knownSources = map[string]bool{
+	"device.id":           true,
+	"device.name":         true,
+	"device.display_name": true,
+	"now.hour":            true,
+	"now.minute":          true,
+	"dawn.hour":           true,
+	"dawn.minute":         true,
+	"sunrise.hour":        true,
+	"sunrise.minute":      true,
+	"solar_noon.hour":     true,
+	"solar_noon.minute":   true,
+	"sunset.hour":         true,
+	"sunset.minute":       true,
+	"dusk.hour":           true,
+	"dusk.minute":         true,
+}
+
+// prepare validates action
+func (a *action) prepare() error {
+	kinds := 0
+	if a.Send != nil {
+		kinds++
+		if a.Send.Type == "" {
+			return fmt.Errorf("send: type is required")
+		}
+		if schema.FindMessageDescriptor(a.Send.Type) == nil {
+			return fmt.Errorf("send: protobuf '%s' is not registered", a.Send.Type)
+		}
+		if err := validateValue(a.Send.Fields); err != nil {
+			return fmt.Errorf("send: %v", err)
+		}
+	}
+	if a.Publish != nil {
+		kinds++
+		if a.Publish.Type == "" {
+			return fmt.Errorf("publish: type is required")
+		}
+		if err := validateValue(a.Publish.Data); err != nil {
+			return fmt.Errorf("publish: %v", err)
+		}
+	}
+	if a.Handler != "" {
+		kinds++
+		if a.Handler == handlerName {
+			return fmt.Errorf("handler: rules can not call itself")
+		}
+		if device.FindHandlerByName(a.Handler) == nil {
+			return fmt.Errorf("handler: unknown handler '%s'", a.Handler)
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("exactly one of send, publish or handler is required")
+	}
+
+	return nil
+}
+
+// run executes action, in dry run mode it is only logged
+func (a *action) run(rule string, env *environment, dryRun bool) error {
+	switch {
+	case a.Send != nil:
+		target, msg, err := a.Send.build(env)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			glog.Infof("0x%x: rule %s: dry run: send %s to 0x%x: %v", env.dev.ID, rule, a.Send.Type, target.ID, msg)
+			return nil
+		}
+		return processor.SendMessage(target, msg)
+
+	case a.Publish != nil:
+		data, err := evaluate(a.Publish.Data, env)
+		if err != nil {
+			return err
+		}
+		event := &events.Event{
+			Type:     a.Publish.Type,
+			Time:     env.now,
+			DeviceID: env.dev.IDhex,
+		}
+		if data != nil {
+			event.Data = data.(map[string]interface{})
+		}
+		if dryRun {
+			glog.Infof("0x%x: rule %s: dry run: publish %s: %v", env.dev.ID, rule, event.Type, event.Data)
+			return nil
+		}
+		events.Publish(event)
+
+	default:
+		handler := device.FindHandlerByName(a.Handler)
+		if handler == nil {
+			return fmt.Errorf("unknown handler '%s'", a.Handler)
+		}
+		if dryRun {
+			glog.Infof("0x%x: rule %s: dry run: pass %s to handler %s", env.dev.ID, rule, env.msgType, a.Handler)
+			return nil
+		}
+		return handler.ProcessMessage(env.dev, env.msgType, env.msg)
+	}
+
+	return nil
+}
+
+// build finds target device and creates message to send
+func (s *sendAction) build(env *environment) (*device.Device, proto.Message, error) {
+	target := env.dev
+	if s.Device != "" {
+		target = device.FindDevice(s.Device)
+		if target == nil {
+			return nil, nil, fmt.Errorf("device '%s' not found", s.Device)
+		}
+	}
+	fields, err := evaluate(s.Fields, env)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := schema.NewMessageFromFields(s.Type, fields.(map[string]interface{}))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return target, msg, nil
+}
+
+// evaluate replaces expressions in (nested) value. Strings starting with "$" are
+// expressions, "$$" is escape for literal "$". Sources:
+// - $msg.<field>: flattened field of incoming message
+// - $device.id, $device.name, $device.display_name: device message came from
+// - $now.hour, $now.minute
+// - $<event>.hour, $<event>.minute: sun event (dawn, sunrise, solar_noon, sunset, dusk) at device location
+// Numeric sources may be adjusted, e.g. "$sunrise.hour + 1".
+func evaluate(value interface{}, env *environment) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if strings.HasPrefix(v, "$$") {
+			return v[1:], nil
+		}
+		if strings.HasPrefix(v, "$") {
+			return evaluateExpression(v, env)
+		}
+	case []interface{}:
+		results := make([]interface{}, len(v))
+		for i, item := range v {
+			result, err := evaluate(item, env)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = result
+		}
+		return results, nil
+	case map[string]interface{}:
+		results := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result, err := evaluate(item, env)
+			if err != nil {
+				return nil, err
+			}
+			results[key] = result
+		}
+		return results, nil
+	case map[interface{}]interface{}:
+		// YAML decodes nested maps this way, make them JSON friendly
+		results := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result, err := evaluate(item, env)
+			if err != nil {
+				return nil, err
+			}
+			results[fmt.Sprint(key)] = result
+		}
+		return results, nil
+	}
+
+	return value, nil
+}
+
+func evaluateExpression(expression string, env *environment) (interface{}, error) {
+	match := expressionRe.FindStringSubmatch(expression)
+	if match == nil {
+		return nil, fmt.Errorf("invalid expression '%s'", expression)
+	}
+
+	value, err := source(match[1], env)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", expression, err)
+	}
+	if match[2] == "" {
+		return value, nil
+	}
+
+	number, ok := toFloat(value)
+	if !ok {
+		return nil, fmt.Errorf("%s: %v is not a number", expression, value)
+	}
+	delta, _ := strconv.ParseFloat(match[3], 64)
+	if match[2] == "-" {
+		delta = -delta
+	}
+	number += delta
+	if number == math.Trunc(number) {
+		return int64(number), nil
+	}
+	return number, nil
+}
+
+// source returns value of expression source, e.g. "msg.temperature.value_c"
+func source(name string, env *environment) (interface{}, error) {
+	if strings.HasPrefix(name, "msg.") {
+		value, ok := env.fields[name[len("msg."):]]
+		if !ok {
+			return nil, fmt.Errorf("no such field in message")
+		}
+		return value, nil
+	}
+
+	if !knownSources[name] {
+		return nil, fmt.Errorf("unknown source")
+	}
+	switch name {
+	case "device.id":
+		return env.dev.IDhex, nil
+	case "device.name":
+		return env.dev.Name, nil
+	case "device.display_name":
+		return env.dev.DisplayName, nil
+	}
+
+	// <now|sun event>.<hour|minute>
+	parts := strings.Split(name, ".")
+	value := env.now
+	if parts[0] != "now" {
+		value = env.sun.Event(parts[0])
+	}
+	if value.IsZero() {
+		return nil, fmt.Errorf("%s time is not known", parts[0])
+	}
+	value = value.In(env.now.Location())
+	if parts[1] == "hour" {
+		return int64(value.Hour()), nil
+	}
+	return int64(value.Minute()), nil
+}
+
+// validateValue checks all expressions in (nested) value
+func validateValue(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		if !strings.HasPrefix(v, "$") || strings.HasPrefix(v, "$$") {
+			return nil
+		}
+		match := expressionRe.FindStringSubmatch(v)
+		if match == nil {
+			return fmt.Errorf("invalid expression '%s'", v)
+		}
+		if !knownSources[match[1]] && !strings.HasPrefix(match[1], "msg.") {
+			return fmt.Errorf("%s: unknown source '%s'", v, match[1])
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := validateValue(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			if err := validateValue(item); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for _, item := range v {
+			if err := validateValue(item); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
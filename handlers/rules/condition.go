@@ -0,0 +1,241 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/utils/sun"
+)
+
+// environment is everything rule conditions / actions are evaluated against
+type environment struct {
+	dev     *device.Device
+	msgType string
+	msg     proto.Message
+	// Flattened fields of incoming message, see flattenOptions
+	fields map[string]interface{}
+
+	now time.Time
+	// Sun times at device location for today
+	sun *sun.Times
+}
+
+// condition is single rule condition, all specified checks must be true
+type condition struct {
+	// Flattened field name of incoming message, e.g. "temperature.value_c".
+	// For nested messages name of message itself may be used with Exists.
+	Field     string      `yaml:",omitempty"`
+	Equals    interface{} `yaml:",omitempty"`
+	NotEquals interface{} `yaml:"not_equals,omitempty"`
+	Above     *float64    `yaml:",omitempty"`
+	Below     *float64    `yaml:",omitempty"`
+	Exists    *bool       `yaml:",omitempty"`
+
+	// Time of day window: "HH:MM" or sun event at device location (dawn, sunrise,
+	// solar_noon, sunset, dusk) with optional offset, e.g. "sunset-30m". Window may wrap around midnight ("22:00" - "06:00").
+	After  string `yaml:",omitempty"`
+	Before string `yaml:",omitempty"`
+	// Days of week: mon, tue, wed, thu, fri, sat, sun
+	Weekdays []string `yaml:",omitempty"`
+
+	after    *timeOfDay
+	before   *timeOfDay
+	weekdays map[time.Weekday]bool
+}
+
+// timeOfDay is either fixed time or time relative to sun event
+type timeOfDay struct {
+	// Sun event, empty for fixed time
+	event  string
+	offset time.Duration
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// prepare validates condition and parses time / weekdays
+func (c *condition) prepare() error {
+	hasField := c.Equals != nil || c.NotEquals != nil || c.Above != nil || c.Below != nil || c.Exists != nil
+	if hasField && c.Field == "" {
+		return fmt.Errorf("field name is required")
+	}
+	if c.Field == "" && c.After == "" && c.Before == "" && len(c.Weekdays) == 0 {
+		return fmt.Errorf("empty condition")
+	}
+
+	var err error
+	if c.After != "" {
+		if c.after, err = parseTimeOfDay(c.After); err != nil {
+			return err
+		}
+	}
+	if c.Before != "" {
+		if c.before, err = parseTimeOfDay(c.Before); err != nil {
+			return err
+		}
+	}
+	if len(c.Weekdays) > 0 {
+		c.weekdays = map[time.Weekday]bool{}
+		for _, name := range c.Weekdays {
+			name = strings.ToLower(name)
+			if len(name) > 3 {
+				name = name[:3]
+			}
+			day, ok := weekdayNames[name]
+			if !ok {
+				return fmt.Errorf("invalid weekday '%s'", name)
+			}
+			c.weekdays[day] = true
+		}
+	}
+
+	return nil
+}
+
+func (c *condition) matches(env *environment) bool {
+	if c.Field != "" && !c.matchesField(env.fields) {
+		return false
+	}
+	if c.weekdays != nil && !c.weekdays[env.now.Weekday()] {
+		return false
+	}
+	if c.after != nil || c.before != nil {
+		return c.matchesTime(env)
+	}
+
+	return true
+}
+
+func (c *condition) matchesField(fields map[string]interface{}) bool {
+	value, ok := fields[c.Field]
+	if !ok {
+		// Nested message: present when any of its fields present
+		prefix := c.Field + "."
+		for name := range fields {
+			if strings.HasPrefix(name, prefix) {
+				ok = true
+				break
+			}
+		}
+	}
+	if c.Exists != nil && ok != *c.Exists {
+		return false
+	}
+	if !ok {
+		// Value checks on missing field are never true
+		return c.Equals == nil && c.NotEquals == nil && c.Above == nil && c.Below == nil
+	}
+
+	// YAML and protobuf types differ (e.g. int vs uint32), so compare text representations
+	if c.Equals != nil && fmt.Sprint(value) != fmt.Sprint(c.Equals) {
+		return false
+	}
+	if c.NotEquals != nil && fmt.Sprint(value) == fmt.Sprint(c.NotEquals) {
+		return false
+	}
+	if c.Above != nil || c.Below != nil {
+		number, ok := toFloat(value)
+		if !ok {
+			return false
+		}
+		if c.Above != nil && number <= *c.Above {
+			return false
+		}
+		if c.Below != nil && number >= *c.Below {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *condition) matchesTime(env *environment) bool {
+	now := sinceMidnight(env.now)
+	var after, before time.Duration
+	var ok bool
+	if c.after != nil {
+		if after, ok = c.after.resolve(env); !ok {
+			return false
+		}
+	}
+	if c.before != nil {
+		if before, ok = c.before.resolve(env); !ok {
+			return false
+		}
+	}
+
+	switch {
+	case c.before == nil:
+		return now >= after
+	case c.after == nil:
+		return now < before
+	case after <= before:
+		return now >= after && now < before
+	default:
+		// Wraps around midnight
+		return now >= after || now < before
+	}
+}
+
+func parseTimeOfDay(value string) (*timeOfDay, error) {
+	if parsed, err := time.Parse("15:04", strings.TrimSpace(value)); err == nil {
+		return &timeOfDay{offset: sinceMidnight(parsed)}, nil
+	}
+	event, offset, err := sun.ParseEvent(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time '%s', expected HH:MM or sun event: %v", value, err)
+	}
+	return &timeOfDay{event: event, offset: offset}, nil
+}
+
+// resolve returns time of day as duration since midnight,
+// false when sun event does not happen today
+func (t *timeOfDay) resolve(env *environment) (time.Duration, bool) {
+	if t.event == "" {
+		return t.offset, true
+	}
+	event := env.sun.Event(t.event)
+	if event.IsZero() {
+		return 0, false
+	}
+
+	return sinceMidnight(event.In(env.now.Location())) + t.offset, true
+}
+
+func sinceMidnight(value time.Time) time.Duration {
+	hour, min, sec := value.Clock()
+	return time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case time.Duration:
+		return v.Seconds(), true
+	}
+	return 0, false
+}
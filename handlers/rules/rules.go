@@ -0,0 +1,504 @@
+// Package rules implements declarative automation: YAML configured rules with
+// conditions on incoming messages, device, time of day / sun and actions
+// to send messages to devices, publish events or call other handlers.
+//
+// Example (replacement of belyalov custom handler):
+//
+//	enabled: true
+//	rules:
+//	  - name: asterisk
+//	    message_types: [belyalov.Status]
+//	    when:
+//	      - field: misha_control.button2
+//	        equals: true
+//	    actions:
+//	      - send:
+//	          device: "0x343534340029001e"
+//	          type: belyalov.Control
+//	          fields:
+//	            wall_ctrl_spotlight.hour_on: 17
+//	            wall_ctrl_spotlight.hour_off: 23
+//	            wall_ctrl_spotlight.w: true
+//	  - name: control
+//	    message_types: [belyalov.Status]
+//	    when:
+//	      - field: misha_control
+//	        exists: false
+//	    actions:
+//	      - send:
+//	          type: belyalov.Control
+//	          fields:
+//	            wall_spotlight.hour_on: $sunset.hour
+//	            wall_spotlight.hour_off: $sunrise.hour + 1
+//	            wall_ctrl_spotlight.hour_on: 17
+//	            wall_ctrl_spotlight.hour_off: 23
+//	  - name: animation
+//	    message_types: [belyalov.Status]
+//	    when:
+//	      - field: misha_control
+//	        exists: false
+//	      - after: "10:00"
+//	        before: "20:00"
+//	    actions:
+//	      - send:
+//	          type: belyalov.Control
+//	          fields:
+//	            love_heart.enable_animation: true
+//	            tulip.enable_animation: true
+//	  - name: porch_light
+//	    on: sun.sunset
+//	    devices: ["porch"]
+//	    actions:
+//	      - send:
+//	          type: belyalov.Control
+//	          fields:
+//	            wall_spotlight.w: true
+//
+// Rules with "on" are fired by sun events (sun.dawn, sun.sunrise, sun.solar_noon,
+// sun.sunset, sun.dusk) at location of every device matching "devices" instead of
+// incoming messages. They're run by main loop, see Queue.
+package rules
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"gopkg.in/yaml.v2"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/utils"
+	"github.com/open-iot-devices/server/utils/events"
+	"github.com/open-iot-devices/server/utils/metrics"
+	"github.com/open-iot-devices/server/utils/sun"
+)
+
+const handlerName = "rules"
+
+type rulesConfig struct {
+	Enabled bool
+	// Only log actions instead of running them
+	DryRun bool `yaml:"dry_run,omitempty"`
+	// How often config file is checked for changes, "0" disables hot reload
+	ReloadInterval string `yaml:"reload_interval,omitempty"`
+	Rules          []*rule
+}
+
+type rule struct {
+	Name string
+	// Sun event firing rule, e.g. "sun.sunset", rule is not matched against incoming messages then
+	On string `yaml:",omitempty"`
+	// Filters, empty means everything. Shell patterns (path.Match) are allowed.
+	// Devices matches device ID (0x...) or display name
+	Devices      []string `yaml:",omitempty"`
+	MessageTypes []string `yaml:"message_types,omitempty"`
+	// All conditions must be true
+	When    []*condition `yaml:",omitempty"`
+	Actions []*action
+}
+
+type deviceHandler struct {
+	filename string
+	// Clock / sun times / device location name, replaceable for tests
+	now            func() time.Time
+	sunTimes       func(dev *device.Device, date time.Time) *sun.Times
+	deviceLocation func(dev *device.Device) string
+
+	mutex   sync.RWMutex
+	config  *rulesConfig
+	modTime time.Time
+
+	sunEvents *events.Subscription
+	doneCh    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// Trigger is sun event firing rules. It is run by main loop,
+// so rule actions don't race with message processing.
+type Trigger struct {
+	handler *deviceHandler
+	event   *events.Event
+}
+
+var triggerQueue = make(chan *Trigger)
+
+// Queue returns channel of sun events firing rules, they must be run using Trigger.Run()
+func Queue() <-chan *Trigger {
+	return triggerQueue
+}
+
+// Run fires rules of sun event
+func (t *Trigger) Run() {
+	if err := t.handler.processEvent(t.event); err != nil {
+		glog.Infof("Rules: %s: %v", t.event.Type, err)
+	}
+}
+
+var flagConfigFilename = flag.String("config.rules", ".config/rules.yaml", "Rules config filename")
+
+// Conditions refer to elements of repeated fields by index and compare enums by name
+var flattenOptions = utils.FlattenOptions{SplitRepeated: true, EnumNames: true}
+
+var (
+	metricFired = metrics.NewCounter("openiot_rules_fired_total",
+		"Rules matched incoming message", "rule")
+	metricErrors = metrics.NewCounter("openiot_rules_errors_total",
+		"Rule actions failed", "rule")
+)
+
+func (h *deviceHandler) GetName() string {
+	return handlerName
+}
+
+func (h *deviceHandler) Start() error {
+	h.filename = *flagConfigFilename
+	if _, err := os.Stat(h.filename); err != nil {
+		// This is not fatal error, continue
+		glog.Infof("Unable to load config: %v, rules disabled.", err)
+		return nil
+	}
+
+	return h.start()
+}
+
+// start loads rules from config file and starts hot reloader
+func (h *deviceHandler) start() error {
+	if h.now == nil {
+		h.now = time.Now
+		h.sunTimes = func(dev *device.Device, date time.Time) *sun.Times {
+			return sun.GetDeviceLocation(dev).Times(date)
+		}
+	}
+	if h.deviceLocation == nil {
+		h.deviceLocation = func(dev *device.Device) string {
+			return sun.GetDeviceLocation(dev).Name
+		}
+	}
+
+	info, err := os.Stat(h.filename)
+	if err != nil {
+		return err
+	}
+	config, err := loadConfig(h.filename)
+	if err != nil {
+		return err
+	}
+	if !config.Enabled {
+		glog.Infof("Rules disabled")
+		return nil
+	}
+	interval, err := time.ParseDuration(config.ReloadInterval)
+	if err != nil {
+		return fmt.Errorf("rules: invalid reload_interval: %v", err)
+	}
+
+	h.mutex.Lock()
+	h.config = config
+	h.modTime = info.ModTime()
+	h.mutex.Unlock()
+	glog.Infof("Rules: loaded %d rules from %s", len(config.Rules), h.filename)
+
+	h.doneCh = make(chan struct{})
+	if interval > 0 {
+		h.wg.Add(1)
+		go h.reloader(interval)
+	}
+	// Rules with sun events may appear on reload, so always subscribed
+	h.sunEvents = sun.Subscribe(16, "")
+	h.wg.Add(1)
+	go h.forwardEvents()
+
+	return nil
+}
+
+func (h *deviceHandler) Stop() {
+	if h.doneCh != nil {
+		close(h.doneCh)
+		h.wg.Wait()
+		h.sunEvents.Close()
+		h.doneCh = nil
+	}
+}
+
+// forwardEvents passes sun events to main loop, see Queue
+func (h *deviceHandler) forwardEvents() {
+	defer h.wg.Done()
+
+	for {
+		select {
+		case event := <-h.sunEvents.C:
+			select {
+			case triggerQueue <- &Trigger{handler: h, event: event}:
+			case <-h.doneCh:
+				return
+			}
+		case <-h.doneCh:
+			return
+		}
+	}
+}
+
+func (h *deviceHandler) AddDevice(device *device.Device) {
+
+}
+
+func (h *deviceHandler) RemoveDevice(device *device.Device) {
+
+}
+
+func (h *deviceHandler) ProcessMessage(dev *device.Device, msgType string, msg proto.Message) error {
+	h.mutex.RLock()
+	config := h.config
+	h.mutex.RUnlock()
+	if config == nil || !config.Enabled {
+		return nil
+	}
+
+	now := h.now()
+	env := &environment{
+		dev:     dev,
+		msgType: msgType,
+		msg:     msg,
+		fields:  utils.FlattenProtobuf(msg, flattenOptions),
+		now:     now,
+		sun:     h.sunTimes(dev, now),
+	}
+	var errs []string
+	for _, r := range config.Rules {
+		if r.On != "" || !r.matches(env) {
+			continue
+		}
+		errs = append(errs, r.fire(env, config.DryRun)...)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("0x%x: %s", dev.ID, strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// processEvent fires rules of sun event for every matching device at event's location
+func (h *deviceHandler) processEvent(event *events.Event) error {
+	h.mutex.RLock()
+	config := h.config
+	h.mutex.RUnlock()
+	if config == nil || !config.Enabled {
+		return nil
+	}
+
+	location, _ := event.Data["location"].(string)
+	now := h.now()
+	var errs []string
+	for _, r := range config.Rules {
+		if r.On != event.Type {
+			continue
+		}
+		for _, dev := range device.GetAllDevices() {
+			if h.deviceLocation(dev) != location {
+				continue
+			}
+			env := &environment{
+				dev:    dev,
+				fields: map[string]interface{}{},
+				now:    now,
+				sun:    h.sunTimes(dev, now),
+			}
+			if !r.matches(env) {
+				continue
+			}
+			for _, err := range r.fire(env, config.DryRun) {
+				errs = append(errs, fmt.Sprintf("0x%x: %s", dev.ID, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// fire runs all actions of matched rule, returns errors of failed ones
+func (r *rule) fire(env *environment, dryRun bool) []string {
+	metricFired.Inc(r.Name)
+	glog.V(1).Infof("0x%x: rule %s matched", env.dev.ID, r.Name)
+	var errs []string
+	for _, a := range r.Actions {
+		if err := a.run(r.Name, env, dryRun); err != nil {
+			metricErrors.Inc(r.Name)
+			errs = append(errs, fmt.Sprintf("rule %s: %v", r.Name, err))
+		}
+	}
+
+	return errs
+}
+
+func (r *rule) matches(env *environment) bool {
+	if len(r.Devices) > 0 && !matchAny(r.Devices, env.dev.IDhex, env.dev.DisplayName) {
+		return false
+	}
+	if len(r.MessageTypes) > 0 && !matchAny(r.MessageTypes, env.msgType) {
+		return false
+	}
+	for _, c := range r.When {
+		if !c.matches(env) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reloader periodically checks config file and reloads rules when it has changed
+func (h *deviceHandler) reloader(interval time.Duration) {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.reload()
+		case <-h.doneCh:
+			return
+		}
+	}
+}
+
+// reload loads rules if config file has been modified.
+// Invalid config is reported and previous rules are kept.
+func (h *deviceHandler) reload() {
+	info, err := os.Stat(h.filename)
+	if err != nil {
+		glog.Infof("Rules: %v", err)
+		return
+	}
+	h.mutex.RLock()
+	modified := !info.ModTime().Equal(h.modTime)
+	h.mutex.RUnlock()
+	if !modified {
+		return
+	}
+
+	config, err := loadConfig(h.filename)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	// Do not try to load the same broken file again
+	h.modTime = info.ModTime()
+	if err != nil {
+		glog.Infof("Rules: unable to reload %s, keeping previous rules: %v", h.filename, err)
+		return
+	}
+	h.config = config
+	glog.Infof("Rules: reloaded %d rules from %s", len(config.Rules), h.filename)
+}
+
+// loadConfig reads and validates rules config
+func loadConfig(filename string) (*rulesConfig, error) {
+	reader, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	config := &rulesConfig{ReloadInterval: "10s"}
+	decoder := yaml.NewDecoder(reader)
+	decoder.SetStrict(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, err
+	}
+	if err := config.prepare(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// prepare validates all rules
+func (c *rulesConfig) prepare() error {
+	names := map[string]bool{}
+	for index, r := range c.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule%d", index)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rules: duplicate rule name '%s'", r.Name)
+		}
+		names[r.Name] = true
+
+		for _, pattern := range append(append([]string{}, r.Devices...), r.MessageTypes...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %s: invalid filter '%s': %v", r.Name, pattern, err)
+			}
+		}
+		for _, c := range r.When {
+			if err := c.prepare(); err != nil {
+				return fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+		}
+		if r.On != "" {
+			if err := r.prepareEvent(); err != nil {
+				return fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+		}
+		if len(r.Actions) == 0 {
+			return fmt.Errorf("rule %s: no actions", r.Name)
+		}
+		for _, a := range r.Actions {
+			if err := a.prepare(); err != nil {
+				return fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// prepareEvent validates rule fired by sun event: there is no incoming message
+func (r *rule) prepareEvent() error {
+	event := strings.TrimPrefix(r.On, sun.EventTypePrefix)
+	if name, offset, err := sun.ParseEvent(event); err != nil || event == r.On || name != event || offset != 0 {
+		return fmt.Errorf("on: unknown event '%s', expected one of %s<%s>",
+			r.On, sun.EventTypePrefix, strings.Join(sun.AllEvents, "|"))
+	}
+	if len(r.Devices) == 0 {
+		return fmt.Errorf("devices are required for rule fired by %s", r.On)
+	}
+	if len(r.MessageTypes) > 0 {
+		return fmt.Errorf("message_types are not allowed for rule fired by %s", r.On)
+	}
+	for _, c := range r.When {
+		if c.Field != "" {
+			return fmt.Errorf("field conditions are not allowed for rule fired by %s", r.On)
+		}
+	}
+	for _, a := range r.Actions {
+		if a.Handler != "" {
+			return fmt.Errorf("handler actions are not allowed for rule fired by %s", r.On)
+		}
+	}
+
+	return nil
+}
+
+// Register device handler
+func init() {
+	device.MustAddHandler(&deviceHandler{})
+}
@@ -0,0 +1,439 @@
+package rules
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/protobufs/go/openiot/sensor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/encode"
+	"github.com/open-iot-devices/server/utils/events"
+	"github.com/open-iot-devices/server/utils/sun"
+)
+
+type mockTransport struct {
+	history [][]byte
+}
+
+func (m *mockTransport) GetName() string {
+	return "mock"
+}
+
+func (m *mockTransport) GetTypeName() string {
+	return "mock"
+}
+
+func (m *mockTransport) Start() error {
+	return nil
+}
+
+func (m *mockTransport) Stop() {
+}
+
+func (m *mockTransport) Receive() <-chan []byte {
+	return nil
+}
+
+func (m *mockTransport) Send(msg []byte) error {
+	m.history = append(m.history, msg)
+	return nil
+}
+
+type mockHandler struct {
+	messages []proto.Message
+}
+
+func (m *mockHandler) GetName() string {
+	return "rules_mock"
+}
+
+func (m *mockHandler) Start() error {
+	return nil
+}
+
+func (m *mockHandler) Stop() {
+}
+
+func (m *mockHandler) ProcessMessage(dev *device.Device, msgType string, msg proto.Message) error {
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+func (m *mockHandler) AddDevice(dev *device.Device) {
+}
+
+func (m *mockHandler) RemoveDevice(dev *device.Device) {
+}
+
+var testNow = time.Date(2020, 6, 1, 21, 30, 0, 0, time.Local) // Monday
+
+func testMessageType() string {
+	return string(proto.MessageReflect(&sensor.MultiSensorStatus{}).Descriptor().FullName())
+}
+
+var testSunTimes = &sun.Times{
+	CivilDawn: time.Date(2020, 6, 1, 5, 5, 0, 0, time.Local),
+	Sunrise:   time.Date(2020, 6, 1, 5, 40, 0, 0, time.Local),
+	SolarNoon: time.Date(2020, 6, 1, 13, 2, 0, 0, time.Local),
+	Sunset:    time.Date(2020, 6, 1, 20, 25, 0, 0, time.Local),
+	CivilDusk: time.Date(2020, 6, 1, 20, 58, 0, 0, time.Local),
+}
+
+func newTestHandler(t *testing.T, config string) (*deviceHandler, func()) {
+	dir, err := ioutil.TempDir("", "rules")
+	require.NoError(t, err)
+	h := &deviceHandler{
+		filename: filepath.Join(dir, "rules.yaml"),
+		now:      func() time.Time { return testNow },
+		sunTimes: func(*device.Device, time.Time) *sun.Times { return testSunTimes },
+	}
+	require.NoError(t, ioutil.WriteFile(h.filename, []byte(config), 0644))
+	require.NoError(t, h.start())
+	return h, func() {
+		h.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestDevice(t *testing.T, id uint64, name string) (*device.Device, *mockTransport) {
+	dev := device.NewDevice(id)
+	dev.DisplayName = name
+	transport := &mockTransport{}
+	dev.SetTransport(transport)
+	require.NoError(t, device.AddDevice(dev))
+	return dev, transport
+}
+
+func TestConditions(t *testing.T) {
+	env := &environment{
+		fields: map[string]interface{}{
+			"temperature.value_c": float32(21.5),
+			"uptime":              uint32(10),
+			"enabled":             true,
+		},
+		now: testNow,
+		sun: testSunTimes,
+	}
+	number := func(value float64) *float64 { return &value }
+	boolean := func(value bool) *bool { return &value }
+
+	for _, test := range []struct {
+		condition condition
+		expected  bool
+	}{
+		{condition{Field: "uptime", Equals: 10}, true},
+		{condition{Field: "uptime", Equals: 11}, false},
+		{condition{Field: "enabled", Equals: true}, true},
+		{condition{Field: "enabled", NotEquals: true}, false},
+		{condition{Field: "temperature.value_c", Above: number(21), Below: number(22)}, true},
+		{condition{Field: "temperature.value_c", Above: number(21.5)}, false},
+		{condition{Field: "temperature", Exists: boolean(true)}, true},
+		{condition{Field: "humidity", Exists: boolean(false)}, true},
+		{condition{Field: "humidity", Equals: 1}, false},
+		{condition{Weekdays: []string{"Monday", "tue"}}, true},
+		{condition{Weekdays: []string{"sun"}}, false},
+		{condition{After: "21:00", Before: "22:00"}, true},
+		{condition{After: "22:00", Before: "06:00"}, false},
+		{condition{After: "21:00", Before: "06:00"}, true},
+		{condition{After: "sunset", Before: "sunrise"}, true},
+		{condition{After: "sunset + 1h30m"}, false},
+		{condition{Before: "sunset+1h30m"}, true},
+		{condition{After: "sunrise", Before: "sunset"}, false},
+		{condition{After: "dusk", Before: "dawn - 30m"}, true},
+		{condition{After: "solar_noon", Before: "dusk+30m"}, false},
+	} {
+		require.NoError(t, test.condition.prepare())
+		assert.Equal(t, test.expected, test.condition.matches(env), "%+v", test.condition)
+	}
+
+	// Sun does not set (polar day)
+	env.sun = &sun.Times{Sunrise: testSunTimes.Sunrise}
+	c := condition{After: "sunset"}
+	require.NoError(t, c.prepare())
+	assert.False(t, c.matches(env))
+}
+
+func TestEvaluate(t *testing.T) {
+	env := &environment{
+		dev:    device.NewDevice(0x10),
+		fields: map[string]interface{}{"uptime": uint32(10)},
+		now:    testNow,
+		sun:    &sun.Times{Sunrise: testSunTimes.Sunrise},
+	}
+	env.dev.DisplayName = "kitchen"
+
+	value, err := evaluate(map[interface{}]interface{}{
+		"uptime":  "$msg.uptime - 1",
+		"hour":    "$sunrise.hour+1",
+		"minute":  "$now.minute + 0.5",
+		"device":  "$device.display_name",
+		"escaped": "$$5",
+		"list":    []interface{}{1, "$device.id"},
+	}, env)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"uptime":  int64(9),
+		"hour":    int64(6),
+		"minute":  30.5,
+		"device":  "kitchen",
+		"escaped": "$5",
+		"list":    []interface{}{1, "0x10"},
+	}, value)
+
+	for _, expression := range []string{"$msg.unknown", "$sunset.hour", "$device.id + 1", "$now"} {
+		_, err := evaluate(expression, env)
+		assert.Error(t, err, expression)
+	}
+	assert.Error(t, validateValue([]interface{}{"$now.second"}))
+	assert.Error(t, validateValue(map[string]interface{}{"a": "$msg.x * 2"}))
+	assert.NoError(t, validateValue(map[string]interface{}{"a": "$msg.x + 2", "b": "$$"}))
+}
+
+func TestProcessMessage(t *testing.T) {
+	mock := &mockHandler{}
+	device.MustAddHandler(mock)
+	defer device.DeleteHandler(mock.GetName())
+	source, sourceTransport := newTestDevice(t, 0x1001, "button")
+	defer device.DeleteDeviceByID(source.ID)
+	target, targetTransport := newTestDevice(t, 0x1002, "lamp")
+	defer device.DeleteDeviceByID(target.ID)
+	sub := events.Subscribe(10, nil)
+	defer sub.Close()
+
+	h, cleanup := newTestHandler(t, `
+enabled: true
+rules:
+  - name: lamp
+    devices: ["button"]
+    message_types: ["*.MultiSensorStatus"]
+    when:
+      - field: temperature.value_c
+        above: 20
+      - after: sunset
+    actions:
+      - send:
+          device: lamp
+          type: openiot.JoinResponse
+          fields:
+            name: $device.display_name
+            timestamp: $sunset.hour + 1
+      - publish:
+          type: lamp_on
+          data:
+            temperature: $msg.temperature.value_c
+      - handler: rules_mock
+  - name: never
+    devices: ["0x1002"]
+    actions:
+      - handler: rules_mock
+`)
+	defer cleanup()
+
+	msg := &sensor.MultiSensorStatus{Temperature: &sensor.Temperature{ValueC: 21}}
+	require.NoError(t, h.ProcessMessage(source, testMessageType(), msg))
+
+	assert.Empty(t, sourceTransport.history)
+	require.Len(t, targetTransport.history, 1)
+	buf := bytes.NewBuffer(targetTransport.history[0])
+	hdr := &openiot.Header{}
+	require.NoError(t, encode.ReadSingleMessage(buf, hdr))
+	assert.Equal(t, target.ID, hdr.DeviceId)
+	info := &openiot.MessageInfo{}
+	resp := &openiot.JoinResponse{}
+	require.NoError(t, encode.ReadPlain(buf, info, resp))
+	assert.Equal(t, "button", resp.Name)
+	assert.Equal(t, int64(21), resp.Timestamp)
+
+	require.Len(t, sub.C, 1)
+	event := <-sub.C
+	assert.Equal(t, "lamp_on", event.Type)
+	assert.Equal(t, "0x1001", event.DeviceID)
+	assert.Equal(t, map[string]interface{}{"temperature": float32(21)}, event.Data)
+
+	assert.Equal(t, []proto.Message{msg}, mock.messages)
+
+	// Conditions not met
+	msg.Temperature.ValueC = 19
+	require.NoError(t, h.ProcessMessage(source, testMessageType(), msg))
+	assert.Len(t, targetTransport.history, 1)
+	assert.Len(t, mock.messages, 1)
+
+	// Action failed: target device removed
+	msg.Temperature.ValueC = 25
+	require.NoError(t, device.DeleteDeviceByID(target.ID))
+	assert.Error(t, h.ProcessMessage(source, testMessageType(), msg))
+}
+
+func TestDryRun(t *testing.T) {
+	mock := &mockHandler{}
+	device.MustAddHandler(mock)
+	defer device.DeleteHandler(mock.GetName())
+	dev, transport := newTestDevice(t, 0x1003, "")
+	defer device.DeleteDeviceByID(dev.ID)
+	sub := events.Subscribe(10, nil)
+	defer sub.Close()
+
+	h, cleanup := newTestHandler(t, `
+enabled: true
+dry_run: true
+rules:
+  - actions:
+      - send:
+          type: openiot.JoinResponse
+      - publish:
+          type: dry
+      - handler: rules_mock
+`)
+	defer cleanup()
+
+	require.NoError(t, h.ProcessMessage(dev, testMessageType(), &sensor.MultiSensorStatus{}))
+	assert.Empty(t, transport.history)
+	assert.Empty(t, sub.C)
+	assert.Empty(t, mock.messages)
+}
+
+func TestReload(t *testing.T) {
+	h, cleanup := newTestHandler(t, `
+enabled: true
+reload_interval: 0s
+rules:
+  - name: first
+    actions:
+      - publish:
+          type: first
+`)
+	defer cleanup()
+	require.Len(t, h.config.Rules, 1)
+	assert.Equal(t, "first", h.config.Rules[0].Name)
+
+	update := func(config string) {
+		require.NoError(t, ioutil.WriteFile(h.filename, []byte(config), 0644))
+		modTime := h.modTime.Add(time.Second)
+		require.NoError(t, os.Chtimes(h.filename, modTime, modTime))
+		h.reload()
+	}
+
+	update(`
+enabled: true
+rules:
+  - name: second
+    actions:
+      - publish:
+          type: second
+  - name: third
+    actions:
+      - publish:
+          type: third
+`)
+	require.Len(t, h.config.Rules, 2)
+	assert.Equal(t, "second", h.config.Rules[0].Name)
+
+	// Broken config: previous rules kept
+	update(`
+enabled: true
+rules:
+  - name: broken
+`)
+	require.Len(t, h.config.Rules, 2)
+	assert.Equal(t, "second", h.config.Rules[0].Name)
+}
+
+func TestSunEventRule(t *testing.T) {
+	lamp, lampTransport := newTestDevice(t, 0x1003, "porch_lamp")
+	defer device.DeleteDeviceByID(lamp.ID)
+	other, otherTransport := newTestDevice(t, 0x1004, "other_lamp")
+	defer device.DeleteDeviceByID(other.ID)
+
+	h, cleanup := newTestHandler(t, `
+enabled: true
+rules:
+  - name: porch
+    on: sun.sunset
+    devices: ["porch_*"]
+    actions:
+      - send:
+          type: openiot.JoinResponse
+          fields:
+            name: $device.display_name
+            timestamp: $sunset.hour
+`)
+	defer cleanup()
+
+	// Fired by main loop
+	events.Publish(&events.Event{
+		Type: sun.EventTypePrefix + sun.EventSunset,
+		Time: testNow,
+		Data: map[string]interface{}{"location": sun.DefaultLocation},
+	})
+	select {
+	case trigger := <-Queue():
+		assert.Empty(t, lampTransport.history)
+		trigger.Run()
+	case <-time.After(5 * time.Second):
+		t.Fatal("sun event not queued")
+	}
+	require.Len(t, lampTransport.history, 1)
+	assert.Empty(t, otherTransport.history)
+	buf := bytes.NewBuffer(lampTransport.history[0])
+	require.NoError(t, encode.ReadSingleMessage(buf, &openiot.Header{}))
+	resp := &openiot.JoinResponse{}
+	require.NoError(t, encode.ReadPlain(buf, &openiot.MessageInfo{}, resp))
+	assert.Equal(t, "porch_lamp", resp.Name)
+	assert.Equal(t, int64(20), resp.Timestamp)
+
+	// Other event / location, incoming message
+	require.NoError(t, h.processEvent(&events.Event{
+		Type: sun.EventTypePrefix + sun.EventSunrise,
+		Data: map[string]interface{}{"location": sun.DefaultLocation},
+	}))
+	require.NoError(t, h.processEvent(&events.Event{
+		Type: sun.EventTypePrefix + sun.EventSunset,
+		Data: map[string]interface{}{"location": "cabin"},
+	}))
+	require.NoError(t, h.ProcessMessage(lamp, testMessageType(), &sensor.MultiSensorStatus{}))
+	assert.Len(t, lampTransport.history, 1)
+}
+
+func TestConfigNegative(t *testing.T) {
+	for _, config := range []string{
+		"enabled: true\nunknown: 1\n",
+		"enabled: true\nreload_interval: often\n",
+		"enabled: true\nrules:\n  - name: a\n",
+		"enabled: true\nrules:\n  - name: a\n    actions: [{publish: {type: a}}]\n  - name: a\n    actions: [{publish: {type: a}}]\n",
+		"enabled: true\nrules:\n  - devices: ['[']\n    actions: [{publish: {type: a}}]\n",
+		"enabled: true\nrules:\n  - when: [{}]\n    actions: [{publish: {type: a}}]\n",
+		"enabled: true\nrules:\n  - when: [{equals: 1}]\n    actions: [{publish: {type: a}}]\n",
+		"enabled: true\nrules:\n  - when: [{after: '25:00'}]\n    actions: [{publish: {type: a}}]\n",
+		"enabled: true\nrules:\n  - when: [{before: 'sunset 1h'}]\n    actions: [{publish: {type: a}}]\n",
+		"enabled: true\nrules:\n  - when: [{weekdays: [someday]}]\n    actions: [{publish: {type: a}}]\n",
+		"enabled: true\nrules:\n  - actions: [{}]\n",
+		"enabled: true\nrules:\n  - actions: [{publish: {type: a}, handler: logger}]\n",
+		"enabled: true\nrules:\n  - actions: [{publish: {type: a, data: {x: $unknown.source}}}]\n",
+		"enabled: true\nrules:\n  - actions: [{send: {type: unknown.Message}}]\n",
+		"enabled: true\nrules:\n  - actions: [{handler: unknown}]\n",
+		"enabled: true\nrules:\n  - actions: [{handler: rules}]\n",
+		"enabled: true\nrules:\n  - on: sun.noon\n    devices: [a]\n    actions: [{publish: {type: a}}]\n",
+		"enabled: true\nrules:\n  - on: sun.sunset+1h\n    devices: [a]\n    actions: [{publish: {type: a}}]\n",
+		"enabled: true\nrules:\n  - on: sunset\n    devices: [a]\n    actions: [{publish: {type: a}}]\n",
+		"enabled: true\nrules:\n  - on: sun.sunset\n    actions: [{publish: {type: a}}]\n",
+		"enabled: true\nrules:\n  - on: sun.sunset\n    devices: [a]\n    message_types: [a]\n    actions: [{publish: {type: a}}]\n",
+		"enabled: true\nrules:\n  - on: sun.sunset\n    devices: [a]\n    when: [{field: a, exists: true}]\n    actions: [{publish: {type: a}}]\n",
+		"enabled: true\nrules:\n  - on: sun.sunset\n    devices: [a]\n    actions: [{handler: logger}]\n",
+	} {
+		dir, err := ioutil.TempDir("", "rules")
+		require.NoError(t, err)
+		h := &deviceHandler{filename: filepath.Join(dir, "rules.yaml")}
+		require.NoError(t, ioutil.WriteFile(h.filename, []byte(config), 0644))
+		assert.Error(t, h.start(), config)
+		os.RemoveAll(dir)
+	}
+}
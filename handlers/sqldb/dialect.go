@@ -0,0 +1,120 @@
+package sqldb
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	// Database drivers, sqlite3 is in sqlite.go
+	_ "github.com/lib/pq"
+)
+
+// Column types, mapped into database specific types by dialect
+const (
+	typeBool = iota
+	typeInt
+	typeUint64
+	typeFloat
+	typeText
+	typeTimestamp
+)
+
+// dialect describes differences of SQL databases
+type dialect struct {
+	// Primary key column definition
+	primaryKey string
+	types      map[int]string
+	// Placeholder of n-th (from 1) query parameter
+	placeholder func(n int) string
+}
+
+var dialects = map[string]*dialect{
+	"sqlite3": {
+		primaryKey: "INTEGER PRIMARY KEY AUTOINCREMENT",
+		types: map[int]string{
+			typeBool:      "BOOLEAN",
+			typeInt:       "INTEGER",
+			typeUint64:    "INTEGER",
+			typeFloat:     "REAL",
+			typeText:      "TEXT",
+			typeTimestamp: "TIMESTAMP",
+		},
+		placeholder: func(n int) string { return "?" },
+	},
+	"postgres": {
+		primaryKey: "BIGSERIAL PRIMARY KEY",
+		types: map[int]string{
+			typeBool:      "BOOLEAN",
+			typeInt:       "BIGINT",
+			typeUint64:    "NUMERIC(20)",
+			typeFloat:     "DOUBLE PRECISION",
+			typeText:      "TEXT",
+			typeTimestamp: "TIMESTAMPTZ",
+		},
+		placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+	},
+}
+
+// placeholders returns comma separated placeholders for count parameters
+func (d *dialect) placeholders(count int) string {
+	values := make([]string, count)
+	for i := range values {
+		values[i] = d.placeholder(i + 1)
+	}
+	return strings.Join(values, ", ")
+}
+
+// quote quotes identifier (table / column name)
+func quote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// identifier converts protobuf / field name into lower case SQL identifier,
+// e.g. "openiot.sensor.MultiSensorStatus" -> "openiot_sensor_multisensorstatus"
+func identifier(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, name)
+}
+
+// columnType returns column type of flattened field (see utils.ListFlattenedFields).
+// Oneof names, enums, bytes and repeated fields (as JSON) are stored as text.
+func columnType(field protoreflect.FieldDescriptor) int {
+	if field == nil || field.IsList() || field.IsMap() {
+		return typeText
+	}
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return typeBool
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return typeInt
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return typeUint64
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return typeFloat
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		switch field.Message().FullName() {
+		case "google.protobuf.Timestamp":
+			return typeTimestamp
+		case "google.protobuf.Duration":
+			// Seconds
+			return typeFloat
+		case "google.protobuf.BytesValue":
+			return typeText
+		}
+		// Wrappers
+		if value := field.Message().Fields().ByName("value"); value != nil {
+			return columnType(value)
+		}
+	}
+	return typeText
+}
@@ -0,0 +1,195 @@
+package sqldb
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/open-iot-devices/protobufs/go/openiot/sensor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/open-iot-devices/server/device"
+)
+
+func newTestHandler(t *testing.T) (*deviceHandler, func()) {
+	if !contains(sql.Drivers(), "sqlite3") {
+		t.Skip("sqlite3 driver is not compiled in")
+	}
+	dir, err := ioutil.TempDir("", "sqldb")
+	require.NoError(t, err)
+	h := &deviceHandler{config: sqlConfig{
+		Enabled:      true,
+		DSN:          filepath.Join(dir, "test.db"),
+		StoreDevices: true,
+	}}
+	require.NoError(t, h.start())
+	return h, func() {
+		h.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestDevice() *device.Device {
+	dev := device.NewDevice(0x1234)
+	dev.DisplayName = "kitchen"
+	dev.ProtobufName = testMessageType()
+	return dev
+}
+
+func testMessageType() string {
+	return string(proto.MessageReflect(&sensor.MultiSensorStatus{}).Descriptor().FullName())
+}
+
+func TestStoreMessages(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	dev := newTestDevice()
+	h.AddDevice(dev)
+
+	var displayName string
+	var lastSeen *time.Time
+	row := h.db.QueryRow(`SELECT "display_name", "last_seen" FROM "devices" WHERE "id" = ?`, dev.IDhex)
+	require.NoError(t, row.Scan(&displayName, &lastSeen))
+	assert.Equal(t, "kitchen", displayName)
+	assert.Nil(t, lastSeen)
+
+	for i := 1; i <= 2; i++ {
+		msg := &sensor.MultiSensorStatus{
+			Temperature: &sensor.Temperature{ValueC: 20 + float32(i)},
+			Uptime:      uint32(i),
+		}
+		require.NoError(t, h.ProcessMessage(dev, testMessageType(), msg))
+	}
+
+	rows, err := h.db.Query(`SELECT "device_id", "temperature_value_c", "uptime" FROM ` +
+		quote(identifier(testMessageType())) + ` ORDER BY "id"`)
+	require.NoError(t, err)
+	defer rows.Close()
+	var results [][]interface{}
+	for rows.Next() {
+		var id string
+		var temperature float64
+		var uptime int64
+		require.NoError(t, rows.Scan(&id, &temperature, &uptime))
+		results = append(results, []interface{}{id, temperature, uptime})
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, [][]interface{}{
+		{"0x1234", float64(21), int64(1)},
+		{"0x1234", float64(22), int64(2)},
+	}, results)
+
+	// Device renamed, last seen updated
+	dev.DisplayName = "bedroom"
+	require.NoError(t, h.ProcessMessage(dev, testMessageType(), &sensor.MultiSensorStatus{}))
+	row = h.db.QueryRow(`SELECT "display_name", "last_seen" FROM "devices" WHERE "id" = ?`, dev.IDhex)
+	require.NoError(t, row.Scan(&displayName, &lastSeen))
+	assert.Equal(t, "bedroom", displayName)
+	require.NotNil(t, lastSeen)
+	assert.WithinDuration(t, time.Now(), *lastSeen, time.Minute)
+}
+
+func TestSchemaEvolution(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	dev := newTestDevice()
+
+	// Table created by older version of protobuf: only uptime field
+	name := quote(identifier(testMessageType()))
+	_, err := h.db.Exec(`CREATE TABLE ` + name + ` ("id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"timestamp" TIMESTAMP NOT NULL, "device_id" TEXT NOT NULL, "uptime" INTEGER)`)
+	require.NoError(t, err)
+	_, err = h.db.Exec(`INSERT INTO `+name+` ("timestamp", "device_id", "uptime") VALUES (?, ?, ?)`,
+		time.Now(), "0x1", 5)
+	require.NoError(t, err)
+
+	msg := &sensor.MultiSensorStatus{Temperature: &sensor.Temperature{ValueC: 20}}
+	require.NoError(t, h.ProcessMessage(dev, testMessageType(), msg))
+
+	columns, err := h.columns(identifier(testMessageType()))
+	require.NoError(t, err)
+	assert.True(t, columns["temperature_value_c"])
+	var count int
+	require.NoError(t, h.db.QueryRow(`SELECT COUNT(*) FROM `+name+` WHERE "uptime" = 5`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
+
+func TestSchemaReload(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	dev := newTestDevice()
+
+	// Dynamic message "test.Reload", the same as loaded from descriptor sets
+	makeMessage := func(fields ...string) *dynamicpb.Message {
+		msg := &descriptorpb.DescriptorProto{Name: proto.String("Reload")}
+		for index, name := range fields {
+			msg.Field = append(msg.Field, &descriptorpb.FieldDescriptorProto{
+				Name:     proto.String(name),
+				JsonName: proto.String(name),
+				Number:   proto.Int32(int32(index + 1)),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_UINT32.Enum(),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			})
+		}
+		file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+			Name:        proto.String("test/reload.proto"),
+			Package:     proto.String("test"),
+			Syntax:      proto.String("proto3"),
+			MessageType: []*descriptorpb.DescriptorProto{msg},
+		}, nil)
+		require.NoError(t, err)
+		result := dynamicpb.NewMessage(file.Messages().Get(0))
+		for index := range fields {
+			field := file.Messages().Get(0).Fields().Get(index)
+			result.Set(field, protoreflect.ValueOfUint32(uint32(index+1)))
+		}
+		return result
+	}
+
+	require.NoError(t, h.ProcessMessage(dev, "test.Reload", makeMessage("a")))
+	// Schemas reloaded: field added
+	require.NoError(t, h.ProcessMessage(dev, "test.Reload", makeMessage("a", "b")))
+
+	columns, err := h.columns("test_reload")
+	require.NoError(t, err)
+	assert.True(t, columns["b"])
+	var count int
+	require.NoError(t, h.db.QueryRow(`SELECT COUNT(*) FROM "test_reload" WHERE "b" = 2`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
+
+func TestDialects(t *testing.T) {
+	assert.Equal(t, "?, ?", dialects["sqlite3"].placeholders(2))
+	assert.Equal(t, "$1, $2, $3", dialects["postgres"].placeholders(3))
+	assert.Equal(t, "openiot_sensor_multisensorstatus", identifier("openiot.sensor.MultiSensorStatus"))
+	assert.Equal(t, `"a""b"`, quote(`a"b`))
+
+	value, err := columnValue(uint64(1) << 63)
+	require.NoError(t, err)
+	assert.Equal(t, "9223372036854775808", value)
+	value, err = columnValue([]interface{}{uint32(1), uint32(2)})
+	require.NoError(t, err)
+	assert.Equal(t, "[1,2]", value)
+	value, err = columnValue(90 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, float64(90), value)
+}
+
+func TestConfigNegative(t *testing.T) {
+	for _, config := range []sqlConfig{
+		{Driver: "oracle"},
+		{Driver: "postgres"},
+	} {
+		h := &deviceHandler{config: config}
+		assert.Error(t, h.start())
+	}
+}
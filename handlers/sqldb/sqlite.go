@@ -0,0 +1,7 @@
+//go:build cgo
+// +build cgo
+
+package sqldb
+
+// SQLite driver requires cgo, server built with CGO_ENABLED=0 supports postgres only
+import _ "github.com/mattn/go-sqlite3"
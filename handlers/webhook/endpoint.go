@@ -0,0 +1,321 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/open-iot-devices/server/device"
+)
+
+// Header carrying HMAC-SHA256 of request body, "sha256=<hex>"
+const signatureHeader = "X-OpenIoT-Signature"
+
+type endpointConfig struct {
+	Name        string
+	URL         string
+	Method      string            `yaml:",omitempty"`
+	Headers     map[string]string `yaml:",omitempty"`
+	ContentType string            `yaml:"content_type,omitempty"`
+	// Go text/template of request body, JSON of message is used when empty
+	Template string `yaml:",omitempty"`
+	// Secret to sign request body with (HMAC-SHA256)
+	Secret  string `yaml:",omitempty"`
+	Timeout string `yaml:",omitempty"`
+	// Amount of pending calls, new ones are dropped when queue is full
+	QueueSize int `yaml:"queue_size,omitempty"`
+	// Amount of concurrent requests to endpoint
+	Concurrency int `yaml:",omitempty"`
+	// Retries of failed call, with exponential delay starting from RetryDelay
+	MaxRetries int    `yaml:"max_retries,omitempty"`
+	RetryDelay string `yaml:"retry_delay,omitempty"`
+
+	// Filters, empty means everything. Shell patterns (path.Match) are allowed.
+	// Devices matches device ID (0x...) or display name
+	Devices      []string `yaml:",omitempty"`
+	MessageTypes []string `yaml:"message_types,omitempty"`
+	// Call endpoint only when message has at least one of fields (flattened name)
+	Fields []string `yaml:",omitempty"`
+}
+
+// templateData is what body template is executed with
+type templateData struct {
+	Device    *deviceInfo
+	Type      string
+	Fields    map[string]interface{}
+	Timestamp time.Time
+}
+
+// deviceInfo is device as seen by templates: no key / sequences
+type deviceInfo struct {
+	ID           uint64
+	IDhex        string
+	Name         string
+	DisplayName  string
+	Manufacturer string
+	ProductURL   string
+	Handlers     []string
+	Transport    string
+}
+
+func newDeviceInfo(dev *device.Device) *deviceInfo {
+	return &deviceInfo{
+		ID:           dev.ID,
+		IDhex:        dev.IDhex,
+		Name:         dev.Name,
+		DisplayName:  dev.DisplayName,
+		Manufacturer: dev.Manufacturer,
+		ProductURL:   dev.ProductURL,
+		Handlers:     append([]string{}, dev.HandlerNames...),
+		Transport:    dev.TransportName,
+	}
+}
+
+type endpoint struct {
+	config     endpointConfig
+	template   *template.Template
+	client     *http.Client
+	retryDelay time.Duration
+
+	queue  chan []byte
+	doneCh chan interface{}
+	wg     sync.WaitGroup
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+func newEndpoint(config *endpointConfig) (*endpoint, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	for _, list := range [][]string{config.Devices, config.MessageTypes, config.Fields} {
+		for _, pattern := range list {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid filter '%s': %v", pattern, err)
+			}
+		}
+	}
+	if config.Method == "" {
+		config.Method = http.MethodPost
+	}
+	if config.ContentType == "" {
+		config.ContentType = "application/json"
+	}
+	switch {
+	case config.QueueSize == 0:
+		config.QueueSize = 1000
+	case config.QueueSize < 0:
+		return nil, fmt.Errorf("queue_size must not be negative")
+	}
+	switch {
+	case config.Concurrency == 0:
+		config.Concurrency = 1
+	case config.Concurrency < 0:
+		return nil, fmt.Errorf("concurrency must not be negative")
+	}
+	timeout, err := parseDuration(config.Timeout, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("timeout: %v", err)
+	}
+	retryDelay, err := parseDuration(config.RetryDelay, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("retry_delay: %v", err)
+	}
+
+	ep := &endpoint{
+		config:     *config,
+		client:     &http.Client{Timeout: timeout},
+		retryDelay: retryDelay,
+		queue:      make(chan []byte, config.QueueSize),
+		doneCh:     make(chan interface{}),
+	}
+	if config.Template != "" {
+		tmpl, err := template.New(config.Name).Funcs(templateFuncs).Parse(config.Template)
+		if err != nil {
+			return nil, err
+		}
+		ep.template = tmpl
+	}
+
+	return ep, nil
+}
+
+func (ep *endpoint) start() {
+	for i := 0; i < ep.config.Concurrency; i++ {
+		ep.wg.Add(1)
+		go ep.run()
+	}
+}
+
+// stop stops retries and waits until everything queued is sent
+func (ep *endpoint) stop() {
+	close(ep.doneCh)
+	close(ep.queue)
+	ep.wg.Wait()
+	ep.client.CloseIdleConnections()
+}
+
+// matches returns true when message passes all filters of endpoint
+func (ep *endpoint) matches(data *templateData) bool {
+	if len(ep.config.Devices) > 0 &&
+		!matchAny(ep.config.Devices, data.Device.IDhex, data.Device.DisplayName) {
+		return false
+	}
+	if len(ep.config.MessageTypes) > 0 && !matchAny(ep.config.MessageTypes, data.Type) {
+		return false
+	}
+	if len(ep.config.Fields) > 0 {
+		for name := range data.Fields {
+			if matchAny(ep.config.Fields, name) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// render makes request body
+func (ep *endpoint) render(data *templateData) ([]byte, error) {
+	if ep.template == nil {
+		return json.Marshal(map[string]interface{}{
+			"device": map[string]string{
+				"id":           data.Device.IDhex,
+				"name":         data.Device.Name,
+				"display_name": data.Device.DisplayName,
+				"manufacturer": data.Device.Manufacturer,
+			},
+			"type":      data.Type,
+			"timestamp": data.Timestamp,
+			"fields":    data.Fields,
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := ep.template.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// enqueue schedules call with body, drops it when queue is full
+func (ep *endpoint) enqueue(body []byte) {
+	select {
+	case ep.queue <- body:
+	default:
+		metricDropped.Inc(ep.config.Name)
+		glog.Infof("Webhook %s: queue is full, call dropped", ep.config.Name)
+	}
+}
+
+func (ep *endpoint) run() {
+	defer ep.wg.Done()
+
+	for body := range ep.queue {
+		ep.deliver(body)
+	}
+}
+
+// deliver calls endpoint, retrying with exponential delay until
+// MaxRetries exceeded or endpoint stopped
+func (ep *endpoint) deliver(body []byte) {
+	delay := ep.retryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := ep.call(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= ep.config.MaxRetries {
+			metricDropped.Inc(ep.config.Name)
+			glog.Infof("Webhook %s: %v, call dropped", ep.config.Name, err)
+			return
+		}
+		glog.V(2).Infof("Webhook %s: %v, retry in %v", ep.config.Name, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ep.doneCh:
+			metricDropped.Inc(ep.config.Name)
+			glog.Infof("Webhook %s: %v, call dropped on shutdown", ep.config.Name, err)
+			return
+		}
+		delay *= 2
+	}
+}
+
+// call makes single HTTP request. Returns whether failed request
+// is worth to retry (network errors, 5xx and 429)
+func (ep *endpoint) call(body []byte) (bool, error) {
+	req, err := http.NewRequest(ep.config.Method, ep.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", ep.config.ContentType)
+	for name, value := range ep.config.Headers {
+		req.Header.Set(name, value)
+	}
+	if ep.config.Secret != "" {
+		req.Header.Set(signatureHeader, "sha256="+sign(ep.config.Secret, body))
+	}
+
+	resp, err := ep.client.Do(req)
+	if err != nil {
+		metricRequests.Inc(ep.config.Name, "error")
+		return true, err
+	}
+	// Read body to allow connection reuse
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	metricRequests.Inc(ep.config.Name, strconv.Itoa(resp.StatusCode))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("%s %s: %s", ep.config.Method, ep.config.URL,
+		strings.TrimSpace(resp.Status))
+}
+
+// parseDuration parses value, returns defaultValue when it is empty
+func parseDuration(value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// sign returns hex HMAC-SHA256 of body
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,148 @@
+package webhook
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"gopkg.in/yaml.v2"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/utils"
+	"github.com/open-iot-devices/server/utils/metrics"
+)
+
+const handlerName = "webhook"
+
+type webhookConfig struct {
+	Enabled   bool
+	Endpoints []*endpointConfig
+}
+
+type deviceHandler struct {
+	config    webhookConfig
+	endpoints []*endpoint
+
+	mutex   sync.RWMutex
+	stopped bool
+}
+
+var flagConfigFilename = flag.String("config.webhook", ".config/webhook.yaml", "Webhooks config filename")
+
+// Every element of repeated field and enum name is available to templates
+var flattenOptions = utils.FlattenOptions{SplitRepeated: true, EnumNames: true}
+
+var (
+	metricRequests = metrics.NewCounter("openiot_webhook_requests_total",
+		"Webhook HTTP requests by endpoint and result (HTTP status or error)", "endpoint", "result")
+	metricDropped = metrics.NewCounter("openiot_webhook_dropped_total",
+		"Webhook calls dropped because of full queue or exhausted retries", "endpoint")
+)
+
+func (h *deviceHandler) GetName() string {
+	return handlerName
+}
+
+func (h *deviceHandler) Start() error {
+	// Load configuration
+	reader, err := os.Open(*flagConfigFilename)
+	if err != nil {
+		// This is not fatal error, continue
+		glog.Infof("Unable to load config: %v, webhooks disabled.", err)
+		return nil
+	}
+	defer reader.Close()
+	decoder := yaml.NewDecoder(reader)
+	decoder.SetStrict(true)
+	if err := decoder.Decode(&h.config); err != nil {
+		return err
+	}
+	if !h.config.Enabled {
+		glog.Infof("Webhooks disabled")
+		return nil
+	}
+
+	return h.start()
+}
+
+// start creates endpoints from config and starts their workers
+func (h *deviceHandler) start() error {
+	names := map[string]bool{}
+	for index, config := range h.config.Endpoints {
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("endpoint%d", index)
+		}
+		if names[config.Name] {
+			return fmt.Errorf("webhook: duplicate endpoint name '%s'", config.Name)
+		}
+		names[config.Name] = true
+
+		ep, err := newEndpoint(config)
+		if err != nil {
+			return fmt.Errorf("webhook %s: %v", config.Name, err)
+		}
+		h.endpoints = append(h.endpoints, ep)
+	}
+	for _, ep := range h.endpoints {
+		ep.start()
+		glog.Infof("Webhook %s -> %s", ep.config.Name, ep.config.URL)
+	}
+
+	return nil
+}
+
+// Stop waits until all queued calls are made
+func (h *deviceHandler) Stop() {
+	h.mutex.Lock()
+	h.stopped = true
+	h.mutex.Unlock()
+
+	for _, ep := range h.endpoints {
+		ep.stop()
+	}
+}
+
+func (h *deviceHandler) AddDevice(device *device.Device) {
+
+}
+
+func (h *deviceHandler) RemoveDevice(device *device.Device) {
+
+}
+
+func (h *deviceHandler) ProcessMessage(dev *device.Device, msgType string, msg proto.Message) error {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if h.stopped || len(h.endpoints) == 0 {
+		return nil
+	}
+
+	data := &templateData{
+		Device:    newDeviceInfo(dev),
+		Type:      msgType,
+		Fields:    utils.FlattenProtobuf(msg, flattenOptions),
+		Timestamp: time.Now(),
+	}
+	for _, ep := range h.endpoints {
+		if !ep.matches(data) {
+			continue
+		}
+		body, err := ep.render(data)
+		if err != nil {
+			glog.Infof("0x%x: webhook %s: %v", dev.ID, ep.config.Name, err)
+			continue
+		}
+		ep.enqueue(body)
+	}
+
+	return nil
+}
+
+// Register device handler
+func init() {
+	device.MustAddHandler(&deviceHandler{})
+}
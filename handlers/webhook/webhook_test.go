@@ -0,0 +1,224 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/open-iot-devices/protobufs/go/openiot/sensor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/server/device"
+)
+
+// webhookServer records received requests, failing first "failures" of them
+type webhookServer struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	failures int
+	status   int
+	requests []*http.Request
+	bodies   []string
+}
+
+func newWebhookServer() *webhookServer {
+	s := &webhookServer{status: http.StatusServiceUnavailable}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.failures > 0 {
+			s.failures--
+			w.WriteHeader(s.status)
+			return
+		}
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(body))
+	}))
+	return s
+}
+
+func (s *webhookServer) received() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.bodies...)
+}
+
+// waitFor polls condition until it becomes true, fails test after 5 seconds
+func waitFor(t *testing.T, condition func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestHandler(t *testing.T, configs ...*endpointConfig) *deviceHandler {
+	h := &deviceHandler{config: webhookConfig{Enabled: true, Endpoints: configs}}
+	require.NoError(t, h.start())
+	return h
+}
+
+func newTestDevice() *device.Device {
+	dev := device.NewDevice(0x1234)
+	dev.Name = "multisensor"
+	dev.DisplayName = "kitchen"
+	return dev
+}
+
+func TestDefaultBody(t *testing.T) {
+	server := newWebhookServer()
+	defer server.Close()
+	h := newTestHandler(t, &endpointConfig{
+		URL:     server.URL,
+		Secret:  "secret",
+		Headers: map[string]string{"X-Test": "1"},
+	})
+	dev := newTestDevice()
+
+	msg := &sensor.MultiSensorStatus{
+		Temperature: &sensor.Temperature{ValueC: 21.5},
+		Uptime:      100,
+	}
+	require.NoError(t, h.ProcessMessage(dev, "sensor.MultiSensorStatus", msg))
+	h.Stop()
+
+	bodies := server.received()
+	require.Len(t, bodies, 1)
+	req := server.requests[0]
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "1", req.Header.Get("X-Test"))
+	assert.Equal(t, "sha256="+sign("secret", []byte(bodies[0])), req.Header.Get(signatureHeader))
+
+	var decoded struct {
+		Device map[string]string
+		Type   string
+		Fields map[string]interface{}
+	}
+	require.NoError(t, json.Unmarshal([]byte(bodies[0]), &decoded))
+	assert.Equal(t, "0x1234", decoded.Device["id"])
+	assert.Equal(t, "kitchen", decoded.Device["display_name"])
+	assert.Equal(t, "Unknown", decoded.Device["manufacturer"])
+	assert.Equal(t, "sensor.MultiSensorStatus", decoded.Type)
+	assert.Equal(t, 21.5, decoded.Fields["temperature.value_c"])
+	assert.Equal(t, float64(100), decoded.Fields["uptime"])
+}
+
+func TestTemplateAndFilters(t *testing.T) {
+	server := newWebhookServer()
+	defer server.Close()
+	h := newTestHandler(t,
+		&endpointConfig{
+			Name:     "temperature",
+			URL:      server.URL,
+			Template: `{{.Device.DisplayName}} {{index .Fields "temperature.value_c"}} {{json .Device.IDhex}}`,
+			Devices:  []string{"kitch*"},
+			Fields:   []string{"temperature.*"},
+		},
+		&endpointConfig{
+			Name:         "other",
+			URL:          server.URL,
+			MessageTypes: []string{"openiot.*"},
+		},
+	)
+	dev := newTestDevice()
+	other := device.NewDevice(0x5678)
+
+	require.NoError(t, h.ProcessMessage(dev, "sensor.MultiSensorStatus",
+		&sensor.MultiSensorStatus{Temperature: &sensor.Temperature{ValueC: 20}}))
+	// Filtered out: no temperature / other device
+	require.NoError(t, h.ProcessMessage(dev, "sensor.MultiSensorStatus",
+		&sensor.MultiSensorStatus{Uptime: 1}))
+	require.NoError(t, h.ProcessMessage(other, "sensor.MultiSensorStatus",
+		&sensor.MultiSensorStatus{Temperature: &sensor.Temperature{ValueC: 20}}))
+	h.Stop()
+
+	assert.Equal(t, []string{`kitchen 20 "0x1234"`}, server.received())
+}
+
+func TestTemplateNoKey(t *testing.T) {
+	dev := newTestDevice()
+	dev.SetKey([]byte("0123456789abcdef"))
+	ep, err := newEndpoint(&endpointConfig{URL: "http://localhost", Template: "{{.Device.KeyString}}"})
+	require.NoError(t, err)
+
+	_, err = ep.render(&templateData{Device: newDeviceInfo(dev)})
+	assert.Error(t, err)
+	ep, err = newEndpoint(&endpointConfig{URL: "http://localhost", Template: "{{json .Device}}"})
+	require.NoError(t, err)
+	body, err := ep.render(&templateData{Device: newDeviceInfo(dev)})
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), dev.KeyString)
+	assert.Contains(t, string(body), `"DisplayName":"kitchen"`)
+}
+
+func TestRetry(t *testing.T) {
+	server := newWebhookServer()
+	defer server.Close()
+	server.failures = 2
+	h := newTestHandler(t, &endpointConfig{
+		Name:       "retry",
+		URL:        server.URL,
+		Template:   "{{.Type}}",
+		MaxRetries: 3,
+		RetryDelay: "1ms",
+	})
+	dev := newTestDevice()
+	failed := metricRequests.Value("retry", "503")
+
+	require.NoError(t, h.ProcessMessage(dev, "test", &sensor.MultiSensorStatus{}))
+	waitFor(t, func() bool {
+		return len(server.received()) == 1
+	})
+	h.Stop()
+	assert.Equal(t, []string{"test"}, server.received())
+	assert.Equal(t, float64(2), metricRequests.Value("retry", "503")-failed)
+
+	// Client errors are not retried
+	server.mutex.Lock()
+	server.failures = 1
+	server.status = http.StatusBadRequest
+	server.mutex.Unlock()
+	h = newTestHandler(t, &endpointConfig{
+		Name:       "noretry",
+		URL:        server.URL,
+		MaxRetries: 3,
+		RetryDelay: "1ms",
+	})
+	dropped := metricDropped.Value("noretry")
+	failed = metricRequests.Value("noretry", "400")
+	require.NoError(t, h.ProcessMessage(dev, "test", &sensor.MultiSensorStatus{}))
+	waitFor(t, func() bool {
+		return metricDropped.Value("noretry") == dropped+1
+	})
+	h.Stop()
+	assert.Len(t, server.received(), 1)
+	assert.Equal(t, float64(1), metricRequests.Value("noretry", "400")-failed)
+}
+
+func TestConfigNegative(t *testing.T) {
+	for _, config := range []*endpointConfig{
+		{},
+		{URL: "http://localhost", Template: "{{.Unclosed"},
+		{URL: "http://localhost", Devices: []string{"["}},
+		{URL: "http://localhost", Timeout: "10"},
+		{URL: "http://localhost", QueueSize: -1},
+		{URL: "http://localhost", Concurrency: -1},
+	} {
+		h := &deviceHandler{config: webhookConfig{Endpoints: []*endpointConfig{config}}}
+		assert.Error(t, h.start())
+	}
+	h := &deviceHandler{config: webhookConfig{Endpoints: []*endpointConfig{
+		{Name: "a", URL: "http://localhost"},
+		{Name: "a", URL: "http://localhost"},
+	}}}
+	assert.Error(t, h.start())
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/open-iot-devices/server/admin"
+	"github.com/open-iot-devices/server/admin/ui"
+	"github.com/open-iot-devices/server/utils/metrics"
+)
+
+var flagHTTPAddr = flag.String("http.addr", ":8080", "Listen address of built-in HTTP server (/metrics, /api/, /ui/), empty to disable")
+var flagHTTPCert = flag.String("http.tls_cert", "", "TLS certificate file of HTTP server, admin API and UI are served only with TLS unless http.addr is loopback")
+var flagHTTPKey = flag.String("http.tls_key", "", "TLS private key file of HTTP server")
+
+// httpMux contains all HTTP endpoints served by server
+var httpMux = http.NewServeMux()
+
+func init() {
+	httpMux.Handle("/metrics", metrics.Handler())
+}
+
+// mountAdmin adds admin API and UI to httpMux. Bearer token must not be sent
+// in plain text over network, so without TLS only loopback address is allowed.
+func mountAdmin(addr string, tls bool) {
+	if !tls && !isLoopback(addr) {
+		glog.Warningf("Admin API and UI disabled: TLS (-http.tls_cert / -http.tls_key) is required to serve them on %s", addr)
+		return
+	}
+	httpMux.Handle("/api/", admin.Handler())
+	httpMux.Handle("/ui/", ui.Handler())
+}
+
+// startHTTPServer starts HTTP server, it will be terminated once doneCh closed
+func startHTTPServer(wg *sync.WaitGroup, doneCh chan interface{}) {
+	if *flagHTTPAddr == "" {
+		glog.Info("HTTP server disabled")
+		return
+	}
+	tls := *flagHTTPCert != "" || *flagHTTPKey != ""
+	mountAdmin(*flagHTTPAddr, tls)
+	// No WriteTimeout: /api/stream is long living
+	server := &http.Server{
+		Addr:              *flagHTTPAddr,
+		Handler:           httpMux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		glog.Infof("HTTP server listening on %s", *flagHTTPAddr)
+		var err error
+		if tls {
+			err = server.ListenAndServeTLS(*flagHTTPCert, *flagHTTPKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			glog.Errorf("HTTP server failed: %v", err)
+		}
+	}()
+	go func() {
+		<-doneCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+}
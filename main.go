@@ -12,14 +12,26 @@ import (
 
 	"github.com/golang/glog"
 
+	"github.com/open-iot-devices/server/admin"
 	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/handlers/mqtt"
+	"github.com/open-iot-devices/server/handlers/rules"
 	"github.com/open-iot-devices/server/processor"
+	"github.com/open-iot-devices/server/scheduler"
 	"github.com/open-iot-devices/server/transport"
+	"github.com/open-iot-devices/server/utils"
+	"github.com/open-iot-devices/server/utils/schema"
 	"github.com/open-iot-devices/server/utils/sun"
 )
 
 var flagTransportsFilename = flag.String("config.transports", ".config/transports.yaml", "Transports config filename")
 var flagDevicesFilename = flag.String("config.devices", ".config/devices.yaml", "Devices config filename")
+var flagSchemasDir = flag.String("config.schemas", ".config/schemas", "Directory with protobuf descriptor sets (protoc --include_imports -o)")
+var flagMetadataFilename = flag.String("config.metadata", ".config/metadata.yaml", "Protobuf fields metadata (units, scale, tags) config filename")
+var flagJoinRulesFilename = flag.String("config.join_rules", ".config/join_rules.yaml", "Device join rules config filename")
+var flagLocationsFilename = flag.String("config.locations", ".config/locations.yaml", "Named locations (coordinates for sun data) config filename")
+var flagSchedulerFilename = flag.String("config.scheduler", ".config/scheduler.yaml", "Scheduled jobs config filename")
+var flagSchedulerState = flag.String("scheduler.state", ".config/scheduler_state.yaml", "Filename to persist scheduled jobs last run times")
 var flagMsgBuffer = flag.Uint("buffer", 32, "Receive message buffer size, in messages")
 
 func main() {
@@ -31,6 +43,14 @@ func main() {
 	var wg sync.WaitGroup
 	doneCh := make(chan interface{})
 
+	// Load dynamic protobufs (in addition to compiled in)
+	if err := schema.Load(*flagSchemasDir); err != nil {
+		glog.Fatalf("Unable to load protobuf schemas: %v", err)
+	}
+
+	loadFieldMetadata(*flagMetadataFilename)
+	loadSunLocations(*flagLocationsFilename)
+
 	// Load transports
 	if fd, err := os.Open(*flagTransportsFilename); err == nil {
 		if err := transport.LoadTransports(fd); err != nil {
@@ -65,6 +85,22 @@ func main() {
 	} else {
 		glog.Errorf("Unable to open: %v", err)
 	}
+	// Load rules for newly joined devices
+	if fd, err := os.Open(*flagJoinRulesFilename); err == nil {
+		if err := processor.LoadJoinRules(fd); err != nil {
+			glog.Fatalf("Unable to LoadJoinRules: %v", err)
+		}
+	} else {
+		glog.Infof("Join rules not loaded: %v", err)
+	}
+	// Persist new device key right after key rotation
+	processor.OnDeviceKeyChanged = func(dev *device.Device) {
+		saveDevicesToFile(*flagDevicesFilename)
+	}
+	// ... and changes made using admin API
+	admin.OnDevicesChanged = func() {
+		saveDevicesToFile(*flagDevicesFilename)
+	}
 	// Print all devices
 	glog.Info("Registered devices:")
 	for _, dev := range device.GetAllDevices() {
@@ -99,14 +135,23 @@ func main() {
 		}(&wg, tr)
 	}
 
-	glog.Info("Starting sun data updater...")
+	startHTTPServer(&wg, doneCh)
+	startGRPCServer(&wg, doneCh)
+
+	glog.Info("Starting sun events / data cross-check...")
 	if err := sun.Start(context.Background()); err != nil {
-		glog.Fatalf("Unable to start sun data updater: %v", err)
+		glog.Fatalf("Unable to start sun events / data cross-check: %v", err)
 	}
 
-	// Setup SIGTERM / SIGINT
+	glog.Info("Starting scheduler...")
+	loadSchedulerJobs(*flagSchedulerFilename)
+	if err := scheduler.Start(*flagSchedulerState); err != nil {
+		glog.Fatalf("Unable to start scheduler: %v", err)
+	}
+
+	// Setup SIGTERM / SIGINT / SIGHUP (reload)
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	glog.Info("OpenIoT server ready.")
 
@@ -116,21 +161,48 @@ func main() {
 
 	// Main loop, handle:
 	// - all incoming packets from transports
+	// - scheduled jobs, admin API requests, MQTT commands, rules fired by sun events
 	// - ctrl+c
 	ticker := time.NewTicker(5 * time.Minute)
 	for {
 		select {
 		case <-ticker.C:
 			saveDevicesToFile(*flagDevicesFilename)
+			glog.Infof("Key exchange stats: %+v", processor.GetKeyExchangeStats())
 
 		case message := <-incomingMessagesCh:
 			if err := processor.ProcessMessage(message); err != nil {
 				glog.Infof("ProcessPacket failed: %v", err)
 			}
 
+		case job := <-scheduler.Queue():
+			if err := job.Run(); err != nil {
+				glog.Infof("Scheduled job failed: %v", err)
+			}
+
+		case request := <-admin.Queue():
+			request.Run()
+
+		case command := <-mqtt.Queue():
+			command.Run()
+
+		case trigger := <-rules.Queue():
+			trigger.Run()
+
 		case sig := <-signalCh:
+			if sig == syscall.SIGHUP {
+				glog.Info("Got SIGHUP, reloading protobuf schemas / metadata / locations / scheduled jobs...")
+				if err := schema.Load(*flagSchemasDir); err != nil {
+					glog.Errorf("Unable to reload protobuf schemas: %v", err)
+				}
+				loadFieldMetadata(*flagMetadataFilename)
+				loadSunLocations(*flagLocationsFilename)
+				loadSchedulerJobs(*flagSchedulerFilename)
+				continue
+			}
 			glog.Infof("Got SIG %v, terminating...", sig)
 			// Gracefully shutdown everything
+			scheduler.Stop()
 			close(doneCh)
 			wg.Wait()
 			return
@@ -138,12 +210,61 @@ func main() {
 	}
 }
 
+func loadFieldMetadata(filename string) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		glog.Infof("Fields metadata not loaded: %v", err)
+		return
+	}
+	defer fd.Close()
+	if err := utils.LoadFieldMetadata(fd); err != nil {
+		glog.Errorf("Unable to LoadFieldMetadata: %v", err)
+	}
+}
+
+func loadSunLocations(filename string) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		glog.Infof("Locations not loaded: %v", err)
+		return
+	}
+	defer fd.Close()
+	if err := sun.LoadLocations(fd); err != nil {
+		glog.Errorf("Unable to LoadLocations: %v", err)
+	}
+}
+
+func loadSchedulerJobs(filename string) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		glog.Infof("Scheduled jobs not loaded: %v", err)
+		return
+	}
+	defer fd.Close()
+	if err := scheduler.LoadJobs(fd); err != nil {
+		glog.Errorf("Unable to LoadJobs: %v", err)
+	}
+}
+
+// saveDevicesToFile atomically replaces devices configuration:
+// writes it into temporary file first, then renames it.
 func saveDevicesToFile(filename string) {
-	if fd, err := os.Create(filename); err == nil {
-		if err := device.SaveDevices(fd); err != nil {
-			glog.Errorf("Unable to SaveDevices: %v", err)
-		}
-	} else {
+	tmpFilename := filename + ".tmp"
+	fd, err := os.Create(tmpFilename)
+	if err != nil {
 		glog.Errorf("Unable to create: %v", err)
+		return
+	}
+	if err := device.SaveDevices(fd); err != nil {
+		glog.Errorf("Unable to SaveDevices: %v", err)
+		fd.Close()
+		return
+	}
+	if err := fd.Close(); err != nil {
+		glog.Errorf("Unable to SaveDevices: %v", err)
+		return
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		glog.Errorf("Unable to SaveDevices: %v", err)
 	}
 }
@@ -8,8 +8,14 @@ import (
 	_ "github.com/open-iot-devices/server/transport/udp"
 
 	// Device handlers
+	_ "github.com/open-iot-devices/server/handlers/file"
 	_ "github.com/open-iot-devices/server/handlers/influxdb"
 	_ "github.com/open-iot-devices/server/handlers/logger"
+	_ "github.com/open-iot-devices/server/handlers/mqtt"
+	_ "github.com/open-iot-devices/server/handlers/prometheus"
+	_ "github.com/open-iot-devices/server/handlers/rules"
+	_ "github.com/open-iot-devices/server/handlers/sqldb"
+	_ "github.com/open-iot-devices/server/handlers/webhook"
 
 	// Protobufs
 	_ "github.com/open-iot-devices/protobufs/go/openiot"
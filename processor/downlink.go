@@ -0,0 +1,24 @@
+package processor
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/encode"
+)
+
+// SendMessage encodes (encrypts) msg for device and sends it
+// using device's transport.
+func SendMessage(dev *device.Device, msg proto.Message) error {
+	if dev.Transport() == nil {
+		return fmt.Errorf("0x%x: device has no transport", dev.ID)
+	}
+	payload, err := encode.MakeReadyToSendDeviceMessage(dev, msg)
+	if err != nil {
+		return fmt.Errorf("0x%x: %v", dev.ID, err)
+	}
+
+	return sendPacket(dev.Transport(), payload)
+}
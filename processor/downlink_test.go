@@ -0,0 +1,39 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/encode"
+)
+
+func TestSendMessage(t *testing.T) {
+	key := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	dev := &device.Device{
+		ID:             0x78,
+		EncryptionType: openiot.EncryptionType_AES_ECB,
+	}
+	dev.SetKey(key)
+
+	// No transport yet
+	assert.Error(t, SendMessage(dev, &openiot.JoinResponse{}))
+
+	transport := &mockTransport{}
+	dev.SetTransport(transport)
+	require.NoError(t, SendMessage(dev, &openiot.JoinResponse{Name: "srv"}))
+	assert.Equal(t, uint32(1), dev.SequenceSend)
+
+	buf := transport.LastMessage()
+	hdr := &openiot.Header{}
+	require.NoError(t, encode.ReadSingleMessage(buf, hdr))
+	assert.Equal(t, dev.ID, hdr.DeviceId)
+	info := &openiot.MessageInfo{}
+	resp := &openiot.JoinResponse{}
+	require.NoError(t, encode.DecryptAndReadECB(buf, key, info, resp))
+	assert.Equal(t, uint32(1), info.Sequence)
+	assert.Equal(t, "srv", resp.Name)
+}
@@ -0,0 +1,55 @@
+package processor
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+var flagHistorySize = flag.Int("history.size", 10, "Amount of recent messages kept per device (admin API), 0 to disable")
+
+// RecentMessage is message recently received from device
+type RecentMessage struct {
+	Time    time.Time
+	Type    string
+	Message proto.Message
+}
+
+var history = map[uint64][]*RecentMessage{}
+var historyLock sync.Mutex
+
+// GetRecentMessages returns recent messages of device, oldest first
+func GetRecentMessages(id uint64) []*RecentMessage {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	return append([]*RecentMessage{}, history[id]...)
+}
+
+// DeleteRecentMessages forgets recent messages of device, e.g. when device is deleted
+func DeleteRecentMessages(id uint64) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	delete(history, id)
+}
+
+func addRecentMessage(id uint64, msgType string, msg proto.Message) {
+	if *flagHistorySize <= 0 {
+		return
+	}
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	messages := append(history[id], &RecentMessage{
+		Time:    time.Now(),
+		Type:    msgType,
+		Message: msg,
+	})
+	if len(messages) > *flagHistorySize {
+		messages = messages[len(messages)-*flagHistorySize:]
+	}
+	history[id] = messages
+}
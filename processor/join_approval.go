@@ -0,0 +1,137 @@
+package processor
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/device"
+)
+
+var flagJoinApprove = flag.Bool("join.approve", false, "Newly joined devices must be approved (admin API) before they're registered")
+var flagJoinPendingTTL = flag.Duration("join.pending_ttl", time.Hour, "Time to wait for approval of joined device, it has to join again after that")
+
+// Max amount of devices waiting for approval. Once full new joins are rejected
+// until pending ones expire, so flood of joins cannot evict legitimate ones.
+const maxPendingJoins = 128
+
+// PendingJoin is device joined network and waiting for approval
+type PendingJoin struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Manufacturer string    `json:"manufacturer"`
+	ProductURL   string    `json:"product_url"`
+	ProtobufName string    `json:"protobuf_name"`
+	Transport    string    `json:"transport"`
+	Handlers     []string  `json:"handlers"`
+	Time         time.Time `json:"time"`
+
+	hdr     *openiot.Header
+	dev     *device.Device
+	expires time.Time
+}
+
+var pendingJoins = map[uint64]*PendingJoin{}
+var pendingJoinsLock sync.Mutex
+
+// GetPendingJoins returns devices waiting for approval, oldest first
+func GetPendingJoins() []*PendingJoin {
+	pendingJoinsLock.Lock()
+	defer pendingJoinsLock.Unlock()
+	expirePendingJoins()
+
+	results := []*PendingJoin{}
+	for _, pending := range pendingJoins {
+		results = append(results, pending)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Time.Before(results[j].Time)
+	})
+	return results
+}
+
+// ApproveJoin registers pending device and sends JoinResponse to it
+func ApproveJoin(id uint64) (*device.Device, error) {
+	pending := removePendingJoin(id)
+	if pending == nil {
+		return nil, fmt.Errorf("0x%x: no pending join", id)
+	}
+	if device.FindDeviceByID(id) != nil {
+		return nil, fmt.Errorf("0x%x: device already registered", id)
+	}
+	registerJoinedDevice(pending.dev, pending.Handlers)
+
+	return pending.dev, sendJoinResponse(pending.hdr, pending.dev, pending.dev.Transport())
+}
+
+// RejectJoin forgets pending device, it has to join again
+func RejectJoin(id uint64) error {
+	if removePendingJoin(id) == nil {
+		return fmt.Errorf("0x%x: no pending join", id)
+	}
+	glog.Infof("0x%x: Join rejected", id)
+	return nil
+}
+
+func addPendingJoin(hdr *openiot.Header, dev *device.Device, handlers []string) error {
+	pendingJoinsLock.Lock()
+	defer pendingJoinsLock.Unlock()
+	expirePendingJoins()
+
+	// Duplicate JoinRequest replaces pending one
+	if _, ok := pendingJoins[dev.ID]; !ok && len(pendingJoins) >= maxPendingJoins {
+		return fmt.Errorf("0x%x: too many pending joins", dev.ID)
+	}
+	now := timeNow()
+	pendingJoins[dev.ID] = &PendingJoin{
+		ID:           dev.IDhex,
+		Name:         dev.Name,
+		Manufacturer: dev.Manufacturer,
+		ProductURL:   dev.ProductURL,
+		ProtobufName: dev.ProtobufName,
+		Transport:    dev.TransportName,
+		Handlers:     handlers,
+		Time:         now,
+		hdr:          hdr,
+		dev:          dev,
+		expires:      now.Add(*flagJoinPendingTTL),
+	}
+	glog.Infof("0x%x: Join is waiting for approval: name='%s' manufacturer='%s' protobuf='%s'",
+		dev.ID, dev.Name, dev.Manufacturer, dev.ProtobufName)
+
+	return nil
+}
+
+func findPendingJoin(id uint64) *PendingJoin {
+	pendingJoinsLock.Lock()
+	defer pendingJoinsLock.Unlock()
+	expirePendingJoins()
+
+	return pendingJoins[id]
+}
+
+func removePendingJoin(id uint64) *PendingJoin {
+	pendingJoinsLock.Lock()
+	defer pendingJoinsLock.Unlock()
+	expirePendingJoins()
+
+	pending := pendingJoins[id]
+	delete(pendingJoins, id)
+	return pending
+}
+
+// expirePendingJoins drops joins not approved in time. Must be called with lock held.
+func expirePendingJoins() {
+	now := timeNow()
+	for id, pending := range pendingJoins {
+		if now.After(pending.expires) {
+			delete(pendingJoins, id)
+			glog.Infof("0x%x: Join was not approved in time", id)
+		}
+	}
+}
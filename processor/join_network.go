@@ -5,16 +5,15 @@ import (
 	"crypto/aes"
 	"flag"
 	"fmt"
-	"math/rand"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/golang/groupcache/lru"
 
 	"github.com/open-iot-devices/protobufs/go/openiot"
 	"github.com/open-iot-devices/server/device"
 	"github.com/open-iot-devices/server/encode"
 	"github.com/open-iot-devices/server/transport"
+	"github.com/open-iot-devices/server/utils/events"
 )
 
 type keyExchangeItem struct {
@@ -24,14 +23,15 @@ type keyExchangeItem struct {
 
 var flagServerName = flag.String("server.name", "Open IoT Server", "Name of this server")
 
-// Temporary map of devices where SystemJoinResponse was sent
-var keyExchangeCache = lru.New(128)
-
 func processKeyExchangeRequest(
 	hdr *openiot.Header, buf *bytes.Buffer, transport transport.Transport) error {
 
+	// For registered devices it could be only response for server initiated key rotation
 	if dev := device.FindDeviceByID(hdr.DeviceId); dev != nil {
-		return fmt.Errorf("Key Exchange request for already registered device 0x%x", hdr.DeviceId)
+		return processRekeyResponse(dev, buf)
+	}
+	if err := keyExchangeCache.Allow(transport.GetName(), hdr.DeviceId); err != nil {
+		return err
 	}
 
 	// Deserialize KeyExchangerequest
@@ -47,12 +47,14 @@ func processKeyExchangeRequest(
 	}
 	// Generate controller's part of Diffie-Hellman key exchange
 	// and keep it until JoinRequest arrives
-	private, public := generateDiffieHellman(request.DhG, request.DhP)
+	private, public := encode.GenerateDiffieHellman(request.DhG, request.DhP)
 	entry := &keyExchangeItem{
-		key:            calculateDiffieHellmanKey(request.DhP, request.DhA, private),
+		key:            encode.DiffieHellmanKey(request.DhP, request.DhA, private),
 		encryptionType: request.EncryptionType,
 	}
-	keyExchangeCache.Add(hdr.DeviceId, entry)
+	if err := keyExchangeCache.Add(hdr.DeviceId, entry); err != nil {
+		return err
+	}
 
 	// Send KeyExchangeResponse: always un-encrypted
 	response := &openiot.KeyExchangeResponse{
@@ -71,7 +73,9 @@ func processKeyExchangeRequest(
 		entry.key,
 	)
 
-	return transport.Send(payload)
+	metricKeyExchanges.Inc("join")
+
+	return sendPacket(transport, payload)
 }
 
 func processJoinRequest(
@@ -84,8 +88,11 @@ func processJoinRequest(
 	if dev := device.FindDeviceByID(hdr.DeviceId); dev != nil {
 		encParams.key = dev.Key()
 		encParams.encryptionType = dev.EncryptionType
+	} else if pending := findPendingJoin(hdr.DeviceId); pending != nil {
+		encParams.key = pending.dev.Key()
+		encParams.encryptionType = pending.dev.EncryptionType
 	} else if keyInfo, ok := keyExchangeCache.Get(hdr.DeviceId); ok {
-		encParams = keyInfo.(*keyExchangeItem)
+		encParams = keyInfo
 	}
 
 	// Read/Decode JoinRequest
@@ -106,74 +113,57 @@ func processJoinRequest(
 		dev.DisplayName = fmt.Sprintf("device_%x", dev.ID)
 		dev.EncryptionType = encParams.encryptionType
 		dev.SetKey(encParams.key)
-		if joinRequest.DefaultHandler != "" {
-			dev.AddHandler(joinRequest.DefaultHandler)
+		// Server side rules may override / extend device's suggestions
+		handlers, err := applyJoinRules(dev, joinRequest)
+		if err != nil {
+			return err
+		}
+		keyExchangeCache.Complete(dev.ID)
+		if *flagJoinApprove {
+			// JoinResponse will be sent once approved
+			return addPendingJoin(hdr, dev, handlers)
 		}
-		device.AddDevice(dev)
-		glog.Infof("0x%x: Joined! name='%s' manufacturer='%s' url='%s' handler='%s', protobuf='%s'",
-			dev.ID,
-			dev.Name,
-			dev.Manufacturer,
-			dev.ProductURL,
-			joinRequest.DefaultHandler,
-			dev.ProtobufName,
-		)
+		registerJoinedDevice(dev, handlers)
 	} else {
 		glog.Infof("0x%x: Valid JoinRequest (dup?) from already registered device.", dev.ID)
 	}
 
-	// Send response
-	joinResp := &openiot.JoinResponse{
-		Name:      *flagServerName,
-		Timestamp: time.Now().Unix(),
-	}
-	payload, err := encode.MakeReadyToSendMessage(hdr, encParams.encryptionType, encParams.key, joinResp)
-	if err != nil {
-		return err
-	}
-	return transport.Send(payload)
+	return sendJoinResponse(hdr, dev, transport)
 }
 
-// Diffie-Hellman implementation //
-
-func generateDiffieHellman(dhG, dhP uint64) ([]uint32, []uint32) {
-	public := make([]uint32, aes.BlockSize)
-	private := make([]uint32, aes.BlockSize)
-	for i := 0; i < aes.BlockSize; i++ {
-		private[i] = rand.Uint32() % 4096
-		public[i] = uint32(
-			diffieHellmanPowMod(int(dhG), int(private[i]), int(dhP)),
-		)
+// registerJoinedDevice adds newly joined device into registry
+func registerJoinedDevice(dev *device.Device, handlers []string) {
+	for _, name := range handlers {
+		dev.AddHandler(name)
 	}
-	return private, public
+	device.AddDevice(dev)
+	metricJoins.Inc()
+	events.Publish(&events.Event{
+		Type:     EventJoined,
+		DeviceID: dev.IDhex,
+		Data: map[string]interface{}{
+			"name":          dev.Name,
+			"protobuf_name": dev.ProtobufName,
+		},
+	})
+	glog.Infof("0x%x: Joined! name='%s' manufacturer='%s' url='%s' handlers=%v, protobuf='%s'",
+		dev.ID,
+		dev.Name,
+		dev.Manufacturer,
+		dev.ProductURL,
+		dev.HandlerNames,
+		dev.ProtobufName,
+	)
 }
 
-func calculateDiffieHellmanKey(dhP uint64, public, private []uint32) []byte {
-	key := make([]byte, len(private))
-	for index := range private {
-		key[index] = byte(diffieHellmanPowMod(
-			int(public[index]),
-			int(private[index]),
-			int(dhP),
-		))
+func sendJoinResponse(hdr *openiot.Header, dev *device.Device, transport transport.Transport) error {
+	joinResp := &openiot.JoinResponse{
+		Name:      *flagServerName,
+		Timestamp: time.Now().Unix(),
 	}
-	return key
-}
-
-// it does math: g**x mod n
-func diffieHellmanPowMod(g, x, p int) int {
-	var r int
-	var y int = 1
-
-	for x > 0 {
-		r = x % 2
-		// Fast exponention
-		if r == 1 {
-			y = (y * g) % p
-		}
-		g = g * g % p
-		x = x / 2
+	payload, err := encode.MakeReadyToSendMessage(hdr, dev.EncryptionType, dev.Key(), joinResp)
+	if err != nil {
+		return err
 	}
-
-	return y
+	return sendPacket(transport, payload)
 }
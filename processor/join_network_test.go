@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"hash/crc32"
-	"math/rand"
 	"testing"
 	"time"
 
@@ -33,7 +32,7 @@ func TestKeyExchange(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		transport := &mockTransport{}
 		// Generate Key Exchange request
-		privateA, publicA := generateDiffieHellman(dhG, dhP)
+		privateA, publicA := encode.GenerateDiffieHellman(dhG, dhP)
 		keyReq := &openiot.KeyExchangeRequest{
 			DhG: dhG,
 			DhP: dhP,
@@ -55,11 +54,11 @@ func TestKeyExchange(t *testing.T) {
 		assert.False(t, hdrResp.JoinRequest)
 
 		// Validate key correctness
-		key := calculateDiffieHellmanKey(keyReq.DhP, keyResp.DhB, privateA)
+		key := encode.DiffieHellmanKey(keyReq.DhP, keyResp.DhB, privateA)
 		// Ensure that the same key is pending in the list
 		cached, ok := keyExchangeCache.Get(hdr.DeviceId)
 		assert.True(t, ok)
-		assert.Equal(t, key, cached.(*keyExchangeItem).key)
+		assert.Equal(t, key, cached.key)
 	}
 
 	// Finally only one key should be in cache
@@ -101,18 +100,6 @@ func TestKeyExchangeNegative(t *testing.T) {
 	assert.True(t, transport.Empty())
 }
 
-func TestGenerateDiffieHellman(t *testing.T) {
-	rand.Seed(1)
-	private, public := generateDiffieHellman(199, 4001)
-
-	assert.Equal(t,
-		[]uint32{1090, 1054, 2958, 2422, 2818, 780, 1650, 1368, 3728, 3912, 2445, 1375, 3909, 4067, 688, 2613},
-		private)
-	assert.Equal(t,
-		[]uint32{121, 3672, 1450, 3760, 394, 1031, 2886, 3418, 625, 1154, 3231, 2055, 755, 1524, 3610, 3203},
-		public)
-}
-
 func TestJoinNoEncryption(t *testing.T) {
 	defer device.DeleteAllDevices()
 	// When no encryption used device may simply send
@@ -292,7 +279,7 @@ func performJoinRequest(
 
 func performKeyExchangeRequest(id uint64, enc openiot.EncryptionType) ([]byte, error) {
 	// Generate Diffie Hellman numbers / KeyExchange Request
-	privateA, publicA := generateDiffieHellman(dhG, dhP)
+	privateA, publicA := encode.GenerateDiffieHellman(dhG, dhP)
 	keyReq := &openiot.KeyExchangeRequest{
 		DhG:            dhG,
 		DhP:            dhP,
@@ -334,5 +321,96 @@ func performKeyExchangeRequest(id uint64, enc openiot.EncryptionType) ([]byte, e
 	err = encode.DecryptAndRead(respBuf, openiot.EncryptionType_PLAIN, nil, keyResp)
 
 	// Calculate encryption key
-	return calculateDiffieHellmanKey(keyReq.DhP, keyResp.DhB, privateA), nil
+	return encode.DiffieHellmanKey(keyReq.DhP, keyResp.DhB, privateA), nil
+}
+
+func TestJoinApproval(t *testing.T) {
+	defer device.DeleteAllDevices()
+	defer func() { *flagJoinApprove = false }()
+	*flagJoinApprove = true
+
+	joinReq := &openiot.JoinRequest{
+		Name:           "pending1",
+		Manufacturer:   "man1",
+		ProtobufName:   "proto1",
+		DefaultHandler: "someHandler",
+	}
+	hdr := &openiot.Header{
+		DeviceId:    0x4455,
+		JoinRequest: true,
+	}
+	payload, err := encode.MakeReadyToSendMessage(hdr, openiot.EncryptionType_PLAIN, nil, joinReq)
+	require.NoError(t, err)
+	transport := &mockTransport{}
+	// Duplicates replace pending join
+	for i := 0; i < 2; i++ {
+		require.NoError(t, ProcessMessage(&Message{Source: transport, Payload: payload}))
+	}
+
+	// Device is not registered / not responded until approved
+	assert.Nil(t, device.FindDeviceByID(0x4455))
+	assert.True(t, transport.Empty())
+	pending := GetPendingJoins()
+	require.Len(t, pending, 1)
+	assert.Equal(t, "0x4455", pending[0].ID)
+	assert.Equal(t, "pending1", pending[0].Name)
+	assert.Equal(t, []string{"someHandler"}, pending[0].Handlers)
+
+	dev, err := ApproveJoin(0x4455)
+	require.NoError(t, err)
+	assert.Equal(t, dev, device.FindDeviceByID(0x4455))
+	assert.Equal(t, []string{"someHandler"}, dev.HandlerNames)
+	assert.Empty(t, GetPendingJoins())
+	// JoinResponse sent
+	buf := transport.LastMessage()
+	require.NoError(t, encode.ReadSingleMessage(buf, &openiot.Header{}))
+	joinResp := &openiot.JoinResponse{}
+	require.NoError(t, encode.ReadSingleMessage(buf, joinResp))
+	assert.Equal(t, *flagServerName, joinResp.Name)
+
+	// Reject
+	hdr.DeviceId = 0x4456
+	payload, err = encode.MakeReadyToSendMessage(hdr, openiot.EncryptionType_PLAIN, nil, joinReq)
+	require.NoError(t, err)
+	require.NoError(t, ProcessMessage(&Message{Source: transport, Payload: payload}))
+	require.NoError(t, RejectJoin(0x4456))
+	assert.Nil(t, device.FindDeviceByID(0x4456))
+
+	// Negative
+	assert.Error(t, RejectJoin(0x4456))
+	_, err = ApproveJoin(0x4456)
+	assert.Error(t, err)
+}
+
+func TestJoinApprovalExpire(t *testing.T) {
+	defer device.DeleteAllDevices()
+	defer func() { *flagJoinApprove = false }()
+	*flagJoinApprove = true
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	transport := &mockTransport{}
+	join := func(id uint64) error {
+		hdr := &openiot.Header{DeviceId: id, JoinRequest: true}
+		payload, err := encode.MakeReadyToSendMessage(hdr, openiot.EncryptionType_PLAIN, nil,
+			&openiot.JoinRequest{Name: "flood", ProtobufName: "proto1"})
+		require.NoError(t, err)
+		return ProcessMessage(&Message{Source: transport, Payload: payload})
+	}
+
+	// Fill all slots: new joins rejected
+	for id := uint64(0x10000); id < 0x10000+maxPendingJoins; id++ {
+		require.NoError(t, join(id))
+	}
+	assert.Error(t, join(0x4457))
+	assert.Nil(t, findPendingJoin(0x4457))
+
+	// Not approved in time: slots are free again
+	now = now.Add(*flagJoinPendingTTL + time.Second)
+	require.NoError(t, join(0x4457))
+	pending := GetPendingJoins()
+	require.Len(t, pending, 1)
+	assert.Equal(t, "0x4457", pending[0].ID)
+	require.NoError(t, RejectJoin(0x4457))
 }
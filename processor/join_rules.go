@@ -0,0 +1,181 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"sync"
+	"text/template"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/transport"
+	"gopkg.in/yaml.v2"
+)
+
+// JoinRule describes how to setup newly joined device.
+// Rules are evaluated in order, every matched rule is applied.
+type JoinRule struct {
+	Name  string
+	Match JoinRuleMatch
+
+	// Handlers to be associated with device. By default they
+	// extend device's suggestion (JoinRequest.DefaultHandler)
+	Handlers        []string
+	ReplaceHandlers bool `yaml:"replace_handlers"`
+	// DisplayName is text/template, e.g. "sensor_{{.IDhex}}"
+	DisplayName string `yaml:"display_name"`
+	// Transport to be used to send messages to device
+	Transport string
+	// Additional message types device may send, by type tag
+	MessageTypes map[uint32]string `yaml:"message_types"`
+
+	displayName *template.Template
+	idFrom      uint64
+	idTo        uint64
+}
+
+// JoinRuleMatch defines conditions for rule. Empty condition matches everything.
+// String conditions are shell patterns, e.g. "openiot.sensor.*"
+type JoinRuleMatch struct {
+	ProtobufName string `yaml:"protobuf_name"`
+	Manufacturer string
+	Name         string
+	IDFrom       string `yaml:"id_from"`
+	IDTo         string `yaml:"id_to"`
+}
+
+var joinRules []*JoinRule
+var joinRulesLock sync.RWMutex
+
+// LoadJoinRules reads and parses YAML join rules configuration.
+// Replaces all previously loaded rules.
+func LoadJoinRules(reader io.Reader) error {
+	var rules []*JoinRule
+	decoder := yaml.NewDecoder(reader)
+	decoder.SetStrict(true)
+	if err := decoder.Decode(&rules); err != nil && err != io.EOF {
+		return err
+	}
+
+	for index, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("join rule #%d '%s': %v", index, rule.Name, err)
+		}
+	}
+
+	joinRulesLock.Lock()
+	joinRules = rules
+	joinRulesLock.Unlock()
+
+	return nil
+}
+
+// DeleteAllJoinRules removes all join rules
+func DeleteAllJoinRules() {
+	joinRulesLock.Lock()
+	defer joinRulesLock.Unlock()
+	joinRules = nil
+}
+
+func (rule *JoinRule) compile() error {
+	// Validate patterns
+	for _, pattern := range []string{rule.Match.ProtobufName, rule.Match.Manufacturer, rule.Match.Name} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+		}
+	}
+	// Device ID range
+	rule.idFrom = 0
+	rule.idTo = ^uint64(0)
+	if rule.Match.IDFrom != "" {
+		id, err := strconv.ParseUint(rule.Match.IDFrom, 0, 64)
+		if err != nil {
+			return err
+		}
+		rule.idFrom = id
+	}
+	if rule.Match.IDTo != "" {
+		id, err := strconv.ParseUint(rule.Match.IDTo, 0, 64)
+		if err != nil {
+			return err
+		}
+		rule.idTo = id
+	}
+	if rule.idFrom > rule.idTo {
+		return fmt.Errorf("empty id range %s..%s", rule.Match.IDFrom, rule.Match.IDTo)
+	}
+	// Display name template
+	if rule.DisplayName != "" {
+		tmpl, err := template.New(rule.Name).Option("missingkey=error").Parse(rule.DisplayName)
+		if err != nil {
+			return err
+		}
+		rule.displayName = tmpl
+	}
+
+	return nil
+}
+
+func (rule *JoinRule) matches(dev *device.Device) bool {
+	if dev.ID < rule.idFrom || dev.ID > rule.idTo {
+		return false
+	}
+	return matchPattern(rule.Match.ProtobufName, dev.ProtobufName) &&
+		matchPattern(rule.Match.Manufacturer, dev.Manufacturer) &&
+		matchPattern(rule.Match.Name, dev.Name)
+}
+
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, value)
+	return matched
+}
+
+// applyJoinRules runs all matched join rules against just joined device,
+// returns final list of handler names.
+func applyJoinRules(dev *device.Device, request *openiot.JoinRequest) ([]string, error) {
+	var handlers []string
+	if request.DefaultHandler != "" {
+		handlers = append(handlers, request.DefaultHandler)
+	}
+
+	joinRulesLock.RLock()
+	defer joinRulesLock.RUnlock()
+
+	for _, rule := range joinRules {
+		if !rule.matches(dev) {
+			continue
+		}
+		if rule.ReplaceHandlers {
+			handlers = nil
+		}
+		handlers = append(handlers, rule.Handlers...)
+		if rule.displayName != nil {
+			var buf bytes.Buffer
+			if err := rule.displayName.Execute(&buf, dev); err != nil {
+				return nil, fmt.Errorf("join rule '%s': %v", rule.Name, err)
+			}
+			dev.DisplayName = buf.String()
+		}
+		for tag, name := range rule.MessageTypes {
+			if dev.MessageTypes == nil {
+				dev.MessageTypes = map[uint32]string{}
+			}
+			dev.MessageTypes[tag] = name
+		}
+		if rule.Transport != "" {
+			tr := transport.FindTransportByName(rule.Transport)
+			if tr == nil {
+				return nil, fmt.Errorf("join rule '%s': unknown transport '%s'", rule.Name, rule.Transport)
+			}
+			dev.SetTransport(tr)
+		}
+	}
+
+	return handlers, nil
+}
@@ -0,0 +1,101 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/device"
+)
+
+var testJoinRules = `
+- name: sensors
+  match:
+    protobuf_name: "openiot.sensor.*"
+  handlers: [influxdb]
+  display_name: "sensor_{{.IDhex}}"
+- name: lab
+  match:
+    manufacturer: "ACME*"
+    id_from: "0x100"
+    id_to: "0x1ff"
+  handlers: [logger]
+  replace_handlers: true
+`
+
+func TestJoinRules(t *testing.T) {
+	require.NoError(t, LoadJoinRules(strings.NewReader(testJoinRules)))
+	defer DeleteAllJoinRules()
+
+	runs := []struct {
+		id           uint64
+		protobuf     string
+		manufacturer string
+		handler      string
+		handlers     []string
+		displayName  string
+	}{
+		// No rules matched: device's suggestion used
+		{0x1, "proto", "man", "dev", []string{"dev"}, "dev_name"},
+		// Extend device's handler / set display name
+		{0x2, "openiot.sensor.Temp", "man", "dev", []string{"dev", "influxdb"}, "sensor_0x2"},
+		// Out of id range
+		{0x200, "proto", "ACME Inc", "dev", []string{"dev"}, "dev_name"},
+		// Both rules matched, second replaces handlers
+		{0x150, "openiot.sensor.Temp", "ACME Inc", "dev", []string{"logger"}, "sensor_0x150"},
+	}
+
+	for _, run := range runs {
+		dev := device.NewDevice(run.id)
+		dev.ProtobufName = run.protobuf
+		dev.Manufacturer = run.manufacturer
+		dev.DisplayName = "dev_name"
+		handlers, err := applyJoinRules(dev, &openiot.JoinRequest{DefaultHandler: run.handler})
+		require.NoError(t, err)
+		assert.Equal(t, run.handlers, handlers, "device 0x%x", run.id)
+		assert.Equal(t, run.displayName, dev.DisplayName, "device 0x%x", run.id)
+	}
+}
+
+func TestJoinRulesTransport(t *testing.T) {
+	require.NoError(t, LoadJoinRules(strings.NewReader(`[{name: t, transport: unknown}]`)))
+	defer DeleteAllJoinRules()
+
+	_, err := applyJoinRules(device.NewDevice(1), &openiot.JoinRequest{})
+	assert.EqualError(t, err, "join rule 't': unknown transport 'unknown'")
+}
+
+func TestJoinRulesNegative(t *testing.T) {
+	runs := map[string]string{
+		`[{name: a, match: {id_from: zzz}}]`:                  "join rule #0 'a': strconv.ParseUint: parsing \"zzz\": invalid syntax",
+		`[{name: b, match: {id_from: "0x10", id_to: "0x1"}}]`: "join rule #0 'b': empty id range 0x10..0x1",
+		`[{name: c, match: {name: "[a"}}]`:                    "join rule #0 'c': invalid pattern '[a': syntax error in pattern",
+		`[{name: d, display_name: "{{.Unknown"}]`:             "join rule #0 'd': template: d:1: unclosed action",
+		`[{name: e, unknown_field: 1}]`:                       "yaml: unmarshal errors:\n  line 1: field unknown_field not found in type processor.JoinRule",
+	}
+	for config, expected := range runs {
+		assert.EqualError(t, LoadJoinRules(strings.NewReader(config)), expected)
+	}
+}
+
+func TestJoinWithRules(t *testing.T) {
+	defer device.DeleteAllDevices()
+	require.NoError(t, LoadJoinRules(strings.NewReader(testJoinRules)))
+	defer DeleteAllJoinRules()
+
+	joinReq := &openiot.JoinRequest{
+		Name:           "sensor",
+		ProtobufName:   "openiot.sensor.MultiSensorStatus",
+		DefaultHandler: "someHandler",
+	}
+	_, err := performJoinRequest(0x42, openiot.EncryptionType_PLAIN, nil, joinReq)
+	require.NoError(t, err)
+
+	dev := device.FindDeviceByID(0x42)
+	require.NotNil(t, dev)
+	assert.Equal(t, "sensor_0x42", dev.DisplayName)
+	assert.Equal(t, []string{"someHandler", "influxdb"}, dev.HandlerNames)
+}
@@ -0,0 +1,225 @@
+package processor
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var flagKeyExchangeTTL = flag.Duration("keyexchange.ttl", time.Minute, "Time to wait JoinRequest after KeyExchange")
+var flagKeyExchangeMaxSessions = flag.Int("keyexchange.max_sessions", 128, "Max amount of pending key exchanges")
+var flagKeyExchangeRate = flag.Float64("keyexchange.rate", 1, "Max rate of key exchange requests per transport, in requests per second")
+var flagKeyExchangeBurst = flag.Int("keyexchange.burst", 10, "Max burst of key exchange requests per transport")
+var flagKeyExchangeDeviceRate = flag.Float64("keyexchange.device_rate", 0.1, "Max rate of key exchange requests per device, in requests per second")
+var flagKeyExchangeDeviceBurst = flag.Int("keyexchange.device_burst", 3, "Max burst of key exchange requests per device")
+
+// KeyExchangeStats contains key exchange counters
+type KeyExchangeStats struct {
+	Started     uint64
+	Completed   uint64
+	Expired     uint64
+	RateLimited uint64
+	Rejected    uint64
+	Pending     int
+}
+
+type keyExchangeSession struct {
+	item    *keyExchangeItem
+	expires time.Time
+}
+
+// tokenBucket is simple token bucket rate limiter
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds tokens for time passed since last update
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens += now.Sub(b.updated).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.updated = now
+}
+
+// limiterSource identifies sender of key exchange requests: transport
+// does not tell remote address, so device is identified by ID
+type limiterSource struct {
+	transport string
+	id        uint64
+}
+
+// keyExchangeSessions keeps pending key exchanges (from KeyExchangeRequest
+// until JoinRequest). It is thread safe, entries expire after ttl.
+// When full new sessions are rejected, so flood of requests cannot
+// evict legitimate pending exchanges.
+type keyExchangeSessions struct {
+	sync.Mutex
+
+	sessions map[uint64]*keyExchangeSession
+	// Transport wide limiters cap total rate, so requests with random
+	// device IDs cannot flood server either
+	limiters       map[string]*tokenBucket
+	sourceLimiters map[limiterSource]*tokenBucket
+	stats          KeyExchangeStats
+}
+
+// Allows to mock time in tests
+var timeNow = time.Now
+
+// Pending key exchanges (devices where KeyExchangeResponse was sent)
+var keyExchangeCache = newKeyExchangeSessions()
+
+func newKeyExchangeSessions() *keyExchangeSessions {
+	return &keyExchangeSessions{
+		sessions:       map[uint64]*keyExchangeSession{},
+		limiters:       map[string]*tokenBucket{},
+		sourceLimiters: map[limiterSource]*tokenBucket{},
+	}
+}
+
+// GetKeyExchangeStats returns snapshot of key exchange counters
+func GetKeyExchangeStats() KeyExchangeStats {
+	return keyExchangeCache.Stats()
+}
+
+// Allow checks whether new key exchange of device id over transport is
+// allowed by rate limiters: per device one and transport wide one.
+func (s *keyExchangeSessions) Allow(transport string, id uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := timeNow()
+	bucket, ok := s.limiters[transport]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(*flagKeyExchangeBurst), updated: now}
+		s.limiters[transport] = bucket
+	}
+	bucket.refill(now, *flagKeyExchangeRate, *flagKeyExchangeBurst)
+	source := limiterSource{transport: transport, id: id}
+	sourceBucket, ok := s.sourceLimiters[source]
+	if !ok {
+		sourceBucket = &tokenBucket{tokens: float64(*flagKeyExchangeDeviceBurst), updated: now}
+	}
+	sourceBucket.refill(now, *flagKeyExchangeDeviceRate, *flagKeyExchangeDeviceBurst)
+
+	if sourceBucket.tokens < 1 {
+		s.stats.RateLimited++
+		return fmt.Errorf("Key exchange rate limit exceeded for device 0x%x on '%s'", id, transport)
+	}
+	if bucket.tokens < 1 {
+		s.stats.RateLimited++
+		return fmt.Errorf("Key exchange rate limit exceeded for '%s'", transport)
+	}
+	bucket.tokens--
+	sourceBucket.tokens--
+	if !ok {
+		// New sources are added no faster than transport rate allows
+		s.removeIdleLimiters(now)
+		s.sourceLimiters[source] = sourceBucket
+	}
+
+	return nil
+}
+
+// Add starts new key exchange session (replaces existing for the same device)
+func (s *keyExchangeSessions) Add(id uint64, item *keyExchangeItem) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.removeExpired()
+	if _, ok := s.sessions[id]; !ok && len(s.sessions) >= *flagKeyExchangeMaxSessions {
+		s.stats.Rejected++
+		return fmt.Errorf("Too many pending key exchanges (%d)", len(s.sessions))
+	}
+	s.sessions[id] = &keyExchangeSession{
+		item:    item,
+		expires: timeNow().Add(*flagKeyExchangeTTL),
+	}
+	s.stats.Started++
+
+	return nil
+}
+
+// Get returns pending (not expired) key exchange of device
+func (s *keyExchangeSessions) Get(id uint64) (*keyExchangeItem, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	if timeNow().After(session.expires) {
+		delete(s.sessions, id)
+		s.stats.Expired++
+		return nil, false
+	}
+
+	return session.item, true
+}
+
+// Complete removes key exchange session once device joined
+func (s *keyExchangeSessions) Complete(id uint64) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.sessions[id]; ok {
+		delete(s.sessions, id)
+		s.stats.Completed++
+	}
+}
+
+// Len returns amount of pending key exchanges
+func (s *keyExchangeSessions) Len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.sessions)
+}
+
+// Clear removes all sessions / rate limiters
+func (s *keyExchangeSessions) Clear() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.sessions = map[uint64]*keyExchangeSession{}
+	s.limiters = map[string]*tokenBucket{}
+	s.sourceLimiters = map[limiterSource]*tokenBucket{}
+}
+
+// Stats returns snapshot of counters
+func (s *keyExchangeSessions) Stats() KeyExchangeStats {
+	s.Lock()
+	defer s.Unlock()
+
+	s.removeExpired()
+	stats := s.stats
+	stats.Pending = len(s.sessions)
+
+	return stats
+}
+
+// must be called with lock held
+func (s *keyExchangeSessions) removeExpired() {
+	now := timeNow()
+	for id, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, id)
+			s.stats.Expired++
+		}
+	}
+}
+
+// removeIdleLimiters removes per device limiters which are full again:
+// they're the same as new ones. Must be called with lock held.
+func (s *keyExchangeSessions) removeIdleLimiters(now time.Time) {
+	for source, bucket := range s.sourceLimiters {
+		bucket.refill(now, *flagKeyExchangeDeviceRate, *flagKeyExchangeDeviceBurst)
+		if bucket.tokens >= float64(*flagKeyExchangeDeviceBurst) {
+			delete(s.sourceLimiters, source)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyExchangeSessionsExpire(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	sessions := newKeyExchangeSessions()
+	item := &keyExchangeItem{key: []byte{1, 2, 3}}
+	assert.NoError(t, sessions.Add(1, item))
+	assert.NoError(t, sessions.Add(2, item))
+
+	cached, ok := sessions.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, item, cached)
+
+	// Both sessions expire
+	now = now.Add(*flagKeyExchangeTTL + time.Second)
+	_, ok = sessions.Get(1)
+	assert.False(t, ok)
+	assert.Equal(t, KeyExchangeStats{Started: 2, Expired: 2}, sessions.Stats())
+}
+
+func TestKeyExchangeSessionsLimit(t *testing.T) {
+	sessions := newKeyExchangeSessions()
+	item := &keyExchangeItem{}
+
+	for i := 0; i < *flagKeyExchangeMaxSessions; i++ {
+		assert.NoError(t, sessions.Add(uint64(i), item))
+	}
+	// New session rejected, however existing one can be restarted
+	assert.EqualError(t, sessions.Add(1000, item), "Too many pending key exchanges (128)")
+	assert.NoError(t, sessions.Add(1, item))
+
+	// Complete session: free one slot
+	sessions.Complete(1)
+	sessions.Complete(1)
+	assert.NoError(t, sessions.Add(1000, item))
+
+	stats := sessions.Stats()
+	assert.Equal(t, uint64(1), stats.Rejected)
+	assert.Equal(t, uint64(1), stats.Completed)
+	assert.Equal(t, 128, stats.Pending)
+}
+
+func TestKeyExchangeSessionsRateLimit(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	sessions := newKeyExchangeSessions()
+	// Transport wide burst, from different devices
+	for i := 0; i < *flagKeyExchangeBurst; i++ {
+		assert.NoError(t, sessions.Allow("t1", uint64(i)))
+	}
+	assert.EqualError(t, sessions.Allow("t1", 100), "Key exchange rate limit exceeded for 't1'")
+	// Other transport is not affected
+	assert.NoError(t, sessions.Allow("t2", 100))
+
+	// Refill one token
+	now = now.Add(time.Second)
+	assert.NoError(t, sessions.Allow("t1", 100))
+	assert.Error(t, sessions.Allow("t1", 101))
+	assert.Equal(t, uint64(2), sessions.Stats().RateLimited)
+}
+
+func TestKeyExchangeSessionsDeviceRateLimit(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	sessions := newKeyExchangeSessions()
+	for i := 0; i < *flagKeyExchangeDeviceBurst; i++ {
+		assert.NoError(t, sessions.Allow("t1", 1))
+	}
+	assert.EqualError(t, sessions.Allow("t1", 1), "Key exchange rate limit exceeded for device 0x1 on 't1'")
+	// Neither other devices nor the same device on other transport are affected
+	assert.NoError(t, sessions.Allow("t1", 2))
+	assert.NoError(t, sessions.Allow("t2", 1))
+
+	// Device's bucket refills slower than transport's one
+	now = now.Add(time.Second)
+	assert.Error(t, sessions.Allow("t1", 1))
+	now = now.Add(time.Duration(float64(time.Second) / *flagKeyExchangeDeviceRate))
+	assert.NoError(t, sessions.Allow("t1", 1))
+
+	// Idle limiters are removed once full again
+	now = now.Add(time.Hour)
+	assert.NoError(t, sessions.Allow("t1", 3))
+	assert.Len(t, sessions.sourceLimiters, 1)
+}
@@ -0,0 +1,161 @@
+package processor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/transport"
+	"github.com/open-iot-devices/server/utils/metrics"
+)
+
+// Reasons of dropped packets (label of openiot_packets_dropped_total)
+const (
+	dropReasonMalformed     = "malformed"
+	dropReasonCRC           = "crc"
+	dropReasonUnknownDevice = "unknown_device"
+	dropReasonUnknownType   = "unknown_type"
+	dropReasonDecrypt       = "decrypt"
+	dropReasonDuplicate     = "duplicate"
+	dropReasonJoin          = "join"
+)
+
+var (
+	metricPacketsReceived = metrics.NewCounter("openiot_transport_packets_received_total",
+		"Packets received from transport", "transport_type", "transport")
+	metricBytesReceived = metrics.NewCounter("openiot_transport_bytes_received_total",
+		"Bytes received from transport", "transport_type", "transport")
+	metricPacketsSent = metrics.NewCounter("openiot_transport_packets_sent_total",
+		"Packets sent to transport", "transport_type", "transport")
+	metricSendErrors = metrics.NewCounter("openiot_transport_send_errors_total",
+		"Failed attempts to send packet", "transport_type", "transport")
+
+	metricPacketsDropped = metrics.NewCounter("openiot_packets_dropped_total",
+		"Packets dropped by processor", "reason")
+	metricMessagesProcessed = metrics.NewCounter("openiot_messages_processed_total",
+		"Device messages successfully decoded and passed to handlers", "message_type")
+	metricJoins = metrics.NewCounter("openiot_joins_total",
+		"Devices joined network")
+	metricKeyExchanges = metrics.NewCounter("openiot_key_exchanges_total",
+		"Key exchanges by kind: join (new device), rotation (server initiated) and rotation_completed", "kind")
+
+	metricHandlerDuration = metrics.NewHistogram("openiot_handler_duration_seconds",
+		"Time spent in device handler's ProcessMessage", nil, "handler")
+	metricHandlerErrors = metrics.NewCounter("openiot_handler_errors_total",
+		"Errors returned by device handler's ProcessMessage", "handler")
+
+	_ = metrics.NewGaugeFunc("openiot_key_exchange_sessions",
+		"Pending key exchanges (waiting for JoinRequest)", func() float64 {
+			return float64(keyExchangeCache.Len())
+		})
+	_ = metrics.NewGaugeFunc("openiot_devices",
+		"Registered devices", func() float64 {
+			return float64(len(device.GetAllDevices()))
+		})
+)
+
+// dropError is error caused by invalid / unexpected packet,
+// reason is used as metric label.
+type dropError struct {
+	reason string
+	err    error
+}
+
+func (e *dropError) Error() string {
+	return e.err.Error()
+}
+
+func (e *dropError) Unwrap() error {
+	return e.err
+}
+
+func dropped(reason string, err error) error {
+	return &dropError{reason: reason, err: err}
+}
+
+// dropReason returns reason of packet processing error
+func dropReason(err error) string {
+	if drop, ok := err.(*dropError); ok {
+		return drop.reason
+	}
+	return dropReasonMalformed
+}
+
+// countDropped increases dropped packets counter for packet processing error
+func countDropped(err error) {
+	metricPacketsDropped.Inc(dropReason(err))
+}
+
+// TransportStats is amount of packets passed through transport since start
+type TransportStats struct {
+	PacketsReceived uint64 `json:"packets_received"`
+	BytesReceived   uint64 `json:"bytes_received"`
+	PacketsSent     uint64 `json:"packets_sent"`
+	SendErrors      uint64 `json:"send_errors"`
+	// Nil if nothing received since start
+	LastReceived *time.Time `json:"last_received,omitempty"`
+}
+
+// Time of last packet received, by transport name
+var lastReceived = map[string]time.Time{}
+var lastReceivedLock sync.Mutex
+
+// GetTransportStats returns transport's packets / bytes counters
+func GetTransportStats(tr transport.Transport) TransportStats {
+	labels := transportLabels(tr)
+	stats := TransportStats{
+		PacketsReceived: uint64(metricPacketsReceived.Value(labels...)),
+		BytesReceived:   uint64(metricBytesReceived.Value(labels...)),
+		PacketsSent:     uint64(metricPacketsSent.Value(labels...)),
+		SendErrors:      uint64(metricSendErrors.Value(labels...)),
+	}
+
+	lastReceivedLock.Lock()
+	defer lastReceivedLock.Unlock()
+	if last, ok := lastReceived[labels[1]]; ok {
+		stats.LastReceived = &last
+	}
+	return stats
+}
+
+// countReceived updates transport stats on packet received
+func countReceived(tr transport.Transport, payload []byte) {
+	labels := transportLabels(tr)
+	metricPacketsReceived.Inc(labels...)
+	metricBytesReceived.Add(float64(len(payload)), labels...)
+
+	lastReceivedLock.Lock()
+	defer lastReceivedLock.Unlock()
+	lastReceived[labels[1]] = time.Now()
+}
+
+func transportLabels(tr transport.Transport) []string {
+	if tr == nil {
+		return []string{"", ""}
+	}
+	return []string{tr.GetTypeName(), tr.GetName()}
+}
+
+// sendPacket sends payload to transport, updating transport stats
+func sendPacket(tr transport.Transport, payload []byte) error {
+	labels := transportLabels(tr)
+	if err := tr.Send(payload); err != nil {
+		metricSendErrors.Inc(labels...)
+		return err
+	}
+	metricPacketsSent.Inc(labels...)
+	return nil
+}
+
+// runHandler calls device handler, updating handler stats
+func runHandler(handler device.Handler, dev *device.Device, msgType string, msg proto.Message) error {
+	started := time.Now()
+	err := handler.ProcessMessage(dev, msgType, msg)
+	metricHandlerDuration.Observe(time.Since(started).Seconds(), handler.GetName())
+	if err != nil {
+		metricHandlerErrors.Inc(handler.GetName())
+	}
+	return err
+}
@@ -1,6 +1,12 @@
 package processor
 
-import "bytes"
+import (
+	"bytes"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/open-iot-devices/server/device"
+)
 
 type mockTransport struct {
 	history [][]byte
@@ -42,3 +48,32 @@ func (m *mockTransport) LastMessage() *bytes.Buffer {
 	}
 	return bytes.NewBuffer(m.history[size-1])
 }
+
+type mockHandler struct {
+	name     string
+	msgTypes []string
+	messages []proto.Message
+}
+
+func (m *mockHandler) GetName() string {
+	return m.name
+}
+
+func (m *mockHandler) Start() error {
+	return nil
+}
+
+func (m *mockHandler) Stop() {
+}
+
+func (m *mockHandler) ProcessMessage(dev *device.Device, msgType string, msg proto.Message) error {
+	m.msgTypes = append(m.msgTypes, msgType)
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+func (m *mockHandler) AddDevice(dev *device.Device) {
+}
+
+func (m *mockHandler) RemoveDevice(dev *device.Device) {
+}
@@ -2,9 +2,10 @@ package processor
 
 import (
 	"bytes"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"hash/crc32"
-	"reflect"
 
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
@@ -13,8 +14,25 @@ import (
 	"github.com/open-iot-devices/server/device"
 	"github.com/open-iot-devices/server/encode"
 	"github.com/open-iot-devices/server/transport"
+	"github.com/open-iot-devices/server/utils/events"
+	"github.com/open-iot-devices/server/utils/schema"
 )
 
+// Events published (see utils/events) by processor
+const (
+	// Device message decoded and passed to handlers. Data: "type" (protobuf name),
+	// "message" (proto.Message), "transport" and "handlers" (names)
+	EventMessage = "device.message"
+	// New device registered. Data: "name", "protobuf_name"
+	EventJoined = "device.joined"
+	// Packet dropped. Data: "reason" (e.g. "crc", "duplicate"), "error",
+	// "transport" and "payload" (raw packet, hex). Device ID is set when header is readable.
+	EventError = "device.error"
+)
+
+var flagSequenceWindow = flag.Uint("sequence.window", 10000,
+	"Max distance between sequence of encrypted message and the last received one, 0 to disable check")
+
 // Message contains packet payload and source transport
 type Message struct {
 	Source  transport.Transport
@@ -23,6 +41,34 @@ type Message struct {
 
 // ProcessMessage decodes / de-serializes raw packet and calls appropriate handler
 func ProcessMessage(message *Message) error {
+	countReceived(message.Source, message.Payload)
+
+	err := processMessage(message)
+	if err != nil {
+		countDropped(err)
+		publishError(message, err)
+	}
+	return err
+}
+
+func publishError(message *Message, err error) {
+	event := &events.Event{
+		Type: EventError,
+		Data: map[string]interface{}{
+			"reason":    dropReason(err),
+			"error":     err.Error(),
+			"transport": transportLabels(message.Source)[1],
+			"payload":   hex.EncodeToString(message.Payload),
+		},
+	}
+	hdr := &openiot.Header{}
+	if encode.ReadSingleMessage(bytes.NewBuffer(message.Payload), hdr) == nil {
+		event.DeviceID = fmt.Sprintf("0x%x", hdr.DeviceId)
+	}
+	events.Publish(event)
+}
+
+func processMessage(message *Message) error {
 	buf := bytes.NewBuffer(message.Payload)
 
 	// First message (openiot.Header) is always unencrypted
@@ -33,56 +79,160 @@ func ProcessMessage(message *Message) error {
 
 	// Check CRC of message payload
 	if hdr.Crc != crc32.ChecksumIEEE(buf.Bytes()) {
-		return fmt.Errorf("CRC check failed")
+		return dropped(dropReasonCRC, fmt.Errorf("CRC check failed"))
 	}
 
 	// Process Network Join Requests
 	if hdr.KeyExchange {
-		return processKeyExchangeRequest(hdr, buf, message.Source)
+		if err := processKeyExchangeRequest(hdr, buf, message.Source); err != nil {
+			return dropped(dropReasonJoin, err)
+		}
+		return nil
 	}
 	if hdr.JoinRequest {
-		return processJoinRequest(hdr, buf, message.Source)
+		if err := processJoinRequest(hdr, buf, message.Source); err != nil {
+			return dropped(dropReasonJoin, err)
+		}
+		return nil
 	}
 
 	// At this point we serve only registered devices
 	dev := device.FindDeviceByID(hdr.DeviceId)
 	if dev == nil {
-		return fmt.Errorf("Device 0x%x is not registered", hdr.DeviceId)
+		return dropped(dropReasonUnknownDevice, fmt.Errorf("Device 0x%x is not registered", hdr.DeviceId))
 	}
 
-	// De-Serialize MessageInfo
-	info := &openiot.MessageInfo{}
-	msgType := proto.MessageType(dev.ProtobufName)
-	if msgType == nil {
-		return fmt.Errorf("0x%x: Protobuf '%s' is not registered", dev.ID, dev.ProtobufName)
+	// Default message type must be known
+	if schema.FindMessageDescriptor(dev.ProtobufName) == nil {
+		return dropped(dropReasonUnknownType,
+			fmt.Errorf("0x%x: Protobuf '%s' is not registered", dev.ID, dev.ProtobufName))
 	}
 
-	// De-Serialize device message
-	msg := reflect.New(msgType.Elem()).Interface().(proto.Message)
-	err := encode.DecryptAndRead(buf, dev.EncryptionType, dev.Key(), info, msg)
+	// Decrypt / De-Serialize MessageInfo and device message
+	payload := buf.Bytes()
+	var confirmedKey []byte
+	info, msgType, msg, err := readDeviceMessage(dev, dev.Key(), buf)
+	if err == nil {
+		err = checkSequence(dev, info)
+	}
 	if err != nil {
-		return fmt.Errorf("0x%x: decrypt/deserialize failed: %v", dev.ID, err)
+		// During key rotation device may already use new key
+		newKey := pendingDeviceKey(dev)
+		if newKey == nil {
+			return err
+		}
+		newInfo, newMsgType, newMsg, newErr := readDeviceMessage(dev, newKey, bytes.NewBuffer(payload))
+		if newErr == nil {
+			newErr = checkSequence(dev, newInfo)
+		}
+		if newErr != nil {
+			// Report error of current key
+			return err
+		}
+		info, msgType, msg = newInfo, newMsgType, newMsg
+		confirmedKey = newKey
 	}
 
-	// Drop duplicates
-	if info.Sequence <= dev.SequenceReceive {
-		return fmt.Errorf("0x%x: drop duplicate packet seq %d (last seq %d)",
-			dev.ID,
-			info.Sequence,
-			dev.SequenceReceive,
-		)
-	}
 	dev.SequenceReceive = info.Sequence
+	if confirmedKey != nil {
+		confirmDeviceKey(dev, confirmedKey)
+	}
+	// Track device's schema version (e.g. after firmware upgrade)
+	if _, version := encode.GetMessageType(info); version != 0 && version != dev.SchemaVersion {
+		glog.Infof("0x%x: schema version changed %d -> %d", dev.ID, dev.SchemaVersion, version)
+		dev.SchemaVersion = version
+	}
 
 	// Run all associated handlers
-	glog.Infof("Message from %s/%s/%s",
+	glog.Infof("Message %s from %s/%s/%s",
+		msgType,
 		message.Source.GetTypeName(),
 		message.Source.GetName(),
 		dev.DisplayName,
 	)
+	metricMessagesProcessed.Inc(msgType)
+	addRecentMessage(dev.ID, msgType, msg)
 	for _, handler := range dev.Handlers() {
-		handler.ProcessMessage(dev, msg)
+		if err := runHandler(handler, dev, msgType, msg); err != nil {
+			glog.Infof("0x%x: handler %s failed: %v", dev.ID, handler.GetName(), err)
+		}
+	}
+	events.Publish(&events.Event{
+		Type:     EventMessage,
+		DeviceID: dev.IDhex,
+		Data: map[string]interface{}{
+			"type":      msgType,
+			"message":   msg,
+			"transport": transportLabels(message.Source)[1],
+			"handlers":  dev.HandlerNames,
+		},
+	})
+
+	// Server requested key rotation
+	if dev.RekeyPending {
+		if err := sendRekeyRequest(dev); err != nil {
+			glog.Infof("0x%x: unable to start key rotation: %v", dev.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// checkSequence drops duplicates and messages with sequence too far ahead of
+// the last received one. There is no MAC, so message decrypted with wrong key
+// (e.g. old one during key rotation) may still be de-serialized, however
+// it has random sequence.
+func checkSequence(dev *device.Device, info *openiot.MessageInfo) error {
+	if info.Sequence <= dev.SequenceReceive {
+		return dropped(dropReasonDuplicate, fmt.Errorf("0x%x: drop duplicate packet seq %d (last seq %d)",
+			dev.ID,
+			info.Sequence,
+			dev.SequenceReceive,
+		))
+	}
+	// Nothing received yet: sequence may start anywhere
+	window := uint32(*flagSequenceWindow)
+	if window == 0 || dev.EncryptionType == openiot.EncryptionType_PLAIN || dev.SequenceReceive == 0 {
+		return nil
+	}
+	if info.Sequence-dev.SequenceReceive > window {
+		return dropped(dropReasonDecrypt, fmt.Errorf("0x%x: implausible seq %d (last seq %d), wrong key?",
+			dev.ID,
+			info.Sequence,
+			dev.SequenceReceive,
+		))
 	}
 
 	return nil
 }
+
+// readDeviceMessage decrypts buffer, then de-serializes MessageInfo
+// followed by device message of type selected by MessageInfo's type tag.
+func readDeviceMessage(dev *device.Device, key []byte, buf *bytes.Buffer) (
+	*openiot.MessageInfo, string, proto.Message, error) {
+
+	decrypted, err := encode.Decrypt(buf, dev.EncryptionType, key)
+	if err != nil {
+		return nil, "", nil, dropped(dropReasonDecrypt, fmt.Errorf("0x%x: decrypt/deserialize failed: %v", dev.ID, err))
+	}
+	info := &openiot.MessageInfo{}
+	if err := encode.ReadSingleMessage(decrypted, info); err != nil {
+		return nil, "", nil, dropped(dropReasonDecrypt, fmt.Errorf("0x%x: decrypt/deserialize failed: %v", dev.ID, err))
+	}
+
+	// Lookup message type
+	tag, _ := encode.GetMessageType(info)
+	msgType := dev.MessageTypeName(tag)
+	if msgType == "" {
+		return nil, "", nil, dropped(dropReasonUnknownType, fmt.Errorf("0x%x: unknown message type tag %d", dev.ID, tag))
+	}
+	msg := schema.NewMessage(msgType)
+	if msg == nil {
+		return nil, "", nil, dropped(dropReasonUnknownType, fmt.Errorf("0x%x: Protobuf '%s' is not registered", dev.ID, msgType))
+	}
+	if err := encode.ReadSingleMessage(decrypted, msg); err != nil {
+		return nil, "", nil, dropped(dropReasonDecrypt, fmt.Errorf("0x%x: decrypt/deserialize failed: %v", dev.ID, err))
+	}
+
+	return info, msgType, msg, nil
+}
@@ -2,13 +2,17 @@ package processor
 
 import (
 	"bytes"
+	"encoding/hex"
 	"hash/crc32"
 	"testing"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/open-iot-devices/protobufs/go/openiot"
 	"github.com/open-iot-devices/server/device"
 	"github.com/open-iot-devices/server/encode"
+	"github.com/open-iot-devices/server/utils/events"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMalformedMessage(t *testing.T) {
@@ -30,8 +34,22 @@ func TestInvalidCRC(t *testing.T) {
 	encode.WriteSingleMessage(&buf, hdr)
 	buf.WriteString("somejunkpayload")
 
+	sub := events.Subscribe(1, func(event *events.Event) bool {
+		return event.Type == EventError
+	})
+	defer sub.Close()
+	dropped := metricPacketsDropped.Value(dropReasonCRC)
 	err := ProcessMessage(&Message{Payload: buf.Bytes()})
 	assert.EqualError(t, err, "CRC check failed")
+	assert.Equal(t, dropped+1, metricPacketsDropped.Value(dropReasonCRC))
+
+	// Error published with raw packet
+	require.Len(t, sub.C, 1)
+	event := <-sub.C
+	assert.Equal(t, "0x6f", event.DeviceID)
+	assert.Equal(t, "crc", event.Data["reason"])
+	assert.Equal(t, "CRC check failed", event.Data["error"])
+	assert.Equal(t, hex.EncodeToString(buf.Bytes()), event.Data["payload"])
 }
 
 func TestUnknownDevice(t *testing.T) {
@@ -122,9 +140,78 @@ func TestDeviceMessageDuplicate(t *testing.T) {
 		Source:  &mockTransport{},
 	})
 	assert.NoError(t, err)
+	duplicates := metricPacketsDropped.Value(dropReasonDuplicate)
 	err = ProcessMessage(&Message{
 		Payload: payload,
 		Source:  &mockTransport{},
 	})
 	assert.EqualError(t, err, "0xff: drop duplicate packet seq 1 (last seq 1)")
+	assert.Equal(t, duplicates+1, metricPacketsDropped.Value(dropReasonDuplicate))
+}
+
+func TestDeviceMessageTypes(t *testing.T) {
+	handler := &mockHandler{name: "types"}
+	device.MustAddHandler(handler)
+	defer device.DeleteHandler(handler.name)
+
+	dev := &device.Device{
+		ID:           0xff,
+		ProtobufName: "openiot.JoinRequest",
+		MessageTypes: map[uint32]string{
+			1: "openiot.KeyExchangeRequest",
+		},
+	}
+	dev.AddHandler(handler.name)
+	assert.NoError(t, device.AddDevice(dev))
+	defer device.DeleteAllDevices()
+	DeleteRecentMessages(dev.ID)
+	defer DeleteRecentMessages(dev.ID)
+
+	runs := []struct {
+		tag     uint32
+		version uint32
+		msg     proto.Message
+	}{
+		{0, 0, &openiot.JoinRequest{Name: "join"}},
+		{1, 2, &openiot.KeyExchangeRequest{DhG: 11}},
+	}
+	for index, run := range runs {
+		hdr := &openiot.Header{
+			DeviceId: dev.ID,
+		}
+		info := &openiot.MessageInfo{
+			Sequence: uint32(index + 1),
+		}
+		encode.SetMessageType(info, run.tag, run.version)
+		payload, err := encode.MakeReadyToSendMessage(hdr, openiot.EncryptionType_PLAIN, nil, info, run.msg)
+		require.NoError(t, err)
+		require.NoError(t, ProcessMessage(&Message{
+			Payload: payload,
+			Source:  &mockTransport{},
+		}))
+		assert.Equal(t, run.version, dev.SchemaVersion)
+	}
+
+	assert.Equal(t, []string{"openiot.JoinRequest", "openiot.KeyExchangeRequest"}, handler.msgTypes)
+	assert.Equal(t, "join", handler.messages[0].(*openiot.JoinRequest).Name)
+	assert.Equal(t, uint64(11), handler.messages[1].(*openiot.KeyExchangeRequest).DhG)
+
+	// Recent messages
+	recent := GetRecentMessages(dev.ID)
+	require.Len(t, recent, 2)
+	assert.Equal(t, "openiot.KeyExchangeRequest", recent[1].Type)
+	assert.Equal(t, handler.messages[1], recent[1].Message)
+
+	// Unknown type tag
+	hdr := &openiot.Header{
+		DeviceId: dev.ID,
+	}
+	info := &openiot.MessageInfo{
+		Sequence: 10,
+	}
+	encode.SetMessageType(info, 5, 0)
+	payload, err := encode.MakeReadyToSendMessage(hdr, openiot.EncryptionType_PLAIN, nil, info)
+	require.NoError(t, err)
+	err = ProcessMessage(&Message{Payload: payload})
+	assert.EqualError(t, err, "0xff: unknown message type tag 5")
 }
@@ -0,0 +1,146 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/encode"
+)
+
+// Server initiated key rotation works as follows:
+// - Device is marked for rotation (RequestKeyRotation)
+// - On the next uplink server sends KeyExchangeRequest (header has KeyExchange flag)
+//   encrypted with current device key
+// - Device replies with KeyExchangeResponse, encrypted with current key as well
+// - Server calculates new key, both keys are accepted during grace window
+// - Once first message encrypted with new key arrives - new key replaces old one
+
+const (
+	rekeyDhG = 199
+	rekeyDhP = 4001
+)
+
+var flagRekeyGrace = flag.Duration("rekey.grace", 10*time.Minute, "Time window when both old and new keys are accepted")
+
+// OnDeviceKeyChanged is called when device confirmed usage of new key,
+// or state of key rotation changed, used to persist devices configuration.
+var OnDeviceKeyChanged func(dev *device.Device)
+
+// RequestKeyRotation marks device for key rotation, exchange
+// will be started on next message from device.
+func RequestKeyRotation(id uint64) error {
+	dev := device.FindDeviceByID(id)
+	if dev == nil {
+		return fmt.Errorf("Device 0x%x is not registered", id)
+	}
+	if dev.EncryptionType == openiot.EncryptionType_PLAIN {
+		return fmt.Errorf("0x%x: key rotation is not possible for unencrypted device", id)
+	}
+	dev.RekeyPending = true
+
+	return nil
+}
+
+// sendRekeyRequest sends KeyExchangeRequest to device.
+// Request will be re-sent on every uplink until device replies.
+func sendRekeyRequest(dev *device.Device) error {
+	if dev.Rekey != nil && dev.Rekey.NewKey() != nil {
+		// Waiting for confirmation from device
+		return nil
+	}
+	if dev.Rekey == nil {
+		session := &device.RekeySession{}
+		session.Private, session.Public = encode.GenerateDiffieHellman(rekeyDhG, rekeyDhP)
+		dev.Rekey = session
+		// Device may reply (and switch key) right after request is sent
+		notifyDeviceKeyChanged(dev)
+	}
+
+	if dev.Transport() == nil {
+		return fmt.Errorf("0x%x: no transport to send key exchange", dev.ID)
+	}
+	hdr := &openiot.Header{
+		DeviceId:    dev.ID,
+		KeyExchange: true,
+	}
+	request := &openiot.KeyExchangeRequest{
+		DhG:            rekeyDhG,
+		DhP:            rekeyDhP,
+		DhA:            dev.Rekey.Public,
+		EncryptionType: dev.EncryptionType,
+	}
+	payload, err := encode.MakeReadyToSendMessage(hdr, dev.EncryptionType, dev.Key(), request)
+	if err != nil {
+		return err
+	}
+	glog.Infof("0x%x: key rotation started", dev.ID)
+	metricKeyExchanges.Inc("rotation")
+
+	return sendPacket(dev.Transport(), payload)
+}
+
+// processRekeyResponse handles KeyExchangeResponse from already registered device
+func processRekeyResponse(dev *device.Device, buf *bytes.Buffer) error {
+	session := dev.Rekey
+	if session == nil {
+		return fmt.Errorf("Key Exchange request for already registered device 0x%x", dev.ID)
+	}
+
+	// Response is protected by current key
+	response := &openiot.KeyExchangeResponse{}
+	if err := encode.DecryptAndRead(buf, dev.EncryptionType, dev.Key(), response); err != nil {
+		return fmt.Errorf("0x%x: key rotation: %v", dev.ID, err)
+	}
+	if len(response.DhB) != aes.BlockSize {
+		return fmt.Errorf("Invalid DhB len, %d", len(response.DhB))
+	}
+	if len(session.Private) != aes.BlockSize {
+		return fmt.Errorf("0x%x: key rotation: invalid session", dev.ID)
+	}
+	session.SetNewKey(encode.DiffieHellmanKey(rekeyDhP, response.DhB, session.Private),
+		timeNow().Add(*flagRekeyGrace))
+	glog.Infof("0x%x: key rotation: new key calculated, waiting for confirmation", dev.ID)
+	notifyDeviceKeyChanged(dev)
+
+	return nil
+}
+
+// pendingDeviceKey returns new (not yet confirmed) device key, if any
+func pendingDeviceKey(dev *device.Device) []byte {
+	session := dev.Rekey
+	if session == nil || session.NewKey() == nil {
+		return nil
+	}
+	if timeNow().After(session.Expires) {
+		// Grace window is over, device will be asked once again
+		glog.Infof("0x%x: key rotation timed out", dev.ID)
+		dev.Rekey = nil
+		return nil
+	}
+
+	return session.NewKey()
+}
+
+// confirmDeviceKey replaces device key with new one
+func confirmDeviceKey(dev *device.Device, key []byte) {
+	dev.Rekey = nil
+	dev.SetKey(key)
+	dev.RekeyPending = false
+	glog.Infof("0x%x: key rotation completed", dev.ID)
+	metricKeyExchanges.Inc("rotation_completed")
+
+	notifyDeviceKeyChanged(dev)
+}
+
+func notifyDeviceKeyChanged(dev *device.Device) {
+	if OnDeviceKeyChanged != nil {
+		OnDeviceKeyChanged(dev)
+	}
+}
@@ -0,0 +1,206 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/encode"
+)
+
+func TestKeyRotation(t *testing.T) {
+	defer device.DeleteAllDevices()
+
+	oldKey := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	transport := &mockTransport{}
+	dev := &device.Device{
+		ID:             0x77,
+		ProtobufName:   "openiot.JoinRequest",
+		EncryptionType: openiot.EncryptionType_AES_ECB,
+	}
+	dev.SetKey(oldKey)
+	dev.SetTransport(transport)
+	require.NoError(t, device.AddDevice(dev))
+
+	var changed *device.Device
+	OnDeviceKeyChanged = func(dev *device.Device) { changed = dev }
+	defer func() { OnDeviceKeyChanged = nil }()
+
+	require.NoError(t, RequestKeyRotation(dev.ID))
+	assert.True(t, dev.RekeyPending)
+
+	// Any uplink triggers key exchange
+	require.NoError(t, sendDeviceMessage(dev, oldKey, 1))
+	hdrResp := &openiot.Header{}
+	keyReq := &openiot.KeyExchangeRequest{}
+	respBuf := transport.LastMessage()
+	require.NoError(t, encode.ReadSingleMessage(respBuf, hdrResp))
+	require.NoError(t, encode.DecryptAndRead(respBuf, dev.EncryptionType, oldKey, keyReq))
+	assert.True(t, hdrResp.KeyExchange)
+
+	// Device side of exchange, reply is protected by old key
+	private, public := encode.GenerateDiffieHellman(keyReq.DhG, keyReq.DhP)
+	newKey := encode.DiffieHellmanKey(keyReq.DhP, keyReq.DhA, private)
+	hdr := &openiot.Header{
+		DeviceId:    dev.ID,
+		KeyExchange: true,
+	}
+	payload, err := encode.MakeReadyToSendMessage(hdr, dev.EncryptionType, oldKey,
+		&openiot.KeyExchangeResponse{DhB: public})
+	require.NoError(t, err)
+	require.NoError(t, ProcessMessage(&Message{Source: transport, Payload: payload}))
+
+	// Grace window: old key still accepted
+	require.NoError(t, sendDeviceMessage(dev, oldKey, 2))
+	assert.Equal(t, oldKey, dev.Key())
+	assert.NotNil(t, dev.Rekey)
+
+	// Device switched to new key
+	require.NoError(t, sendDeviceMessage(dev, newKey, 3))
+	assert.Equal(t, newKey, dev.Key())
+	assert.False(t, dev.RekeyPending)
+	assert.Nil(t, dev.Rekey)
+	assert.Equal(t, dev, changed)
+
+	// Old key is not valid anymore
+	assert.Error(t, sendDeviceMessage(dev, oldKey, 4))
+}
+
+func TestKeyRotationGraceExpired(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	dev := device.NewDevice(0x78)
+	dev.Rekey = &device.RekeySession{}
+	dev.Rekey.SetNewKey([]byte{1}, now.Add(time.Second))
+	assert.Equal(t, []byte{1}, pendingDeviceKey(dev))
+
+	now = now.Add(2 * time.Second)
+	assert.Nil(t, pendingDeviceKey(dev))
+	assert.Nil(t, dev.Rekey)
+}
+
+func TestKeyRotationWrongKeyDecoded(t *testing.T) {
+	defer device.DeleteAllDevices()
+
+	oldKey := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	dev := &device.Device{
+		ID:              0x7a,
+		ProtobufName:    "openiot.JoinRequest",
+		EncryptionType:  openiot.EncryptionType_AES_ECB,
+		SequenceReceive: 10,
+	}
+	dev.SetKey(oldKey)
+	dev.SetTransport(&mockTransport{})
+	require.NoError(t, device.AddDevice(dev))
+
+	// Find new key, so message encrypted with it is de-serialized
+	// with old key as well (there is no MAC)
+	var newKey, frame []byte
+	for index := 0; index < 1000000 && newKey == nil; index++ {
+		hash := sha256.Sum256([]byte(strconv.Itoa(index)))
+		payload, err := encode.MakeReadyToSendMessage(&openiot.Header{}, dev.EncryptionType, hash[:16],
+			&openiot.MessageInfo{Sequence: 11}, &openiot.JoinRequest{})
+		require.NoError(t, err)
+		buf := bytes.NewBuffer(payload)
+		require.NoError(t, encode.ReadSingleMessage(buf, &openiot.Header{}))
+		frame = buf.Bytes()
+		if _, _, _, err := readDeviceMessage(dev, oldKey, bytes.NewBuffer(frame)); err == nil {
+			newKey = hash[:16]
+		}
+	}
+	require.NotNil(t, newKey)
+	info, _, _, err := readDeviceMessage(dev, oldKey, bytes.NewBuffer(frame))
+	require.NoError(t, err)
+	require.Error(t, checkSequence(dev, info))
+	dev.Rekey = &device.RekeySession{}
+	dev.Rekey.SetNewKey(newKey, time.Now().Add(time.Minute))
+
+	// Garbage decrypted with old key has implausible sequence, so new key is used
+	require.NoError(t, sendDeviceMessage(dev, newKey, 11))
+	assert.Equal(t, newKey, dev.Key())
+	assert.EqualValues(t, 11, dev.SequenceReceive)
+	assert.Nil(t, dev.Rekey)
+}
+
+func TestKeyRotationPersisted(t *testing.T) {
+	defer device.DeleteAllDevices()
+
+	dev := &device.Device{
+		ID:             0x7b,
+		IDhex:          "0x7b",
+		ProtobufName:   "openiot.JoinRequest",
+		EncryptionType: openiot.EncryptionType_AES_ECB,
+		RekeyPending:   true,
+	}
+	dev.SetKey([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	dev.SetTransport(&mockTransport{})
+
+	saved := 0
+	OnDeviceKeyChanged = func(dev *device.Device) { saved++ }
+	defer func() { OnDeviceKeyChanged = nil }()
+
+	// Server's part of exchange is saved before request is sent
+	require.NoError(t, sendRekeyRequest(dev))
+	require.NotNil(t, dev.Rekey)
+	assert.Equal(t, 1, saved)
+	// ... and new key once device replied
+	private, public := encode.GenerateDiffieHellman(rekeyDhG, rekeyDhP)
+	payload, err := encode.MakeReadyToSendMessage(&openiot.Header{}, dev.EncryptionType, dev.Key(),
+		&openiot.KeyExchangeResponse{DhB: public})
+	require.NoError(t, err)
+	buf := bytes.NewBuffer(payload)
+	require.NoError(t, encode.ReadSingleMessage(buf, &openiot.Header{}))
+	require.NoError(t, processRekeyResponse(dev, buf))
+	assert.Equal(t, 2, saved)
+	newKey := encode.DiffieHellmanKey(rekeyDhP, dev.Rekey.Public, private)
+	assert.Equal(t, newKey, dev.Rekey.NewKey())
+
+	// Restart: session is restored from devices config
+	var out bytes.Buffer
+	require.NoError(t, device.AddDevice(dev))
+	require.NoError(t, device.SaveDevices(&out))
+	device.DeleteAllDevices()
+	require.NoError(t, device.LoadDevices(&out))
+	loaded := device.FindDeviceByID(0x7b)
+	require.NotNil(t, loaded)
+	assert.Equal(t, newKey, pendingDeviceKey(loaded))
+}
+
+func TestKeyRotationNegative(t *testing.T) {
+	defer device.DeleteAllDevices()
+
+	assert.EqualError(t, RequestKeyRotation(0x79), "Device 0x79 is not registered")
+
+	require.NoError(t, device.AddDevice(device.NewDevice(0x79)))
+	assert.EqualError(t, RequestKeyRotation(0x79),
+		"0x79: key rotation is not possible for unencrypted device")
+}
+
+// helpers //
+
+func sendDeviceMessage(dev *device.Device, key []byte, sequence uint32) error {
+	hdr := &openiot.Header{
+		DeviceId: dev.ID,
+	}
+	info := &openiot.MessageInfo{
+		Sequence: sequence,
+	}
+	payload, err := encode.MakeReadyToSendMessage(hdr, dev.EncryptionType, key, info, &openiot.JoinRequest{})
+	if err != nil {
+		return err
+	}
+
+	return ProcessMessage(&Message{
+		Source:  dev.Transport(),
+		Payload: payload,
+	})
+}
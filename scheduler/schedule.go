@@ -0,0 +1,220 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-iot-devices/server/utils/sun"
+)
+
+// schedule calculates job run times
+type schedule interface {
+	// next returns first run time strictly after given time,
+	// zero time when unknown (e.g. no sunset in polar day)
+	next(after time.Time) time.Time
+}
+
+// cronSchedule is standard 5 fields cron expression:
+// minute hour day-of-month month day-of-week
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Day matches when either of dom / dow matches if both are restricted
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{min: 0, max: 59}
+	cronHour   = cronField{min: 0, max: 23}
+	cronDom    = cronField{min: 1, max: 31}
+	cronMonth  = cronField{min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 is Sunday as well
+	cronDow = cronField{min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses cron expression, e.g. "*/15 6-22 * * mon-fri" or "@daily"
+func parseCron(expression string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[expression]; ok {
+		expression = macro
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron '%s': expected 5 fields", expression)
+	}
+
+	result := &cronSchedule{
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+	var err error
+	for index, target := range []struct {
+		bits  *uint64
+		field cronField
+	}{
+		{&result.minute, cronMinute},
+		{&result.hour, cronHour},
+		{&result.dom, cronDom},
+		{&result.month, cronMonth},
+		{&result.dow, cronDow},
+	} {
+		if *target.bits, err = target.field.parse(fields[index]); err != nil {
+			return nil, fmt.Errorf("cron '%s': %v", expression, err)
+		}
+	}
+	// Sunday: 7 -> 0
+	if result.dow&(1<<7) != 0 {
+		result.dow |= 1
+	}
+
+	return result, nil
+}
+
+// parse parses comma separated list of "*", "N", "N-M" with optional "/step"
+func (f cronField) parse(value string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(value, ",") {
+		rangePart, step := part, 1
+		if index := strings.Index(part, "/"); index != -1 {
+			var err error
+			if step, err = strconv.Atoi(part[index+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+			rangePart = part[:index]
+		}
+
+		from, to := f.min, f.max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if from, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step != 1 {
+				// "N/step" means from N to max
+				to = f.max
+			}
+			if from > to {
+				return 0, fmt.Errorf("invalid range '%s'", rangePart)
+			}
+		}
+		for i := from; i <= to; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, nil
+}
+
+func (f cronField) value(value string) (int, error) {
+	if number, ok := f.names[strings.ToLower(value)]; ok {
+		return number, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < f.min || number > f.max {
+		return 0, fmt.Errorf("invalid value '%s', expected %d-%d", value, f.min, f.max)
+	}
+	return number, nil
+}
+
+func (s *cronSchedule) next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	// Impossible expressions (e.g. Feb 30) never match
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// sunSchedule runs job at sun event of location with offset, e.g. 30 minutes after sunset
+type sunSchedule struct {
+	event    string
+	offset   time.Duration
+	location string
+}
+
+// parseSun parses sun event with optional offset, e.g. "sunset+30m", "dawn - 1h".
+// Empty location means default one (see sun.GetLocation).
+func parseSun(value, location string) (*sunSchedule, error) {
+	event, offset, err := sun.ParseEvent(value)
+	if err != nil {
+		return nil, err
+	}
+	if sun.GetLocation(location) == nil {
+		return nil, fmt.Errorf("unknown location '%s'", location)
+	}
+
+	return &sunSchedule{event: event, offset: offset, location: location}, nil
+}
+
+func (s *sunSchedule) next(after time.Time) time.Time {
+	// Offset may move run to previous / next day
+	for day := -1; day <= 2; day++ {
+		eventTime, ok := sunEventTime(s.location, s.event, after.AddDate(0, 0, day))
+		if !ok {
+			continue
+		}
+		if run := eventTime.Add(s.offset); run.After(after) {
+			return run
+		}
+	}
+	return time.Time{}
+}
+
+// sunEventTime returns time of sun event at location on date of given time, false when
+// it does not happen (polar day / night) or location is gone. Replaceable for tests.
+var sunEventTime = func(location, event string, date time.Time) (time.Time, bool) {
+	loc := sun.GetLocation(location)
+	if loc == nil {
+		return time.Time{}, false
+	}
+	eventTime := loc.Times(date).Event(event)
+	return eventTime, !eventTime.IsZero()
+}
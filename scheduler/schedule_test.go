@@ -0,0 +1,90 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func date(month time.Month, day, hour, min int) time.Time {
+	return time.Date(2020, month, day, hour, min, 0, 0, time.UTC)
+}
+
+func TestCron(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		after      time.Time
+		expected   time.Time
+	}{
+		{"* * * * *", date(6, 1, 10, 0), date(6, 1, 10, 1)},
+		{"30 6 * * *", date(6, 1, 6, 30), date(6, 2, 6, 30)},
+		{"*/15 * * * *", date(6, 1, 10, 50), date(6, 1, 11, 0)},
+		{"5/20 * * * *", date(6, 1, 10, 26), date(6, 1, 10, 45)},
+		{"0 22-23,1 * * *", date(6, 1, 23, 30), date(6, 2, 1, 0)},
+		// 2020-06-01 is Monday
+		{"0 9 * * sat,Sun", date(6, 1, 0, 0), date(6, 6, 9, 0)},
+		{"0 9 * * 7", date(6, 1, 0, 0), date(6, 7, 9, 0)},
+		{"0 9 * * mon-fri", date(6, 5, 10, 0), date(6, 8, 9, 0)},
+		// Either day of month or day of week
+		{"0 0 15 * sat", date(6, 1, 0, 0), date(6, 6, 0, 0)},
+		{"0 0 29 feb *", date(6, 1, 0, 0), time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", date(6, 1, 0, 0), date(7, 1, 0, 0)},
+		{"@hourly", date(12, 31, 23, 0), time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", date(6, 1, 0, 0), time.Time{}},
+	} {
+		schedule, err := parseCron(test.expression)
+		require.NoError(t, err, test.expression)
+		assert.Equal(t, test.expected, schedule.next(test.after), test.expression)
+	}
+
+	for _, expression := range []string{
+		"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+		"* * * * 8", "5-1 * * * *", "*/0 * * * *", "* * * foo *", "@often",
+	} {
+		_, err := parseCron(expression)
+		assert.Error(t, err, expression)
+	}
+}
+
+func TestSun(t *testing.T) {
+	defer func(original func(string, string, time.Time) (time.Time, bool)) { sunEventTime = original }(sunEventTime)
+	sunEventTime = func(location, event string, day time.Time) (time.Time, bool) {
+		if event == "sunrise" {
+			return time.Date(day.Year(), day.Month(), day.Day(), 5, 40, 0, 0, day.Location()), true
+		}
+		return time.Date(day.Year(), day.Month(), day.Day(), 20, 25, 0, 0, day.Location()), true
+	}
+
+	for _, test := range []struct {
+		value    string
+		after    time.Time
+		expected time.Time
+	}{
+		{"sunset", date(6, 1, 10, 0), date(6, 1, 20, 25)},
+		{"sunset + 30m", date(6, 1, 20, 40), date(6, 1, 20, 55)},
+		{"sunset+30m", date(6, 1, 20, 55), date(6, 2, 20, 55)},
+		{"sunrise-6h", date(6, 1, 0, 0), date(6, 1, 23, 40)},
+		{"sunset+4h", date(6, 1, 0, 0), date(6, 1, 0, 25)},
+	} {
+		schedule, err := parseSun(test.value, "")
+		require.NoError(t, err, test.value)
+		assert.Equal(t, test.expected, schedule.next(test.after), test.value)
+	}
+
+	for _, value := range []string{"noon", "sunset 1h", "sunrise+often"} {
+		_, err := parseSun(value, "")
+		assert.Error(t, err, value)
+	}
+	_, err := parseSun("sunset", "nowhere")
+	assert.Error(t, err)
+
+	// No sun data yet
+	sunEventTime = func(string, string, time.Time) (time.Time, bool) {
+		return time.Time{}, false
+	}
+	schedule, err := parseSun("sunset", "")
+	require.NoError(t, err)
+	assert.True(t, schedule.next(date(6, 1, 0, 0)).IsZero())
+}
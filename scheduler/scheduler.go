@@ -0,0 +1,450 @@
+// Package scheduler runs jobs at given times: by cron expression or relative
+// to sun events. Jobs send messages to devices or pass them to device handlers.
+//
+// Due jobs are not run by scheduler itself, they're enqueued (see Queue) to be
+// run by main loop, together with processing of incoming messages.
+// Last run times are persisted, so jobs missed while server was down may be
+// caught up on start.
+package scheduler
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/processor"
+	"github.com/open-iot-devices/server/utils/schema"
+)
+
+// Job is single scheduled job, e.g.:
+//
+//	name: porch_light_on
+//	sun: sunset+30m
+//	catch_up: 2h
+//	device: porch
+//	type: belyalov.Control
+//	fields:
+//	  wall_spotlight.w: true
+type Job struct {
+	Name string
+	// Either cron expression ("30 6 * * mon-fri", "@daily") or sun event
+	// (dawn, sunrise, solar_noon, sunset, dusk) with optional offset ("sunset+30m", "sunrise-1h")
+	Cron string `yaml:",omitempty"`
+	Sun  string `yaml:",omitempty"`
+	// Named location of sun event (see utils/sun), default one if empty
+	Location string `yaml:",omitempty"`
+	// Run missed job once on start, if it was due no longer than given duration ago (e.g. "12h").
+	// Missed runs are skipped when empty.
+	CatchUp string `yaml:"catch_up,omitempty"`
+
+	// Target device: ID (0x...) or display name
+	Device string
+	// Protobuf full name and flattened fields of message, see schema.NewMessageFromFields
+	Type   string
+	Fields map[string]interface{} `yaml:",omitempty"`
+	// Pass message to device handler (as if it came from device) instead of sending it to device
+	Handler string `yaml:",omitempty"`
+
+	schedule schedule
+	catchUp  time.Duration
+	// Scheduler job belongs to, records results of Run
+	scheduler *scheduler
+}
+
+// JobStatus is job's last / next run times. Last run is the last successful one,
+// LastFailure / LastError are set when job has failed since then.
+type JobStatus struct {
+	Name        string     `json:"name"`
+	NextRun     *time.Time `json:"next_run"`
+	LastRun     *time.Time `json:"last_run,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+type jobFailure struct {
+	time time.Time
+	err  string
+}
+
+// Upper limit of time between checks: sun data may appear / change, clock may jump
+const maxSleep = time.Minute
+
+type scheduler struct {
+	now   func() time.Time
+	queue chan *Job
+
+	mutex         sync.Mutex
+	jobs          []*Job
+	stateFilename string
+	// Job name -> last successful run time, persisted
+	lastRuns map[string]time.Time
+	// Job name -> last failure, if job has not succeeded since then
+	failures map[string]*jobFailure
+	// Job name -> next run time, zero if unknown
+	nextRuns map[string]time.Time
+
+	wakeCh chan struct{}
+	doneCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+var defaultScheduler = newScheduler()
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		now:      time.Now,
+		queue:    make(chan *Job, 16),
+		lastRuns: map[string]time.Time{},
+		failures: map[string]*jobFailure{},
+		nextRuns: map[string]time.Time{},
+		wakeCh:   make(chan struct{}, 1),
+	}
+}
+
+// LoadJobs reads and parses YAML jobs configuration.
+// Replaces all previously loaded jobs.
+func LoadJobs(reader io.Reader) error {
+	jobs, err := parseJobs(reader)
+	if err != nil {
+		return err
+	}
+	defaultScheduler.setJobs(jobs)
+
+	return nil
+}
+
+// Start loads last run times from stateFilename (if exists), enqueues
+// missed jobs and starts scheduling
+func Start(stateFilename string) error {
+	return defaultScheduler.start(stateFilename)
+}
+
+// Stop stops scheduling, already enqueued jobs are kept
+func Stop() {
+	defaultScheduler.stop()
+}
+
+// Queue returns channel of due jobs, they must be run using Job.Run()
+func Queue() <-chan *Job {
+	return defaultScheduler.queue
+}
+
+// GetUpcomingJobs returns all jobs sorted by next run time,
+// jobs with unknown next run time are last
+func GetUpcomingJobs() []*JobStatus {
+	return defaultScheduler.upcoming()
+}
+
+// Run sends job's message to device or passes it to device handler.
+// Successful run is recorded as job's last run, failed one is reported by GetUpcomingJobs.
+func (job *Job) Run() error {
+	err := job.run()
+	if job.scheduler != nil {
+		job.scheduler.finished(job, err)
+	}
+	return err
+}
+
+func (job *Job) run() error {
+	dev := device.FindDevice(job.Device)
+	if dev == nil {
+		return fmt.Errorf("job %s: device '%s' not found", job.Name, job.Device)
+	}
+	msg, err := schema.NewMessageFromFields(job.Type, job.Fields)
+	if err != nil {
+		return fmt.Errorf("job %s: %v", job.Name, err)
+	}
+
+	if job.Handler != "" {
+		handler := device.FindHandlerByName(job.Handler)
+		if handler == nil {
+			return fmt.Errorf("job %s: unknown handler '%s'", job.Name, job.Handler)
+		}
+		return handler.ProcessMessage(dev, job.Type, msg)
+	}
+	return processor.SendMessage(dev, msg)
+}
+
+func parseJobs(reader io.Reader) ([]*Job, error) {
+	var jobs []*Job
+	decoder := yaml.NewDecoder(reader)
+	decoder.SetStrict(true)
+	if err := decoder.Decode(&jobs); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for index, job := range jobs {
+		if err := job.compile(); err != nil {
+			return nil, fmt.Errorf("job #%d '%s': %v", index, job.Name, err)
+		}
+		if names[job.Name] {
+			return nil, fmt.Errorf("job #%d: duplicate name '%s'", index, job.Name)
+		}
+		names[job.Name] = true
+	}
+
+	return jobs, nil
+}
+
+func (job *Job) compile() error {
+	if job.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	var err error
+	switch {
+	case job.Cron != "" && job.Sun != "":
+		return fmt.Errorf("only one of cron or sun is allowed")
+	case job.Cron != "":
+		job.schedule, err = parseCron(job.Cron)
+	case job.Sun != "":
+		job.schedule, err = parseSun(job.Sun, job.Location)
+	default:
+		return fmt.Errorf("cron or sun is required")
+	}
+	if err != nil {
+		return err
+	}
+	if job.CatchUp != "" {
+		if job.catchUp, err = time.ParseDuration(job.CatchUp); err != nil {
+			return fmt.Errorf("invalid catch_up: %v", err)
+		}
+	}
+
+	if job.Device == "" {
+		return fmt.Errorf("device is required")
+	}
+	if schema.FindMessageDescriptor(job.Type) == nil {
+		return fmt.Errorf("protobuf '%s' is not registered", job.Type)
+	}
+	if job.Handler != "" && device.FindHandlerByName(job.Handler) == nil {
+		return fmt.Errorf("unknown handler '%s'", job.Handler)
+	}
+
+	return nil
+}
+
+func (s *scheduler) setJobs(jobs []*Job) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.jobs = jobs
+	s.nextRuns = map[string]time.Time{}
+	now := s.now()
+	for _, job := range jobs {
+		job.scheduler = s
+		s.nextRuns[job.Name] = job.schedule.next(now)
+	}
+	s.wake()
+}
+
+func (s *scheduler) start(stateFilename string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stateFilename = stateFilename
+	if err := s.loadState(); err != nil {
+		return err
+	}
+
+	now := s.now()
+	for _, job := range s.jobs {
+		if s.missed(job, now) {
+			glog.Infof("Scheduler: job %s missed, catching up", job.Name)
+			s.nextRuns[job.Name] = now
+		}
+	}
+
+	s.doneCh = make(chan struct{})
+	s.wg.Add(1)
+	go s.run()
+
+	return nil
+}
+
+func (s *scheduler) stop() {
+	if s.doneCh != nil {
+		close(s.doneCh)
+		s.wg.Wait()
+		s.doneCh = nil
+	}
+}
+
+// missed returns true if job was due since last run, within job's
+// catch up period. Must be called with lock held.
+func (s *scheduler) missed(job *Job, now time.Time) bool {
+	lastRun, ok := s.lastRuns[job.Name]
+	if !ok || job.catchUp == 0 {
+		return false
+	}
+
+	from := lastRun
+	if windowStart := now.Add(-job.catchUp); windowStart.After(from) {
+		from = windowStart
+	}
+	run := job.schedule.next(from)
+	return !run.IsZero() && !run.After(now)
+}
+
+func (s *scheduler) run() {
+	defer s.wg.Done()
+
+	for {
+		due, sleep := s.due()
+		for _, job := range due {
+			select {
+			case s.queue <- job:
+			case <-s.doneCh:
+				return
+			}
+		}
+
+		timer := time.NewTimer(sleep)
+		select {
+		case <-timer.C:
+		case <-s.wakeCh:
+			timer.Stop()
+		case <-s.doneCh:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// due returns jobs to be run now and schedules their next runs,
+// also returns how long to sleep until next check
+func (s *scheduler) due() ([]*Job, time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	sleep := maxSleep
+	var due []*Job
+	for _, job := range s.jobs {
+		next := s.nextRuns[job.Name]
+		if next.IsZero() {
+			// E.g. sun data is not available yet
+			next = job.schedule.next(now)
+		} else if !next.After(now) {
+			due = append(due, job)
+			next = job.schedule.next(now)
+		}
+		s.nextRuns[job.Name] = next
+		if !next.IsZero() && next.Sub(now) < sleep {
+			sleep = next.Sub(now)
+		}
+	}
+
+	return due, sleep
+}
+
+// finished records result of job run: last run time (persisted) or failure.
+// Job enqueued but not run (e.g. server stopped) is not recorded,
+// so it may be caught up on next start.
+func (s *scheduler) finished(job *Job, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	if err != nil {
+		s.failures[job.Name] = &jobFailure{time: now, err: err.Error()}
+		return
+	}
+	delete(s.failures, job.Name)
+	s.lastRuns[job.Name] = now
+	if err := s.saveState(); err != nil {
+		glog.Errorf("Scheduler: unable to save state: %v", err)
+	}
+}
+
+func (s *scheduler) upcoming() []*JobStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var results []*JobStatus
+	for _, job := range s.jobs {
+		status := &JobStatus{Name: job.Name}
+		if next := s.nextRuns[job.Name]; !next.IsZero() {
+			status.NextRun = &next
+		}
+		if last, ok := s.lastRuns[job.Name]; ok {
+			status.LastRun = &last
+		}
+		if failure := s.failures[job.Name]; failure != nil {
+			status.LastFailure = &failure.time
+			status.LastError = failure.err
+		}
+		results = append(results, status)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i].NextRun, results[j].NextRun
+		if a == nil || b == nil {
+			return b == nil && a != nil
+		}
+		return a.Before(*b)
+	})
+
+	return results
+}
+
+// wake makes scheduler to re-check jobs
+func (s *scheduler) wake() {
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// loadState reads last run times, missing file is not an error.
+// Must be called with lock held.
+func (s *scheduler) loadState() error {
+	if s.stateFilename == "" {
+		return nil
+	}
+	fd, err := os.Open(s.stateFilename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	lastRuns := map[string]time.Time{}
+	if err := yaml.NewDecoder(fd).Decode(&lastRuns); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %v", s.stateFilename, err)
+	}
+	s.lastRuns = lastRuns
+
+	return nil
+}
+
+// saveState atomically replaces state file with last run times.
+// Must be called with lock held.
+func (s *scheduler) saveState() error {
+	if s.stateFilename == "" {
+		return nil
+	}
+	tmpFilename := s.stateFilename + ".tmp"
+	fd, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	if err := yaml.NewEncoder(fd).Encode(s.lastRuns); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFilename, s.stateFilename)
+}
@@ -0,0 +1,215 @@
+package scheduler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/open-iot-devices/server/device"
+)
+
+type mockHandler struct {
+	devices  []*device.Device
+	messages []proto.Message
+}
+
+func (m *mockHandler) GetName() string {
+	return "scheduler_mock"
+}
+
+func (m *mockHandler) Start() error {
+	return nil
+}
+
+func (m *mockHandler) Stop() {
+}
+
+func (m *mockHandler) ProcessMessage(dev *device.Device, msgType string, msg proto.Message) error {
+	m.devices = append(m.devices, dev)
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+func (m *mockHandler) AddDevice(dev *device.Device) {
+}
+
+func (m *mockHandler) RemoveDevice(dev *device.Device) {
+}
+
+func mustParseJobs(t *testing.T, config string) []*Job {
+	jobs, err := parseJobs(strings.NewReader(config))
+	require.NoError(t, err)
+	return jobs
+}
+
+func TestRunJob(t *testing.T) {
+	mock := &mockHandler{}
+	device.MustAddHandler(mock)
+	defer device.DeleteHandler(mock.GetName())
+	dev := device.NewDevice(0x2001)
+	dev.DisplayName = "porch"
+	require.NoError(t, device.AddDevice(dev))
+	defer device.DeleteDeviceByID(dev.ID)
+
+	jobs := mustParseJobs(t, `
+- name: handler
+  cron: "@daily"
+  device: porch
+  type: openiot.JoinResponse
+  fields:
+    name: hello
+  handler: scheduler_mock
+- name: send
+  cron: "@daily"
+  device: "0x2001"
+  type: openiot.JoinResponse
+- name: unknown
+  cron: "@daily"
+  device: garage
+  type: openiot.JoinResponse
+`)
+	require.NoError(t, jobs[0].Run())
+	assert.Equal(t, []*device.Device{dev}, mock.devices)
+	require.Len(t, mock.messages, 1)
+	assert.Equal(t, "hello", mock.messages[0].(*openiot.JoinResponse).Name)
+
+	// Device has no transport
+	assert.Error(t, jobs[1].Run())
+	assert.Error(t, jobs[2].Run())
+}
+
+func TestCatchUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scheduler")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFilename := filepath.Join(dir, "state.yaml")
+
+	now := date(6, 1, 7, 0)
+	lastRuns := map[string]time.Time{
+		// Missed today's 06:00 run
+		"recent": date(5, 31, 6, 0),
+		// Missed 01:00 run, too long ago
+		"old": date(5, 31, 1, 0),
+		// Nothing missed
+		"done": date(6, 1, 6, 30),
+	}
+	raw, err := yaml.Marshal(lastRuns)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(stateFilename, raw, 0644))
+
+	mock := &mockHandler{}
+	device.MustAddHandler(mock)
+	defer device.DeleteHandler(mock.GetName())
+
+	s := newScheduler()
+	s.now = func() time.Time { return now }
+	s.setJobs(mustParseJobs(t, `
+- name: recent
+  cron: "0 6 * * *"
+  catch_up: 2h
+  device: porch
+  type: openiot.JoinResponse
+  handler: scheduler_mock
+- name: old
+  cron: "0 1 * * *"
+  catch_up: 2h
+  device: porch
+  type: openiot.JoinResponse
+- name: done
+  cron: "30 6 * * *"
+  catch_up: 2h
+  device: porch
+  type: openiot.JoinResponse
+- name: new
+  cron: "0 8 * * *"
+  device: porch
+  type: openiot.JoinResponse
+`))
+	require.NoError(t, s.start(stateFilename))
+	defer s.stop()
+
+	var job *Job
+	select {
+	case job = <-s.queue:
+		assert.Equal(t, "recent", job.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for job")
+	}
+	// Only one job caught up
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, s.queue)
+
+	// Enqueued / failed job is not recorded as run
+	assert.Equal(t, lastRuns["recent"], *s.upcoming()[2].LastRun)
+	assert.Error(t, job.Run())
+	upcoming := s.upcoming()
+	assert.Equal(t, lastRuns["recent"], *upcoming[2].LastRun)
+	assert.Equal(t, now, *upcoming[2].LastFailure)
+	assert.Equal(t, "job recent: device 'porch' not found", upcoming[2].LastError)
+
+	dev := device.NewDevice(0x2002)
+	dev.DisplayName = "porch"
+	require.NoError(t, device.AddDevice(dev))
+	defer device.DeleteDeviceByID(dev.ID)
+	require.NoError(t, job.Run())
+	require.Len(t, mock.messages, 1)
+
+	upcoming = s.upcoming()
+	var names []string
+	for _, status := range upcoming {
+		names = append(names, status.Name)
+	}
+	assert.Equal(t, []string{"new", "old", "recent", "done"}, names)
+	assert.Equal(t, date(6, 1, 8, 0), *upcoming[0].NextRun)
+	assert.Nil(t, upcoming[0].LastRun)
+	assert.Equal(t, date(6, 2, 1, 0), *upcoming[1].NextRun)
+	assert.Equal(t, date(6, 2, 6, 0), *upcoming[2].NextRun)
+	assert.Equal(t, now, *upcoming[2].LastRun)
+	assert.Nil(t, upcoming[2].LastFailure)
+	assert.Empty(t, upcoming[2].LastError)
+
+	// Last run persisted
+	raw, err = ioutil.ReadFile(stateFilename)
+	require.NoError(t, err)
+	saved := map[string]time.Time{}
+	require.NoError(t, yaml.Unmarshal(raw, &saved))
+	assert.Equal(t, now, saved["recent"].UTC())
+	assert.Equal(t, lastRuns["old"], saved["old"].UTC())
+
+	// Listing
+	defaultScheduler.setJobs(mustParseJobs(t, "- {name: a, cron: '@daily', device: x, type: openiot.JoinResponse}\n"))
+	defer defaultScheduler.setJobs(nil)
+	jobs := GetUpcomingJobs()
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "a", jobs[0].Name)
+	assert.NotNil(t, jobs[0].NextRun)
+}
+
+func TestParseJobsNegative(t *testing.T) {
+	for _, config := range []string{
+		"- name: a\n  unknown: 1\n",
+		"- cron: '@daily'\n  device: a\n  type: openiot.JoinResponse\n",
+		"- name: a\n  device: a\n  type: openiot.JoinResponse\n",
+		"- name: a\n  cron: '@daily'\n  sun: sunset\n  device: a\n  type: openiot.JoinResponse\n",
+		"- name: a\n  cron: '* *'\n  device: a\n  type: openiot.JoinResponse\n",
+		"- name: a\n  sun: noon\n  device: a\n  type: openiot.JoinResponse\n",
+		"- name: a\n  cron: '@daily'\n  catch_up: often\n  device: a\n  type: openiot.JoinResponse\n",
+		"- name: a\n  cron: '@daily'\n  type: openiot.JoinResponse\n",
+		"- name: a\n  cron: '@daily'\n  device: a\n  type: unknown.Message\n",
+		"- name: a\n  cron: '@daily'\n  device: a\n  type: openiot.JoinResponse\n  handler: unknown\n",
+		"- {name: a, cron: '@daily', device: a, type: openiot.JoinResponse}\n" +
+			"- {name: a, cron: '@daily', device: a, type: openiot.JoinResponse}\n",
+	} {
+		_, err := parseJobs(strings.NewReader(config))
+		assert.Error(t, err, config)
+	}
+}
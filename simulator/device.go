@@ -0,0 +1,357 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/encode"
+	"github.com/open-iot-devices/server/utils/schema"
+)
+
+// JoinRequest is re-sent few times before starting over from KeyExchange
+const joinAttempts = 3
+
+var errTimeout = errors.New("no response from server")
+
+// Device is single virtual device
+type Device struct {
+	sim *Simulator
+	// Device side parameters: key, sequences, etc. It is not added into device registry.
+	dev   *device.Device
+	rand  *rand.Rand
+	inbox chan []byte
+	// Public part of last handled key rotation request
+	rekeyDhA []uint32
+
+	lock   sync.Mutex
+	joined bool
+}
+
+func newDevice(sim *Simulator, id uint64) *Device {
+	dev := device.NewDevice(id)
+	dev.EncryptionType = sim.config.EncryptionType
+	dev.ProtobufName = sim.config.MessageType
+
+	return &Device{
+		sim:   sim,
+		dev:   dev,
+		rand:  rand.New(rand.NewSource(sim.config.Seed + int64(id))),
+		inbox: make(chan []byte, inboxSize),
+	}
+}
+
+// ID returns device ID
+func (d *Device) ID() uint64 {
+	return d.dev.ID
+}
+
+// Joined tells whether device has joined network
+func (d *Device) Joined() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.joined
+}
+
+// Key returns current encryption key of device
+func (d *Device) Key() []byte {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.dev.Key()
+}
+
+func (d *Device) setKey(key []byte) {
+	d.lock.Lock()
+	d.dev.SetKey(key)
+	d.lock.Unlock()
+}
+
+func (d *Device) run(ctx context.Context) {
+	config := &d.sim.config
+
+	// Spread devices over first interval
+	timer := time.NewTimer(time.Duration(d.rand.Int63n(int64(config.Interval))))
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		return
+	}
+
+	if !d.join(ctx) {
+		return
+	}
+
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+	for sent := 0; ; {
+		if err := d.sendMessage(); err != nil {
+			glog.V(1).Infof("0x%x: unable to send message: %v", d.ID(), err)
+		}
+		sent++
+		if config.Messages != 0 && sent >= config.Messages {
+			return
+		}
+		for waiting := true; waiting; {
+			select {
+			case packet := <-d.inbox:
+				d.downlink(packet)
+			case <-ticker.C:
+				waiting = false
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// join performs KeyExchange (encrypted devices only) and JoinRequest.
+// Retries until succeeded, returns false when ctx is done.
+func (d *Device) join(ctx context.Context) bool {
+	for ctx.Err() == nil {
+		if d.dev.EncryptionType != openiot.EncryptionType_PLAIN {
+			key, err := d.keyExchange(ctx)
+			if err != nil {
+				glog.V(1).Infof("0x%x: key exchange failed: %v", d.ID(), err)
+				continue
+			}
+			d.setKey(key)
+		}
+		for attempt := 0; attempt < joinAttempts && ctx.Err() == nil; attempt++ {
+			if err := d.joinRequest(ctx); err != nil {
+				glog.V(1).Infof("0x%x: join failed: %v", d.ID(), err)
+				continue
+			}
+			d.lock.Lock()
+			d.joined = true
+			d.lock.Unlock()
+			d.sim.count(func(stats *Stats) { stats.Joined++ })
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *Device) keyExchange(ctx context.Context) ([]byte, error) {
+	private, public := encode.GenerateDiffieHellman(dhG, dhP)
+	hdr := &openiot.Header{
+		DeviceId:    d.ID(),
+		KeyExchange: true,
+	}
+	request := &openiot.KeyExchangeRequest{
+		DhG:            dhG,
+		DhP:            dhP,
+		DhA:            public,
+		EncryptionType: d.dev.EncryptionType,
+	}
+	payload, err := encode.MakeReadyToSendMessage(hdr, openiot.EncryptionType_PLAIN, nil, request)
+	if err != nil {
+		return nil, err
+	}
+	d.sim.count(func(stats *Stats) { stats.KeyExchanges++ })
+
+	buf, err := d.request(ctx, payload, func(hdr *openiot.Header) bool {
+		return hdr.KeyExchange
+	})
+	if err != nil {
+		return nil, err
+	}
+	response := &openiot.KeyExchangeResponse{}
+	if err := encode.ReadSingleMessage(buf, response); err != nil {
+		return nil, err
+	}
+	if len(response.DhB) != len(private) {
+		return nil, fmt.Errorf("Invalid DhB len, %d", len(response.DhB))
+	}
+
+	return encode.DiffieHellmanKey(dhP, response.DhB, private), nil
+}
+
+func (d *Device) joinRequest(ctx context.Context) error {
+	config := &d.sim.config
+	hdr := &openiot.Header{
+		DeviceId:    d.ID(),
+		JoinRequest: true,
+	}
+	request := &openiot.JoinRequest{
+		Name:         config.Name,
+		Manufacturer: config.Manufacturer,
+		ProductUrl:   config.ProductURL,
+		ProtobufName: config.MessageType,
+	}
+	payload, err := encode.MakeReadyToSendMessage(hdr, d.dev.EncryptionType, d.dev.Key(), request)
+	if err != nil {
+		return err
+	}
+	d.sim.count(func(stats *Stats) { stats.JoinRequests++ })
+
+	buf, err := d.request(ctx, payload, func(hdr *openiot.Header) bool {
+		return hdr.JoinRequest
+	})
+	if err != nil {
+		return err
+	}
+
+	return encode.DecryptAndRead(buf, d.dev.EncryptionType, d.dev.Key(), &openiot.JoinResponse{})
+}
+
+// request sends payload and waits for matching response from server.
+// Returns response without header.
+func (d *Device) request(ctx context.Context, payload []byte, match func(hdr *openiot.Header) bool) (*bytes.Buffer, error) {
+	// Send errors are handled like lost packets
+	if err := d.sim.send(payload); err != nil {
+		glog.V(1).Infof("0x%x: send failed: %v", d.ID(), err)
+	}
+
+	// Random part of timeout prevents devices from retrying all at once
+	timeout := d.sim.config.Timeout
+	timer := time.NewTimer(timeout + time.Duration(d.rand.Int63n(int64(timeout)/2+1)))
+	defer timer.Stop()
+	for {
+		select {
+		case packet := <-d.inbox:
+			hdr, buf, err := readHeader(packet)
+			if err == nil && match(hdr) {
+				return buf, nil
+			}
+			// E.g. late response for previous request
+			d.sim.count(func(stats *Stats) { stats.Dropped++ })
+		case <-timer.C:
+			d.sim.count(func(stats *Stats) { stats.Timeouts++ })
+			return nil, errTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (d *Device) sendMessage() error {
+	msg := schema.NewMessage(d.sim.config.MessageType)
+	fillMessage(d.rand, proto.MessageReflect(msg), 0)
+	payload, err := encode.MakeReadyToSendDeviceMessage(d.dev, msg)
+	if err != nil {
+		return err
+	}
+	d.sim.count(func(stats *Stats) { stats.Sent++ })
+
+	return d.sim.send(payload)
+}
+
+// downlink handles packet sent by server after device has joined
+func (d *Device) downlink(packet []byte) {
+	hdr, buf, err := readHeader(packet)
+	if err == nil {
+		switch {
+		case hdr.KeyExchange:
+			err = d.rekey(buf)
+		case hdr.JoinRequest:
+			err = fmt.Errorf("JoinResponse for already joined device")
+		default:
+			err = d.receive(buf)
+		}
+	}
+	if err != nil {
+		glog.V(1).Infof("0x%x: downlink dropped: %v", d.ID(), err)
+		d.sim.count(func(stats *Stats) { stats.Dropped++ })
+	}
+}
+
+// rekey replies to server initiated key rotation and starts using new key
+func (d *Device) rekey(buf *bytes.Buffer) error {
+	request := &openiot.KeyExchangeRequest{}
+	if err := encode.DecryptAndRead(buf, d.dev.EncryptionType, d.dev.Key(), request); err != nil {
+		return err
+	}
+	if len(request.DhA) != aes.BlockSize || request.DhP == 0 {
+		return fmt.Errorf("Invalid key rotation request")
+	}
+	// Server repeats request until response arrives
+	if equalPublic(request.DhA, d.rekeyDhA) {
+		return fmt.Errorf("duplicate key rotation request")
+	}
+
+	private, public := encode.GenerateDiffieHellman(request.DhG, request.DhP)
+	hdr := &openiot.Header{
+		DeviceId:    d.ID(),
+		KeyExchange: true,
+	}
+	payload, err := encode.MakeReadyToSendMessage(hdr, d.dev.EncryptionType, d.dev.Key(),
+		&openiot.KeyExchangeResponse{DhB: public})
+	if err != nil {
+		return err
+	}
+	if err := d.sim.send(payload); err != nil {
+		return err
+	}
+	d.rekeyDhA = request.DhA
+	d.setKey(encode.DiffieHellmanKey(request.DhP, request.DhA, private))
+	d.sim.count(func(stats *Stats) { stats.Rekeys++ })
+
+	return nil
+}
+
+// receive decodes downlink message
+func (d *Device) receive(buf *bytes.Buffer) error {
+	decrypted, err := encode.Decrypt(buf, d.dev.EncryptionType, d.dev.Key())
+	if err != nil {
+		return err
+	}
+	info := &openiot.MessageInfo{}
+	if err := encode.ReadSingleMessage(decrypted, info); err != nil {
+		return err
+	}
+	if info.Sequence <= d.dev.SequenceReceive {
+		return fmt.Errorf("duplicate downlink seq %d (last seq %d)", info.Sequence, d.dev.SequenceReceive)
+	}
+	msg := schema.NewMessage(d.sim.config.DownlinkType)
+	if err := encode.ReadSingleMessage(decrypted, msg); err != nil {
+		return err
+	}
+	d.dev.SequenceReceive = info.Sequence
+	d.sim.count(func(stats *Stats) { stats.Downlinks++ })
+	if d.sim.config.OnDownlink != nil {
+		d.sim.config.OnDownlink(d, msg)
+	}
+
+	return nil
+}
+
+// readHeader reads packet header and checks CRC of the rest
+func readHeader(packet []byte) (*openiot.Header, *bytes.Buffer, error) {
+	buf := bytes.NewBuffer(packet)
+	hdr := &openiot.Header{}
+	if err := encode.ReadSingleMessage(buf, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr.Crc != crc32.ChecksumIEEE(buf.Bytes()) {
+		return nil, nil, fmt.Errorf("CRC check failed")
+	}
+
+	return hdr, buf, nil
+}
+
+func equalPublic(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,268 @@
+// Package simulator emulates OpenIoT devices end to end, so server can be
+// load / integration tested without hardware. Every virtual device performs
+// KeyExchange and JoinRequest, then periodically sends messages of configured
+// protobuf type filled with generated values and handles downlinks, including
+// server initiated key rotation.
+//
+// All devices share single transport, like devices behind one radio gateway:
+// simulator's transport is counterpart of server's one (e.g. UDP transport
+// listening on server's "remote" address and sending to server's "listen" one).
+// Uplink packets may be lost, duplicated or reordered on purpose (see Faults).
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/encode"
+	"github.com/open-iot-devices/server/transport"
+	"github.com/open-iot-devices/server/utils/schema"
+)
+
+// Config describes virtual devices
+type Config struct {
+	// Amount of virtual devices, their IDs are FirstID, FirstID+1, ...
+	Devices int
+	FirstID uint64
+	// JoinRequest parameters
+	Name         string
+	Manufacturer string
+	ProductURL   string
+	// Protobuf name of messages sent by devices
+	MessageType string
+	// Protobuf name of downlink messages, MessageType when empty
+	DownlinkType   string
+	EncryptionType openiot.EncryptionType
+	// Time between messages of single device. To spread load devices start
+	// at random moment within first interval.
+	Interval time.Duration
+	// Amount of messages sent by every device, 0 means until stopped
+	Messages int
+	// Time to wait for KeyExchange / JoinRequest response before retry
+	Timeout time.Duration
+	Faults  Faults
+	// Seed of generated values and faults, the same seed gives the same
+	// values and faults (unless timing changes order of packets)
+	Seed int64
+	// Called from device's goroutine for every downlink message
+	OnDownlink func(dev *Device, msg proto.Message)
+}
+
+// Faults are probabilities (0..1) of uplink packet to be lost, sent twice,
+// or held and sent after next packet.
+type Faults struct {
+	Loss      float64
+	Duplicate float64
+	Reorder   float64
+}
+
+// Stats contains simulator counters
+type Stats struct {
+	Joined       int
+	KeyExchanges uint64
+	JoinRequests uint64
+	Timeouts     uint64
+	Sent         uint64
+	Lost         uint64
+	Duplicated   uint64
+	Reordered    uint64
+	Downlinks    uint64
+	Rekeys       uint64
+	// Downlink packets not processed: unknown device, malformed, duplicates
+	Dropped uint64
+}
+
+const (
+	defaultTimeout = 5 * time.Second
+	inboxSize      = 16
+	// Diffie-Hellman parameters used by devices
+	dhG = 199
+	dhP = 4001
+)
+
+// Simulator runs set of virtual devices
+type Simulator struct {
+	config    Config
+	transport transport.Transport
+	devices   []*Device
+	byID      map[uint64]*Device
+
+	lock  sync.Mutex
+	stats Stats
+	// Faults are decided by own generator, so they don't depend on values
+	rand *rand.Rand
+	// Packet held to be sent after next one
+	held []byte
+}
+
+// New creates simulator of devices using tr to talk to server.
+// Transport must be started already.
+func New(config Config, tr transport.Transport) (*Simulator, error) {
+	if config.Devices <= 0 {
+		return nil, fmt.Errorf("amount of devices must be positive")
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive")
+	}
+	if schema.NewMessage(config.MessageType) == nil {
+		return nil, fmt.Errorf("Protobuf '%s' is not registered", config.MessageType)
+	}
+	if config.DownlinkType == "" {
+		config.DownlinkType = config.MessageType
+	}
+	if schema.NewMessage(config.DownlinkType) == nil {
+		return nil, fmt.Errorf("Protobuf '%s' is not registered", config.DownlinkType)
+	}
+	if config.EncryptionType != openiot.EncryptionType_PLAIN && config.EncryptionType != openiot.EncryptionType_AES_ECB {
+		return nil, fmt.Errorf("Encoding %v is not supported", config.EncryptionType)
+	}
+	for _, value := range []float64{config.Faults.Loss, config.Faults.Duplicate, config.Faults.Reorder} {
+		if value < 0 || value > 1 {
+			return nil, fmt.Errorf("fault probability must be within 0..1")
+		}
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+
+	s := &Simulator{
+		config:    config,
+		transport: tr,
+		byID:      map[uint64]*Device{},
+		rand:      rand.New(rand.NewSource(config.Seed)),
+	}
+	for index := 0; index < config.Devices; index++ {
+		dev := newDevice(s, config.FirstID+uint64(index))
+		s.devices = append(s.devices, dev)
+		s.byID[dev.ID()] = dev
+	}
+
+	return s, nil
+}
+
+// Devices returns all virtual devices
+func (s *Simulator) Devices() []*Device {
+	return s.devices
+}
+
+// Stats returns snapshot of simulator counters
+func (s *Simulator) Stats() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.stats
+}
+
+// Run runs all devices until ctx is done or, when amount of messages
+// is limited, until all devices sent their messages.
+func (s *Simulator) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Deliver downlinks to devices
+	go func() {
+		for {
+			select {
+			case packet := <-s.transport.Receive():
+				s.dispatch(packet)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, dev := range s.devices {
+		wg.Add(1)
+		go func(dev *Device) {
+			defer wg.Done()
+			dev.run(ctx)
+		}(dev)
+	}
+	wg.Wait()
+
+	// Packet may still be held for reordering
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.held != nil {
+		s.transport.Send(s.held)
+		s.held = nil
+	}
+
+	return nil
+}
+
+// dispatch passes downlink packet to device it's addressed to
+func (s *Simulator) dispatch(packet []byte) {
+	// Transport may re-use buffer
+	packet = append([]byte{}, packet...)
+	hdr := &openiot.Header{}
+	if err := encode.ReadSingleMessage(bytes.NewBuffer(packet), hdr); err != nil {
+		s.count(func(stats *Stats) { stats.Dropped++ })
+		return
+	}
+	dev, ok := s.byID[hdr.DeviceId]
+	if !ok {
+		s.count(func(stats *Stats) { stats.Dropped++ })
+		return
+	}
+	select {
+	case dev.inbox <- packet:
+	default:
+		// Device is not fast enough
+		s.count(func(stats *Stats) { stats.Dropped++ })
+	}
+}
+
+// send sends uplink packet, injecting faults
+func (s *Simulator) send(payload []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	faults := s.config.Faults
+	if s.chance(faults.Loss) {
+		s.stats.Lost++
+		return nil
+	}
+	if s.held == nil && s.chance(faults.Reorder) {
+		s.stats.Reordered++
+		s.held = payload
+		return nil
+	}
+	packets := [][]byte{payload}
+	if s.chance(faults.Duplicate) {
+		s.stats.Duplicated++
+		packets = append(packets, payload)
+	}
+	if s.held != nil {
+		packets = append(packets, s.held)
+		s.held = nil
+	}
+	for _, packet := range packets {
+		if err := s.transport.Send(packet); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Simulator) chance(probability float64) bool {
+	return probability > 0 && s.rand.Float64() < probability
+}
+
+func (s *Simulator) count(fn func(stats *Stats)) {
+	s.lock.Lock()
+	fn(&s.stats)
+	s.lock.Unlock()
+}
@@ -0,0 +1,303 @@
+package simulator
+
+import (
+	"context"
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/processor"
+	"github.com/open-iot-devices/server/utils/events"
+)
+
+// loopback is in-memory transport, packets sent are received by peer
+type loopback struct {
+	name      string
+	receiveCh chan []byte
+	peer      *loopback
+}
+
+func newLoopback(name string) (*loopback, *loopback) {
+	server := &loopback{name: name, receiveCh: make(chan []byte, 4096)}
+	sim := &loopback{name: name + "_sim", receiveCh: make(chan []byte, 4096)}
+	server.peer, sim.peer = sim, server
+	return server, sim
+}
+
+func (l *loopback) GetName() string {
+	return l.name
+}
+
+func (l *loopback) GetTypeName() string {
+	return "loopback"
+}
+
+func (l *loopback) Start() error {
+	return nil
+}
+
+func (l *loopback) Stop() {
+}
+
+func (l *loopback) Receive() <-chan []byte {
+	return l.receiveCh
+}
+
+func (l *loopback) Send(packet []byte) error {
+	l.peer.receiveCh <- append([]byte{}, packet...)
+	return nil
+}
+
+// testServer processes packets like main loop of server does
+type testServer struct {
+	transport *loopback
+	calls     chan func()
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+func startServer(t *testing.T, tr *loopback) *testServer {
+	// Devices join at once
+	require.NoError(t, flag.Set("keyexchange.rate", "10000"))
+	require.NoError(t, flag.Set("keyexchange.burst", "10000"))
+
+	s := &testServer{
+		transport: tr,
+		calls:     make(chan func()),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.stopped)
+		for {
+			select {
+			case packet := <-tr.receiveCh:
+				s.process(packet)
+			case fn := <-s.calls:
+				fn()
+			case <-s.done:
+				// Process packets sent before stop
+				for {
+					select {
+					case packet := <-tr.receiveCh:
+						s.process(packet)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return s
+}
+
+func (s *testServer) process(packet []byte) {
+	processor.ProcessMessage(&processor.Message{Source: s.transport, Payload: packet})
+}
+
+// call runs fn from server's loop
+func (s *testServer) call(fn func()) {
+	done := make(chan struct{})
+	s.calls <- func() {
+		fn()
+		close(done)
+	}
+	<-done
+}
+
+func (s *testServer) stop() {
+	close(s.done)
+	<-s.stopped
+	device.DeleteAllDevices()
+	flag.Set("keyexchange.rate", "1")
+	flag.Set("keyexchange.burst", "10")
+}
+
+// waitFor polls condition until it becomes true, fails test after 5 seconds
+func waitFor(t *testing.T, condition func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// countMessages returns amount of messages accepted by processor per device
+func countMessages(sub *events.Subscription) map[string]int {
+	sub.Close()
+	counts := map[string]int{}
+	for event := range sub.C {
+		counts[event.DeviceID]++
+	}
+	return counts
+}
+
+func TestSimulator(t *testing.T) {
+	serverTr, simTr := newLoopback("sim1")
+	server := startServer(t, serverTr)
+	sub := events.Subscribe(1000, func(event *events.Event) bool {
+		return event.Type == processor.EventMessage
+	})
+
+	sim, err := New(Config{
+		Devices:        50,
+		FirstID:        0x1000,
+		Name:           "simulated",
+		MessageType:    "openiot.KeyExchangeRequest",
+		EncryptionType: openiot.EncryptionType_AES_ECB,
+		Interval:       20 * time.Millisecond,
+		Messages:       3,
+		Timeout:        time.Second,
+		Seed:           1,
+	}, simTr)
+	require.NoError(t, err)
+	require.NoError(t, sim.Run(context.Background()))
+	server.stop()
+
+	stats := sim.Stats()
+	assert.Equal(t, 50, stats.Joined)
+	assert.EqualValues(t, 50, stats.KeyExchanges)
+	assert.EqualValues(t, 50, stats.JoinRequests)
+	assert.EqualValues(t, 150, stats.Sent)
+	assert.Zero(t, stats.Lost+stats.Duplicated+stats.Reordered+stats.Timeouts+stats.Dropped)
+
+	counts := countMessages(sub)
+	assert.Len(t, counts, 50)
+	for _, dev := range sim.Devices() {
+		assert.True(t, dev.Joined())
+		assert.Equal(t, 3, counts[dev.dev.IDhex], dev.dev.IDhex)
+	}
+}
+
+func TestSimulatorFaults(t *testing.T) {
+	serverTr, simTr := newLoopback("sim2")
+	server := startServer(t, serverTr)
+	sub := events.Subscribe(1000, func(event *events.Event) bool {
+		return event.Type == processor.EventMessage
+	})
+
+	sim, err := New(Config{
+		Devices:     10,
+		FirstID:     0x2000,
+		MessageType: "openiot.JoinRequest",
+		Interval:    5 * time.Millisecond,
+		Messages:    20,
+		Timeout:     50 * time.Millisecond,
+		Faults:      Faults{Loss: 0.2, Duplicate: 0.2, Reorder: 0.2},
+		Seed:        1,
+	}, simTr)
+	require.NoError(t, err)
+	require.NoError(t, sim.Run(context.Background()))
+	server.stop()
+
+	stats := sim.Stats()
+	assert.Equal(t, 10, stats.Joined)
+	assert.EqualValues(t, 200, stats.Sent)
+	assert.NotZero(t, stats.Lost)
+	assert.NotZero(t, stats.Duplicated)
+	assert.NotZero(t, stats.Reordered)
+
+	// Processor must never accept the same message twice
+	total := 0
+	for id, count := range countMessages(sub) {
+		assert.True(t, count <= 20, "%s: %d messages accepted", id, count)
+		total += count
+	}
+	assert.True(t, total > 0)
+	assert.True(t, total < 200)
+}
+
+func TestSimulatorDownlinks(t *testing.T) {
+	serverTr, simTr := newLoopback("sim3")
+	server := startServer(t, serverTr)
+	defer server.stop()
+
+	downlinks := make(chan proto.Message, 10)
+	sim, err := New(Config{
+		Devices:        1,
+		FirstID:        0x3000,
+		MessageType:    "openiot.KeyExchangeRequest",
+		DownlinkType:   "openiot.JoinResponse",
+		EncryptionType: openiot.EncryptionType_AES_ECB,
+		Interval:       10 * time.Millisecond,
+		Timeout:        time.Second,
+		OnDownlink: func(dev *Device, msg proto.Message) {
+			downlinks <- msg
+		},
+	}, simTr)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- sim.Run(ctx)
+	}()
+	simDev := sim.Devices()[0]
+	waitFor(t, simDev.Joined)
+
+	// Downlink
+	server.call(func() {
+		err = processor.SendMessage(device.FindDeviceByID(0x3000), &openiot.JoinResponse{Name: "downlink"})
+	})
+	require.NoError(t, err)
+	select {
+	case msg := <-downlinks:
+		assert.Equal(t, "downlink", msg.(*openiot.JoinResponse).Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("downlink not received")
+	}
+
+	// Key rotation
+	oldKey := simDev.Key()
+	server.call(func() {
+		err = processor.RequestKeyRotation(0x3000)
+	})
+	require.NoError(t, err)
+	waitFor(t, func() bool {
+		var pending bool
+		server.call(func() {
+			pending = device.FindDeviceByID(0x3000).RekeyPending
+		})
+		return !pending
+	})
+	server.call(func() {
+		assert.Equal(t, simDev.Key(), device.FindDeviceByID(0x3000).Key())
+	})
+	assert.NotEqual(t, oldKey, simDev.Key())
+	assert.EqualValues(t, 1, sim.Stats().Rekeys)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestNew(t *testing.T) {
+	config := Config{Devices: 1, Interval: time.Second, MessageType: "openiot.JoinRequest"}
+	_, err := New(config, nil)
+	assert.NoError(t, err)
+
+	invalid := config
+	invalid.MessageType = "nothing"
+	_, err = New(invalid, nil)
+	assert.EqualError(t, err, "Protobuf 'nothing' is not registered")
+
+	invalid = config
+	invalid.Devices = 0
+	_, err = New(invalid, nil)
+	assert.Error(t, err)
+
+	invalid = config
+	invalid.EncryptionType = openiot.EncryptionType_AES_CBC
+	_, err = New(invalid, nil)
+	assert.EqualError(t, err, "Encoding AES_CBC is not supported")
+
+	invalid = config
+	invalid.Faults.Loss = 2
+	_, err = New(invalid, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,107 @@
+package simulator
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Nested messages deeper than that are left empty (recursive types)
+const maxDepth = 5
+
+// fillMessage sets all fields of msg to random values. Numbers are kept
+// small (integers 0..100, floats -100..100), so they look like sensor readings
+// and are valid for well known types (e.g. Timestamp) as well.
+// Only one field of oneof is set.
+func fillMessage(r *rand.Rand, msg protoreflect.Message, depth int) {
+	desc := msg.Descriptor()
+	oneofs := desc.Oneofs()
+	chosen := map[protoreflect.FullName]int{}
+	for index := 0; index < oneofs.Len(); index++ {
+		oneof := oneofs.Get(index)
+		chosen[oneof.FullName()] = r.Intn(oneof.Fields().Len())
+	}
+
+	fields := desc.Fields()
+	for index := 0; index < fields.Len(); index++ {
+		field := fields.Get(index)
+		if oneof := field.ContainingOneof(); oneof != nil {
+			if oneof.Fields().Get(chosen[oneof.FullName()]) != field {
+				continue
+			}
+		}
+		if field.Kind() == protoreflect.MessageKind || field.Kind() == protoreflect.GroupKind {
+			if depth >= maxDepth {
+				continue
+			}
+		}
+
+		switch {
+		case field.IsList():
+			list := msg.Mutable(field).List()
+			for count := r.Intn(3) + 1; count > 0; count-- {
+				if field.Message() != nil {
+					element := list.NewElement()
+					fillMessage(r, element.Message(), depth+1)
+					list.Append(element)
+				} else {
+					list.Append(randomValue(r, field))
+				}
+			}
+		case field.IsMap():
+			entries := msg.Mutable(field).Map()
+			for count := r.Intn(3) + 1; count > 0; count-- {
+				key := randomValue(r, field.MapKey()).MapKey()
+				if field.MapValue().Message() != nil {
+					value := entries.NewValue()
+					fillMessage(r, value.Message(), depth+1)
+					entries.Set(key, value)
+				} else {
+					entries.Set(key, randomValue(r, field.MapValue()))
+				}
+			}
+		case field.Message() != nil:
+			fillMessage(r, msg.Mutable(field).Message(), depth+1)
+		default:
+			msg.Set(field, randomValue(r, field))
+		}
+	}
+}
+
+// randomValue returns random value of scalar field
+func randomValue(r *rand.Rand, field protoreflect.FieldDescriptor) protoreflect.Value {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return protoreflect.ValueOfBool(r.Intn(2) == 1)
+	case protoreflect.EnumKind:
+		values := field.Enum().Values()
+		return protoreflect.ValueOfEnum(values.Get(r.Intn(values.Len())).Number())
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return protoreflect.ValueOfInt32(int32(r.Intn(101)))
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return protoreflect.ValueOfInt64(int64(r.Intn(101)))
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return protoreflect.ValueOfUint32(uint32(r.Intn(101)))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return protoreflect.ValueOfUint64(uint64(r.Intn(101)))
+	case protoreflect.FloatKind:
+		return protoreflect.ValueOfFloat32(float32(randomFloat(r)))
+	case protoreflect.DoubleKind:
+		return protoreflect.ValueOfFloat64(randomFloat(r))
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(fmt.Sprintf("%s-%d", field.Name(), r.Intn(1000)))
+	case protoreflect.BytesKind:
+		value := make([]byte, 4)
+		r.Read(value)
+		return protoreflect.ValueOfBytes(value)
+	}
+
+	panic(fmt.Sprintf("unexpected kind %v", field.Kind()))
+}
+
+// randomFloat returns value within -100..100 with 2 decimal places
+func randomFloat(r *rand.Rand) float64 {
+	return math.Round((r.Float64()*200-100)*100) / 100
+}
@@ -0,0 +1,31 @@
+package simulator
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+)
+
+func TestFillMessage(t *testing.T) {
+	msg := &openiot.KeyExchangeRequest{}
+	fillMessage(rand.New(rand.NewSource(1)), proto.MessageReflect(msg), 0)
+	assert.True(t, msg.DhG <= 100)
+	assert.True(t, msg.DhP <= 100)
+	assert.NotEmpty(t, msg.DhA)
+	assert.True(t, len(msg.DhA) <= 3)
+	_, ok := openiot.EncryptionType_name[int32(msg.EncryptionType)]
+	assert.True(t, ok)
+
+	// Same seed - same values
+	again := &openiot.KeyExchangeRequest{}
+	fillMessage(rand.New(rand.NewSource(1)), proto.MessageReflect(again), 0)
+	assert.True(t, proto.Equal(msg, again))
+
+	join := &openiot.JoinRequest{}
+	fillMessage(rand.New(rand.NewSource(1)), proto.MessageReflect(join), 0)
+	assert.Regexp(t, "^name-[0-9]+$", join.Name)
+}
@@ -108,7 +108,10 @@ func (s *UDP) serve() {
 			glog.Infof("%s: readFrom failed: %v", s.GetName(), err)
 			continue
 		}
-		s.receiveCh <- buf[:n]
+		// Buffer is re-used for the next packet while this one is still queued
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		s.receiveCh <- packet
 	}
 }
 
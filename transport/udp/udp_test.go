@@ -0,0 +1,42 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceiveQueued(t *testing.T) {
+	tr := NewUDP("test").(*UDP)
+	tr.Listen = "127.0.0.1:0"
+	require.NoError(t, tr.Start())
+	defer tr.Stop()
+
+	conn, err := net.Dial("udp", tr.socket.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Send few packets before reading any: one is queued in channel
+	// while the next one is already read from socket
+	var packets [][]byte
+	for index := 0; index < 3; index++ {
+		packet := []byte(fmt.Sprintf("packet%d", index))
+		packets = append(packets, packet)
+		_, err := conn.Write(packet)
+		require.NoError(t, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, expected := range packets {
+		select {
+		case packet := <-tr.Receive():
+			assert.Equal(t, expected, packet)
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet not received")
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Event is something happened in server, e.g. rule fired or sun has set
+type Event struct {
+	Type     string                 `json:"type"`
+	Time     time.Time              `json:"time"`
+	DeviceID string                 `json:"device_id,omitempty"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+// Subscription delivers published events into C until closed
+type Subscription struct {
+	C <-chan *Event
+
+	ch     chan *Event
+	filter func(*Event) bool
+	// Amount of events not delivered because subscriber was too slow
+	dropped uint64
+}
+
+var mutex sync.RWMutex
+var subscriptions = map[*Subscription]bool{}
+
+// Subscribe creates new subscription for events matching filter (nil means all).
+// Events are never blocked on slow subscribers: when buffer is full
+// new events are dropped.
+func Subscribe(buffer int, filter func(*Event) bool) *Subscription {
+	ch := make(chan *Event, buffer)
+	sub := &Subscription{C: ch, ch: ch, filter: filter}
+
+	mutex.Lock()
+	subscriptions[sub] = true
+	mutex.Unlock()
+
+	return sub
+}
+
+// Close stops delivery of events and closes channel C
+func (s *Subscription) Close() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if subscriptions[s] {
+		delete(subscriptions, s)
+		close(s.ch)
+	}
+}
+
+// Dropped returns amount of events dropped because of full buffer
+func (s *Subscription) Dropped() uint64 {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	return s.dropped
+}
+
+// Publish delivers event to all matching subscribers,
+// Time is set to current time when empty
+func Publish(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	glog.V(2).Infof("Event %s, device '%s': %v", event.Type, event.DeviceID, event.Data)
+
+	// Write lock: dropped counters are updated
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for sub := range subscriptions {
+		if sub.filter != nil && !sub.filter(event) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			sub.dropped++
+		}
+	}
+}
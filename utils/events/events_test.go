@@ -0,0 +1,40 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	all := Subscribe(10, nil)
+	defer all.Close()
+	sunset := Subscribe(1, func(event *Event) bool {
+		return event.Type == "sunset"
+	})
+	defer sunset.Close()
+
+	Publish(&Event{Type: "rule", DeviceID: "0x1"})
+	Publish(&Event{Type: "sunset"})
+	Publish(&Event{Type: "sunset"})
+
+	require.Len(t, all.C, 3)
+	event := <-all.C
+	assert.Equal(t, "rule", event.Type)
+	assert.Equal(t, "0x1", event.DeviceID)
+	assert.False(t, event.Time.IsZero())
+
+	// Buffer of 1: second sunset dropped
+	require.Len(t, sunset.C, 1)
+	assert.Equal(t, "sunset", (<-sunset.C).Type)
+	assert.Equal(t, uint64(1), sunset.Dropped())
+	assert.Equal(t, uint64(0), all.Dropped())
+
+	// Closed subscription gets nothing, channel closed
+	sunset.Close()
+	sunset.Close()
+	Publish(&Event{Type: "sunset"})
+	_, ok := <-sunset.C
+	assert.False(t, ok)
+}
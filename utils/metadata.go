@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"gopkg.in/yaml.v2"
+)
+
+// FieldMetadata describes how time series handlers should treat field.
+// It can be declared using custom field options (see UnitFieldOption)
+// or YAML overlay (see LoadFieldMetadata), overlay takes precedence.
+type FieldMetadata struct {
+	Unit string
+	// Value is converted to float: value * scale + offset. Zero scale means 1
+	Scale  float64
+	Offset float64
+	// Tag fields are stored as (indexed) tags rather than values
+	Tag bool
+	// Measurement overrides measurement name derived from field name
+	Measurement string
+	// Name overrides field name within measurement
+	Name string
+}
+
+// MessageMetadata is YAML overlay for single protobuf message
+type MessageMetadata struct {
+	// Default measurement for all message fields
+	Measurement string
+	// Keyed by flattened field name, shell patterns allowed, e.g. "sensors.*.value"
+	Fields map[string]*FieldMetadata
+}
+
+// Measurement is group of values ready to be written into time series database
+type Measurement struct {
+	Name   string
+	Tags   map[string]string
+	Fields map[string]interface{}
+	// Field name -> unit, only for fields with known units
+	Units map[string]string
+}
+
+var metadataByProtobuf = map[string]*MessageMetadata{}
+var metadataLock sync.RWMutex
+
+// LoadFieldMetadata reads YAML metadata overlay keyed by protobuf full name, e.g.:
+//
+//	openiot.sensor.MultiSensorStatus:
+//	  measurement: climate
+//	  fields:
+//	    battery.voltage: {unit: v, scale: 0.001}
+//	    room: {tag: true}
+func LoadFieldMetadata(reader io.Reader) error {
+	metadata := map[string]*MessageMetadata{}
+	decoder := yaml.NewDecoder(reader)
+	decoder.SetStrict(true)
+	if err := decoder.Decode(&metadata); err != nil && err != io.EOF {
+		return err
+	}
+	// Validate patterns
+	for protobufName, msg := range metadata {
+		for pattern := range msg.Fields {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: invalid pattern '%s': %v", protobufName, pattern, err)
+			}
+		}
+	}
+
+	metadataLock.Lock()
+	metadataByProtobuf = metadata
+	metadataLock.Unlock()
+
+	return nil
+}
+
+// DefaultMeasurement is measurement of top level scalar fields
+const DefaultMeasurement = "default"
+
+// ExtractMeasurements flattens protobuf message and groups values into measurements
+// with field metadata applied. By default measurement name is the first component of
+// field name (see SplitProtobufFullName). Every element of repeated field is own
+// value, so metadata patterns may refer to them, e.g. "items.*.v".
+// maxElements limits elements of repeated / map fields, 0 means no limit.
+func ExtractMeasurements(msg proto.Message, maxElements int) map[string]*Measurement {
+	reflected := proto.MessageReflect(msg)
+	f := newFlattener(FlattenOptions{SplitRepeated: true, EnumNames: true, MaxElements: maxElements}, reflected)
+
+	metadataLock.RLock()
+	overlay := metadataByProtobuf[string(reflected.Descriptor().FullName())]
+	metadataLock.RUnlock()
+
+	measurements := map[string]*Measurement{}
+	for fullName, value := range f.results {
+		metadata := getFieldMetadataFromOptions(f.fields[fullName])
+		if overlay != nil {
+			metadata = overlay.apply(fullName, metadata)
+		}
+
+		// Measurement / name
+		tableName, metricName := SplitProtobufFullName(fullName)
+		if overlay != nil && overlay.Measurement != "" {
+			tableName, metricName = overlay.Measurement, fullName
+		}
+		if metadata.Measurement != "" {
+			tableName = metadata.Measurement
+		}
+		if metadata.Name != "" {
+			metricName = metadata.Name
+		}
+		measurement, ok := measurements[tableName]
+		if !ok {
+			measurement = &Measurement{
+				Name:   tableName,
+				Tags:   map[string]string{},
+				Fields: map[string]interface{}{},
+				Units:  map[string]string{},
+			}
+			measurements[tableName] = measurement
+		}
+
+		// Value
+		if metadata.Scale != 0 || metadata.Offset != 0 {
+			if number, ok := toFloat64(value); ok {
+				scale := metadata.Scale
+				if scale == 0 {
+					scale = 1
+				}
+				value = number*scale + metadata.Offset
+			}
+		}
+		if metadata.Tag {
+			measurement.Tags[metricName] = fmt.Sprint(value)
+			continue
+		}
+		measurement.Fields[metricName] = value
+		if metadata.Unit != "" {
+			measurement.Units[metricName] = metadata.Unit
+		}
+	}
+
+	return measurements
+}
+
+// SplitProtobufFullName splits flattened field name into
+// measurement and field name: "temperature.value_c" -> "temperature", "value_c"
+func SplitProtobufFullName(fullName string) (string, string) {
+	tokens := strings.SplitN(fullName, ".", 2)
+	if len(tokens) > 1 {
+		return tokens[0], tokens[1]
+	}
+	return DefaultMeasurement, fullName
+}
+
+// apply merges overlay field metadata on top of base (from proto options).
+// Exact name match takes precedence over patterns.
+func (m *MessageMetadata) apply(fullName string, base FieldMetadata) FieldMetadata {
+	overlay, ok := m.Fields[fullName]
+	if !ok {
+		// Patterns are checked in sorted order to be deterministic
+		patterns := make([]string, 0, len(m.Fields))
+		for pattern := range m.Fields {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, fullName); matched {
+				overlay = m.Fields[pattern]
+				break
+			}
+		}
+	}
+	if overlay == nil {
+		return base
+	}
+
+	if overlay.Unit != "" {
+		base.Unit = overlay.Unit
+	}
+	if overlay.Scale != 0 {
+		base.Scale = overlay.Scale
+	}
+	if overlay.Offset != 0 {
+		base.Offset = overlay.Offset
+	}
+	if overlay.Tag {
+		base.Tag = true
+	}
+	if overlay.Measurement != "" {
+		base.Measurement = overlay.Measurement
+	}
+	if overlay.Name != "" {
+		base.Name = overlay.Name
+	}
+
+	return base
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestExtractMeasurements(t *testing.T) {
+	desc := makeTestMessageDescriptor(t)
+	fields := desc.Fields()
+	msg := dynamicpb.NewMessage(desc)
+	msg.Set(fields.ByName("temperature"), protoreflect.ValueOfFloat32(21.5))
+	msg.Set(fields.ByName("mode"), protoreflect.ValueOfEnum(1))
+	items := msg.Mutable(fields.ByName("items")).List()
+	item := items.NewElement()
+	item.Message().Set(fields.ByName("items").Message().Fields().ByName("v"), protoreflect.ValueOfUint32(1500))
+	items.Append(item)
+
+	// No overlay: grouped by first name component, unit from proto option
+	require.NoError(t, LoadFieldMetadata(strings.NewReader("")))
+	measurements := ExtractMeasurements(msg, 0)
+	assert.Equal(t, float32(21.5), measurements["default"].Fields["temperature"])
+	assert.Equal(t, "c", measurements["default"].Units["temperature"])
+	assert.Equal(t, "ON", measurements["default"].Fields["mode"])
+	assert.Equal(t, uint32(1500), measurements["items"].Fields["0.v"])
+
+	// Overlay
+	overlay := `
+test.Full:
+  measurement: climate
+  fields:
+    mode: {tag: true}
+    "items.*.v": {unit: v, scale: 0.001, name: voltage, measurement: battery}
+    temperature: {offset: 273.15, unit: k}
+`
+	require.NoError(t, LoadFieldMetadata(strings.NewReader(overlay)))
+	defer LoadFieldMetadata(strings.NewReader(""))
+
+	measurements = ExtractMeasurements(msg, 0)
+	climate := measurements["climate"]
+	require.NotNil(t, climate)
+	assert.Equal(t, map[string]string{"mode": "ON"}, climate.Tags)
+	assert.InDelta(t, 294.65, climate.Fields["temperature"], 0.001)
+	assert.Equal(t, "k", climate.Units["temperature"])
+	battery := measurements["battery"]
+	require.NotNil(t, battery)
+	assert.InDelta(t, 1.5, battery.Fields["voltage"], 0.001)
+	assert.Equal(t, map[string]string{"voltage": "v"}, battery.Units)
+}
+
+func TestLoadFieldMetadataNegative(t *testing.T) {
+	err := LoadFieldMetadata(strings.NewReader(`test.Full: {fields: {"[a": {unit: c}}}`))
+	assert.EqualError(t, err, "test.Full: invalid pattern '[a': syntax error in pattern")
+}
+
+func TestSplitProtobufFullName(t *testing.T) {
+	table, name := SplitProtobufFullName("temperature.value_c")
+	assert.Equal(t, "temperature", table)
+	assert.Equal(t, "value_c", name)
+	table, name = SplitProtobufFullName("uptime")
+	assert.Equal(t, "default", table)
+	assert.Equal(t, "uptime", name)
+}
@@ -0,0 +1,393 @@
+// Package metrics implements minimal Prometheus compatible metrics
+// (counters, gauges, histograms) exposed in text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets suitable for latencies, in seconds
+var DefaultBuckets = []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+type metric interface {
+	// write outputs all metric's samples in text exposition format
+	write(writer *bufio.Writer)
+}
+
+var registry = map[string]metric{}
+var registryLock sync.Mutex
+
+func register(name string, m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("metric '%s' already registered", name))
+	}
+	registry[name] = m
+}
+
+// Registered tells whether metric with given name already exists
+func Registered(name string) bool {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	_, ok := registry[name]
+	return ok
+}
+
+// Unregister removes metric, used mostly in tests
+func Unregister(name string) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	delete(registry, name)
+}
+
+// Handler returns http.Handler serving all registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writer := bufio.NewWriter(w)
+		WriteAll(writer)
+		writer.Flush()
+	})
+}
+
+// WriteAll writes all registered metrics, sorted by name
+func WriteAll(writer *bufio.Writer) {
+	registryLock.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(registry))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, registry[name])
+	}
+	registryLock.Unlock()
+
+	for _, m := range metrics {
+		m.write(writer)
+	}
+}
+
+// vec is collection of samples of the same metric keyed by label values
+type vec struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+
+	mutex   sync.Mutex
+	samples map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+	// Histograms only
+	counts []uint64
+	count  uint64
+}
+
+func newVec(name, help, typ string, labelNames []string) *vec {
+	return &vec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		samples:    map[string]*sample{},
+	}
+}
+
+// Name returns metric name
+func (v *vec) Name() string {
+	return v.name
+}
+
+// get returns sample for given label values, must be called with lock held
+func (v *vec) get(labelValues []string) *sample {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric '%s': expected %d label values, got %d",
+			v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.samples[key]
+	if !ok {
+		s = &sample{labelValues: append([]string{}, labelValues...)}
+		v.samples[key] = s
+	}
+	return s
+}
+
+func (v *vec) sortedSamples() []*sample {
+	keys := make([]string, 0, len(v.samples))
+	for key := range v.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	samples := make([]*sample, 0, len(keys))
+	for _, key := range keys {
+		samples = append(samples, v.samples[key])
+	}
+	return samples
+}
+
+func (v *vec) writeHeader(writer *bufio.Writer) {
+	fmt.Fprintf(writer, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(writer, "# TYPE %s %s\n", v.name, v.typ)
+}
+
+func (v *vec) write(writer *bufio.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.writeHeader(writer)
+	for _, s := range v.sortedSamples() {
+		fmt.Fprintf(writer, "%s%s %s\n", v.name, formatLabels(v.labelNames, s.labelValues), formatValue(s.value))
+	}
+}
+
+// Counter //
+
+// Counter is monotonically increasing value
+type Counter struct {
+	*vec
+}
+
+// NewCounter creates and registers new counter
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{newVec(name, help, "counter", labelNames)}
+	register(name, c)
+	return c
+}
+
+// Inc increments counter by 1
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases counter by value
+func (c *Counter) Add(value float64, labelValues ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.get(labelValues).value += value
+}
+
+// Value returns current value of counter
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.get(labelValues).value
+}
+
+// Gauge //
+
+// Gauge is value which can go up and down
+type Gauge struct {
+	*vec
+}
+
+// NewGauge creates and registers new gauge
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	g := &Gauge{newVec(name, help, "gauge", labelNames)}
+	register(name, g)
+	return g
+}
+
+// Set sets gauge value
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.get(labelValues).value = value
+}
+
+// Value returns current value of gauge
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.get(labelValues).value
+}
+
+// Delete removes sample with given label values
+func (g *Gauge) Delete(labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	delete(g.samples, strings.Join(labelValues, "\xff"))
+}
+
+// DeleteMatching removes all samples matched by filter
+func (g *Gauge) DeleteMatching(filter func(labels map[string]string) bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for key, s := range g.samples {
+		labels := map[string]string{}
+		for i, name := range g.labelNames {
+			labels[name] = s.labelValues[i]
+		}
+		if filter(labels) {
+			delete(g.samples, key)
+		}
+	}
+}
+
+// GaugeFunc is gauge which value is obtained by calling function on every scrape
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc creates and registers new function based gauge
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(writer *bufio.Writer) {
+	fmt.Fprintf(writer, "# HELP %s %s\n", g.name, escapeHelp(g.help))
+	fmt.Fprintf(writer, "# TYPE %s gauge\n", g.name)
+	fmt.Fprintf(writer, "%s %s\n", g.name, formatValue(g.fn()))
+}
+
+// Histogram //
+
+// Histogram counts observations in configurable buckets
+type Histogram struct {
+	*vec
+	buckets []float64
+}
+
+// NewHistogram creates and registers new histogram. Nil buckets means DefaultBuckets.
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{newVec(name, help, "histogram", labelNames), buckets}
+	register(name, h)
+	return h
+}
+
+// Observe adds single observation
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s := h.get(labelValues)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// Count returns amount of observations
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.get(labelValues).count
+}
+
+func (h *Histogram) write(writer *bufio.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.writeHeader(writer)
+	labelNames := append(append([]string{}, h.labelNames...), "le")
+	for _, s := range h.sortedSamples() {
+		labelValues := append(append([]string{}, s.labelValues...), "")
+		for i, bound := range h.buckets {
+			var count uint64
+			if s.counts != nil {
+				count = s.counts[i]
+			}
+			labelValues[len(labelValues)-1] = formatValue(bound)
+			fmt.Fprintf(writer, "%s_bucket%s %d\n", h.name, formatLabels(labelNames, labelValues), count)
+		}
+		labelValues[len(labelValues)-1] = "+Inf"
+		fmt.Fprintf(writer, "%s_bucket%s %d\n", h.name, formatLabels(labelNames, labelValues), s.count)
+		labels := formatLabels(h.labelNames, s.labelValues)
+		fmt.Fprintf(writer, "%s_sum%s %s\n", h.name, labels, formatValue(s.value))
+		fmt.Fprintf(writer, "%s_count%s %d\n", h.name, labels, s.count)
+	}
+}
+
+// helpers //
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
+
+// SanitizeName converts arbitrary string into valid metric name:
+// all characters except [a-zA-Z0-9_:] are replaced with underscore,
+// names starting with digit are prefixed with underscore.
+func SanitizeName(name string) string {
+	var builder strings.Builder
+	if len(name) > 0 && name[0] >= '0' && name[0] <= '9' {
+		builder.WriteByte('_')
+	}
+	for _, r := range name {
+		valid := r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9')
+		if valid {
+			builder.WriteRune(r)
+		} else {
+			builder.WriteByte('_')
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExposition(t *testing.T) {
+	counter := NewCounter("test_packets_total", "Packets\nreceived", "transport")
+	defer Unregister("test_packets_total")
+	gauge := NewGauge("test_temperature", "Temperature", "device_id", "display_name")
+	defer Unregister("test_temperature")
+	histogram := NewHistogram("test_duration_seconds", "Duration", []float64{1, 0.1}, "handler")
+	defer Unregister("test_duration_seconds")
+	NewGaugeFunc("test_sessions", "Sessions", func() float64 { return 3 })
+	defer Unregister("test_sessions")
+
+	counter.Inc("udp")
+	counter.Add(2, "udp")
+	counter.Inc("serial")
+	gauge.Set(21.5, "0x1", `kitchen "main"`)
+	gauge.Set(1, "0x2", "attic")
+	gauge.Delete("0x2", "attic")
+	histogram.Observe(0.05, "influxdb")
+	histogram.Observe(0.5, "influxdb")
+	assert.Equal(t, float64(3), counter.Value("udp"))
+	assert.Equal(t, uint64(2), histogram.Count("influxdb"))
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(recorder.Body)
+	require.NoError(t, err)
+
+	expected := `# HELP test_duration_seconds Duration
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{handler="influxdb",le="0.1"} 1
+test_duration_seconds_bucket{handler="influxdb",le="1"} 2
+test_duration_seconds_bucket{handler="influxdb",le="+Inf"} 2
+test_duration_seconds_sum{handler="influxdb"} 0.55
+test_duration_seconds_count{handler="influxdb"} 2
+# HELP test_packets_total Packets\nreceived
+# TYPE test_packets_total counter
+test_packets_total{transport="serial"} 1
+test_packets_total{transport="udp"} 3
+# HELP test_sessions Sessions
+# TYPE test_sessions gauge
+test_sessions 3
+# HELP test_temperature Temperature
+# TYPE test_temperature gauge
+test_temperature{device_id="0x1",display_name="kitchen \"main\""} 21.5
+`
+	assert.Equal(t, expected, string(body))
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "version=0.0.4")
+}
+
+func TestRegistryNegative(t *testing.T) {
+	NewCounter("test_dup", "")
+	defer Unregister("test_dup")
+
+	assert.Panics(t, func() { NewGauge("test_dup", "") })
+	// Wrong amount of label values
+	assert.Panics(t, func() { NewCounter("test_labels", "", "a").Inc() })
+	Unregister("test_labels")
+}
+
+func TestSanitizeName(t *testing.T) {
+	assert.Equal(t, "temperature_value_c", SanitizeName("temperature.value_c"))
+	assert.Equal(t, "_1st_sensor", SanitizeName("1st-sensor"))
+}
@@ -1,13 +1,49 @@
 package utils
 
 import (
+	"encoding/hex"
 	"fmt"
-	"reflect"
+	"math"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
+// Custom field options to annotate fields with metadata, e.g.:
+//
+//	extend google.protobuf.FieldOptions { string unit = 50001; }
+//	float temperature = 1 [(unit) = "c"];
+const (
+	UnitFieldOption        protowire.Number = 50001 // string
+	ScaleFieldOption       protowire.Number = 50002 // double
+	OffsetFieldOption      protowire.Number = 50003 // double
+	TagFieldOption         protowire.Number = 50004 // bool
+	MeasurementFieldOption protowire.Number = 50005 // string
+)
+
+// FlattenOptions controls how protobuf message is flattened into name -> value pairs.
+// Zero value gives the same values as the original reflection based implementation:
+// repeated fields are aggregated, enums are numbers.
+type FlattenOptions struct {
+	// SplitRepeated gives every element of repeated field own name: "values.0", "values.1", ...
+	// otherwise repeated field is emitted as one slice value per name
+	SplitRepeated bool
+	// EnumNames emits enums as value names. Otherwise enums are numbers: values of
+	// generated Go enum type when it is compiled in (printed as names by fmt), int32 if not.
+	EnumNames bool
+	// UnitSuffix appends field's unit (see UnitFieldOption) to name, e.g. "temperature_c"
+	UnitSuffix bool
+	// MaxElements limits amount of elements of every repeated field and entries
+	// of every map (the first ones in key order), 0 means no limit
+	MaxElements int
+}
+
 // ProtoGetFieldNameFromTag extracts original protobuf name from
 // protobuf's field tag
 func ProtoGetFieldNameFromTag(value string) string {
@@ -22,38 +58,319 @@ func ProtoGetFieldNameFromTag(value string) string {
 }
 
 // ExtractAllNameValuesFromProtobuf scans / extracts all protobuf fields / values into
-// map of name -> value
+// map of name -> value using zero FlattenOptions
 func ExtractAllNameValuesFromProtobuf(msg proto.Message) map[string]interface{} {
-	results := map[string]interface{}{}
-	extractValuesRecursively("", reflect.ValueOf(msg), results)
+	return FlattenProtobuf(msg, FlattenOptions{})
+}
 
-	return results
+// FlattenProtobuf extracts all protobuf fields / values into map of name -> value.
+// Nested messages are joined by dot, e.g. "temperature.value_c".
+// Rules:
+// - repeated fields: slice or "name.N" (see FlattenOptions.SplitRepeated)
+// - maps: "name.key"
+// - oneof: only selected field, plus "oneof_name" -> selected field name
+// - enums: numbers or value names (see FlattenOptions.EnumNames)
+// - bytes: hex string
+// - Timestamp / Duration: time.Time / time.Duration
+// - wrappers (e.g. UInt32Value): wrapped value
+func FlattenProtobuf(msg proto.Message, options FlattenOptions) map[string]interface{} {
+	return newFlattener(options, proto.MessageReflect(msg)).results
 }
 
-func extractValuesRecursively(prefix string, value reflect.Value, results map[string]interface{}) {
-	reflected := reflect.Indirect(value)
-	for i := 0; i < reflected.NumField(); i++ {
-		// skip protobuf internals (not marked with "protobuf" fields)
-		tag, ok := reflected.Type().Field(i).Tag.Lookup("protobuf")
-		if !ok {
+type flattener struct {
+	options FlattenOptions
+	results map[string]interface{}
+	// Field descriptors of flattened values (oneof names have none)
+	fields map[string]protoreflect.FieldDescriptor
+}
+
+func newFlattener(options FlattenOptions, msg protoreflect.Message) *flattener {
+	f := &flattener{
+		options: options,
+		results: map[string]interface{}{},
+		fields:  map[string]protoreflect.FieldDescriptor{},
+	}
+	if msg != nil {
+		f.message("", msg)
+	}
+	return f
+}
+
+func (f *flattener) set(name string, field protoreflect.FieldDescriptor, value interface{}) {
+	f.results[name] = value
+	f.fields[name] = field
+}
+
+func (f *flattener) message(prefix string, msg protoreflect.Message) {
+	desc := msg.Descriptor()
+
+	// Name of selected oneof field
+	oneofs := desc.Oneofs()
+	for i := 0; i < oneofs.Len(); i++ {
+		oneof := oneofs.Get(i)
+		if oneof.IsSynthetic() {
+			continue
+		}
+		if selected := msg.WhichOneof(oneof); selected != nil {
+			f.results[getFullFieldName(prefix, string(oneof.Name()))] = string(selected.Name())
+		}
+	}
+
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		// skip not selected oneof fields and unset proto3 optionals
+		if field.ContainingOneof() != nil && !msg.Has(field) {
 			continue
 		}
-		fullName := getFullFieldName(prefix, ProtoGetFieldNameFromTag(tag))
-		value := reflected.Field(i)
-		// All structs in protobufs are pointers, process them recursively
-		if value.Kind() == reflect.Ptr {
+		name := getFullFieldName(prefix, f.fieldName(field))
+		value := msg.Get(field)
+		switch {
+		case field.IsList():
+			f.list(name, field, value.List())
+		case field.IsMap():
+			f.mapEntries(name, field, value.Map())
+		case isMessageField(field):
 			// skip empty structures
-			if value.IsNil() {
-				continue
+			if msg.Has(field) {
+				f.value(name, field, value)
 			}
-			extractValuesRecursively(fullName, value, results)
+		default:
+			f.value(name, field, value)
+		}
+	}
+}
+
+func (f *flattener) list(name string, field protoreflect.FieldDescriptor, list protoreflect.List) {
+	size := list.Len()
+	if f.options.MaxElements > 0 && size > f.options.MaxElements {
+		size = f.options.MaxElements
+	}
+	if f.options.SplitRepeated {
+		for i := 0; i < size; i++ {
+			f.value(fmt.Sprintf("%s.%d", name, i), field, list.Get(i))
+		}
+		return
+	}
+
+	// Flatten elements one by one, then group values by name
+	for i := 0; i < size; i++ {
+		element := newFlattener(f.options, nil)
+		element.value(name, field, list.Get(i))
+		for elementName, value := range element.results {
+			values, _ := f.results[elementName].([]interface{})
+			f.set(elementName, element.fields[elementName], append(values, value))
+		}
+	}
+}
+
+func (f *flattener) mapEntries(name string, field protoreflect.FieldDescriptor, entries protoreflect.Map) {
+	if f.options.MaxElements <= 0 || entries.Len() <= f.options.MaxElements {
+		entries.Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+			f.value(getFullFieldName(name, key.String()), field.MapValue(), value)
+			return true
+		})
+		return
+	}
+
+	keys := make([]protoreflect.MapKey, 0, entries.Len())
+	entries.Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+	for _, key := range keys[:f.options.MaxElements] {
+		f.value(getFullFieldName(name, key.String()), field.MapValue(), entries.Get(key))
+	}
+}
+
+func (f *flattener) value(name string, field protoreflect.FieldDescriptor, value protoreflect.Value) {
+	switch field.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		if wellKnown, ok := wellKnownValue(value.Message()); ok {
+			f.set(name, field, wellKnown)
+			return
+		}
+		f.message(name, value.Message())
+	case protoreflect.EnumKind:
+		number := value.Enum()
+		if enumValue := field.Enum().Values().ByNumber(number); enumValue != nil && f.options.EnumNames {
+			f.set(name, field, string(enumValue.Name()))
+		} else if enumType, err := protoregistry.GlobalTypes.FindEnumByName(field.Enum().FullName()); err == nil {
+			f.set(name, field, enumType.New(number))
 		} else {
-			// scalar types
-			results[fullName] = value.Interface()
+			f.set(name, field, int32(number))
 		}
+	case protoreflect.BytesKind:
+		f.set(name, field, hex.EncodeToString(value.Bytes()))
+	default:
+		f.set(name, field, value.Interface())
 	}
 }
 
+// FlattenedField is name and descriptor of single value produced by FlattenProtobuf
+type FlattenedField struct {
+	Name  string
+	Field protoreflect.FieldDescriptor
+}
+
+// ListFlattenedFields returns all names FlattenProtobuf may produce for message type,
+// in declaration order. Maps are skipped since their keys are not known in advance,
+// so are repeated fields when options.SplitRepeated is set.
+// Recursive messages are not expanded. Oneof names have no Field.
+func ListFlattenedFields(desc protoreflect.MessageDescriptor, options FlattenOptions) []FlattenedField {
+	f := &flattener{options: options}
+	return f.listFields("", desc, nil)
+}
+
+// listFields lists fields of desc, parents contains message names from the root
+func (f *flattener) listFields(prefix string, desc protoreflect.MessageDescriptor,
+	parents []protoreflect.FullName) []FlattenedField {
+	for _, parent := range parents {
+		if parent == desc.FullName() {
+			return nil
+		}
+	}
+	parents = append(parents, desc.FullName())
+
+	var results []FlattenedField
+	oneofs := desc.Oneofs()
+	for i := 0; i < oneofs.Len(); i++ {
+		if oneof := oneofs.Get(i); !oneof.IsSynthetic() {
+			results = append(results, FlattenedField{Name: getFullFieldName(prefix, string(oneof.Name()))})
+		}
+	}
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		if field.IsMap() || (field.IsList() && f.options.SplitRepeated) {
+			continue
+		}
+		name := getFullFieldName(prefix, f.fieldName(field))
+		if isMessageField(field) && !isWellKnownMessage(field.Message()) {
+			results = append(results, f.listFields(name, field.Message(), parents)...)
+			continue
+		}
+		results = append(results, FlattenedField{Name: name, Field: field})
+	}
+	return results
+}
+
+func (f *flattener) fieldName(field protoreflect.FieldDescriptor) string {
+	name := string(field.Name())
+	if f.options.UnitSuffix {
+		if unit := GetFieldUnit(field); unit != "" {
+			name = fmt.Sprintf("%s_%s", name, unit)
+		}
+	}
+	return name
+}
+
+// GetFieldUnit returns unit of field declared using UnitFieldOption, if any
+func GetFieldUnit(field protoreflect.FieldDescriptor) string {
+	return getFieldMetadataFromOptions(field).Unit
+}
+
+// getFieldMetadataFromOptions reads custom field options (see UnitFieldOption)
+func getFieldMetadataFromOptions(field protoreflect.FieldDescriptor) FieldMetadata {
+	var metadata FieldMetadata
+	if field == nil {
+		return metadata
+	}
+	options, ok := field.Options().(*descriptorpb.FieldOptions)
+	if !ok || options == nil {
+		return metadata
+	}
+	// Extensions are not compiled in, so they're kept as unknown fields
+	raw := proto.MessageReflect(options).GetUnknown()
+	for len(raw) > 0 {
+		num, typ, n := protowire.ConsumeTag(raw)
+		if n < 0 {
+			break
+		}
+		raw = raw[n:]
+		switch {
+		case num == UnitFieldOption && typ == protowire.BytesType:
+			metadata.Unit, n = protowire.ConsumeString(raw)
+		case num == MeasurementFieldOption && typ == protowire.BytesType:
+			metadata.Measurement, n = protowire.ConsumeString(raw)
+		case num == ScaleFieldOption && typ == protowire.Fixed64Type:
+			var value uint64
+			value, n = protowire.ConsumeFixed64(raw)
+			metadata.Scale = math.Float64frombits(value)
+		case num == OffsetFieldOption && typ == protowire.Fixed64Type:
+			var value uint64
+			value, n = protowire.ConsumeFixed64(raw)
+			metadata.Offset = math.Float64frombits(value)
+		case num == TagFieldOption && typ == protowire.VarintType:
+			var value uint64
+			value, n = protowire.ConsumeVarint(raw)
+			metadata.Tag = protowire.DecodeBool(value)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, raw)
+		}
+		if n < 0 {
+			break
+		}
+		raw = raw[n:]
+	}
+
+	return metadata
+}
+
+// wellKnownTypes are google.protobuf types flattened into single plain value,
+// keyed by full name
+var wellKnownTypes = map[protoreflect.FullName]func(msg protoreflect.Message) interface{}{
+	"google.protobuf.Timestamp": func(msg protoreflect.Message) interface{} {
+		seconds, nanos := secondsAndNanos(msg)
+		return time.Unix(seconds, nanos).UTC()
+	},
+	"google.protobuf.Duration": func(msg protoreflect.Message) interface{} {
+		seconds, nanos := secondsAndNanos(msg)
+		return time.Duration(seconds)*time.Second + time.Duration(nanos)
+	},
+	"google.protobuf.DoubleValue": wrapperValue,
+	"google.protobuf.FloatValue":  wrapperValue,
+	"google.protobuf.Int64Value":  wrapperValue,
+	"google.protobuf.UInt64Value": wrapperValue,
+	"google.protobuf.Int32Value":  wrapperValue,
+	"google.protobuf.UInt32Value": wrapperValue,
+	"google.protobuf.BoolValue":   wrapperValue,
+	"google.protobuf.StringValue": wrapperValue,
+	"google.protobuf.BytesValue": func(msg protoreflect.Message) interface{} {
+		return hex.EncodeToString(msg.Get(msg.Descriptor().Fields().ByName("value")).Bytes())
+	},
+}
+
+func secondsAndNanos(msg protoreflect.Message) (int64, int64) {
+	fields := msg.Descriptor().Fields()
+	return msg.Get(fields.ByName("seconds")).Int(), msg.Get(fields.ByName("nanos")).Int()
+}
+
+func wrapperValue(msg protoreflect.Message) interface{} {
+	return msg.Get(msg.Descriptor().Fields().ByName("value")).Interface()
+}
+
+// wellKnownValue converts google.protobuf well known types into plain values
+func wellKnownValue(msg protoreflect.Message) (interface{}, bool) {
+	if convert, ok := wellKnownTypes[msg.Descriptor().FullName()]; ok {
+		return convert(msg), true
+	}
+	return nil, false
+}
+
+// isWellKnownMessage returns true for types flattened into single value by wellKnownValue
+func isWellKnownMessage(desc protoreflect.MessageDescriptor) bool {
+	_, ok := wellKnownTypes[desc.FullName()]
+	return ok
+}
+
+func isMessageField(field protoreflect.FieldDescriptor) bool {
+	return field.Kind() == protoreflect.MessageKind || field.Kind() == protoreflect.GroupKind
+}
+
 func getFullFieldName(prefix, name string) string {
 	if prefix == "" {
 		return name
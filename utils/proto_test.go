@@ -1,11 +1,24 @@
 package utils
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/open-iot-devices/protobufs/go/openiot"
 	"github.com/open-iot-devices/protobufs/go/openiot/sensor"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func TestExtractAllValues(t *testing.T) {
@@ -13,15 +26,31 @@ func TestExtractAllValues(t *testing.T) {
 		DhG: 111,
 		DhA: []uint32{1, 2, 3},
 	}
+	// Zero options give the same values as original reflection based implementation
 	expected := map[string]interface{}{
 		"dh_g":            uint64(111),
-		"dh_a":            []uint32{1, 2, 3},
+		"dh_a":            []interface{}{uint32(1), uint32(2), uint32(3)},
 		"dh_p":            uint64(0),
 		"encryption_type": openiot.EncryptionType_PLAIN,
 	}
 
 	results := ExtractAllNameValuesFromProtobuf(req)
 	assert.Equal(t, expected, results)
+	// ... printed the same way as well, e.g. by logger
+	assert.Equal(t, "[1 2 3]", fmt.Sprint(results["dh_a"]))
+	assert.Equal(t, "PLAIN", fmt.Sprint(results["encryption_type"]))
+
+	// Split repeated fields / enum names
+	expected = map[string]interface{}{
+		"dh_g":            uint64(111),
+		"dh_a.0":          uint32(1),
+		"dh_a.1":          uint32(2),
+		"dh_a.2":          uint32(3),
+		"dh_p":            uint64(0),
+		"encryption_type": "PLAIN",
+	}
+	results = FlattenProtobuf(req, FlattenOptions{SplitRepeated: true, EnumNames: true})
+	assert.Equal(t, expected, results)
 }
 
 func TestExtractAllValuesEmbedded(t *testing.T) {
@@ -45,3 +74,180 @@ func TestExtractAllValuesEmbedded(t *testing.T) {
 	results := ExtractAllNameValuesFromProtobuf(req)
 	assert.Equal(t, expected, results)
 }
+
+func TestFlattenProtobuf(t *testing.T) {
+	desc := makeTestMessageDescriptor(t)
+	fields := desc.Fields()
+	msg := dynamicpb.NewMessage(desc)
+
+	now := time.Unix(1600000000, 500).UTC()
+	msg.Set(fields.ByName("temperature"), protoreflect.ValueOfFloat32(21.5))
+	msg.Set(fields.ByName("mode"), protoreflect.ValueOfEnum(1))
+	msg.Set(fields.ByName("raw"), protoreflect.ValueOfBytes([]byte{0xca, 0xfe}))
+	msg.Set(fields.ByName("ts"), protoreflect.ValueOfMessage(proto.MessageReflect(timestamppb.New(now))))
+	msg.Set(fields.ByName("uptime"), protoreflect.ValueOfMessage(proto.MessageReflect(durationpb.New(time.Minute))))
+	msg.Set(fields.ByName("battery"), protoreflect.ValueOfMessage(proto.MessageReflect(wrapperspb.UInt32(3300))))
+	msg.Set(fields.ByName("b"), protoreflect.ValueOfString("selected"))
+	counts := msg.Mutable(fields.ByName("counts")).Map()
+	counts.Set(protoreflect.ValueOfString("x").MapKey(), protoreflect.ValueOfInt32(5))
+	items := msg.Mutable(fields.ByName("items")).List()
+	for _, value := range []uint32{7, 8} {
+		item := items.NewElement()
+		item.Message().Set(fields.ByName("items").Message().Fields().ByName("v"), protoreflect.ValueOfUint32(value))
+		items.Append(item)
+	}
+
+	expected := map[string]interface{}{
+		"temperature": float32(21.5),
+		"mode":        int32(1),
+		"raw":         "cafe",
+		"ts":          now,
+		"uptime":      time.Minute,
+		"battery":     uint32(3300),
+		"choice":      "b",
+		"b":           "selected",
+		"counts.x":    int32(5),
+		"items.v":     []interface{}{uint32(7), uint32(8)},
+	}
+	assert.Equal(t, expected, ExtractAllNameValuesFromProtobuf(msg))
+
+	// Units / enum names / split repeated messages
+	results := FlattenProtobuf(msg, FlattenOptions{SplitRepeated: true, EnumNames: true, UnitSuffix: true})
+	assert.Equal(t, float32(21.5), results["temperature_c"])
+	assert.Equal(t, "ON", results["mode"])
+	assert.Equal(t, uint32(7), results["items.0.v"])
+	assert.Equal(t, uint32(8), results["items.1.v"])
+
+	// Limited repeated / map elements, map keys in order
+	counts.Set(protoreflect.ValueOfString("a").MapKey(), protoreflect.ValueOfInt32(6))
+	results = FlattenProtobuf(msg, FlattenOptions{SplitRepeated: true, MaxElements: 1})
+	assert.Equal(t, uint32(7), results["items.0.v"])
+	assert.NotContains(t, results, "items.1.v")
+	assert.Equal(t, int32(6), results["counts.a"])
+	assert.NotContains(t, results, "counts.x")
+	results = FlattenProtobuf(msg, FlattenOptions{MaxElements: 1})
+	assert.Equal(t, []interface{}{uint32(7)}, results["items.v"])
+
+	// Compiled in enums keep their Go type
+	results = ExtractAllNameValuesFromProtobuf(&descriptorpb.FieldDescriptorProto{
+		Type: descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(),
+	})
+	assert.Equal(t, descriptorpb.FieldDescriptorProto_TYPE_INT32, results["type"])
+	assert.Equal(t, "c", GetFieldUnit(fields.ByName("temperature")))
+	assert.Equal(t, "", GetFieldUnit(fields.ByName("mode")))
+}
+
+func TestListFlattenedFields(t *testing.T) {
+	desc := makeTestMessageDescriptor(t)
+	names := func(fields []FlattenedField) []string {
+		var results []string
+		for _, field := range fields {
+			results = append(results, field.Name)
+		}
+		return results
+	}
+
+	fields := ListFlattenedFields(desc, FlattenOptions{SplitRepeated: true})
+	assert.Equal(t, []string{"choice", "temperature", "mode", "raw", "ts", "uptime", "battery", "a", "b"},
+		names(fields))
+	assert.Nil(t, fields[0].Field)
+	assert.Equal(t, desc.Fields().ByName("temperature"), fields[1].Field)
+
+	fields = ListFlattenedFields(desc, FlattenOptions{UnitSuffix: true})
+	assert.Equal(t, []string{"choice", "temperature_c", "mode", "raw", "ts", "uptime", "battery", "a", "b", "items.v"},
+		names(fields))
+}
+
+// helpers //
+
+func makeTestMessageDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		desc := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Type:     typ.Enum(),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+		if typeName != "" {
+			desc.TypeName = proto.String(typeName)
+		}
+		return desc
+	}
+	repeated := func(desc *descriptorpb.FieldDescriptorProto) *descriptorpb.FieldDescriptorProto {
+		desc.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+		return desc
+	}
+	oneof := func(desc *descriptorpb.FieldDescriptorProto) *descriptorpb.FieldDescriptorProto {
+		desc.OneofIndex = proto.Int32(0)
+		return desc
+	}
+
+	// float temperature = 1 [(unit) = "c"];
+	temperature := field("temperature", 1, descriptorpb.FieldDescriptorProto_TYPE_FLOAT, "")
+	temperature.Options = &descriptorpb.FieldOptions{}
+	unit := protowire.AppendTag(nil, UnitFieldOption, protowire.BytesType)
+	unit = protowire.AppendString(unit, "c")
+	proto.MessageReflect(temperature.Options).SetUnknown(unit)
+
+	fileProto := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test/flatten.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		Dependency: []string{
+			"google/protobuf/timestamp.proto",
+			"google/protobuf/duration.proto",
+			"google/protobuf/wrappers.proto",
+		},
+		EnumType: []*descriptorpb.EnumDescriptorProto{
+			{
+				Name: proto.String("Mode"),
+				Value: []*descriptorpb.EnumValueDescriptorProto{
+					{Name: proto.String("OFF"), Number: proto.Int32(0)},
+					{Name: proto.String("ON"), Number: proto.Int32(1)},
+				},
+			},
+		},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Item"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("v", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT32, ""),
+				},
+			},
+			{
+				Name: proto.String("Full"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					temperature,
+					field("mode", 2, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".test.Mode"),
+					field("raw", 3, descriptorpb.FieldDescriptorProto_TYPE_BYTES, ""),
+					field("ts", 4, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.Timestamp"),
+					field("uptime", 5, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.Duration"),
+					field("battery", 6, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.UInt32Value"),
+					oneof(field("a", 7, descriptorpb.FieldDescriptorProto_TYPE_INT32, "")),
+					oneof(field("b", 8, descriptorpb.FieldDescriptorProto_TYPE_STRING, "")),
+					repeated(field("counts", 9, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Full.CountsEntry")),
+					repeated(field("items", 10, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Item")),
+				},
+				OneofDecl: []*descriptorpb.OneofDescriptorProto{
+					{Name: proto.String("choice")},
+				},
+				NestedType: []*descriptorpb.DescriptorProto{
+					{
+						Name: proto.String("CountsEntry"),
+						Field: []*descriptorpb.FieldDescriptorProto{
+							field("key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+							field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32, ""),
+						},
+						Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+					},
+				},
+			},
+		},
+	}
+
+	file, err := protodesc.NewFile(fileProto, protoregistry.GlobalFiles)
+	require.NoError(t, err)
+
+	return file.Messages().ByName("Full")
+}
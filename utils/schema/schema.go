@@ -0,0 +1,181 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Descriptor set files are produced by protoc, e.g.
+// protoc --include_imports -o sensor.pb sensor.proto
+var descriptorExtensions = []string{".pb", ".protoset", ".desc"}
+
+var dynamicFiles = &protoregistry.Files{}
+var lock sync.RWMutex
+
+// NewMessage creates new empty message by protobuf full name.
+// Compiled in messages take precedence over dynamically loaded ones.
+// Returns nil if protobuf is unknown.
+func NewMessage(name string) proto.Message {
+	if msgType := proto.MessageType(name); msgType != nil {
+		return reflect.New(msgType.Elem()).Interface().(proto.Message)
+	}
+	if desc := FindMessageDescriptor(name); desc != nil {
+		return dynamicpb.NewMessage(desc)
+	}
+
+	return nil
+}
+
+// NewMessageFromFields creates message by protobuf full name and fills it from
+// map of flattened field names (e.g. "temperature.value_c", see utils.FlattenProtobuf)
+// to values. Values are converted the same way as protojson does, so enums may be
+// given by name, 64 bit integers as strings, etc.
+func NewMessageFromFields(name string, fields map[string]interface{}) (proto.Message, error) {
+	msg := NewMessage(name)
+	if msg == nil {
+		return nil, fmt.Errorf("Protobuf '%s' is not registered", name)
+	}
+
+	// Build nested JSON object from flattened names
+	root := map[string]interface{}{}
+	for fieldName, value := range fields {
+		parts := strings.Split(fieldName, ".")
+		node := root
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part]
+			if !ok {
+				child = map[string]interface{}{}
+				node[part] = child
+			}
+			if node, ok = child.(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("%s: field '%s' is not a message", name, fieldName)
+			}
+		}
+		last := parts[len(parts)-1]
+		if _, ok := node[last]; ok {
+			return nil, fmt.Errorf("%s: field '%s' conflicts with nested fields", name, fieldName)
+		}
+		node[last] = value
+	}
+	raw, err := json.Marshal(root)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if err := protojson.Unmarshal(raw, proto.MessageV2(msg)); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return msg, nil
+}
+
+// FindMessageDescriptor lookups message descriptor by full name
+// in both compiled in and dynamically loaded protobufs. Returns nil if not found.
+func FindMessageDescriptor(name string) protoreflect.MessageDescriptor {
+	fullName := protoreflect.FullName(name)
+	if msgType, err := protoregistry.GlobalTypes.FindMessageByName(fullName); err == nil {
+		return msgType.Descriptor()
+	}
+
+	lock.RLock()
+	defer lock.RUnlock()
+
+	desc, err := dynamicFiles.FindDescriptorByName(fullName)
+	if err != nil {
+		return nil
+	}
+	msgDesc, _ := desc.(protoreflect.MessageDescriptor)
+
+	return msgDesc
+}
+
+// Load reads all descriptor sets from directory.
+// Replaces previously loaded dynamic protobufs.
+func Load(dir string) error {
+	var filenames []string
+	for _, ext := range descriptorExtensions {
+		matches, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+		if err != nil {
+			return err
+		}
+		filenames = append(filenames, matches...)
+	}
+	sort.Strings(filenames)
+
+	files := &protoregistry.Files{}
+	for _, filename := range filenames {
+		if err := loadDescriptorSet(files, filename); err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		glog.Infof("Loaded protobuf descriptors from %s", filename)
+	}
+
+	lock.Lock()
+	dynamicFiles = files
+	lock.Unlock()
+
+	return nil
+}
+
+func loadDescriptorSet(files *protoregistry.Files, filename string) error {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(raw, set); err != nil {
+		return err
+	}
+
+	// protoc writes files in dependency order (dependencies first)
+	resolver := &resolver{local: files}
+	for _, fileProto := range set.File {
+		// Already known (compiled in or loaded from another set)
+		if _, err := resolver.FindFileByPath(fileProto.GetName()); err == nil {
+			continue
+		}
+		file, err := protodesc.NewFile(fileProto, resolver)
+		if err != nil {
+			return err
+		}
+		if err := files.RegisterFile(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolver looks up dependencies in currently loading files first,
+// then in compiled in ones.
+type resolver struct {
+	local *protoregistry.Files
+}
+
+func (r *resolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if file, err := r.local.FindFileByPath(path); err == nil {
+		return file, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r *resolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if desc, err := r.local.FindDescriptorByName(name); err == nil {
+		return desc, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
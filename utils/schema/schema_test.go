@@ -0,0 +1,173 @@
+package schema
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/open-iot-devices/protobufs/go/openiot"
+	"github.com/open-iot-devices/server/utils"
+)
+
+// Equivalent of:
+// syntax = "proto3";
+// package test;
+// message Nested { string room = 1; }
+// message Reading { float temperature = 1; Nested nested = 2; repeated uint32 values = 3; }
+func makeTestDescriptorSet() *descriptorpb.FileDescriptorSet {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type,
+		label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		desc := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Type:     typ.Enum(),
+			Label:    label.Enum(),
+		}
+		if typeName != "" {
+			desc.TypeName = proto.String(typeName)
+		}
+		return desc
+	}
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+
+	return &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{
+			{
+				Name:    proto.String("test/dynamic.proto"),
+				Package: proto.String("test"),
+				Syntax:  proto.String("proto3"),
+				MessageType: []*descriptorpb.DescriptorProto{
+					{
+						Name: proto.String("Nested"),
+						Field: []*descriptorpb.FieldDescriptorProto{
+							field("room", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+						},
+					},
+					{
+						Name: proto.String("Reading"),
+						Field: []*descriptorpb.FieldDescriptorProto{
+							field("temperature", 1, descriptorpb.FieldDescriptorProto_TYPE_FLOAT, optional, ""),
+							field("nested", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, optional, ".test.Nested"),
+							field("values", 3, descriptorpb.FieldDescriptorProto_TYPE_UINT32, repeated, ""),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func writeDescriptorSet(t *testing.T, dir, filename string, set *descriptorpb.FileDescriptorSet) {
+	raw, err := proto.Marshal(set)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, filename), raw, 0644))
+}
+
+func TestLoadDynamicSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer Load(dir + "/nothing")
+
+	writeDescriptorSet(t, dir, "dynamic.pb", makeTestDescriptorSet())
+	// Not a descriptor set, must be ignored
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("junk"), 0644))
+
+	assert.Nil(t, NewMessage("test.Reading"))
+	require.NoError(t, Load(dir))
+
+	// Fill dynamic message
+	msg := NewMessage("test.Reading")
+	require.IsType(t, &dynamicpb.Message{}, msg)
+	reflected := proto.MessageReflect(msg)
+	fields := reflected.Descriptor().Fields()
+	reflected.Set(fields.ByName("temperature"), protoreflect.ValueOfFloat32(21.5))
+	reflected.Mutable(fields.ByName("nested")).Message().Set(
+		fields.ByName("nested").Message().Fields().ByName("room"), protoreflect.ValueOfString("kitchen"))
+	reflected.Mutable(fields.ByName("values")).List().Append(protoreflect.ValueOfUint32(7))
+
+	// Serialize / de-serialize
+	raw, err := proto.Marshal(msg)
+	require.NoError(t, err)
+	result := NewMessage("test.Reading")
+	require.NoError(t, proto.Unmarshal(raw, result))
+
+	expected := map[string]interface{}{
+		"temperature": float32(21.5),
+		"nested.room": "kitchen",
+		"values":      []interface{}{uint32(7)},
+	}
+	assert.Equal(t, expected, utils.ExtractAllNameValuesFromProtobuf(result))
+
+	// Compiled in protobufs are still generated structs
+	assert.IsType(t, &openiot.Header{}, NewMessage("openiot.Header"))
+	assert.Nil(t, NewMessage("test.Unknown"))
+}
+
+func TestLoadDynamicSchemaNegative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Unresolvable dependency
+	set := makeTestDescriptorSet()
+	set.File[0].MessageType[1].Field[1].TypeName = proto.String(".test.Unknown")
+	writeDescriptorSet(t, dir, "broken.protoset", set)
+
+	err = Load(dir)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "broken.protoset")
+}
+
+func TestNewMessageFromFields(t *testing.T) {
+	msg, err := NewMessageFromFields("openiot.JoinResponse", map[string]interface{}{
+		"name":      "srv",
+		"timestamp": 5,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "srv", msg.(*openiot.JoinResponse).Name)
+	assert.Equal(t, int64(5), msg.(*openiot.JoinResponse).Timestamp)
+
+	// Nested fields
+	dir, err := ioutil.TempDir("", "schema")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer Load(dir + "/nothing")
+	writeDescriptorSet(t, dir, "dynamic.pb", makeTestDescriptorSet())
+	require.NoError(t, Load(dir))
+
+	msg, err = NewMessageFromFields("test.Reading", map[string]interface{}{
+		"temperature": 21.5,
+		"nested.room": "kitchen",
+		"values":      []interface{}{1, 2},
+	})
+	require.NoError(t, err)
+	expected := map[string]interface{}{
+		"temperature": float32(21.5),
+		"nested.room": "kitchen",
+		"values":      []interface{}{uint32(1), uint32(2)},
+	}
+	assert.Equal(t, expected, utils.ExtractAllNameValuesFromProtobuf(msg))
+
+	// Negative
+	for _, fields := range []map[string]interface{}{
+		{"unknown": 1},
+		{"temperature": "hot"},
+		{"nested": "x", "nested.room": "kitchen"},
+	} {
+		_, err := NewMessageFromFields("test.Reading", fields)
+		assert.Error(t, err, "%v", fields)
+	}
+	_, err = NewMessageFromFields("test.Unknown", nil)
+	assert.Error(t, err)
+}
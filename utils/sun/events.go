@@ -0,0 +1,145 @@
+package sun
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/open-iot-devices/server/utils/events"
+)
+
+// Sun events, published (see utils/events) for every named location as "sun.<event>",
+// e.g. "sun.sunset", with location name in event data ("location")
+const (
+	EventDawn      = "dawn"
+	EventSunrise   = "sunrise"
+	EventSolarNoon = "solar_noon"
+	EventSunset    = "sunset"
+	EventDusk      = "dusk"
+)
+
+// EventTypePrefix is prefix of sun event types in utils/events
+const EventTypePrefix = "sun."
+
+// AllEvents lists all sun events in order they happen
+var AllEvents = []string{EventDawn, EventSunrise, EventSolarNoon, EventSunset, EventDusk}
+
+// Upper limit of sleep between event checks: locations may be reloaded, clock may jump
+const maxEventsSleep = time.Hour
+
+// Event returns time of sun event by name, zero if it does not happen that day
+func (t *Times) Event(name string) time.Time {
+	switch name {
+	case EventDawn:
+		return t.CivilDawn
+	case EventSunrise:
+		return t.Sunrise
+	case EventSolarNoon:
+		return t.SolarNoon
+	case EventSunset:
+		return t.Sunset
+	case EventDusk:
+		return t.CivilDusk
+	}
+	return time.Time{}
+}
+
+// ParseEvent parses sun event name with optional offset, e.g. "sunset+30m" or "dawn - 1h"
+func ParseEvent(value string) (string, time.Duration, error) {
+	value = strings.ReplaceAll(value, " ", "")
+	for _, event := range AllEvents {
+		if !strings.HasPrefix(value, event) {
+			continue
+		}
+		rest := value[len(event):]
+		if rest == "" {
+			return event, 0, nil
+		}
+		offset, err := time.ParseDuration(rest)
+		if err != nil || (rest[0] != '+' && rest[0] != '-') {
+			return "", 0, fmt.Errorf("invalid %s offset '%s'", event, rest)
+		}
+		return event, offset, nil
+	}
+
+	return "", 0, fmt.Errorf("invalid sun event '%s', expected one of %s with optional offset",
+		value, strings.Join(AllEvents, ", "))
+}
+
+// Subscribe subscribes to sun events of location (all named locations if empty).
+// Event names (e.g. EventSunset) may be given to limit subscription to them.
+func Subscribe(buffer int, location string, names ...string) *events.Subscription {
+	return events.Subscribe(buffer, func(event *events.Event) bool {
+		if !strings.HasPrefix(event.Type, EventTypePrefix) {
+			return false
+		}
+		if location != "" && event.Data["location"] != location {
+			return false
+		}
+		if len(names) == 0 {
+			return true
+		}
+		for _, name := range names {
+			if event.Type == EventTypePrefix+name {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// eventsBetween returns sun events of all named locations happened in (from, to], ordered by time
+func eventsBetween(from, to time.Time) []*events.Event {
+	var results []*events.Event
+	for _, location := range GetAllLocations() {
+		// Offset of location from UTC can be up to a day, check day before / after
+		for day := from.AddDate(0, 0, -1); !day.After(to.AddDate(0, 0, 1)); day = day.AddDate(0, 0, 1) {
+			times := location.Times(day)
+			for _, name := range AllEvents {
+				eventTime := times.Event(name)
+				if eventTime.IsZero() || !eventTime.After(from) || eventTime.After(to) {
+					continue
+				}
+				results = append(results, &events.Event{
+					Type: EventTypePrefix + name,
+					Time: eventTime,
+					Data: map[string]interface{}{"location": location.Name},
+				})
+			}
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Time.Before(results[j].Time)
+	})
+
+	return results
+}
+
+// publishEvents publishes sun events as they happen, until ctx is done
+func publishEvents(ctx context.Context) {
+	last := time.Now()
+	for {
+		now := time.Now()
+		for _, event := range eventsBetween(last, now) {
+			events.Publish(event)
+		}
+		last = now
+
+		sleep := maxEventsSleep
+		if upcoming := eventsBetween(now, now.Add(maxEventsSleep)); len(upcoming) > 0 {
+			sleep = upcoming[0].Time.Sub(now)
+		}
+		timer := time.NewTimer(sleep)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			glog.Infof("Sun events publisher terminated")
+			return
+		}
+	}
+}
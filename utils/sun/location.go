@@ -0,0 +1,109 @@
+package sun
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/open-iot-devices/server/device"
+)
+
+// DefaultLocation is name of location given by -sun.lat / -sun.long flags,
+// unless overridden by LoadLocations
+const DefaultLocation = "default"
+
+// Location is named place, coordinates are in degrees, north / east are positive
+type Location struct {
+	Name string  `yaml:"-" json:"name"`
+	Lat  float64 `yaml:"lat" json:"lat"`
+	Long float64 `yaml:"long" json:"long"`
+}
+
+var locationsLock sync.RWMutex
+var locations = map[string]*Location{}
+
+// Times returns sun times at location for calendar day of date
+func (l *Location) Times(date time.Time) *Times {
+	return Calculate(date, l.Lat, l.Long)
+}
+
+// LoadLocations reads and parses YAML map of named locations, e.g.:
+//
+//	home: {lat: 39.575, long: -104.902}
+//	cabin: {lat: 40.379, long: -105.526}
+//
+// Replaces all previously loaded locations.
+func LoadLocations(reader io.Reader) error {
+	var loaded map[string]*Location
+	decoder := yaml.NewDecoder(reader)
+	decoder.SetStrict(true)
+	if err := decoder.Decode(&loaded); err != nil && err != io.EOF {
+		return err
+	}
+	for name, location := range loaded {
+		if location == nil || location.Lat < -90 || location.Lat > 90 ||
+			location.Long < -180 || location.Long > 180 {
+			return fmt.Errorf("location '%s': invalid coordinates", name)
+		}
+		location.Name = name
+	}
+
+	locationsLock.Lock()
+	locations = loaded
+	locationsLock.Unlock()
+
+	return nil
+}
+
+// GetLocation returns location by name, empty name means DefaultLocation.
+// Returns nil if not found.
+func GetLocation(name string) *Location {
+	if name == "" {
+		name = DefaultLocation
+	}
+	locationsLock.RLock()
+	location, ok := locations[name]
+	locationsLock.RUnlock()
+	if ok {
+		return location
+	}
+	if name == DefaultLocation {
+		return &Location{Name: DefaultLocation, Lat: *flagLat, Long: *flagLong}
+	}
+	return nil
+}
+
+// GetAllLocations returns all named locations, sorted by name
+func GetAllLocations() []*Location {
+	locationsLock.RLock()
+	results := []*Location{}
+	for _, location := range locations {
+		results = append(results, location)
+	}
+	_, hasDefault := locations[DefaultLocation]
+	locationsLock.RUnlock()
+
+	if !hasDefault {
+		results = append(results, GetLocation(DefaultLocation))
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+// GetDeviceLocation returns location of device: its own coordinates,
+// named location or, if not set / unknown, default location
+func GetDeviceLocation(dev *device.Device) *Location {
+	if dev.Latitude != nil && dev.Longitude != nil {
+		return &Location{Name: dev.IDhex, Lat: *dev.Latitude, Long: *dev.Longitude}
+	}
+	if location := GetLocation(dev.Location); location != nil {
+		return location
+	}
+	return GetLocation(DefaultLocation)
+}
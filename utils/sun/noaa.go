@@ -0,0 +1,193 @@
+package sun
+
+import (
+	"math"
+	"time"
+)
+
+// Zenith angles of sun events, in degrees
+const (
+	// Includes atmospheric refraction and radius of sun disc
+	zenithHorizon      = 90.833
+	zenithCivil        = 96
+	zenithNautical     = 102
+	zenithAstronomical = 108
+)
+
+const (
+	julianDayUnixEpoch  = 2440587.5
+	julianDayJ2000      = 2451545
+	daysInJulianCentury = 36525
+)
+
+// Times are sun events of single day at single location.
+// Events not happening at that day (polar day / night) are zero.
+type Times struct {
+	Sunrise   time.Time
+	Sunset    time.Time
+	SolarNoon time.Time
+	DayLength time.Duration
+
+	// Sun is 6 degrees below horizon
+	CivilDawn time.Time
+	CivilDusk time.Time
+	// Sun is 12 degrees below horizon
+	NauticalDawn time.Time
+	NauticalDusk time.Time
+	// Sun is 18 degrees below horizon
+	AstronomicalDawn time.Time
+	AstronomicalDusk time.Time
+}
+
+// Calculate returns sun times for calendar day of date (in date's location)
+// at given latitude / longitude (degrees, north / east are positive).
+// Uses NOAA solar calculator algorithm, results are in date's location
+// and accurate to about a minute.
+func Calculate(date time.Time, lat, long float64) *Times {
+	day, noon := solarDay(date, long)
+	loc := date.Location()
+	times := &Times{SolarNoon: noon.In(loc)}
+	for _, event := range []struct {
+		zenith     float64
+		dawn, dusk *time.Time
+	}{
+		{zenithHorizon, &times.Sunrise, &times.Sunset},
+		{zenithCivil, &times.CivilDawn, &times.CivilDusk},
+		{zenithNautical, &times.NauticalDawn, &times.NauticalDusk},
+		{zenithAstronomical, &times.AstronomicalDawn, &times.AstronomicalDusk},
+	} {
+		dawn, dusk := crossings(day, noon, lat, long, event.zenith)
+		if !dawn.IsZero() {
+			*event.dawn = dawn.In(loc)
+			*event.dusk = dusk.In(loc)
+		}
+	}
+
+	switch {
+	case !times.Sunrise.IsZero():
+		times.DayLength = times.Sunset.Sub(times.Sunrise)
+	case solarElevation(noon, lat) > 0:
+		// Polar day
+		times.DayLength = 24 * time.Hour
+	}
+
+	return times
+}
+
+// solarDay returns UTC midnight of day whose solar noon falls on calendar day
+// of date (in date's location), and that solar noon. They're different days
+// when time zone is far from longitude, e.g. UTC+14 at Kiritimati (157.4W).
+func solarDay(date time.Time, long float64) (time.Time, time.Time) {
+	year, month, dayOfMonth := date.Date()
+	for _, offset := range []int{0, -1, 1} {
+		day := time.Date(year, month, dayOfMonth+offset, 0, 0, 0, 0, time.UTC)
+		noon := solarNoon(day, long)
+		if y, m, d := noon.In(date.Location()).Date(); y == year && m == month && d == dayOfMonth {
+			return day, noon
+		}
+	}
+
+	day := time.Date(year, month, dayOfMonth, 0, 0, 0, 0, time.UTC)
+	return day, solarNoon(day, long)
+}
+
+// solarPosition is sun declination (degrees) and equation of time (minutes)
+type solarPosition struct {
+	declination float64
+	eqTime      float64
+}
+
+// position calculates solar position at given time
+func position(t time.Time) solarPosition {
+	jd := float64(t.UnixNano())/float64(24*time.Hour) + julianDayUnixEpoch
+	jc := (jd - julianDayJ2000) / daysInJulianCentury
+
+	meanLong := math.Mod(280.46646+jc*(36000.76983+jc*0.0003032), 360)
+	meanAnomaly := 357.52911 + jc*(35999.05029-0.0001537*jc)
+	eccentricity := 0.016708634 - jc*(0.000042037+0.0000001267*jc)
+	center := sin(meanAnomaly)*(1.914602-jc*(0.004817+0.000014*jc)) +
+		sin(2*meanAnomaly)*(0.019993-0.000101*jc) +
+		sin(3*meanAnomaly)*0.000289
+	trueLong := meanLong + center
+	omega := 125.04 - 1934.136*jc
+	apparentLong := trueLong - 0.00569 - 0.00478*sin(omega)
+	meanObliquity := 23 + (26+(21.448-jc*(46.815+jc*(0.00059-jc*0.001813)))/60)/60
+	obliquity := meanObliquity + 0.00256*cos(omega)
+
+	y := math.Pow(math.Tan(radians(obliquity/2)), 2)
+	eqTime := y*sin(2*meanLong) -
+		2*eccentricity*sin(meanAnomaly) +
+		4*eccentricity*y*sin(meanAnomaly)*cos(2*meanLong) -
+		0.5*y*y*sin(4*meanLong) -
+		1.25*eccentricity*eccentricity*sin(2*meanAnomaly)
+
+	return solarPosition{
+		declination: degrees(math.Asin(sin(obliquity) * sin(apparentLong))),
+		eqTime:      4 * degrees(eqTime),
+	}
+}
+
+// solarNoon returns time of solar noon, day is UTC midnight
+func solarNoon(day time.Time, long float64) time.Time {
+	noon := day.Add(minutes(720 - 4*long))
+	// Refine using solar position at noon
+	for i := 0; i < 2; i++ {
+		noon = day.Add(minutes(720 - 4*long - position(noon).eqTime))
+	}
+	return noon
+}
+
+// crossings returns times when sun crosses zenith angle in the morning / evening,
+// zero times when it does not happen at that day
+func crossings(day, noon time.Time, lat, long, zenith float64) (time.Time, time.Time) {
+	results := [2]time.Time{}
+	for index, sign := range []float64{1, -1} {
+		t := noon
+		// Refine using solar position at event time
+		for i := 0; i < 2; i++ {
+			pos := position(t)
+			ha, ok := hourAngle(lat, pos.declination, zenith)
+			if !ok {
+				return time.Time{}, time.Time{}
+			}
+			t = day.Add(minutes(720 - 4*(long+sign*ha) - pos.eqTime))
+		}
+		results[index] = t
+	}
+	return results[0], results[1]
+}
+
+// hourAngle returns hour angle of sun at given zenith, false if sun
+// never reaches it (always above or below)
+func hourAngle(lat, declination, zenith float64) (float64, bool) {
+	value := cos(zenith)/(cos(lat)*cos(declination)) - math.Tan(radians(lat))*math.Tan(radians(declination))
+	if value < -1 || value > 1 {
+		return 0, false
+	}
+	return degrees(math.Acos(value)), true
+}
+
+// solarElevation returns approximate sun elevation (degrees) at solar noon
+func solarElevation(noon time.Time, lat float64) float64 {
+	return 90 - math.Abs(lat-position(noon).declination)
+}
+
+func minutes(value float64) time.Duration {
+	return time.Duration(value * float64(time.Minute))
+}
+
+func radians(value float64) float64 {
+	return value * math.Pi / 180
+}
+
+func degrees(value float64) float64 {
+	return value * 180 / math.Pi
+}
+
+func sin(value float64) float64 {
+	return math.Sin(radians(value))
+}
+
+func cos(value float64) float64 {
+	return math.Cos(radians(value))
+}
@@ -6,7 +6,6 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
-	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -14,25 +13,19 @@ import (
 
 var flagLat = flag.Float64("sun.lat", 39.575295, "Latitude")
 var flagLong = flag.Float64("sun.long", -104.902129, "Longitude")
-var flagInterval = flag.String("sun.interval", "4h", "Sun data refresh interval")
-
-var mutex sync.Mutex
-var currentSunData sunData
-var apiURL string
+var flagInterval = flag.String("sun.interval", "4h", "Interval of sun data cross-check with sunrise-sunset.org")
+var flagCrossCheck = flag.Bool("sun.crosscheck", false, "Periodically compare calculated sun data with sunrise-sunset.org API")
 
 const (
-	apiURLTemplate = "https://api.sunrise-sunset.org/json?lat=%f&lng=%f&formatted=0"
+	apiURLTemplate = "https://api.sunrise-sunset.org/json?lat=%f&lng=%f&date=%s&formatted=0"
+	// Difference between calculated and API sun data to be reported
+	crossCheckTolerance = 5 * time.Minute
 )
 
 type sunData struct {
 	// JSONResults maps to "results" field in JSON repply
 	JSONResults JSONResults `json:"results"`
 	Status      string
-
-	Sunset    time.Time
-	Sunrise   time.Time
-	SolarNoon time.Time
-	DayLength time.Duration
 }
 
 // JSONResults represents sunrise-sunset API
@@ -43,51 +36,51 @@ type JSONResults struct {
 	DayLengthInt    int    `json:"day_length"`
 }
 
-// GetSunset returns current's day time of sunset
-// Data maybe stale
+// GetSunset returns current's day time of sunset, zero if sun does not set today
 func GetSunset() time.Time {
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	return currentSunData.Sunset
+	return GetTimes(time.Now()).Sunset
 }
 
-// GetSunrise returns current's day time of sunrise
-// Data maybe stale
+// GetSunrise returns current's day time of sunrise, zero if sun does not rise today
 func GetSunrise() time.Time {
-	mutex.Lock()
-	defer mutex.Unlock()
+	return GetTimes(time.Now()).Sunrise
+}
 
-	return currentSunData.Sunrise
+// GetTimes returns sun times for calendar day of date at default location
+func GetTimes(date time.Time) *Times {
+	return GetLocation(DefaultLocation).Times(date)
 }
 
-// Start starts periodical sun data refresher
-// It also updates data right away
+// Start starts publishing of sun events (see Subscribe) and periodical
+// cross-check of calculated sun data with sunrise-sunset.org API, if enabled.
+// Network problems are only logged.
 func Start(ctx context.Context) error {
-	// Prepare / parse parameters
-	apiURL = fmt.Sprintf(apiURLTemplate, *flagLat, *flagLong)
 	interval, err := time.ParseDuration(*flagInterval)
 	if err != nil {
 		return err
 	}
-
-	// Run first data refresh immediately
-	if err := refreshData(); err != nil {
-		return err
+	for _, location := range GetAllLocations() {
+		times := location.Times(time.Now())
+		glog.Infof("Sun data of %s: sunrise %s, sunset %s, solar noon %s, day length %s",
+			location.Name, times.Sunrise, times.Sunset, times.SolarNoon, times.DayLength)
+	}
+	go publishEvents(ctx)
+	if !*flagCrossCheck {
+		return nil
 	}
 
-	// .. and on periodical bases
 	go func() {
 		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 		for {
+			if err := crossCheck(apiURLTemplate, time.Now()); err != nil {
+				glog.Errorf("Sun data cross-check failed: %v", err)
+			}
 			select {
 			case <-ticker.C:
-				err := refreshData()
-				if err != nil {
-					glog.Errorf("Unable to refresh sun data: %v", err)
-				}
 			case <-ctx.Done():
-				glog.Infof("Sun updater terminated")
+				glog.Infof("Sun data cross-check terminated")
+				return
 			}
 		}
 	}()
@@ -95,40 +88,57 @@ func Start(ctx context.Context) error {
 	return nil
 }
 
-func refreshData() error {
-	// Perform HTTP request to get updated sun data
-	resp, err := http.Get(apiURL)
+// crossCheck fetches sun data of default location from API and reports difference with calculated one
+func crossCheck(urlTemplate string, date time.Time) error {
+	location := GetLocation(DefaultLocation)
+	apiTimes, err := fetchTimes(fmt.Sprintf(urlTemplate, location.Lat, location.Long, date.Format("2006-01-02")))
 	if err != nil {
 		return err
 	}
+	times := location.Times(date)
+	for _, check := range []struct {
+		name                string
+		calculated, fetched time.Time
+	}{
+		{"sunrise", times.Sunrise, apiTimes.Sunrise},
+		{"sunset", times.Sunset, apiTimes.Sunset},
+		{"solar noon", times.SolarNoon, apiTimes.SolarNoon},
+	} {
+		diff := check.calculated.Sub(check.fetched)
+		if diff < -crossCheckTolerance || diff > crossCheckTolerance {
+			return fmt.Errorf("%s: calculated %s, sunrise-sunset.org %s", check.name, check.calculated, check.fetched)
+		}
+	}
+
+	return nil
+}
+
+// fetchTimes gets sun data from sunrise-sunset.org API
+func fetchTimes(url string) (*Times, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
 	// Parse JSON
 	var result sunData
 	decoder := json.NewDecoder(resp.Body)
-	decoder.Decode(&result)
+	if err := decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("%s: %v", url, err)
+	}
 	if result.Status != "OK" {
-		return fmt.Errorf("%s wrong return status code: %v", apiURL, result.Status)
+		return nil, fmt.Errorf("%s wrong return status code: %v", url, result.Status)
 	}
 
 	// Convert dates to golang format
-	result.Sunset = convertDate(result.JSONResults.SunsetString)
-	result.Sunrise = convertDate(result.JSONResults.SunriseString)
-	result.SolarNoon = convertDate(result.JSONResults.SolarNoonString)
-	result.DayLength, _ = time.ParseDuration(fmt.Sprintf("%ds", result.JSONResults.DayLengthInt))
-	glog.Infof("Got new sun data: sunrise %s, sunset %s, solar noon %s, day lenght %s",
-		result.Sunset,
-		result.Sunrise,
-		result.SolarNoon,
-		result.DayLength,
-	)
-
-	// Update cache
-	mutex.Lock()
-	defer mutex.Unlock()
-	currentSunData = result
-
-	return nil
+	return &Times{
+		Sunrise:   convertDate(result.JSONResults.SunriseString),
+		Sunset:    convertDate(result.JSONResults.SunsetString),
+		SolarNoon: convertDate(result.JSONResults.SolarNoonString),
+		DayLength: time.Duration(result.JSONResults.DayLengthInt) * time.Second,
+	}, nil
 }
 
 func convertDate(input string) time.Time {
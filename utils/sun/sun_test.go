@@ -0,0 +1,237 @@
+package sun
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-iot-devices/server/device"
+	"github.com/open-iot-devices/server/utils/events"
+)
+
+func clock(date time.Time, hour, min int) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), hour, min, 0, 0, date.Location())
+}
+
+// assertClose checks that times differ no more than a minute (tables are rounded to minutes)
+func assertClose(t *testing.T, expected, actual time.Time, name string) {
+	diff := actual.Sub(expected)
+	assert.True(t, diff > -time.Minute && diff < time.Minute, "%s: expected %s, got %s", name, expected, actual)
+}
+
+func TestCalculate(t *testing.T) {
+	// Published sunrise / sunset tables (e.g. timeanddate.com)
+	for _, test := range []struct {
+		name      string
+		lat, long float64
+		date      time.Time
+		// Local times, hour:minute
+		sunrise, sunset, noon [2]int
+		civilDawn, civilDusk  [2]int
+	}{
+		{
+			name: "London", lat: 51.5074, long: -0.1278,
+			date:    time.Date(2020, 6, 21, 0, 0, 0, 0, time.FixedZone("BST", 3600)),
+			sunrise: [2]int{4, 43}, sunset: [2]int{21, 21}, noon: [2]int{13, 2},
+			civilDawn: [2]int{3, 56}, civilDusk: [2]int{22, 9},
+		},
+		{
+			name: "New York", lat: 40.7128, long: -74.006,
+			date:    time.Date(2020, 12, 21, 0, 0, 0, 0, time.FixedZone("EST", -5*3600)),
+			sunrise: [2]int{7, 17}, sunset: [2]int{16, 32}, noon: [2]int{11, 54},
+			civilDawn: [2]int{6, 46}, civilDusk: [2]int{17, 3},
+		},
+		{
+			name: "Sydney", lat: -33.8688, long: 151.2093,
+			date:    time.Date(2020, 12, 21, 0, 0, 0, 0, time.FixedZone("AEDT", 11*3600)),
+			sunrise: [2]int{5, 41}, sunset: [2]int{20, 5}, noon: [2]int{12, 53},
+			civilDawn: [2]int{5, 12}, civilDusk: [2]int{20, 35},
+		},
+		{
+			// UTC+14 west of date line: solar noon of UTC day is next local day
+			name: "Kiritimati", lat: 1.87, long: -157.4,
+			date:    time.Date(2020, 6, 21, 0, 0, 0, 0, time.FixedZone("LINT", 14*3600)),
+			sunrise: [2]int{6, 24}, sunset: [2]int{18, 38}, noon: [2]int{12, 31},
+			civilDawn: [2]int{6, 2}, civilDusk: [2]int{19, 1},
+		},
+	} {
+		times := Calculate(test.date, test.lat, test.long)
+		assertClose(t, clock(test.date, test.sunrise[0], test.sunrise[1]), times.Sunrise, test.name+" sunrise")
+		assertClose(t, clock(test.date, test.sunset[0], test.sunset[1]), times.Sunset, test.name+" sunset")
+		assertClose(t, clock(test.date, test.noon[0], test.noon[1]), times.SolarNoon, test.name+" noon")
+		assertClose(t, clock(test.date, test.civilDawn[0], test.civilDawn[1]), times.CivilDawn, test.name+" civil dawn")
+		assertClose(t, clock(test.date, test.civilDusk[0], test.civilDusk[1]), times.CivilDusk, test.name+" civil dusk")
+		assert.Equal(t, test.date.Location(), times.Sunrise.Location())
+		assert.Equal(t, times.Sunset.Sub(times.Sunrise), times.DayLength)
+
+		// Twilight order
+		assert.True(t, times.NauticalDawn.Before(times.CivilDawn), test.name)
+		assert.True(t, times.NauticalDusk.After(times.CivilDusk), test.name)
+	}
+
+	// London, midsummer: sun is never 18 degrees below horizon
+	london := Calculate(time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC), 51.5074, -0.1278)
+	assert.True(t, london.AstronomicalDawn.IsZero())
+	assert.True(t, london.AstronomicalDusk.IsZero())
+	assert.False(t, london.NauticalDusk.IsZero())
+}
+
+func TestCalculatePolar(t *testing.T) {
+	// Tromsø: polar night
+	times := Calculate(time.Date(2020, 12, 21, 0, 0, 0, 0, time.UTC), 69.6492, 18.9553)
+	assert.True(t, times.Sunrise.IsZero())
+	assert.True(t, times.Sunset.IsZero())
+	assert.Equal(t, time.Duration(0), times.DayLength)
+	assert.False(t, times.CivilDawn.IsZero())
+	assertClose(t, time.Date(2020, 12, 21, 10, 42, 0, 0, time.UTC), times.SolarNoon, "noon")
+
+	// ... and midnight sun
+	times = Calculate(time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC), 69.6492, 18.9553)
+	assert.True(t, times.Sunrise.IsZero())
+	assert.True(t, times.CivilDusk.IsZero())
+	assert.Equal(t, 24*time.Hour, times.DayLength)
+}
+
+func TestCrossCheck(t *testing.T) {
+	date := time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC)
+	times := GetTimes(date)
+	sunset := times.Sunset
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "2020-06-21", r.URL.Query().Get("date"))
+		if expected := r.URL.Query().Get("expected_lat"); expected != "" {
+			assert.Equal(t, expected, r.URL.Query().Get("lat"))
+		}
+		fmt.Fprintf(w, `{"results":{"sunrise":"%s","sunset":"%s","solar_noon":"%s","day_length":%d},"status":"OK"}`,
+			times.Sunrise.Add(time.Minute).Format(time.RFC3339), sunset.Format(time.RFC3339),
+			times.SolarNoon.Format(time.RFC3339), int(times.DayLength.Seconds()))
+	}))
+	defer server.Close()
+	urlTemplate := server.URL + "/json?lat=%f&lng=%f&date=%s"
+
+	require.NoError(t, crossCheck(urlTemplate, date))
+
+	// Difference too big
+	sunset = sunset.Add(time.Hour)
+	assert.Error(t, crossCheck(urlTemplate, date))
+
+	// Default location overridden by locations config
+	defer LoadLocations(strings.NewReader(""))
+	require.NoError(t, LoadLocations(strings.NewReader("default: {lat: 51.5074, long: -0.1278}")))
+	times = GetTimes(date)
+	sunset = times.Sunset
+	require.NoError(t, crossCheck(urlTemplate+"&expected_lat=51.507400", date))
+
+	// API is down
+	server.Close()
+	assert.Error(t, crossCheck(urlTemplate, date))
+}
+
+func TestLocations(t *testing.T) {
+	defer LoadLocations(strings.NewReader(""))
+
+	require.NoError(t, LoadLocations(strings.NewReader(`
+home: {lat: 51.5074, long: -0.1278}
+cabin: {lat: 69.6492, long: 18.9553}
+`)))
+	assert.Equal(t, &Location{Name: "home", Lat: 51.5074, Long: -0.1278}, GetLocation("home"))
+	assert.Nil(t, GetLocation("office"))
+	assert.Equal(t, &Location{Name: DefaultLocation, Lat: *flagLat, Long: *flagLong}, GetLocation(""))
+	var names []string
+	for _, location := range GetAllLocations() {
+		names = append(names, location.Name)
+	}
+	assert.Equal(t, []string{"cabin", DefaultLocation, "home"}, names)
+
+	// Arbitrary date
+	date := time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC)
+	assertClose(t, time.Date(2020, 6, 21, 3, 43, 0, 0, time.UTC), GetLocation("home").Times(date).Sunrise, "sunrise")
+
+	// Device location: own coordinates, named or default one
+	dev := device.NewDevice(1)
+	assert.Equal(t, DefaultLocation, GetDeviceLocation(dev).Name)
+	dev.Location = "cabin"
+	assert.Equal(t, "cabin", GetDeviceLocation(dev).Name)
+	dev.Location = "office"
+	assert.Equal(t, DefaultLocation, GetDeviceLocation(dev).Name)
+	lat, long := 40.7128, -74.006
+	dev.Latitude, dev.Longitude = &lat, &long
+	assert.Equal(t, &Location{Name: "0x1", Lat: lat, Long: long}, GetDeviceLocation(dev))
+
+	// Negative
+	for _, config := range []string{"home: {lat: 91, long: 0}", "home: {lat: 0, long: -181}", "home: {lat: 0, alt: 1}", "home:"} {
+		assert.Error(t, LoadLocations(strings.NewReader(config)), config)
+	}
+	// Failed load does not change locations
+	assert.NotNil(t, GetLocation("cabin"))
+}
+
+func TestParseEvent(t *testing.T) {
+	for _, test := range []struct {
+		value  string
+		event  string
+		offset time.Duration
+	}{
+		{"sunset", EventSunset, 0},
+		{"dusk + 30m", EventDusk, 30 * time.Minute},
+		{"solar_noon-1h", EventSolarNoon, -time.Hour},
+	} {
+		event, offset, err := ParseEvent(test.value)
+		require.NoError(t, err, test.value)
+		assert.Equal(t, test.event, event, test.value)
+		assert.Equal(t, test.offset, offset, test.value)
+	}
+
+	for _, value := range []string{"noon", "sunset 1h", "dawn+often", ""} {
+		_, _, err := ParseEvent(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	defer LoadLocations(strings.NewReader(""))
+	require.NoError(t, LoadLocations(strings.NewReader(`
+default: {lat: 51.5074, long: -0.1278}
+sydney: {lat: -33.8688, long: 151.2093}
+`)))
+
+	// London, 2020-06-21: dawn 02:56, sunrise 03:43, noon 12:02, sunset 20:21, dusk 21:09 UTC.
+	// Sydney, 2020-06-21: sunset 07:54 UTC.
+	from := time.Date(2020, 6, 21, 3, 0, 0, 0, time.UTC)
+	to := time.Date(2020, 6, 21, 12, 30, 0, 0, time.UTC)
+	var names []string
+	for _, event := range eventsBetween(from, to) {
+		assert.True(t, event.Time.After(from) && !event.Time.After(to))
+		names = append(names, fmt.Sprintf("%s %s", event.Data["location"], event.Type))
+	}
+	assert.Equal(t, []string{
+		"default sun.sunrise",
+		"sydney sun.sunset",
+		"sydney sun.dusk",
+		"default sun.solar_noon",
+	}, names)
+
+	// Subscription filters
+	all := Subscribe(10, "")
+	defer all.Close()
+	sunsets := Subscribe(10, "sydney", EventSunset)
+	defer sunsets.Close()
+	others := events.Subscribe(10, nil)
+	defer others.Close()
+	for _, event := range eventsBetween(from, to) {
+		events.Publish(event)
+	}
+	events.Publish(&events.Event{Type: "device.joined"})
+
+	assert.Len(t, all.C, 4)
+	require.Len(t, sunsets.C, 1)
+	event := <-sunsets.C
+	assert.Equal(t, "sun.sunset", event.Type)
+	assert.Equal(t, "sydney", event.Data["location"])
+	assert.Len(t, others.C, 5)
+}